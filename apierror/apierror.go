@@ -0,0 +1,221 @@
+package apierror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	logger "bitbucket.org/conorit/golib-logger"
+)
+
+//Code is a stable machine readable error code.
+//Codes are never renamed or removed, clients may depend on them,
+//while the message may change and is only meant for people.
+type Code string
+
+//general codes
+const (
+	BadRequest       Code = "BAD_REQUEST"
+	InvalidJSON      Code = "INVALID_JSON"
+	ValidationFailed Code = "VALIDATION_FAILED"
+	Unauthorized     Code = "UNAUTHORIZED"
+	Forbidden        Code = "FORBIDDEN"
+	NotFound         Code = "NOT_FOUND"
+	Conflict         Code = "CONFLICT"
+	Internal         Code = "INTERNAL"
+	Unavailable      Code = "UNAVAILABLE"
+	HTTPSRequired    Code = "HTTPS_REQUIRED"
+)
+
+//authentication codes
+const (
+	AuthUserExists          Code = "AUTH_USER_EXISTS"
+	AuthUserNotFound        Code = "AUTH_USER_NOT_FOUND"
+	AuthWrongPassword       Code = "AUTH_WRONG_PASSWORD"
+	AuthTempPasswordExpired Code = "AUTH_TEMP_PASSWORD_EXPIRED"
+	AuthWeakPassword        Code = "AUTH_WEAK_PASSWORD"
+	AuthUserDisabled        Code = "AUTH_USER_DISABLED"
+	AuthUserLocked          Code = "AUTH_USER_LOCKED"
+	AuthUserNotActive       Code = "AUTH_USER_NOT_ACTIVE"
+	AuthIdentifierInUse     Code = "AUTH_IDENTIFIER_IN_USE"
+	AuthInvalidCode         Code = "AUTH_INVALID_CODE"
+	AuthSessionInvalid      Code = "AUTH_SESSION_INVALID"
+	AuthPermissionDenied    Code = "AUTH_PERMISSION_DENIED"
+	AuthNotMember           Code = "AUTH_NOT_MEMBER"
+	AuthClientUnauthorized  Code = "AUTH_CLIENT_UNAUTHORIZED"
+	AuthProviderUnknown     Code = "AUTH_PROVIDER_UNKNOWN"
+	AuthFederationFailed    Code = "AUTH_FEDERATION_FAILED"
+	AuthDirectoryDown       Code = "AUTH_DIRECTORY_UNAVAILABLE"
+	AuthCertificateUnknown  Code = "AUTH_CERTIFICATE_UNKNOWN"
+)
+
+//item codes
+const (
+	ItemInvalid  Code = "ITEM_INVALID"
+	ItemNotFound Code = "ITEM_NOT_FOUND"
+)
+
+//catalogue maps every code to its HTTP status
+var catalogue = map[Code]int{
+	BadRequest:       http.StatusBadRequest,
+	InvalidJSON:      http.StatusBadRequest,
+	ValidationFailed: http.StatusBadRequest,
+	Unauthorized:     http.StatusUnauthorized,
+	Forbidden:        http.StatusForbidden,
+	HTTPSRequired:    http.StatusForbidden,
+	NotFound:         http.StatusNotFound,
+	Conflict:         http.StatusConflict,
+	Internal:         http.StatusInternalServerError,
+	Unavailable:      http.StatusServiceUnavailable,
+
+	AuthUserExists:          http.StatusConflict,
+	AuthUserNotFound:        http.StatusNotFound,
+	AuthWrongPassword:       http.StatusUnauthorized,
+	AuthTempPasswordExpired: http.StatusUnauthorized,
+	AuthWeakPassword:        http.StatusBadRequest,
+	AuthUserDisabled:        http.StatusForbidden,
+	AuthUserLocked:          http.StatusForbidden,
+	AuthUserNotActive:       http.StatusForbidden,
+	AuthIdentifierInUse:     http.StatusConflict,
+	AuthInvalidCode:         http.StatusBadRequest,
+	AuthSessionInvalid:      http.StatusUnauthorized,
+	AuthPermissionDenied:    http.StatusForbidden,
+	AuthNotMember:           http.StatusForbidden,
+	AuthClientUnauthorized:  http.StatusUnauthorized,
+	AuthProviderUnknown:     http.StatusNotFound,
+	AuthFederationFailed:    http.StatusUnauthorized,
+	AuthDirectoryDown:       http.StatusServiceUnavailable,
+	AuthCertificateUnknown:  http.StatusUnauthorized,
+
+	ItemInvalid:  http.StatusBadRequest,
+	ItemNotFound: http.StatusNotFound,
+}
+
+var log = logger.New("apierror")
+
+//Status is the HTTP status of the code, 500 for unknown codes
+func (c Code) Status() int {
+	if status, ok := catalogue[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+} //Code.Status()
+
+//CatalogueEntry describes one code
+type CatalogueEntry struct {
+	Code   Code
+	Status int
+}
+
+//Catalogue lists all codes with their HTTP status, sorted by code
+func Catalogue() []CatalogueEntry {
+	list := []CatalogueEntry{}
+	for code, status := range catalogue {
+		list = append(list, CatalogueEntry{Code: code, Status: status})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+} //Catalogue()
+
+//FieldError describes what is wrong with one field of the request
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+//Error is the body of all error responses, e.g.
+//
+//	{"Code":"AUTH_WRONG_PASSWORD","Message":"Wrong password","RequestID":"..."}
+type Error struct {
+	Code      Code
+	Message   string
+	Details   []FieldError `json:",omitempty"`
+	RequestID string       `json:",omitempty"`
+}
+
+//New makes an error with the code and formatted message
+func New(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+} //New()
+
+func (e *Error) Error() string {
+	return e.Message
+} //Error.Error()
+
+//WithField returns a copy of the error with a field detail added
+func (e *Error) WithField(field, message string) *Error {
+	c := *e
+	c.Details = append(append([]FieldError{}, e.Details...), FieldError{Field: field, Message: message})
+	return &c
+} //Error.WithField()
+
+//Write writes err as error response. When err is an *Error its code is used,
+//else the code is fallback and the message is err.Error()
+func Write(res http.ResponseWriter, req *http.Request, err error, fallback Code) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = New(fallback, "%v", err)
+	}
+	write(res, req, *e)
+} //Write()
+
+//Writef writes an error response with the code and formatted message
+func Writef(res http.ResponseWriter, req *http.Request, code Code, format string, args ...interface{}) {
+	write(res, req, *New(code, format, args...))
+} //Writef()
+
+//write writes a copy of the error, so the request id is never set in shared errors
+func write(res http.ResponseWriter, req *http.Request, e Error) {
+	if req != nil {
+		e.RequestID = RequestIDFromContext(req.Context())
+	}
+	status := e.Code.Status()
+	if status >= 500 {
+		log.Error.Printf("Request %s failed with %s: %s", e.RequestID, e.Code, e.Message)
+	} else {
+		log.Debug.Printf("Request %s failed with %s: %s", e.RequestID, e.Code, e.Message)
+	}
+	jsonData, err := json.Marshal(e)
+	if err != nil {
+		jsonData = []byte(fmt.Sprintf(`{"Code":"%s","Message":"Failed to encode error"}`, Internal))
+		status = http.StatusInternalServerError
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+	res.Write(jsonData)
+} //write()
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+//valid client supplied request ids, anything else is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+//WithRequestID is middleware that identifies every request with the
+//X-Request-ID header from the client, or a new random id,
+//and echoes it in the response so that errors can be correlated with logs
+func WithRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		res.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+	})
+} //WithRequestID()
+
+//RequestIDFromContext returns the id set by WithRequestID, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+} //RequestIDFromContext()
@@ -0,0 +1,168 @@
+package apierror
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+//TestCatalogue checks that every Code constant declared in this package has a status
+func TestCatalogue(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "apierror.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Cannot parse apierror.go: %v", err)
+	}
+	declared := map[Code]bool{}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			v := spec.(*ast.ValueSpec)
+			if ident, ok := v.Type.(*ast.Ident); !ok || ident.Name != "Code" {
+				continue
+			}
+			for _, value := range v.Values {
+				lit := value.(*ast.BasicLit)
+				declared[Code(lit.Value[1:len(lit.Value)-1])] = true
+			}
+		}
+	}
+	if len(declared) == 0 {
+		t.Fatalf("No codes found in apierror.go")
+	}
+
+	validCode := regexp.MustCompile(`^[A-Z][A-Z_]*[A-Z]$`)
+	for code := range declared {
+		if _, ok := catalogue[code]; !ok {
+			t.Errorf("Code %s is not in the catalogue", code)
+		}
+	}
+	list := Catalogue()
+	if len(list) != len(catalogue) {
+		t.Errorf("Catalogue() has %d of %d codes", len(list), len(catalogue))
+	}
+	for i, e := range list {
+		if !declared[e.Code] {
+			t.Errorf("Catalogue has undeclared code %s", e.Code)
+		}
+		if !validCode.MatchString(string(e.Code)) {
+			t.Errorf("Invalid code %s", e.Code)
+		}
+		if e.Status < 400 || e.Status > 599 || http.StatusText(e.Status) == "" {
+			t.Errorf("Code %s has status %d", e.Code, e.Status)
+		}
+		if i > 0 && list[i-1].Code >= e.Code {
+			t.Errorf("Catalogue not sorted at %s", e.Code)
+		}
+	}
+} //TestCatalogue()
+
+//TestCodes fixes some codes that clients depend on, they may never change
+func TestCodes(t *testing.T) {
+	tests := map[Code]int{
+		"BAD_REQUEST":              http.StatusBadRequest,
+		"NOT_FOUND":                http.StatusNotFound,
+		"AUTH_WRONG_PASSWORD":      http.StatusUnauthorized,
+		"AUTH_PERMISSION_DENIED":   http.StatusForbidden,
+		"AUTH_SESSION_INVALID":     http.StatusUnauthorized,
+		"AUTH_USER_EXISTS":         http.StatusConflict,
+		"ITEM_NOT_FOUND":           http.StatusNotFound,
+		"UNAVAILABLE":              http.StatusServiceUnavailable,
+		"NO_SUCH_CODE_IN_THE_LIST": http.StatusInternalServerError,
+	}
+	for code, want := range tests {
+		if got := code.Status(); got != want {
+			t.Errorf("%s.Status() = %d, want %d", code, got, want)
+		}
+	}
+} //TestCodes()
+
+func decode(t *testing.T, res *httptest.ResponseRecorder) Error {
+	t.Helper()
+	e := Error{}
+	if err := json.Unmarshal(res.Body.Bytes(), &e); err != nil {
+		t.Fatalf("Invalid error body %s: %v", res.Body.String(), err)
+	}
+	if res.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type %s", res.Header().Get("Content-Type"))
+	}
+	return e
+} //decode()
+
+func TestWrite(t *testing.T) {
+	shared := New(AuthUserNotFound, "User does not exist")
+	var req *http.Request
+	WithRequestID(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		req = r
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	res := httptest.NewRecorder()
+	Write(res, req, shared, Internal)
+	e := decode(t, res)
+	if res.Code != http.StatusNotFound || e.Code != AuthUserNotFound || e.Message != shared.Message {
+		t.Errorf("Write(*Error) = %d %+v", res.Code, e)
+	}
+	if e.RequestID == "" || e.RequestID != RequestIDFromContext(req.Context()) {
+		t.Errorf("Write(*Error) has request id %q", e.RequestID)
+	}
+	if shared.RequestID != "" {
+		t.Errorf("Write set the request id in the shared error")
+	}
+
+	res = httptest.NewRecorder()
+	Write(res, nil, fmt.Errorf("disk full"), Unavailable)
+	if e := decode(t, res); res.Code != http.StatusServiceUnavailable || e.Code != Unavailable || e.Message != "disk full" || e.RequestID != "" {
+		t.Errorf("Write(error) = %d %+v", res.Code, e)
+	}
+
+	res = httptest.NewRecorder()
+	Writef(res, nil, ValidationFailed, "Invalid %s", "name")
+	if e := decode(t, res); res.Code != http.StatusBadRequest || e.Code != ValidationFailed || e.Message != "Invalid name" {
+		t.Errorf("Writef = %d %+v", res.Code, e)
+	}
+} //TestWrite()
+
+func TestWithField(t *testing.T) {
+	e := New(ValidationFailed, "Invalid request")
+	a := e.WithField("Name", "required")
+	b := a.WithField("Email", "invalid")
+	c := a.WithField("Phone", "invalid")
+	if len(e.Details) != 0 || len(a.Details) != 1 || len(b.Details) != 2 {
+		t.Errorf("WithField changed the original: %+v %+v %+v", e, a, b)
+	}
+	if b.Details[1].Field != "Email" || c.Details[1].Field != "Phone" {
+		t.Errorf("WithField copies share details: %+v %+v", b, c)
+	}
+} //TestWithField()
+
+func TestWithRequestID(t *testing.T) {
+	tests := map[string]bool{
+		"abc-123.X_y":           true,
+		"":                      false,
+		"has space":             false,
+		"<script>":              false,
+		strings.Repeat("a", 65): false,
+	}
+	for header, kept := range tests {
+		var id string
+		h := WithRequestID(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			id = RequestIDFromContext(req.Context())
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Request-ID", header)
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if id == "" || res.Header().Get("X-Request-ID") != id || (id == header) != kept {
+			t.Errorf("X-Request-ID %q got id %q, response %q", header, id, res.Header().Get("X-Request-ID"))
+		}
+	}
+} //TestWithRequestID()
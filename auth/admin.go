@@ -0,0 +1,378 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/pat"
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//admin pagination limits
+const (
+	adminDefaultPageSize = 20
+	adminMaxPageSize     = 100
+)
+
+//addAdminRoutes adds the user management API for administrators
+//paths with more parts are added first, because pat matches on prefix
+func addAdminRoutes(r *pat.Router) {
+	r.Post("/admin/users/{id}/disable", RequirePermission("user:write", adminDisableHandler))
+	r.Post("/admin/users/{id}/enable", RequirePermission("user:write", adminEnableHandler))
+	r.Post("/admin/users/{id}/reset", RequirePermission("user:write", adminResetHandler))
+	r.Post("/admin/users/{id}/unlock", RequirePermission("user:write", adminUnlockHandler))
+	r.Post("/admin/users/{id}/status", RequirePermission("user:write", adminStatusHandler))
+	r.Get("/admin/users/{id}/status", RequirePermission("user:read", adminStatusHistoryHandler))
+	r.Delete("/admin/users/{id}/sessions", RequirePermission("user:write", adminEndSessionsHandler))
+	r.Get("/admin/users/{id}/sessions", RequirePermission("user:read", adminListSessionsHandler))
+	r.Get("/admin/users/{id}", RequirePermission("user:read", adminGetUserHandler))
+	r.Delete("/admin/users/{id}", RequirePermission("user:write", adminDeleteUserHandler))
+	r.Get("/admin/users", RequirePermission("user:read", adminListUsersHandler))
+	r.Delete("/admin/clients/{id}", RequirePermission("client:write", deleteClientHandler))
+	r.Get("/admin/clients", RequirePermission("client:read", listClientsHandler))
+	r.Post("/admin/clients", RequirePermission("client:write", createClientHandler))
+	r.Get("/admin/audit/verify", RequirePermission("audit:read", adminVerifyAuditHandler))
+	r.Get("/admin/audit/anchor", RequirePermission("audit:read", adminAuditAnchorHandler))
+	r.Get("/admin/audit", RequirePermission("audit:read", adminAuditHandler))
+	r.Post("/admin/webhooks/deliveries/{id}/redeliver", RequirePermission("webhook:write", redeliverHandler))
+	r.Get("/admin/webhooks/{id}/deliveries", RequirePermission("webhook:read", listDeliveriesHandler))
+	r.Delete("/admin/webhooks/{id}", RequirePermission("webhook:write", deleteWebhookHandler))
+	r.Get("/admin/webhooks", RequirePermission("webhook:read", listWebhooksHandler))
+	r.Post("/admin/webhooks", RequirePermission("webhook:write", createWebhookHandler))
+} //addAdminRoutes()
+
+//adminUser is the user as shown to administrators, without password fields:
+//the empty Password and TempPassword hide those of the embedded User
+type adminUser struct {
+	User
+	Password       string `json:",omitempty"`
+	TempPassword   string `json:",omitempty"`
+	ActiveSessions int    `json:",omitempty"`
+}
+
+func newAdminUser(u User) adminUser {
+	return adminUser{User: u}
+}
+
+//UserDetails is the user as shown to administrators, with the nr of active sessions
+func UserDetails(u User) adminUser {
+	details := newAdminUser(u)
+	n, err := dbSessionCollection().Find(bson.M{
+		"_user_id": u.ID,
+		"ended":    false,
+		"lasttime": bson.M{"$gt": time.Now().Add(-settings.SessionExpiry)},
+	}).Count()
+	if err != nil {
+		log.Error.Printf("Failed to count sessions of user.id=%s: %v", u.ID.Hex(), err)
+	}
+	details.ActiveSessions = n
+	return details
+} //UserDetails()
+
+//userList is one page of users
+type userList struct {
+	Total int
+	Page  int
+	Size  int
+	Users []adminUser
+}
+
+//ListUsers returns one page of users sorted by name,
+//optionally only those with names containing the search text
+func ListUsers(search string, page, size int) (userList, error) {
+	query := bson.M{}
+	if search != "" {
+		query["name"] = bson.M{"$regex": regexp.QuoteMeta(search), "$options": "i"}
+	}
+	list := userList{Page: page, Size: size, Users: []adminUser{}}
+	q := dbUserCollection().Find(query)
+	var err error
+	if list.Total, err = q.Count(); err != nil {
+		return list, log.Errorf(err, "Failed to count users")
+	}
+	users := []User{}
+	if err := q.Sort("name").Skip(page * size).Limit(size).All(&users); err != nil {
+		return list, log.Errorf(err, "Failed to list users")
+	}
+	for _, u := range users {
+		list.Users = append(list.Users, newAdminUser(u))
+	}
+	return list, nil
+} //ListUsers()
+
+//DeleteUser deletes the user after ending all its sessions
+//The status history is kept, ending with the change to deleted
+//which is only recorded there, as the user no longer exists
+func DeleteUser(u User, by bson.ObjectId) error {
+	if u.Status == StatusDeleted || !statusAllowed(u.Status, StatusDeleted) {
+		return log.Errorf(nil, "User %s cannot change from %s to %s", u.Name, u.Status, StatusDeleted)
+	}
+	if _, err := EndUserSessions(u.ID); err != nil {
+		return err
+	}
+	if err := dbUserCollection().RemoveId(u.ID); err != nil {
+		return log.Errorf(err, "Failed to delete user.id=%s", u.ID.Hex())
+	}
+	recordStatusChange(u.ID, u.Status, StatusDeleted, "deleted", by, time.Now())
+	log.Info.Printf("Deleted user.id=%s", u.ID.Hex())
+	return nil
+} //DeleteUser()
+
+//FindUser gets the user by id (hex) or else by name
+func FindUser(nameOrID string) (User, error) {
+	if bson.IsObjectIdHex(nameOrID) {
+		if u, err := (User{}).Get(nameOrID); err == nil {
+			return u, nil
+		}
+	}
+	return User{}.getByName(context.Background(), nameOrID)
+} //FindUser()
+
+func pageParams(req *http.Request) (int, int, error) {
+	page, size := 0, adminDefaultPageSize
+	var err error
+	if v := req.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 0 {
+			return 0, 0, fmt.Errorf("URL parameter page='%s' must have integer value >= 0", v)
+		}
+	}
+	if v := req.URL.Query().Get("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > adminMaxPageSize {
+			return 0, 0, fmt.Errorf("URL parameter size='%s' must have integer value 1..%d", v, adminMaxPageSize)
+		}
+	}
+	return page, size, nil
+} //pageParams()
+
+func writeAdminJSON(res http.ResponseWriter, v interface{}) {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		apierror.Writef(res, nil, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //writeAdminJSON()
+
+//adminLoadUser loads the user identified by the URL, writing the error response on failure
+func adminLoadUser(res http.ResponseWriter, req *http.Request) (User, bool) {
+	u, err := User{}.Get(req.URL.Query().Get(":id"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.AuthUserNotFound)
+		return User{}, false
+	}
+	return u, true
+} //adminLoadUser()
+
+//adminSetStatus changes the user status and responds with the updated user
+func adminSetStatus(res http.ResponseWriter, u User, req *http.Request, to string, reason string) {
+	admin, _ := SessionFromContext(req.Context())
+	changed, err := u.SetStatus(to, reason, admin.UserID)
+	AuditChange(req, AuditEvent{Event: AuditStatus, UserID: u.ID, Name: u.Name, By: admin.UserID, Detail: fmt.Sprintf("%s to %s: %s", u.Status, to, reason)}, err)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Conflict)
+		return
+	}
+	log.Info.Printf("Admin user.id=%s set user %s status=%s", admin.UserID.Hex(), changed.Name, changed.Status)
+	writeAdminJSON(res, newAdminUser(changed))
+} //adminSetStatus()
+
+//adminListUsersHandler lists users with URL params q (search), page (from 0) and size
+func adminListUsersHandler(res http.ResponseWriter, req *http.Request) {
+	page, size, err := pageParams(req)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	list, err := ListUsers(req.URL.Query().Get("q"), page, size)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, list)
+} //adminListUsersHandler()
+
+func adminGetUserHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	writeAdminJSON(res, UserDetails(u))
+} //adminGetUserHandler()
+
+//adminDisableHandler disables the user and ends all its sessions
+func adminDisableHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	if _, err := EndUserSessions(u.ID); err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	adminSetStatus(res, u, req, StatusDisabled, "disabled by admin")
+} //adminDisableHandler()
+
+//adminEnableHandler enables the user, who still has to activate if never activated
+func adminEnableHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	to := StatusActive
+	if u.Password == "" {
+		to = StatusPendingActivation
+	}
+	adminSetStatus(res, u, req, to, "enabled by admin")
+} //adminEnableHandler()
+
+func adminUnlockHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	if u.Status != StatusLocked {
+		apierror.Writef(res, req, apierror.Conflict, "User %s is not locked", u.Name)
+		return
+	}
+	if err := dbUserCollection().UpdateId(u.ID, bson.M{"$set": bson.M{"failedlogins": 0}}); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to update user: %v", err)
+		return
+	}
+	u.FailedLogins = 0
+	to := StatusActive
+	if u.Password == "" {
+		to = StatusPendingActivation
+	}
+	adminSetStatus(res, u, req, to, "unlocked by admin")
+} //adminUnlockHandler()
+
+//adminStatusHandler sets any status allowed from the current status,
+//with JSON body {"Status":"...","Reason":"..."}
+func adminStatusHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	reqData := struct {
+		Status string
+		Reason string
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	if reqData.Status == StatusDeleted {
+		apierror.Writef(res, req, apierror.BadRequest, "Use DELETE to delete a user")
+		return
+	}
+	if reqData.Status != StatusActive && reqData.Status != StatusPendingActivation {
+		if _, err := EndUserSessions(u.ID); err != nil {
+			apierror.Write(res, req, err, apierror.Unavailable)
+			return
+		}
+	}
+	adminSetStatus(res, u, req, reqData.Status, reqData.Reason)
+} //adminStatusHandler()
+
+func adminStatusHistoryHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	list, err := StatusHistory(u.ID)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, list)
+} //adminStatusHistoryHandler()
+
+//adminResetHandler forces a password reset: the current password is cleared,
+//all sessions are ended and a new temp password is returned to send to the user
+func adminResetHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	admin, _ := SessionFromContext(req.Context())
+	u, err := u.ResetPassword()
+	AuditChange(req, AuditEvent{Event: AuditReset, UserID: u.ID, Name: u.Name, By: admin.UserID, Detail: "by admin"}, err)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, map[string]interface{}{
+		"_id":          u.ID,
+		"Name":         u.Name,
+		"TempPassword": u.TempPassword,
+		"TempExpiry":   u.TempExpiry,
+	})
+} //adminResetHandler()
+
+//ResetPassword ends the user's sessions and replaces the password
+//with a new temp password, that the user must activate with
+func (u User) ResetPassword() (User, error) {
+	if _, err := EndUserSessions(u.ID); err != nil {
+		return u, err
+	}
+	u.Password = ""
+	u.setTempPassword()
+	u, err := u.update()
+	if err != nil {
+		return u, log.Errorf(err, "Failed to reset password")
+	}
+	log.Info.Printf("Forced password reset for user %s", u.Name)
+	return u, nil
+} //User.ResetPassword()
+
+func adminEndSessionsHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	admin, _ := SessionFromContext(req.Context())
+	n, err := EndUserSessions(u.ID)
+	AuditChange(req, AuditEvent{Event: AuditSessions, UserID: u.ID, Name: u.Name, By: admin.UserID, Detail: fmt.Sprintf("ended %d sessions", n)}, err)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, map[string]interface{}{"Ended": n})
+} //adminEndSessionsHandler()
+
+func adminListSessionsHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	list, err := UserSessions(u.ID)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, list)
+} //adminListSessionsHandler()
+
+func adminDeleteUserHandler(res http.ResponseWriter, req *http.Request) {
+	u, ok := adminLoadUser(res, req)
+	if !ok {
+		return
+	}
+	s, _ := SessionFromContext(req.Context())
+	if s.UserID == u.ID {
+		apierror.Writef(res, req, apierror.BadRequest, "Cannot delete yourself")
+		return
+	}
+	err := DeleteUser(u, s.UserID)
+	AuditChange(req, AuditEvent{Event: AuditDelete, UserID: u.ID, Name: u.Name, By: s.UserID, Detail: "by admin"}, err)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+} //adminDeleteUserHandler()
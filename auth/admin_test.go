@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPageParams(t *testing.T) {
+	tests := []struct {
+		query      string
+		page, size int
+		ok         bool
+	}{
+		{"", 0, adminDefaultPageSize, true},
+		{"page=3&size=5", 3, 5, true},
+		{"size=100", 0, 100, true},
+		{"size=1", 0, 1, true},
+		{"page=-1", 0, 0, false},
+		{"page=x", 0, 0, false},
+		{"size=0", 0, 0, false},
+		{"size=101", 0, 0, false},
+		{"size=5.5", 0, 0, false},
+	}
+	for _, test := range tests {
+		page, size, err := pageParams(httptest.NewRequest("GET", "/admin/users?"+test.query, nil))
+		if (err == nil) != test.ok || page != test.page || size != test.size {
+			t.Errorf("%q gave page=%d size=%d err=%v", test.query, page, size, err)
+		}
+	}
+} //TestPageParams()
+
+func TestAdminUser(t *testing.T) {
+	u := User{ID: bson.NewObjectId(), Name: "jan@example.com", Password: "hashed", TempPassword: "temp", Status: StatusActive}
+	jsonData, err := json.Marshal(newAdminUser(u))
+	if err != nil {
+		t.Fatalf("Cannot encode: %v", err)
+	}
+	for _, hidden := range []string{"Password", "hashed", "temp"} {
+		if strings.Contains(string(jsonData), hidden) {
+			t.Errorf("Admin user shows %s: %s", hidden, jsonData)
+		}
+	}
+	if !strings.Contains(string(jsonData), u.Name) || !strings.Contains(string(jsonData), u.ID.Hex()) {
+		t.Errorf("Admin user without name or id: %s", jsonData)
+	}
+} //TestAdminUser()
+
+func TestListUsers(t *testing.T) {
+	testDatabase(t)
+	//a unique search text, with a regex character to check it is matched literally
+	search := "list+" + bson.NewObjectId().Hex()
+	users := []User{}
+	for _, n := range []string{"c", "a", "b"} {
+		u, err := NewUser(n + "-" + search + "@example.com")
+		if err != nil {
+			t.Fatalf("Cannot create user: %v", err)
+		}
+		users = append(users, u)
+		t.Cleanup(func() {
+			dbUserCollection().RemoveId(u.ID)
+			dbStatusCollection().RemoveAll(bson.M{"_user_id": u.ID})
+		})
+	}
+
+	list, err := ListUsers(strings.ToUpper(search), 0, 2)
+	if err != nil {
+		t.Fatalf("Cannot list users: %v", err)
+	}
+	if list.Total != 3 || len(list.Users) != 2 || list.Users[0].ID != users[1].ID || list.Users[1].ID != users[2].ID {
+		t.Errorf("First page %+v", list)
+	}
+	if list, err = ListUsers(search, 1, 2); err != nil || list.Total != 3 || len(list.Users) != 1 || list.Users[0].ID != users[0].ID {
+		t.Errorf("Second page %+v, %v", list, err)
+	}
+	if list, err = ListUsers("list."+search[5:], 0, 2); err != nil || list.Total != 0 {
+		t.Errorf("Search is not literal: %+v, %v", list, err)
+	}
+
+	for _, nameOrID := range []string{users[0].ID.Hex(), users[0].Name} {
+		if u, err := FindUser(nameOrID); err != nil || u.ID != users[0].ID {
+			t.Errorf("Find %s gave %+v, %v", nameOrID, u, err)
+		}
+	}
+	if _, err := FindUser(bson.NewObjectId().Hex()); err == nil {
+		t.Errorf("Found unknown user")
+	}
+} //TestListUsers()
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//audit event types
+const (
+	AuditRegister = "register"
+	AuditActivate = "activate"
+	AuditLogin    = "login"
+	AuditLogout   = "logout"
+	AuditReset    = "reset"
+
+	//changes by an administrator, see AuditChange
+	AuditStatus   = "status"
+	AuditDelete   = "delete"
+	AuditRoles    = "roles"    //roles and own permissions of a user
+	AuditRole     = "role"     //definition of a role
+	AuditSessions = "sessions" //all sessions of a user ended
+	AuditClient   = "client"   //oauth client created or deleted
+)
+
+//audit event outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+//AuditEvent is one authentication event in the append-only audit log.
+//Each event includes the hash of the previous event in its own hash,
+//so changing or removing an event breaks the chain from there on.
+//With auth.audit_key the hash is an HMAC, so the chain cannot be rewritten
+//without the key, and an exported AuditAnchor detects removal of the last events
+type AuditEvent struct {
+	Seq       int64 `bson:"_id" json:"Seq"`
+	Time      time.Time
+	Event     string
+	Outcome   string
+	UserID    bson.ObjectId `bson:"_user_id,omitempty" json:"_user_id,omitempty"`
+	Name      string        `json:",omitempty"`
+	SessionID bson.ObjectId `bson:"_session_id,omitempty" json:"_session_id,omitempty"`
+	TenantID  bson.ObjectId `bson:"_tenant_id,omitempty" json:"_tenant_id,omitempty"`
+	IP        string        `json:",omitempty"`
+	Detail    string        `json:",omitempty"`
+	By        bson.ObjectId `bson:"_by_id,omitempty" json:"_by_id,omitempty"` //administrator who made the change
+	PrevHash  string
+	Hash      string
+}
+
+var (
+	//auditMutex serialises appends in this process,
+	//other processes are detected by the duplicate sequence nr
+	auditMutex sync.Mutex
+)
+
+//AuditAnchor is the position of an event in the chain, recorded outside the database
+//(e.g. by a monitoring system) to verify later that the chain still reaches it
+type AuditAnchor struct {
+	Seq  int64
+	Hash string
+}
+
+//hash of the event fields and the previous hash, keyed with auth.audit_key when set
+//each field is prefixed with its length, so a separator in a field cannot shift it into the next
+//time is in UTC ms, as it is stored in the database
+func (e AuditEvent) hash() string {
+	var h hash.Hash
+	if settings.AuditKey != "" {
+		h = hmac.New(sha256.New, []byte(settings.AuditKey))
+	} else {
+		h = sha256.New()
+	}
+	for _, f := range []string{
+		strconv.FormatInt(e.Seq, 10),
+		e.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		e.Event,
+		e.Outcome,
+		idHex(e.UserID),
+		e.Name,
+		idHex(e.SessionID),
+		idHex(e.TenantID),
+		e.IP,
+		e.Detail,
+		e.PrevHash,
+		idHex(e.By),
+	} {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+} //AuditEvent.hash()
+
+func idHex(id bson.ObjectId) string {
+	if id.Valid() {
+		return id.Hex()
+	}
+	return ""
+} //idHex()
+
+//AppendAudit adds the event to the end of the chain
+func AppendAudit(e AuditEvent) (AuditEvent, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	e.Time = time.Now().UTC().Truncate(time.Millisecond)
+	for retry := 0; retry < 5; retry++ {
+		last := AuditEvent{}
+		if err := dbAuditCollection().Find(nil).Sort("-_id").One(&last); err != nil && err != mgo.ErrNotFound {
+			return e, log.Errorf(err, "Failed to get last audit event")
+		}
+		e.Seq = last.Seq + 1
+		e.PrevHash = last.Hash
+		e.Hash = e.hash()
+		err := dbAuditCollection().Insert(e)
+		if err == nil {
+			return e, nil
+		}
+		if !isDuplicate(err) {
+			return e, log.Errorf(err, "Failed to append audit event")
+		}
+		//another process appended the same seq, try after it
+	}
+	return e, log.Errorf(nil, "Failed to append audit event after retries")
+} //AppendAudit()
+
+//audit records the event for the request, logging but not failing on error
+func audit(req *http.Request, e AuditEvent) {
+	if req != nil {
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			e.IP = host
+		} else {
+			e.IP = req.RemoteAddr
+		}
+	}
+	if _, err := AppendAudit(e); err != nil {
+		log.Error.Printf("Audit event %+v not recorded: %v", e, err)
+	}
+
+	//successful events of a user are also published as "user.<event>" (without the session id)
+	if e.Outcome == AuditSuccess && e.UserID.Valid() {
+		PublishEvent("user."+e.Event, idHex(e.TenantID), map[string]interface{}{
+			"_user_id": e.UserID,
+			"Name":     e.Name,
+			"IP":       e.IP,
+			"Detail":   e.Detail,
+		})
+	}
+} //audit()
+
+//AuditChange records a change made by administrator e.By, through the API or
+//from authctl on the stores (req nil), as a failure when err is not nil.
+//It logs but does not fail on error
+func AuditChange(req *http.Request, e AuditEvent, err error) {
+	e.Outcome = AuditSuccess
+	if err != nil {
+		e.Outcome = AuditFailure
+		e.Detail += ": " + err.Error()
+	}
+	audit(req, e)
+} //AuditChange()
+
+//auditError is the detail of a failure event
+func auditError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+} //auditError()
+
+//LastAuditAnchor is the anchor of the last event, to record outside the database
+func LastAuditAnchor() (AuditAnchor, error) {
+	last := AuditEvent{}
+	if err := dbAuditCollection().Find(nil).Sort("-_id").One(&last); err != nil && err != mgo.ErrNotFound {
+		return AuditAnchor{}, log.Errorf(err, "Failed to get last audit event")
+	}
+	return AuditAnchor{Seq: last.Seq, Hash: last.Hash}, nil
+} //LastAuditAnchor()
+
+//ParseAuditAnchor parses an anchor written as "<seq>:<hash>"
+func ParseAuditAnchor(s string) (AuditAnchor, error) {
+	a := AuditAnchor{}
+	if n, err := fmt.Sscanf(s, "%d:%s", &a.Seq, &a.Hash); err != nil || n != 2 || a.Seq < 1 {
+		return AuditAnchor{}, log.Errorf(nil, "Audit anchor \"%s\" is not <seq>:<hash>", s)
+	}
+	return a, nil
+} //ParseAuditAnchor()
+
+func (a AuditAnchor) String() string {
+	return fmt.Sprintf("%d:%s", a.Seq, a.Hash)
+} //AuditAnchor.String()
+
+//auditVerifier checks events in order of seq
+type auditVerifier struct {
+	anchor   AuditAnchor //optional
+	prev     AuditEvent
+	n        int
+	anchored bool
+}
+
+func (v *auditVerifier) next(e AuditEvent) error {
+	if e.Seq != v.prev.Seq+1 {
+		return log.Errorf(nil, "Audit event %d missing before %d", v.prev.Seq+1, e.Seq)
+	}
+	if e.PrevHash != v.prev.Hash {
+		return log.Errorf(nil, "Audit event %d does not follow on event %d", e.Seq, v.prev.Seq)
+	}
+	if e.hash() != e.Hash {
+		return log.Errorf(nil, "Audit event %d was changed or hashed with another key", e.Seq)
+	}
+	if e.Seq == v.anchor.Seq {
+		if e.Hash != v.anchor.Hash {
+			return log.Errorf(nil, "Audit event %d does not match the anchor", e.Seq)
+		}
+		v.anchored = true
+	}
+	v.n++
+	v.prev = e
+	return nil
+} //auditVerifier.next()
+
+//done checks that the chain reached the anchor
+func (v *auditVerifier) done() error {
+	if v.anchor.Seq > 0 && !v.anchored {
+		return log.Errorf(nil, "Audit log ends at event %d before the anchor %d", v.prev.Seq, v.anchor.Seq)
+	}
+	return nil
+} //auditVerifier.done()
+
+//VerifyAuditChain checks the hashes of all events in order, and that the chain
+//still includes the anchor when one is given (AuditAnchor{} for none).
+//It returns the nr of verified events, with an error for the first broken event
+func VerifyAuditChain(anchor AuditAnchor) (int, error) {
+	v := auditVerifier{anchor: anchor}
+	iter := dbAuditCollection().Find(nil).Sort("_id").Iter()
+	e := AuditEvent{}
+	for iter.Next(&e) {
+		if err := v.next(e); err != nil {
+			iter.Close()
+			return v.n, err
+		}
+		e = AuditEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return v.n, log.Errorf(err, "Failed to read audit events")
+	}
+	return v.n, v.done()
+} //VerifyAuditChain()
+
+//auditList is one page of audit events
+type auditList struct {
+	Total  int
+	Page   int
+	Size   int
+	Events []AuditEvent
+}
+
+//adminAuditHandler lists audit events, newest first, with optional URL filters
+//event, outcome, _user_id, name, ip, from and to (RFC3339 times), and page/size
+func adminAuditHandler(res http.ResponseWriter, req *http.Request) {
+	page, size, err := pageParams(req)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	f := AuditFilter{
+		Event:   req.URL.Query().Get("event"),
+		Outcome: req.URL.Query().Get("outcome"),
+		Name:    req.URL.Query().Get("name"),
+		IP:      req.URL.Query().Get("ip"),
+	}
+	if v := req.URL.Query().Get("_user_id"); v != "" {
+		if !bson.IsObjectIdHex(v) {
+			apierror.Writef(res, req, apierror.BadRequest, "URL parameter _user_id='%s' is not an object id", v)
+			return
+		}
+		f.UserID = bson.ObjectIdHex(v)
+	}
+	for param, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := req.URL.Query().Get(param); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				apierror.Writef(res, req, apierror.BadRequest, "URL parameter %s='%s' must be RFC3339 time", param, v)
+				return
+			}
+		}
+	}
+	list, err := SearchAudit(f, page, size)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, list)
+} //adminAuditHandler()
+
+//AuditFilter selects audit events, empty fields match all events
+type AuditFilter struct {
+	Event   string
+	Outcome string
+	Name    string
+	IP      string
+	UserID  bson.ObjectId
+	From    time.Time //inclusive
+	To      time.Time //exclusive
+}
+
+//SearchAudit returns a page of the events that match the filter, newest first
+func SearchAudit(f AuditFilter, page, size int) (auditList, error) {
+	query := bson.M{}
+	for field, v := range map[string]string{"event": f.Event, "outcome": f.Outcome, "name": f.Name, "ip": f.IP} {
+		if v != "" {
+			query[field] = v
+		}
+	}
+	if f.UserID != "" {
+		query["_user_id"] = f.UserID
+	}
+	timeRange := bson.M{}
+	if !f.From.IsZero() {
+		timeRange["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		timeRange["$lt"] = f.To
+	}
+	if len(timeRange) > 0 {
+		query["time"] = timeRange
+	}
+
+	list := auditList{Page: page, Size: size, Events: []AuditEvent{}}
+	q := dbAuditCollection().Find(query)
+	var err error
+	if list.Total, err = q.Count(); err != nil {
+		return list, log.Errorf(err, "Failed to count audit events")
+	}
+	if err := q.Sort("-_id").Skip(page * size).Limit(size).All(&list.Events); err != nil {
+		return list, log.Errorf(err, "Failed to list audit events")
+	}
+	return list, nil
+} //SearchAudit()
+
+//adminVerifyAuditHandler verifies the audit chain, and that it still reaches
+//the optional anchor in URL parameter anchor=<seq>:<hash>
+func adminVerifyAuditHandler(res http.ResponseWriter, req *http.Request) {
+	anchor := AuditAnchor{}
+	if v := req.URL.Query().Get("anchor"); v != "" {
+		var err error
+		if anchor, err = ParseAuditAnchor(v); err != nil {
+			apierror.Writef(res, req, apierror.BadRequest, "URL parameter anchor='%s' must be <seq>:<hash>", v)
+			return
+		}
+	}
+	n, err := VerifyAuditChain(anchor)
+	result := map[string]interface{}{"Verified": n, "Valid": err == nil}
+	if err != nil {
+		result["Error"] = err.Error()
+	}
+	writeAdminJSON(res, result)
+} //adminVerifyAuditHandler()
+
+//adminAuditAnchorHandler returns the anchor of the last event, to record outside the database
+func adminAuditAnchorHandler(res http.ResponseWriter, req *http.Request) {
+	anchor, err := LastAuditAnchor()
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, anchor)
+} //adminAuditAnchorHandler()
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//testAuditChain makes a valid chain of n events, hashed with the current settings
+func testAuditChain(n int) []AuditEvent {
+	events := []AuditEvent{}
+	prev := AuditEvent{}
+	for i := 1; i <= n; i++ {
+		e := AuditEvent{
+			Seq:      int64(i),
+			Time:     time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC),
+			Event:    AuditLogin,
+			Outcome:  AuditSuccess,
+			UserID:   bson.NewObjectId(),
+			Name:     "jan@example.com",
+			IP:       "10.0.0.1",
+			PrevHash: prev.Hash,
+		}
+		e.Hash = e.hash()
+		events = append(events, e)
+		prev = e
+	}
+	return events
+} //testAuditChain()
+
+func verifyTestAuditChain(events []AuditEvent, anchor AuditAnchor) (int, error) {
+	v := auditVerifier{anchor: anchor}
+	for _, e := range events {
+		if err := v.next(e); err != nil {
+			return v.n, err
+		}
+	}
+	return v.n, v.done()
+} //verifyTestAuditChain()
+
+//withAuditKey sets auth.audit_key for the test
+func withAuditKey(t *testing.T, key string) {
+	saved := settings
+	settings.AuditKey = key
+	t.Cleanup(func() { settings = saved })
+} //withAuditKey()
+
+func TestAuditChain(t *testing.T) {
+	for _, key := range []string{"", "0123456789abcdef"} {
+		withAuditKey(t, key)
+		events := testAuditChain(5)
+		if n, err := verifyTestAuditChain(events, AuditAnchor{}); err != nil || n != 5 {
+			t.Errorf("key=%q: valid chain verified %d: %v", key, n, err)
+		}
+
+		changed := append([]AuditEvent{}, events...)
+		changed[2].Outcome = AuditFailure
+		if n, err := verifyTestAuditChain(changed, AuditAnchor{}); err == nil || n != 2 {
+			t.Errorf("key=%q: changed event verified %d: %v", key, n, err)
+		}
+
+		//rehashing a changed event breaks the link to the next event
+		changed[2].Hash = changed[2].hash()
+		if n, err := verifyTestAuditChain(changed, AuditAnchor{}); err == nil || n != 3 {
+			t.Errorf("key=%q: rehashed event verified %d: %v", key, n, err)
+		}
+
+		removed := append(append([]AuditEvent{}, events[:1]...), events[2:]...)
+		if n, err := verifyTestAuditChain(removed, AuditAnchor{}); err == nil || n != 1 {
+			t.Errorf("key=%q: chain with a removed event verified %d: %v", key, n, err)
+		}
+	}
+} //TestAuditChain()
+
+func TestAuditKey(t *testing.T) {
+	withAuditKey(t, "")
+	plain := testAuditChain(3)
+
+	//a chain rewritten without the key does not verify with it
+	withAuditKey(t, "0123456789abcdef")
+	if _, err := verifyTestAuditChain(plain, AuditAnchor{}); err == nil {
+		t.Errorf("Chain hashed without the key verified with it")
+	}
+	keyed := testAuditChain(3)
+	withAuditKey(t, "fedcba9876543210")
+	if _, err := verifyTestAuditChain(keyed, AuditAnchor{}); err == nil {
+		t.Errorf("Chain verified with another key")
+	}
+} //TestAuditKey()
+
+func TestAuditAnchor(t *testing.T) {
+	withAuditKey(t, "")
+	events := testAuditChain(5)
+	anchor := AuditAnchor{Seq: 4, Hash: events[3].Hash}
+
+	if n, err := verifyTestAuditChain(events, anchor); err != nil || n != 5 {
+		t.Errorf("Chain with anchor verified %d: %v", n, err)
+	}
+	//removing the last events leaves a valid chain, but not up to the anchor
+	if _, err := verifyTestAuditChain(events[:3], anchor); err == nil {
+		t.Errorf("Truncated chain verified")
+	}
+	if _, err := verifyTestAuditChain(events, AuditAnchor{Seq: 4, Hash: events[2].Hash}); err == nil {
+		t.Errorf("Chain verified with another anchor hash")
+	}
+
+	if a, err := ParseAuditAnchor(anchor.String()); err != nil || a != anchor {
+		t.Errorf("Parsed anchor %s as %+v, %v", anchor, a, err)
+	}
+	for _, s := range []string{"", "4", "x:abc", "0:abc", "4:"} {
+		if _, err := ParseAuditAnchor(s); err == nil {
+			t.Errorf("Parsed invalid anchor %q", s)
+		}
+	}
+} //TestAuditAnchor()
+
+func TestAuditBy(t *testing.T) {
+	withAuditKey(t, "")
+	e := testAuditChain(1)[0]
+	before := e.hash()
+	e.By = bson.NewObjectId()
+	if e.hash() == before {
+		t.Errorf("By is not in the hash")
+	}
+	e.Hash = e.hash()
+	changed := e
+	changed.By = bson.NewObjectId()
+	if _, err := verifyTestAuditChain([]AuditEvent{changed}, AuditAnchor{}); err == nil {
+		t.Errorf("Changed By verified")
+	}
+	e.By = ""
+	if e.hash() != before {
+		t.Errorf("Hash of events without By changed")
+	}
+} //TestAuditBy()
+
+func TestAuditFieldBoundaries(t *testing.T) {
+	withAuditKey(t, "")
+	e := testAuditChain(1)[0]
+	e.IP = "10.0.0.1"
+	e.Detail = "a|b"
+	shifted := e
+	shifted.IP = "10.0.0.1|a"
+	shifted.Detail = "b"
+	if e.hash() == shifted.hash() {
+		t.Errorf("Moving text between fields did not change the hash")
+	}
+} //TestAuditFieldBoundaries()
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
@@ -11,18 +12,46 @@ import (
 	"bitbucket.org/conorit/golib-logger"
 	types "bitbucket.org/conorit/golib-types"
 	"github.com/gorilla/pat"
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/metrics"
+	"github.com/jansemmelink/auth2/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	log                    = logger.New("auth")
-	dbUserCollection       = Db().DB("auth").C("users")
-	errUserAlreadyExists   = log.Errorf(nil, "User already exists")
-	errUserDoesNotExist    = log.Errorf(nil, "User does not exist")
-	errTempPasswordExpired = log.Errorf(nil, "Temp password expired.")
-	errWrongPassword       = log.Errorf(nil, "Wrong password")
+	errUserAlreadyExists   = apierror.New(apierror.AuthUserExists, "User already exists")
+	errUserDoesNotExist    = apierror.New(apierror.AuthUserNotFound, "User does not exist")
+	errTempPasswordExpired = apierror.New(apierror.AuthTempPasswordExpired, "Temp password expired.")
+	errWrongPassword       = apierror.New(apierror.AuthWrongPassword, "Wrong password")
 )
 
+//loginReason is the metrics label for a failed login
+func loginReason(err error) string {
+	switch err {
+	case errUserDoesNotExist:
+		return "unknown_user"
+	case errWrongPassword:
+		return "wrong_password"
+	case errTempPasswordExpired:
+		return "temp_password_expired"
+	case errUserLocked:
+		return "locked"
+	case errUserDisabled:
+		return "disabled"
+	case errUserNotActive:
+		return "not_active"
+	case errDirectoryUnavailable:
+		return "directory_unavailable"
+	default:
+		return "other"
+	}
+} //loginReason()
+
+//maxFailedLogins is the nr of consecutive wrong passwords after which the user is locked
+const maxFailedLogins = 5
+
 //AddAuthRoutes add the auth API to the router
 func AddAuthRoutes(r *pat.Router) {
 	//auth operations
@@ -39,35 +68,113 @@ func AddAuthRoutes(r *pat.Router) {
 
 	r.Get("/auth/logout", logoutHandler)
 	r.Post("/auth/logout", logoutHandler)
+
+	//token operations for resource servers, require client authentication
+	r.Post("/oauth/introspect", introspectHandler)
+	r.Post("/oauth/revoke", revokeHandler)
+
+	//device authorization grant for clients that cannot open a browser
+	r.Post("/oauth/device_authorization", deviceAuthorizationHandler)
+	r.Post("/oauth/token", tokenHandler)
+	r.Get("/device", devicePageHandler)
+	r.Post("/device", deviceApproveHandler)
+
+	//roles and permissions
+	r.Get("/auth/whoami", RequirePermission("", whoamiHandler))
+	r.Get("/auth/roles", RequirePermission("role:read", listRolesHandler))
+	r.Post("/auth/roles", RequirePermission("role:write", saveRoleHandler))
+	r.Delete("/auth/roles/{name}", RequirePermission("role:write", deleteRoleHandler))
+	r.Put("/auth/users/{id}/roles", RequirePermission("role:write", setUserRolesHandler))
+
+	//organisations (tenants)
+	r.Delete("/auth/organisations/{id}/users/{user_id}", RequirePermission("organisation:write", removeMemberHandler))
+	r.Post("/auth/organisations/{id}/users", RequirePermission("organisation:write", addMemberHandler))
+	r.Get("/auth/organisations", RequirePermission("", listOrganisationsHandler))
+	r.Post("/auth/organisations", RequirePermission("organisation:write", createOrganisationHandler))
+
+	//login identifiers of the logged in user
+	r.Post("/auth/identifiers/verify", RequirePermission("", verifyIdentifierHandler))
+	r.Delete("/auth/identifiers/{value}", RequirePermission("", removeIdentifierHandler))
+	r.Get("/auth/identifiers", RequirePermission("", listIdentifiersHandler))
+	r.Post("/auth/identifiers", RequirePermission("", addIdentifierHandler))
+
+	//email change, confirmed from the new address, cancelled from the old address
+	r.Post("/auth/email/change", RequirePermission("", startEmailChangeHandler))
+	r.Get("/auth/email/confirm", confirmEmailChangeHandler)
+	r.Get("/auth/email/cancel", cancelEmailChangeHandler)
+
+	//federated login with external OpenID Connect providers
+	r.Get("/auth/oidc/{provider}/callback", oidcCallbackHandler)
+	r.Get("/auth/oidc/{provider}/login", oidcLoginHandler)
+
+	//SP-initiated SAML 2.0 login
+	r.Get("/auth/saml/{provider}/metadata", samlMetadataHandler)
+	r.Get("/auth/saml/{provider}/login", samlLoginHandler)
+	r.Post("/auth/saml/{provider}/acs", samlACSHandler)
+
+	//user management for administrators
+	addAdminRoutes(r)
+
+	describeAuthRoutes()
 }
 
 //User is what we store for an authentication entry
 //TempPassword is not encrypted as it does not reveal anything about the user - its a random string
 //TempPassword expires in a few minutes
 //RealPassword is encrypted as SHA-1 when stored in the database
+//Roles and Permissions together give the user's effective permissions
 type User struct {
 	ID           bson.ObjectId `bson:"_id" json:"_id"`
 	Name         string
 	Password     string
 	TempPassword string
 	TempExpiry   time.Time
+	Roles        []string
+	Permissions  []string
+
+	//organisations (tenants) that the user belongs to
+	OrganisationIDs []bson.ObjectId `bson:"_organisation_ids" json:"_organisation_ids"`
+
+	//names that the user can login with, see identifier.go
+	Identifiers []Identifier `bson:",omitempty" json:",omitempty"`
+
+	//subjects of external identity providers linked to the user, see oidc.go
+	ExternalIDs []ExternalID `bson:",omitempty" json:",omitempty"`
+
+	//account lifecycle, see status.go, with the time each status was last entered
+	Status       string
+	StatusTimes  map[string]time.Time
+	FailedLogins int
 }
 
-//Insert to insert into the database - will check duplicate key
+//Insert to insert into the database
+//user.Name is normalised and must be unique, which is enforced by the unique
+//index on name, so that concurrent inserts cannot create the same user twice
+//An unverified identifier of another user with the same value does not prevent registration
 func (u User) Insert() (User, error) {
-	//user.Name must be unique
-	if _, err := u.getByName(u.Name); err == nil {
-		return u, errUserAlreadyExists
+	u.Name = NormaliseName(u.Name)
+	u.Identifiers = []Identifier{nameIdentifier(u.Name)}
+	if err := releaseIdentifier(u.Identifiers[0].Value); err != nil {
+		return u, err
 	}
 
-	//assign new ID
+	//assign new ID, new users must still be activated
 	u.ID = bson.NewObjectId()
+	u.Status = StatusPendingActivation
+	u.StatusTimes = map[string]time.Time{StatusPendingActivation: time.Now()}
 	log.Debug.Printf("Creating user.id=%v", u.ID)
 
 	//insert into the database
-	if err := dbUserCollection.Insert(u); err != nil {
+	start := time.Now()
+	err := dbUserCollection().Insert(u)
+	metrics.ObserveMongo("users", "insert", start)
+	if err != nil {
+		if isDuplicate(err) {
+			return u, errUserAlreadyExists
+		}
 		return u, log.Errorf(err, "Failed on db.insert(%+v)", u)
 	}
+	recordStatusChange(u.ID, "", u.Status, "registered", "", u.StatusTimes[u.Status])
 
 	log.Info.Printf("Created(%+v)", u)
 	return u, nil
@@ -81,36 +188,71 @@ func (u User) Get(id string) (User, error) {
 	}
 	mgoKey := make(bson.M)
 	mgoKey["_id"] = bson.ObjectIdHex(id)
-	if err := dbUserCollection.Find(mgoKey).One(u); err != nil {
+	defer metrics.ObserveMongo("users", "find", time.Now())
+	if err := dbUserCollection().Find(mgoKey).One(&u); err != nil {
 		return User{}, log.Errorf(err, "Failed to get")
 	}
 	return u, nil
 } //User.Get()
 
-func (u User) getByName(name string) (User, error) {
+//getByName gets the user by name or by any of its verified identifiers
+func (u User) getByName(ctx context.Context, name string) (User, error) {
+	name = normaliseLogin(name)
 	log.Debug.Printf("Getting user.name=%s", name)
 	mgoKey := make(bson.M)
-	mgoKey["name"] = name
-	if err := dbUserCollection.Find(mgoKey).One(&u); err != nil {
+	mgoKey["$or"] = []bson.M{
+		{"name": name},
+		{"identifiers": bson.M{"$elemMatch": bson.M{"value": name, "verified": true}}},
+	}
+	defer metrics.ObserveMongo("users", "find", time.Now())
+	_, span := tracing.StartDB(ctx, "users", "find")
+	err := dbUserCollection().Find(mgoKey).One(&u)
+	tracing.End(span, err)
+	if err != nil {
 		return User{}, log.Errorf(err, "User(name=%s) does not exist", name)
 	}
 	return u, nil
 } //user.getByName()
 
-//Authenticate checks the Name + TempPassword/Password as specified against the database
-//and on success, sets the ID and clears the password fields of output
+//Authenticate checks the Name + TempPassword/Password as specified against the database,
+//or the Password against the LDAP directory for the name (see ldap.go),
+//and on success, returns the stored user with the temp password cleared
 func (u User) Authenticate() (User, error) {
+	return u.AuthenticateIn(context.Background(), "")
+} //User.Authenticate()
+
+//AuthenticateIn is Authenticate when logging in to the tenant,
+//which may select the LDAP directory to authenticate with
+//ctx is the request context, used for tracing
+func (u User) AuthenticateIn(ctx context.Context, tenant bson.ObjectId) (User, error) {
+	if u.TempPassword == "" && !u.ID.Valid() {
+		if cfg := directoryFor(u.Name, tenant); cfg != nil {
+			return u.authenticateDirectory(ctx, *cfg, tenant)
+		}
+	}
+	return u.authenticateLocal(ctx)
+} //User.AuthenticateIn()
+
+func (u User) authenticateLocal(ctx context.Context) (user User, err error) {
+	ctx, span := tracing.Start(ctx, "user.authenticate", attribute.String("auth.method", "local"))
+	defer func() { tracing.End(span, err) }()
+
 	//load user by name
 	existingUser := User{}
-	var err error
 	if u.ID.Valid() {
 		existingUser, err = u.Get(u.ID.Hex())
 	} else {
-		existingUser, err = u.getByName(u.Name)
+		existingUser, err = u.getByName(ctx, u.Name)
+		if err == nil && !existingUser.canLoginWith(u.Name) {
+			return u, log.Errorf(nil, "Identifier %s is not verified", u.Name)
+		}
 	}
 	if err != nil {
 		return u, errUserDoesNotExist
 	}
+	if err := existingUser.canAuthenticate(u.TempPassword != ""); err != nil {
+		return u, err
+	}
 
 	//check specified password, temp/real
 	if u.TempPassword != "" {
@@ -118,7 +260,7 @@ func (u User) Authenticate() (User, error) {
 			return u, errTempPasswordExpired
 		}
 		if u.TempPassword != existingUser.TempPassword {
-			return u, errWrongPassword
+			return u, existingUser.failedLogin()
 		}
 		//authenticated inactive user
 		//clear tempPassword so that subsequent
@@ -132,7 +274,7 @@ func (u User) Authenticate() (User, error) {
 		io.WriteString(pwHash, u.Password)
 		pwSha1 := fmt.Sprintf("%x", pwHash.Sum(nil))
 		if pwSha1 != existingUser.Password {
-			return u, errWrongPassword
+			return u, existingUser.failedLogin()
 		}
 
 		//authenticated active user, copy encrypted password
@@ -140,18 +282,50 @@ func (u User) Authenticate() (User, error) {
 		u.Password = existingUser.Password
 	}
 
-	//authenticated: include ID in output
-	//do not include password value loaded from the database
-	u.ID = existingUser.ID
-	return u, nil
-} //User.Authenticate()
+	//authenticated: reset the failed login count
+	if existingUser.FailedLogins > 0 {
+		if err := dbUserCollection().UpdateId(existingUser.ID, bson.M{"$set": bson.M{"failedlogins": 0}}); err != nil {
+			log.Error.Printf("Failed to reset failed logins of user.id=%s: %v", existingUser.ID.Hex(), err)
+		}
+		existingUser.FailedLogins = 0
+	}
+
+	//output the stored user so that later updates keep
+	//all stored fields, but with the password fields set as above
+	existingUser.Password = u.Password
+	existingUser.TempPassword = u.TempPassword
+	existingUser.TempExpiry = u.TempExpiry
+	return existingUser, nil
+} //User.authenticateLocal()
+
+//failedLogin counts a wrong password or temp password and after maxFailedLogins
+//locks the user, also a user still to activate, and clears the temp password
+//it returns the error to report to the caller
+func (u User) failedLogin() error {
+	u.FailedLogins++
+	upd := bson.M{"failedlogins": u.FailedLogins}
+	if u.FailedLogins >= maxFailedLogins {
+		//the temp password cannot be guessed further, a reset issues a new one
+		upd["temppassword"] = ""
+	}
+	if err := dbUserCollection().UpdateId(u.ID, bson.M{"$set": upd}); err != nil {
+		log.Error.Printf("Failed to count failed login of user.id=%s: %v", u.ID.Hex(), err)
+	}
+	if u.FailedLogins >= maxFailedLogins && (u.Status == StatusActive || u.Status == StatusPendingActivation) {
+		if _, err := u.SetStatus(StatusLocked, fmt.Sprintf("%d failed logins", u.FailedLogins), ""); err != nil {
+			log.Error.Printf("Failed to lock user.id=%s: %v", u.ID.Hex(), err)
+		}
+	}
+	return errWrongPassword
+} //User.failedLogin()
 
 //Update the user record in the database
 //ID field must already be set, from Authenticate() or Insert()
 func (u User) update() (User, error) {
 	log.Debug.Printf("Updating user=%+v", u)
+	defer metrics.ObserveMongo("users", "update", time.Now())
 
-	err := dbUserCollection.UpdateId(u.ID, u)
+	err := dbUserCollection().UpdateId(u.ID, u)
 	if err != nil {
 		return u, log.Errorf(err, "Failed to db.update user %+v", u)
 	}
@@ -163,43 +337,42 @@ func registerHandler(res http.ResponseWriter, req *http.Request) {
 	jsonDecoder := json.NewDecoder(req.Body)
 	user := User{}
 	if err := jsonDecoder.Decode(&user); err != nil {
-		http.Error(res, fmt.Sprintf("Invalid JSON: %v", err.Error()), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
 		return
 	}
 	log.Debug.Printf("Register: user.Name=%s", user.Name)
-
-	//validate reqData for this operation
-	if user.Name == "" {
-		http.Error(res, fmt.Sprintf("Invalid Request: missing UserName"), http.StatusBadRequest)
-		return
-	}
-
-	//prepare new userData with random temp password for activation
-	//and no real password
-	user.Password = ""
-	user.TempPassword = types.GeneratePassword(types.PasswordSpecification{Length: 8, Hex: true})
-	user.TempExpiry = time.Now().Add(time.Hour * 1)
-
-	//create the user in the database
-	user, err := user.Insert()
+	name := NormaliseName(user.Name)
+	user, err := NewUser(name)
 	if err != nil {
-		if err == errUserAlreadyExists {
-			http.Error(res, fmt.Sprintf("User already exists"), http.StatusConflict)
-		} else {
-			http.Error(res, fmt.Sprintf("Failed to register: %v", err.Error()), http.StatusBadRequest)
-		}
+		audit(req, AuditEvent{Event: AuditRegister, Outcome: AuditFailure, Name: name, Detail: auditError(err)})
+		//errUserAlreadyExists has its own code
+		apierror.Write(res, req, err, apierror.BadRequest)
 		return
 	}
 	log.Info.Printf("Registered user.Name=%s with ID=%s", user.Name, user.ID.Hex())
+	audit(req, AuditEvent{Event: AuditRegister, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name})
+	metrics.Registration()
 
 	jsonData, err := json.Marshal(user)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to encode response: %v", err.Error()), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
 		return
 	}
 	res.Write(jsonData)
 } //registerHandler()
 
+//NewUser creates a user with a random temp password and no real password,
+//the user must activate with the temp password before it expires
+func NewUser(name string) (User, error) {
+	user := User{Name: NormaliseName(name)}
+	if user.Name == "" {
+		return user, apierror.New(apierror.ValidationFailed, "Invalid Request: missing UserName").WithField("Name", "Missing name")
+	}
+	user.setTempPassword()
+	user.Roles = []string{RoleUser}
+	return user.Insert()
+} //NewUser()
+
 func resetHandler(res http.ResponseWriter, req *http.Request) {
 	//request data either POSTed or in GET URL
 	user := User{}
@@ -208,7 +381,7 @@ func resetHandler(res http.ResponseWriter, req *http.Request) {
 	} else {
 		jsonDecoder := json.NewDecoder(req.Body)
 		if err := jsonDecoder.Decode(&user); err != nil {
-			http.Error(res, fmt.Sprintf("Invalid JSON: %v", err.Error()), http.StatusBadRequest)
+			apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
 			return
 		}
 
@@ -220,10 +393,17 @@ func resetHandler(res http.ResponseWriter, req *http.Request) {
 	log.Debug.Printf("reset: name=%s", user.Name)
 
 	//load existing user by name
+	name := user.Name
 	var err error
-	user, err = user.getByName(user.Name)
+	user, err = user.getByName(req.Context(), user.Name)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("%v", err.Error()), http.StatusNotFound)
+		audit(req, AuditEvent{Event: AuditReset, Outcome: AuditFailure, Name: name, Detail: auditError(err)})
+		apierror.Write(res, req, err, apierror.AuthUserNotFound)
+		return
+	}
+	if err := user.canReset(); err != nil {
+		audit(req, AuditEvent{Event: AuditReset, Outcome: AuditFailure, UserID: user.ID, Name: user.Name, Detail: auditError(err)})
+		apierror.Write(res, req, err, apierror.Forbidden)
 		return
 	}
 
@@ -231,19 +411,20 @@ func resetHandler(res http.ResponseWriter, req *http.Request) {
 
 	//create new temp password, but leave existing password as is
 	//in case user remembers it
-	user.TempPassword = types.GeneratePassword(types.PasswordSpecification{Length: 8, Hex: true})
-	user.TempExpiry = time.Now().Add(time.Hour * 1)
+	user.setTempPassword()
 
 	//update the user in the database
 	user, err = user.update()
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to reset password: %v", err.Error()), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.BadRequest, "Failed to reset password: %v", err)
 		return
 	}
 	log.Info.Printf("Reset done user.Name=%s with ID=%s", user.Name, user.ID.Hex())
+	audit(req, AuditEvent{Event: AuditReset, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name})
+	metrics.Reset()
 	jsonData, err := json.Marshal(user)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to encode response: %v", err.Error()), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
 		return
 	}
 	res.Write(jsonData)
@@ -260,7 +441,7 @@ func activateHandler(res http.ResponseWriter, req *http.Request) {
 	} else {
 		jsonDecoder := json.NewDecoder(req.Body)
 		if err := jsonDecoder.Decode(&user); err != nil {
-			http.Error(res, fmt.Sprintf("Invalid JSON: %v", err.Error()), http.StatusBadRequest)
+			apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
 			return
 		}
 
@@ -271,50 +452,81 @@ func activateHandler(res http.ResponseWriter, req *http.Request) {
 	log.Debug.Printf("activate: name=%s tpw=%s npw=%s", user.Name, user.TempPassword, newPassword)
 
 	//make sure the new password will be strong enough
-	_, err := types.CheckPassword(newPassword, &types.PasswordSpecification{Length: 8, Lower: true, Upper: true, Digit: true})
-	if err != nil {
-		http.Error(res, fmt.Sprintf("New password is not strong enough: %v", err.Error()), http.StatusBadRequest)
+	if err := checkNewPassword(newPassword); err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
 		return
 	}
 
 	//authenticate with temp password
-	user, err = user.Authenticate()
+	name := user.Name
+	user, err := user.AuthenticateIn(req.Context(), "")
 	if err != nil {
-		http.Error(res, fmt.Sprintf("%v", err.Error()), http.StatusForbidden)
+		audit(req, AuditEvent{Event: AuditActivate, Outcome: AuditFailure, Name: name, Detail: auditError(err)})
+		apierror.Write(res, req, err, apierror.Forbidden)
 		return
 	}
 
 	log.Debug.Printf("Authenticated inactive user %s", user.Name)
 
-	//set the real password and clear the temp password in the database
-	pwHash := sha1.New()
-	io.WriteString(pwHash, newPassword)
-	user.Password = fmt.Sprintf("%x", pwHash.Sum(nil))
-	user.TempPassword = ""
-	user.TempExpiry = time.Now()
-	user, err = user.update()
-	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to activate: %v", err.Error()), http.StatusInternalServerError)
+	if user, err = user.Activate(newPassword); err != nil {
+		apierror.Write(res, req, err, apierror.Internal)
 		return
 	}
 
 	//changed the password successfully,
 	//now create session - same as login
-	s, err := Session{}.Create(user)
+	s, err := Session{TenantID: tenantParam(req)}.Create(req.Context(), user)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to create session: %v", err.Error()), http.StatusBadRequest)
+		apierror.Write(res, req, err, apierror.Unavailable)
 		return
 	}
 
 	log.Info.Printf("Logged in %s with session %s", user.Name, s.ID.Hex())
+	audit(req, AuditEvent{Event: AuditActivate, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name, SessionID: s.ID, TenantID: s.TenantID})
+	metrics.Login(AuditSuccess, "activate")
 	jsonData, err := json.Marshal(s)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to encode response: %v", err.Error()), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
 		return
 	}
 	res.Write(jsonData)
 } //activateHandler()
 
+//checkNewPassword checks that a new password is strong enough
+func checkNewPassword(password string) error {
+	spec := passwordSpecification(settings.Password)
+	if _, err := types.CheckPassword(password, &spec); err != nil {
+		return apierror.New(apierror.AuthWeakPassword, "New password is not strong enough: %v", err).WithField("Password", err.Error())
+	}
+	return nil
+} //checkNewPassword()
+
+//Activate sets the real password, clears the temp password and makes the user active.
+//The caller must have authenticated the user with the temp password, or be an administrator
+func (u User) Activate(newPassword string) (User, error) {
+	if err := checkNewPassword(newPassword); err != nil {
+		return u, err
+	}
+	pwHash := sha1.New()
+	io.WriteString(pwHash, newPassword)
+	u.Password = fmt.Sprintf("%x", pwHash.Sum(nil))
+	u.TempPassword = ""
+	u.TempExpiry = time.Now()
+	u, err := u.update()
+	if err != nil {
+		return u, log.Errorf(err, "Failed to activate")
+	}
+	if u, err = u.SetStatus(StatusActive, "activated", ""); err != nil {
+		return u, log.Errorf(err, "Failed to activate")
+	}
+
+	//the temp password was delivered to the registered name, which is now verified
+	if id, ok := u.identifier(u.Name); ok && !id.Verified {
+		u.setIdentifierVerified(id.Value)
+	}
+	return u, nil
+} //User.Activate()
+
 func loginHandler(res http.ResponseWriter, req *http.Request) {
 	//request data either POSTed or in GET URL
 	user := User{}
@@ -324,7 +536,7 @@ func loginHandler(res http.ResponseWriter, req *http.Request) {
 	} else {
 		jsonDecoder := json.NewDecoder(req.Body)
 		if err := jsonDecoder.Decode(&user); err != nil {
-			http.Error(res, fmt.Sprintf("Invalid JSON: %v", err.Error()), http.StatusBadRequest)
+			apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
 			return
 		}
 	}
@@ -333,26 +545,31 @@ func loginHandler(res http.ResponseWriter, req *http.Request) {
 	//authenticate with specified password
 	//(reset temp in case it was specified)
 	user.TempPassword = ""
+	name := user.Name
 	var err error
-	user, err = user.Authenticate()
+	user, err = user.AuthenticateIn(req.Context(), tenantParam(req))
 	if err != nil {
-		http.Error(res, fmt.Sprintf("%v", err.Error()), http.StatusForbidden)
+		audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditFailure, Name: name, TenantID: tenantParam(req), Detail: auditError(err)})
+		metrics.Login(AuditFailure, loginReason(err))
+		apierror.Write(res, req, err, apierror.Forbidden)
 		return
 	}
 
 	log.Debug.Printf("Authenticated active user %s", user.Name)
 
 	//now create session - same as login
-	s, err := Session{}.Create(user)
+	s, err := Session{TenantID: tenantParam(req)}.Create(req.Context(), user)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to create session: %v", err.Error()), http.StatusBadRequest)
+		apierror.Write(res, req, err, apierror.Unavailable)
 		return
 	}
 
 	log.Info.Printf("Logged in %s with session %s", user.Name, s.ID.Hex())
+	audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name, SessionID: s.ID, TenantID: s.TenantID})
+	metrics.Login(AuditSuccess, "password")
 	jsonData, err := json.Marshal(s)
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Failed to encode response: %v", err.Error()), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
 		return
 	}
 	res.Write(jsonData)
@@ -365,17 +582,18 @@ func logoutHandler(res http.ResponseWriter, req *http.Request) {
 	} else {
 		jsonDecoder := json.NewDecoder(req.Body)
 		if err := jsonDecoder.Decode(&session); err != nil {
-			http.Error(res, fmt.Sprintf("Invalid JSON: %v", err.Error()), http.StatusBadRequest)
+			apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
 			return
 		}
 	}
 	log.Debug.Printf("Logout: %+v", session)
-	session, err := session.Verify()
+	session, err := session.Verify(req.Context())
 	if err != nil {
-		http.Error(res, fmt.Sprintf("Unknown session"), http.StatusBadRequest)
+		apierror.Writef(res, req, apierror.AuthSessionInvalid, "Unknown session")
 		return
 	}
 	//end the session
 	log.Debug.Printf("Ending session %+v", session)
-	session.End()
+	session.End(req.Context())
+	audit(req, AuditEvent{Event: AuditLogout, Outcome: AuditSuccess, UserID: session.UserID, SessionID: session.ID, TenantID: session.TenantID})
 } //logoutHandler()
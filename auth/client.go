@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	types "bitbucket.org/conorit/golib-types"
+	"github.com/jansemmelink/auth2/apierror"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Client is an application that calls the OAuth endpoints on behalf of users
+//or on its own behalf, e.g. a resource server that introspects tokens.
+//Secret is encrypted as SHA-1 when stored in the database, same as User.Password
+type Client struct {
+	ID     bson.ObjectId `bson:"_id" json:"_id"`
+	Name   string
+	Secret string `json:",omitempty"`
+}
+
+var (
+	errClientNotAuthorized = apierror.New(apierror.AuthClientUnauthorized, "Client authentication failed")
+)
+
+//Insert creates a new client with a generated secret.
+//The clear secret is only returned here, only the SHA-1 is stored
+func (c Client) Insert() (Client, error) {
+	if c.Name == "" {
+		return c, log.Errorf(nil, "Missing client name")
+	}
+	c.ID = bson.NewObjectId()
+	secret := types.GeneratePassword(types.PasswordSpecification{Length: 32, Hex: true})
+	c.Secret = clientSecretHash(secret)
+	if err := dbClientCollection().Insert(c); err != nil {
+		return Client{}, log.Errorf(err, "Failed on db.insert(client.name=%s)", c.Name)
+	}
+	log.Info.Printf("Created client.id=%s name=%s", c.ID.Hex(), c.Name)
+	c.Secret = secret
+	return c, nil
+} //Client.Insert()
+
+//Get to retrieve from the database by hex string ID
+func (c Client) Get(id string) (Client, error) {
+	if !bson.IsObjectIdHex(id) {
+		return Client{}, log.Errorf(nil, "Invalid client id='%s' is not bson hex object id", id)
+	}
+	if err := dbClientCollection().FindId(bson.ObjectIdHex(id)).One(&c); err != nil {
+		return Client{}, log.Errorf(err, "Client(id=%s) does not exist", id)
+	}
+	return c, nil
+} //Client.Get()
+
+//ListClients returns all clients sorted by name, without their secrets
+func ListClients() ([]Client, error) {
+	list := []Client{}
+	if err := dbClientCollection().Find(nil).Sort("name").All(&list); err != nil {
+		return nil, log.Errorf(err, "Failed to list clients")
+	}
+	for i := range list {
+		list[i].Secret = ""
+	}
+	return list, nil
+} //ListClients()
+
+//DeleteClient deletes the client, its tokens can no longer be introspected or revoked
+func DeleteClient(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return apierror.New(apierror.NotFound, "Invalid client id='%s' is not bson hex object id", id)
+	}
+	if err := dbClientCollection().RemoveId(bson.ObjectIdHex(id)); err != nil {
+		if err == mgo.ErrNotFound {
+			return apierror.New(apierror.NotFound, "Client(id=%s) does not exist", id)
+		}
+		return log.Errorf(err, "Failed to delete client.id=%s", id)
+	}
+	log.Info.Printf("Deleted client.id=%s", id)
+	return nil
+} //DeleteClient()
+
+func listClientsHandler(res http.ResponseWriter, req *http.Request) {
+	list, err := ListClients()
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, list)
+} //listClientsHandler()
+
+func createClientHandler(res http.ResponseWriter, req *http.Request) {
+	c := Client{}
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	if c.Name == "" {
+		apierror.Write(res, req, apierror.New(apierror.ValidationFailed, "Missing client name").WithField("Name", "Missing name"), apierror.BadRequest)
+		return
+	}
+	admin, _ := SessionFromContext(req.Context())
+	c, err := c.Insert()
+	AuditChange(req, AuditEvent{Event: AuditClient, By: admin.UserID, Detail: "created " + c.Name + " " + c.ID.Hex()}, err)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	writeAdminJSON(res, c)
+} //createClientHandler()
+
+func deleteClientHandler(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	admin, _ := SessionFromContext(req.Context())
+	err := DeleteClient(id)
+	AuditChange(req, AuditEvent{Event: AuditClient, By: admin.UserID, Detail: "deleted " + id}, err)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+} //deleteClientHandler()
+
+//authenticateClient checks client credentials as described in RFC 6749 section 2.3.1:
+//HTTP Basic authentication is preferred, client_id and client_secret in the form body
+//is also accepted
+func authenticateClient(req *http.Request) (Client, error) {
+	id, secret, ok := req.BasicAuth()
+	if !ok {
+		id = req.PostFormValue("client_id")
+		secret = req.PostFormValue("client_secret")
+	}
+	if id == "" || secret == "" {
+		return Client{}, errClientNotAuthorized
+	}
+	c, err := Client{}.Get(id)
+	if err != nil {
+		log.Debug.Printf("Unknown client.id=%s: %v", id, err)
+		return Client{}, errClientNotAuthorized
+	}
+	if clientSecretHash(secret) != c.Secret {
+		log.Debug.Printf("Wrong secret for client.id=%s", id)
+		return Client{}, errClientNotAuthorized
+	}
+	c.Secret = ""
+	return c, nil
+} //authenticateClient()
+
+func clientSecretHash(secret string) string {
+	h := sha1.New()
+	io.WriteString(h, secret)
+	return fmt.Sprintf("%x", h.Sum(nil))
+} //clientSecretHash()
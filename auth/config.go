@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"time"
+
+	types "bitbucket.org/conorit/golib-types"
+	"github.com/jansemmelink/auth2/config"
+)
+
+//settings of the package, the defaults until Configure is called
+var settings = config.Default().Auth
+
+//Configure sets the settings of the package,
+//call it at startup before the database is used or requests are served
+func Configure(c config.Auth) {
+	settings = c
+} //Configure()
+
+func passwordSpecification(s config.PasswordSpec) types.PasswordSpecification {
+	return types.PasswordSpecification{Length: s.Length, Hex: s.Hex, Lower: s.Lower, Upper: s.Upper, Digit: s.Digit}
+} //passwordSpecification()
+
+//setTempPassword sets a new generated temp password that the user must activate with before it expires,
+//with a new count of failed attempts
+func (u *User) setTempPassword() {
+	u.TempPassword = types.GeneratePassword(passwordSpecification(settings.TempPassword))
+	u.TempExpiry = time.Now().Add(settings.TempPasswordExpiry)
+	u.FailedLogins = 0
+} //User.setTempPassword()
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jansemmelink/auth2/config"
+	"github.com/jansemmelink/auth2/item"
+)
+
+//testMongoURLEnv names the mongo server used by tests that need a database, e.g. "localhost".
+//Use a server for tests only: the tests write to its auth and item databases,
+//with unique names and values so they need not start empty
+const testMongoURLEnv = "AUTH2_TEST_MONGO_URL"
+
+//testDatabase connects the auth and item packages to the test server,
+//skipping the test when none is configured
+func testDatabase(t *testing.T) {
+	url := os.Getenv(testMongoURLEnv)
+	if url == "" {
+		t.Skipf("%s is not set", testMongoURLEnv)
+	}
+	saved := settings
+	c := config.Default()
+	c.Auth.MongoURL = url
+	c.Item.MongoURL = url
+	Close()
+	item.Close()
+	Configure(c.Auth)
+	item.Configure(c.Item)
+	if err := Connect(); err != nil {
+		t.Fatalf("Cannot connect to %s: %v", testMongoURLEnv, err)
+	}
+	if err := item.Connect(); err != nil {
+		t.Fatalf("Cannot connect to %s: %v", testMongoURLEnv, err)
+	}
+	t.Cleanup(func() {
+		Close()
+		item.Close()
+		Configure(saved)
+		item.Configure(config.Default().Item)
+	})
+} //testDatabase()
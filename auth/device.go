@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/metrics"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//DeviceAuthorization is a pending device authorization grant (RFC 8628)
+//The device polls with DeviceCode while the user enters UserCode on the /device page
+type DeviceAuthorization struct {
+	ID         bson.ObjectId `bson:"_id" json:"_id"`
+	DeviceCode string
+	UserCode   string
+	ClientID   bson.ObjectId `bson:"_client_id"`
+	Scope      string
+	Expiry     time.Time
+	Interval   int //seconds between polls
+	LastPoll   time.Time
+	Status     string
+	UserID     bson.ObjectId `bson:"_user_id,omitempty"`
+	SessionID  bson.ObjectId `bson:"_session_id,omitempty"`
+}
+
+//device authorization status values
+const (
+	deviceStatusPending  = "pending"
+	deviceStatusApproved = "approved"
+	deviceStatusDenied   = "denied"
+)
+
+const (
+	grantTypeDeviceCode  = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeExpiry     = time.Minute * 10
+	deviceDefaultPolling = 5 //seconds
+
+	//user codes use consonants only, so that they cannot spell words
+	//and cannot be confused with digits (RFC 8628 section 6.1)
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+//newDeviceAuthorization creates and stores a new pending grant for the client
+//with the scope of the tokens to issue, "" for all permissions of the user
+func newDeviceAuthorization(c Client, scope string) (DeviceAuthorization, error) {
+	deviceCode, err := randomHex(32)
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+	userCode, err := randomUserCode()
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+	d := DeviceAuthorization{
+		ID:         bson.NewObjectId(),
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientID:   c.ID,
+		Scope:      scope,
+		Expiry:     time.Now().Add(deviceCodeExpiry),
+		Interval:   deviceDefaultPolling,
+		Status:     deviceStatusPending,
+	}
+	if err := dbDeviceCollection().Insert(d); err != nil {
+		return DeviceAuthorization{}, log.Errorf(err, "Failed to db.insert(device authorization)")
+	}
+	log.Info.Printf("Device authorization started for client.id=%s user_code=%s", c.ID.Hex(), d.UserCode)
+	return d, nil
+} //newDeviceAuthorization()
+
+func getDeviceAuthorization(field, value string) (DeviceAuthorization, error) {
+	d := DeviceAuthorization{}
+	if err := dbDeviceCollection().Find(bson.M{field: value}).One(&d); err != nil {
+		return DeviceAuthorization{}, log.Errorf(err, "Device authorization(%s) does not exist", field)
+	}
+	return d, nil
+} //getDeviceAuthorization()
+
+//publicURL is the configured external URL of this service, used to make links.
+//It is never taken from the request, where the Host header is chosen by the client
+func publicURL() string {
+	return strings.TrimSuffix(settings.PublicURL, "/")
+} //publicURL()
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", log.Errorf(err, "Failed to generate random data")
+	}
+	return hex.EncodeToString(b), nil
+} //randomHex()
+
+//randomUserCode returns a code formatted as XXXX-XXXX,
+//with each character picked uniformly from userCodeAlphabet
+func randomUserCode() (string, error) {
+	code := ""
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			code += "-"
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", log.Errorf(err, "Failed to generate random data")
+		}
+		code += string(userCodeAlphabet[n.Int64()])
+	}
+	return code, nil
+} //randomUserCode()
+
+//normaliseUserCode accepts codes typed in lower case, with or without the dash
+func normaliseUserCode(code string) string {
+	code = strings.ToUpper(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+} //normaliseUserCode()
+
+//identifyClient accepts a confidential client with credentials,
+//or a public client with only client_id, as CLIs cannot keep a secret
+func identifyClient(req *http.Request) (Client, error) {
+	if _, _, ok := req.BasicAuth(); ok || req.PostFormValue("client_secret") != "" {
+		return authenticateClient(req)
+	}
+	c, err := Client{}.Get(req.PostFormValue("client_id"))
+	if err != nil {
+		return Client{}, errClientNotAuthorized
+	}
+	c.Secret = ""
+	return c, nil
+} //identifyClient()
+
+func deviceAuthorizationHandler(res http.ResponseWriter, req *http.Request) {
+	client, err := identifyClient(req)
+	if err != nil {
+		oauthError(res, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	d, err := newDeviceAuthorization(client, normaliseScope(req.PostFormValue("scope")))
+	if err != nil {
+		oauthError(res, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	verificationURI := publicURL() + "/device"
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"device_code":               d.DeviceCode,
+		"user_code":                 d.UserCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + d.UserCode,
+		"expires_in":                int(deviceCodeExpiry.Seconds()),
+		"interval":                  d.Interval,
+	})
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //deviceAuthorizationHandler()
+
+//deviceCodeGrant is called from the token endpoint when the device polls
+func deviceCodeGrant(res http.ResponseWriter, req *http.Request) {
+	client, err := identifyClient(req)
+	if err != nil {
+		oauthError(res, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	d, err := getDeviceAuthorization("devicecode", req.PostFormValue("device_code"))
+	if err != nil || d.ClientID != client.ID {
+		oauthError(res, http.StatusBadRequest, "invalid_grant", "Unknown device_code")
+		return
+	}
+	if time.Now().After(d.Expiry) {
+		dbDeviceCollection().RemoveId(d.ID)
+		oauthError(res, http.StatusBadRequest, "expired_token", "The device_code expired")
+		return
+	}
+
+	//polling too fast: each violation adds 5 seconds to the interval (RFC 8628 section 3.5)
+	now := time.Now()
+	tooFast := now.Before(d.LastPoll.Add(time.Duration(d.Interval) * time.Second))
+	upd := bson.M{"lastpoll": now}
+	if tooFast {
+		d.Interval += deviceDefaultPolling
+		upd["interval"] = d.Interval
+	}
+	if err := dbDeviceCollection().UpdateId(d.ID, bson.M{"$set": upd}); err != nil {
+		log.Error.Printf("Failed to update device poll time: %v", err)
+	}
+	if tooFast {
+		oauthError(res, http.StatusBadRequest, "slow_down", fmt.Sprintf("Poll at most every %d seconds", d.Interval))
+		return
+	}
+
+	switch d.Status {
+	case deviceStatusPending:
+		oauthError(res, http.StatusBadRequest, "authorization_pending", "The user has not yet approved the request")
+		return
+	case deviceStatusDenied:
+		dbDeviceCollection().RemoveId(d.ID)
+		oauthError(res, http.StatusBadRequest, "access_denied", "The user denied the request")
+		return
+	}
+
+	//approved: the device code can only be exchanged once
+	if err := dbDeviceCollection().RemoveId(d.ID); err != nil {
+		if err == mgo.ErrNotFound {
+			oauthError(res, http.StatusBadRequest, "invalid_grant", "The device_code was already used")
+		} else {
+			oauthError(res, http.StatusInternalServerError, "server_error", err.Error())
+		}
+		return
+	}
+	log.Info.Printf("Device authorized for user.id=%s session=%s", d.UserID.Hex(), d.SessionID.Hex())
+	tokens, err := issueTokens(client, Session{ID: d.SessionID, UserID: d.UserID}, d.Scope)
+	if err != nil {
+		oauthError(res, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeTokens(res, req, tokens)
+} //deviceCodeGrant()
+
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Device Login</title></head>
+<body>
+<h1>Device Login</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="POST" action="/device">
+<input type="hidden" name="session" value="{{.Session}}">
+<label>Code shown on your device: <input type="text" name="user_code" value="{{.UserCode}}"></label>
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type devicePageData struct {
+	Session  string
+	UserCode string
+	Message  string
+}
+
+func renderDevicePage(res http.ResponseWriter, status int, data devicePageData) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	if err := devicePage.Execute(res, data); err != nil {
+		log.Error.Printf("Failed to render device page: %v", err)
+	}
+} //renderDevicePage()
+
+//devicePageHandler shows the form where the logged-in user enters the user code
+func devicePageHandler(res http.ResponseWriter, req *http.Request) {
+	s, err := SessionFromRequest(req)
+	if err != nil {
+		renderDevicePage(res, http.StatusUnauthorized, devicePageData{Message: "Please login before approving a device."})
+		return
+	}
+	renderDevicePage(res, http.StatusOK, devicePageData{
+		Session:  s.ID.Hex(),
+		UserCode: req.URL.Query().Get("user_code"),
+	})
+} //devicePageHandler()
+
+//deviceApproveHandler approves or denies the device and on approval
+//creates a normal session for the logged-in user
+func deviceApproveHandler(res http.ResponseWriter, req *http.Request) {
+	s, err := SessionFromRequest(req)
+	if err != nil {
+		renderDevicePage(res, http.StatusUnauthorized, devicePageData{Message: "Please login before approving a device."})
+		return
+	}
+	data := devicePageData{Session: s.ID.Hex(), UserCode: req.PostFormValue("user_code")}
+
+	d, err := getDeviceAuthorization("usercode", normaliseUserCode(data.UserCode))
+	if err != nil || d.Status != deviceStatusPending || time.Now().After(d.Expiry) {
+		data.Message = "Unknown or expired code."
+		renderDevicePage(res, http.StatusNotFound, data)
+		return
+	}
+
+	upd := bson.M{"_user_id": s.UserID}
+	user := User{}
+	deviceSession := Session{}
+	if req.PostFormValue("action") == "approve" {
+		user, err = User{}.Get(s.UserID.Hex())
+		if err != nil {
+			data.Message = "Unknown user."
+			renderDevicePage(res, http.StatusForbidden, data)
+			return
+		}
+		deviceSession, err = Session{TenantID: s.TenantID}.Create(req.Context(), user)
+		if err != nil {
+			data.Message = "Failed to create session."
+			renderDevicePage(res, http.StatusInternalServerError, data)
+			return
+		}
+		upd["status"] = deviceStatusApproved
+		upd["_session_id"] = deviceSession.ID
+		data.Message = "Device approved. You may return to your device."
+	} else {
+		upd["status"] = deviceStatusDenied
+		data.Message = "Device denied."
+	}
+	//only a pending device can be decided, so of concurrent approvals only one
+	//succeeds and the sessions created for the others are ended
+	if err := dbDeviceCollection().Update(bson.M{"_id": d.ID, "status": deviceStatusPending}, bson.M{"$set": upd}); err != nil {
+		if deviceSession.ID.Valid() {
+			unused := deviceSession
+			if err := unused.End(req.Context()); err != nil {
+				log.Error.Printf("Failed to end unused device session.id=%s: %v", deviceSession.ID.Hex(), err)
+			}
+		}
+		if err == mgo.ErrNotFound {
+			data.Message = "The code was already approved or denied."
+			renderDevicePage(res, http.StatusConflict, data)
+			return
+		}
+		data.Message = "Failed to update device."
+		renderDevicePage(res, http.StatusInternalServerError, data)
+		return
+	}
+	if deviceSession.ID.Valid() {
+		audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name, SessionID: deviceSession.ID, TenantID: deviceSession.TenantID, Detail: "device " + d.ClientID.Hex()})
+		metrics.Login(AuditSuccess, "device")
+	}
+	log.Info.Printf("User.id=%s set device user_code=%s to %s", s.UserID.Hex(), d.UserCode, upd["status"])
+	data.UserCode = ""
+	renderDevicePage(res, http.StatusOK, data)
+} //deviceApproveHandler()
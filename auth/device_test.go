@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUserCode(t *testing.T) {
+	valid := regexp.MustCompile(`^[` + userCodeAlphabet + `]{4}-[` + userCodeAlphabet + `]{4}$`)
+	for i := 0; i < 20; i++ {
+		code, err := randomUserCode()
+		if err != nil || !valid.MatchString(code) {
+			t.Fatalf("randomUserCode = %q, %v", code, err)
+		}
+		if normaliseUserCode(strings.ToLower(strings.Replace(code, "-", "", 1))) != code {
+			t.Errorf("%s typed in lower case without dash is not normalised", code)
+		}
+	}
+	//every character of the alphabet is used
+	seen := map[rune]bool{}
+	for i := 0; i < 200; i++ {
+		code, _ := randomUserCode()
+		for _, c := range strings.Replace(code, "-", "", 1) {
+			seen[c] = true
+		}
+	}
+	if len(seen) != len(userCodeAlphabet) {
+		t.Errorf("Codes used %d of %d characters", len(seen), len(userCodeAlphabet))
+	}
+	for code, want := range map[string]string{
+		" bcdf-ghjk ": "BCDF-GHJK",
+		"BCDFGHJK":    "BCDF-GHJK",
+		"bcd":         "BCD",
+		"BCDFGHJKL":   "BCDFGHJKL",
+	} {
+		if got := normaliseUserCode(code); got != want {
+			t.Errorf("normaliseUserCode(%q) = %q, want %q", code, got, want)
+		}
+	}
+} //TestUserCode()
+
+func TestDevicePage(t *testing.T) {
+	res := httptest.NewRecorder()
+	devicePageHandler(res, httptest.NewRequest(http.MethodGet, "/device?user_code=BCDF-GHJK", nil))
+	if res.Code != http.StatusUnauthorized || !strings.Contains(res.Body.String(), "Please login") {
+		t.Errorf("Device page without session: %d %s", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	renderDevicePage(res, http.StatusOK, devicePageData{UserCode: `"><script>alert(1)</script>`})
+	if strings.Contains(res.Body.String(), "<script>") || res.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Device page does not escape the user code: %s", res.Body.String())
+	}
+} //TestDevicePage()
+
+//deviceTestClient makes a public client and polls the device endpoints as a device would
+type deviceTestClient struct {
+	client Client
+}
+
+//post posts the form to the handler, with the session as bearer token if not "",
+//and returns the status with the decoded JSON response (nil for HTML)
+func (c deviceTestClient) post(h http.HandlerFunc, session string, form url.Values) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if session != "" {
+		req.Header.Set("Authorization", "Bearer "+session)
+	}
+	res := httptest.NewRecorder()
+	h(res, req)
+	body := map[string]interface{}{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	return res.Code, body
+} //deviceTestClient.post()
+
+func (c deviceTestClient) poll(deviceCode string) (int, map[string]interface{}) {
+	//as if the interval passed since the last poll
+	dbDeviceCollection().Update(bson.M{"devicecode": deviceCode}, bson.M{"$set": bson.M{"lastpoll": time.Time{}}})
+	return c.post(tokenHandler, "", url.Values{
+		"grant_type":  {grantTypeDeviceCode},
+		"client_id":   {c.client.ID.Hex()},
+		"device_code": {deviceCode},
+	})
+} //deviceTestClient.poll()
+
+func TestDeviceFlow(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+	client, err := Client{Name: "device test"}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert client: %v", err)
+	}
+	t.Cleanup(func() { dbClientCollection().RemoveId(client.ID) })
+	u, err := User{Name: "device-" + bson.NewObjectId().Hex() + "@example.com"}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+	s, err := Session{}.Create(ctx, u)
+	if err != nil {
+		t.Fatalf("Cannot create session: %v", err)
+	}
+	t.Cleanup(func() { dbSessionCollection().RemoveAll(bson.M{"_user_id": u.ID}) })
+	c := deviceTestClient{client: client}
+
+	status, start := c.post(deviceAuthorizationHandler, "", url.Values{"client_id": {client.ID.Hex()}, "scope": {"person:read person:read"}})
+	deviceCode, _ := start["device_code"].(string)
+	userCode, _ := start["user_code"].(string)
+	if status != http.StatusOK || deviceCode == "" || userCode == "" || start["verification_uri"] != publicURL()+"/device" {
+		t.Fatalf("Device authorization: %d %v", status, start)
+	}
+	t.Cleanup(func() { dbDeviceCollection().RemoveAll(bson.M{"devicecode": deviceCode}) })
+
+	if status, body := c.poll(deviceCode); status != http.StatusBadRequest || body["error"] != "authorization_pending" {
+		t.Errorf("Poll while pending: %d %v", status, body)
+	}
+	//polling again at once is too fast
+	if status, body := c.post(tokenHandler, "", url.Values{"grant_type": {grantTypeDeviceCode}, "client_id": {client.ID.Hex()}, "device_code": {deviceCode}}); status != http.StatusBadRequest || body["error"] != "slow_down" {
+		t.Errorf("Poll too fast: %d %v", status, body)
+	}
+	if status, body := c.poll("not" + deviceCode); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Poll with unknown code: %d %v", status, body)
+	}
+
+	//the user approves the code typed in lower case, once
+	approve := url.Values{"user_code": {strings.ToLower(userCode)}, "action": {"approve"}}
+	if status, _ := c.post(deviceApproveHandler, "", approve); status != http.StatusUnauthorized {
+		t.Errorf("Approve without session: %d", status)
+	}
+	if status, _ := c.post(deviceApproveHandler, s.ID.Hex(), approve); status != http.StatusOK {
+		t.Errorf("Approve: %d", status)
+	}
+	if status, _ := c.post(deviceApproveHandler, s.ID.Hex(), url.Values{"user_code": {userCode}, "action": {"deny"}}); status != http.StatusNotFound && status != http.StatusConflict {
+		t.Errorf("Deny after approval: %d", status)
+	}
+
+	status, tokens := c.poll(deviceCode)
+	accessToken, _ := tokens["access_token"].(string)
+	if status != http.StatusOK || accessToken == "" || tokens["scope"] != "person:read" {
+		t.Fatalf("Poll after approval: %d %v", status, tokens)
+	}
+	if info := introspectToken(ctx, accessToken, ""); !info.Active || info.Sub != u.ID.Hex() {
+		t.Errorf("Device access token introspected as %+v", info)
+	}
+	if status, body := c.poll(deviceCode); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Poll after tokens were issued: %d %v", status, body)
+	}
+
+	//a denied device gets access_denied
+	_, start = c.post(deviceAuthorizationHandler, "", url.Values{"client_id": {client.ID.Hex()}})
+	deviceCode, _ = start["device_code"].(string)
+	userCode, _ = start["user_code"].(string)
+	if status, _ := c.post(deviceApproveHandler, s.ID.Hex(), url.Values{"user_code": {userCode}, "action": {"deny"}}); status != http.StatusOK {
+		t.Errorf("Deny: %d", status)
+	}
+	if status, body := c.poll(deviceCode); status != http.StatusBadRequest || body["error"] != "access_denied" {
+		t.Errorf("Poll after deny: %d %v", status, body)
+	}
+} //TestDeviceFlow()
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/item"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//EmailChange is a request to change one of the user's email identifiers.
+//The new address must be confirmed before the change takes effect, and the old
+//address is sent a link to cancel the request or to roll back the change
+type EmailChange struct {
+	ID            bson.ObjectId `bson:"_id" json:"_id"`
+	UserID        bson.ObjectId `bson:"_user_id" json:"_user_id"`
+	Old           string
+	New           string
+	ConfirmToken  string `json:"-"` //SHA-1 of token sent to new address
+	CancelToken   string `json:"-"` //SHA-1 of token sent to old address
+	Status        string
+	Created       time.Time
+	ConfirmExpiry time.Time
+	Confirmed     time.Time `json:",omitempty"`
+	RollbackUntil time.Time `json:",omitempty"`
+}
+
+//email change status values
+const (
+	emailChangePending    = "pending"
+	emailChangeConfirmed  = "confirmed"
+	emailChangeCancelled  = "cancelled"
+	emailChangeRolledBack = "rolled_back"
+)
+
+const (
+	emailChangeConfirmExpiry = time.Hour * 24
+	emailChangeRollbackLimit = time.Hour * 24 * 7
+)
+
+//StartEmailChange records the change and sends the confirmation and notice mails
+func (u User) StartEmailChange(ctx context.Context, oldEmail, newEmail string) (EmailChange, error) {
+	if _, ok := u.identifier(oldEmail); !ok {
+		return EmailChange{}, log.Errorf(nil, "User %s has no email %s", u.Name, oldEmail)
+	}
+	if _, err := (User{}).getByName(ctx, newEmail); err == nil {
+		return EmailChange{}, errIdentifierInUse
+	}
+	confirmToken, err := randomHex(32)
+	if err != nil {
+		return EmailChange{}, err
+	}
+	cancelToken, err := randomHex(32)
+	if err != nil {
+		return EmailChange{}, err
+	}
+
+	//only one pending change per user
+	if _, err := dbEmailChangeCollection().UpdateAll(
+		bson.M{"_user_id": u.ID, "status": emailChangePending},
+		bson.M{"$set": bson.M{"status": emailChangeCancelled}}); err != nil {
+		return EmailChange{}, log.Errorf(err, "Failed to cancel pending email changes")
+	}
+
+	now := time.Now()
+	c := EmailChange{
+		ID:            bson.NewObjectId(),
+		UserID:        u.ID,
+		Old:           oldEmail,
+		New:           newEmail,
+		ConfirmToken:  clientSecretHash(confirmToken),
+		CancelToken:   clientSecretHash(cancelToken),
+		Status:        emailChangePending,
+		Created:       now,
+		ConfirmExpiry: now.Add(emailChangeConfirmExpiry),
+	}
+	if err := dbEmailChangeCollection().Insert(c); err != nil {
+		return EmailChange{}, log.Errorf(err, "Failed to db.insert(email change)")
+	}
+
+	confirmLink := publicURL() + "/auth/email/confirm?token=" + url.QueryEscape(confirmToken)
+	cancelLink := publicURL() + "/auth/email/cancel?token=" + url.QueryEscape(cancelToken)
+	if err := item.SendMail(ctx, newEmail, "Confirm your new email address",
+		fmt.Sprintf("<p>Click <a href=\"%s\">here</a> to confirm %s as your new email address.</p>",
+			html.EscapeString(confirmLink), html.EscapeString(newEmail))); err != nil {
+		dbEmailChangeCollection().UpdateId(c.ID, bson.M{"$set": bson.M{"status": emailChangeCancelled}})
+		return EmailChange{}, log.Errorf(err, "Failed to send confirmation to %s", newEmail)
+	}
+	if err := item.SendMail(ctx, oldEmail, "Your email address is being changed",
+		fmt.Sprintf("<p>A change of your email address to %s was requested.</p>"+
+			"<p>If you did not request this, click <a href=\"%s\">here</a> to cancel it. "+
+			"The link remains valid for %d days after the change.</p>",
+			html.EscapeString(newEmail), html.EscapeString(cancelLink), int(emailChangeRollbackLimit.Hours()/24))); err != nil {
+		log.Error.Printf("Failed to send email change notice to %s: %v", oldEmail, err)
+	}
+	log.Info.Printf("User %s started email change %s -> %s", u.Name, oldEmail, newEmail)
+	return c, nil
+} //User.StartEmailChange()
+
+func getEmailChange(tokenField, token string) (EmailChange, error) {
+	c := EmailChange{}
+	if err := dbEmailChangeCollection().Find(bson.M{tokenField: clientSecretHash(token)}).One(&c); err != nil {
+		return EmailChange{}, apierror.New(apierror.AuthInvalidCode, "Unknown email change")
+	}
+	return c, nil
+} //getEmailChange()
+
+//replaceIdentifier replaces one email identifier with another in a single update,
+//so the unique index on identifiers still rejects a value already in use,
+//and updates the user name if it was the replaced email.
+//The confirmation proves the new email is the user's, so other users that did not verify it lose it
+func (u User) replaceIdentifier(from, to string) error {
+	if err := releaseIdentifier(to); err != nil {
+		return err
+	}
+	set := bson.M{"identifiers.$": Identifier{Type: IdentifierEmail, Value: to, Verified: true, VerifiedTime: time.Now()}}
+	if u.Name == from {
+		set["name"] = to
+	}
+	if err := dbUserCollection().Update(bson.M{"_id": u.ID, "identifiers.value": from}, bson.M{"$set": set}); err != nil {
+		if isDuplicate(err) {
+			return errIdentifierInUse
+		}
+		return log.Errorf(err, "Failed to change email %s to %s", from, to)
+	}
+	return nil
+} //User.replaceIdentifier()
+
+//updateEmailChange changes the status of the email change only if it still has status from,
+//so that of a concurrent confirm and cancel only one changes it
+func updateEmailChange(id bson.ObjectId, from string, set bson.M) error {
+	if err := dbEmailChangeCollection().Update(bson.M{"_id": id, "status": from}, bson.M{"$set": set}); err != nil {
+		if err == mgo.ErrNotFound {
+			return log.Errorf(nil, "Email change is no longer %s", from)
+		}
+		return log.Errorf(err, "Failed to update email change %s", id.Hex())
+	}
+	return nil
+} //updateEmailChange()
+
+//ConfirmEmailChange makes the change take effect
+func ConfirmEmailChange(token string) (EmailChange, error) {
+	c, err := getEmailChange("confirmtoken", token)
+	if err != nil {
+		return c, err
+	}
+	if c.Status != emailChangePending {
+		return c, log.Errorf(nil, "Email change is %s", c.Status)
+	}
+	if time.Now().After(c.ConfirmExpiry) {
+		return c, apierror.New(apierror.AuthInvalidCode, "Email change confirmation expired")
+	}
+	u, err := User{}.Get(c.UserID.Hex())
+	if err != nil {
+		return c, err
+	}
+
+	//confirmed before the email is changed, so a rollback can always find the change
+	confirmed := time.Now()
+	rollbackUntil := confirmed.Add(emailChangeRollbackLimit)
+	if err := updateEmailChange(c.ID, emailChangePending, bson.M{
+		"status":        emailChangeConfirmed,
+		"confirmed":     confirmed,
+		"rollbackuntil": rollbackUntil,
+	}); err != nil {
+		return c, err
+	}
+	if err := u.replaceIdentifier(c.Old, c.New); err != nil {
+		if err := updateEmailChange(c.ID, emailChangeConfirmed, bson.M{"status": emailChangePending}); err != nil {
+			log.Error.Printf("Failed to restore email change %s: %v", c.ID.Hex(), err)
+		}
+		return c, err
+	}
+	c.Status = emailChangeConfirmed
+	c.Confirmed = confirmed
+	c.RollbackUntil = rollbackUntil
+	log.Info.Printf("User.id=%s changed email %s -> %s", c.UserID.Hex(), c.Old, c.New)
+	return c, nil
+} //ConfirmEmailChange()
+
+//CancelEmailChange is called from the link sent to the old address.
+//A pending change is cancelled. A confirmed change is rolled back within the limit
+//and all sessions of the user are ended, as the account may be compromised
+func CancelEmailChange(token string) (EmailChange, error) {
+	c, err := getEmailChange("canceltoken", token)
+	if err != nil {
+		return c, err
+	}
+	switch c.Status {
+	case emailChangePending:
+		if err := updateEmailChange(c.ID, emailChangePending, bson.M{"status": emailChangeCancelled}); err != nil {
+			//roll back if it was confirmed meanwhile
+			if latest, getErr := getEmailChange("canceltoken", token); getErr == nil && latest.Status == emailChangeConfirmed {
+				return rollbackEmailChange(latest)
+			}
+			return c, err
+		}
+		c.Status = emailChangeCancelled
+	case emailChangeConfirmed:
+		return rollbackEmailChange(c)
+	default:
+		return c, log.Errorf(nil, "Email change is %s", c.Status)
+	}
+	log.Info.Printf("User.id=%s email change %s -> %s %s", c.UserID.Hex(), c.Old, c.New, c.Status)
+	return c, nil
+} //CancelEmailChange()
+
+//rollbackEmailChange restores the old email of a confirmed change within the limit
+func rollbackEmailChange(c EmailChange) (EmailChange, error) {
+	if time.Now().After(c.RollbackUntil) {
+		return c, log.Errorf(nil, "Email change can no longer be rolled back")
+	}
+	u, err := User{}.Get(c.UserID.Hex())
+	if err != nil {
+		return c, err
+	}
+	if err := updateEmailChange(c.ID, emailChangeConfirmed, bson.M{"status": emailChangeRolledBack}); err != nil {
+		return c, err
+	}
+	if err := u.replaceIdentifier(c.New, c.Old); err != nil {
+		if err := updateEmailChange(c.ID, emailChangeRolledBack, bson.M{"status": emailChangeConfirmed}); err != nil {
+			log.Error.Printf("Failed to restore email change %s: %v", c.ID.Hex(), err)
+		}
+		return c, err
+	}
+	if _, err := EndUserSessions(u.ID); err != nil {
+		log.Error.Printf("Failed to end sessions after email rollback: %v", err)
+	}
+	c.Status = emailChangeRolledBack
+	log.Info.Printf("User.id=%s email change %s -> %s %s", c.UserID.Hex(), c.Old, c.New, c.Status)
+	return c, nil
+} //rollbackEmailChange()
+
+//startEmailChangeHandler starts a change with JSON body {"Old":"...","New":"..."}
+//Old may be omitted when the user has only one email address
+func startEmailChangeHandler(res http.ResponseWriter, req *http.Request) {
+	reqData := struct {
+		Old string
+		New string
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	newID, err := NewIdentifier(IdentifierEmail, reqData.New)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	s, _ := SessionFromContext(req.Context())
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+		return
+	}
+
+	old := NormaliseEmail(reqData.Old)
+	if old == "" {
+		for _, id := range u.Identifiers {
+			if id.Type != IdentifierEmail || !id.Verified {
+				continue
+			}
+			if old != "" {
+				apierror.Writef(res, req, apierror.BadRequest, "Specify which email address to change")
+				return
+			}
+			old = id.Value
+		}
+	}
+	if id, ok := u.identifier(old); !ok || id.Type != IdentifierEmail || !id.Verified {
+		apierror.Writef(res, req, apierror.BadRequest, "No verified email address to change")
+		return
+	}
+
+	c, err := u.StartEmailChange(req.Context(), old, newID.Value)
+	if err != nil {
+		if err == errIdentifierInUse {
+			apierror.Write(res, req, err, apierror.Conflict)
+		} else {
+			apierror.Writef(res, req, apierror.BadRequest, "Failed to change email: %v", err)
+		}
+		return
+	}
+	jsonData, _ := json.Marshal(c)
+	res.Write(jsonData)
+} //startEmailChangeHandler()
+
+func confirmEmailChangeHandler(res http.ResponseWriter, req *http.Request) {
+	c, err := ConfirmEmailChange(req.URL.Query().Get("token"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	jsonData, _ := json.Marshal(c)
+	res.Write(jsonData)
+} //confirmEmailChangeHandler()
+
+func cancelEmailChangeHandler(res http.ResponseWriter, req *http.Request) {
+	c, err := CancelEmailChange(req.URL.Query().Get("token"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	jsonData, _ := json.Marshal(c)
+	res.Write(jsonData)
+} //cancelEmailChangeHandler()
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/config"
+	"github.com/jansemmelink/auth2/item"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//testMail is a mail received by the test SMTP server
+type testMail struct {
+	To   string
+	Body string
+}
+
+//withMail sends mail for the test to a local SMTP server, which passes every mail it receives
+//to the returned channel. Call it after testDatabase, which also configures the item package
+func withMail(t *testing.T) <-chan testMail {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	mails := make(chan testMail, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSMTP(conn, mails)
+		}
+	}()
+	saved := config.Default().Item
+	saved.MongoURL = os.Getenv(testMongoURLEnv)
+	c := saved
+	c.Mail = config.Mail{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, From: "auth@example.com"}
+	item.Configure(c)
+	t.Cleanup(func() {
+		l.Close()
+		item.Configure(saved)
+	})
+	return mails
+} //withMail()
+
+//serveTestSMTP accepts every command of one SMTP connection, without extensions
+func serveTestSMTP(conn net.Conn, mails chan<- testMail) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+	reply("220 test")
+	m := testMail{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.To = strings.Trim(line[len("RCPT TO:"):], "<> \r\n")
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 send data")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				m.Body += line
+			}
+			mails <- m
+			m = testMail{}
+			reply("250 ok")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+} //serveTestSMTP()
+
+//receiveToken returns the token in the link to path in the next mail, which must be sent to the address
+func receiveToken(t *testing.T, mails <-chan testMail, to, path string) string {
+	select {
+	case m := <-mails:
+		if m.To != to {
+			t.Fatalf("Mail sent to %s instead of %s", m.To, to)
+		}
+		match := regexp.MustCompile(regexp.QuoteMeta(path) + `\?token=([0-9a-f]+)`).FindStringSubmatch(m.Body)
+		if match == nil {
+			t.Fatalf("Mail to %s without link to %s: %s", to, path, m.Body)
+		}
+		return match[1]
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No mail sent to %s", to)
+	}
+	return ""
+} //receiveToken()
+
+func TestStartEmailChangeWithout(t *testing.T) {
+	u := User{Name: "jan@example.com", Identifiers: []Identifier{nameIdentifier("jan@example.com")}}
+	if _, err := u.StartEmailChange(context.Background(), "piet@example.com", "new@example.com"); err == nil {
+		t.Errorf("Changed an email the user does not have")
+	}
+} //TestStartEmailChangeWithout()
+
+func TestEmailChange(t *testing.T) {
+	testDatabase(t)
+	if err := EnsureUserIndexes(); err != nil {
+		t.Fatalf("Cannot create user indexes: %v", err)
+	}
+	mails := withMail(t)
+	ctx := context.Background()
+	email := func() string { return "email-" + bson.NewObjectId().Hex() + "@example.com" }
+	u, err := User{Name: email()}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() {
+		dbUserCollection().RemoveId(u.ID)
+		dbEmailChangeCollection().RemoveAll(bson.M{"_user_id": u.ID})
+	})
+	if err := u.setIdentifierVerified(u.Name); err != nil {
+		t.Fatalf("Cannot verify name: %v", err)
+	}
+	old := u.Name
+	invalidCode := func(err error) bool {
+		e, ok := err.(*apierror.Error)
+		return ok && e.Code == apierror.AuthInvalidCode
+	}
+
+	//a new change replaces the pending one
+	replaced := email()
+	if _, err := u.StartEmailChange(ctx, old, replaced); err != nil {
+		t.Fatalf("Cannot start change: %v", err)
+	}
+	first := receiveToken(t, mails, replaced, "/auth/email/confirm")
+	receiveToken(t, mails, old, "/auth/email/cancel")
+	newEmail := email()
+	if _, err := u.StartEmailChange(ctx, old, newEmail); err != nil {
+		t.Fatalf("Cannot start change: %v", err)
+	}
+	confirm := receiveToken(t, mails, newEmail, "/auth/email/confirm")
+	cancel := receiveToken(t, mails, old, "/auth/email/cancel")
+	if c, err := ConfirmEmailChange(first); err == nil || c.Status != emailChangeCancelled {
+		t.Errorf("Confirmed a replaced change: %+v, %v", c, err)
+	}
+	if _, err := ConfirmEmailChange("x" + confirm); !invalidCode(err) {
+		t.Errorf("Confirmed with an unknown token: %v", err)
+	}
+	if _, err := ConfirmEmailChange(cancel); !invalidCode(err) {
+		t.Errorf("Confirmed with the cancel token: %v", err)
+	}
+
+	c, err := ConfirmEmailChange(confirm)
+	if err != nil || c.Status != emailChangeConfirmed || !c.RollbackUntil.After(time.Now()) {
+		t.Fatalf("Cannot confirm: %+v, %v", c, err)
+	}
+	u, _ = User{}.Get(u.ID.Hex())
+	if u.Name != newEmail || !u.canLoginWith(newEmail) || u.canLoginWith(old) {
+		t.Errorf("After the change: %+v", u)
+	}
+	if _, err := ConfirmEmailChange(confirm); err == nil {
+		t.Errorf("Confirmed twice")
+	}
+
+	//the old address can roll the change back
+	if c, err = CancelEmailChange(cancel); err != nil || c.Status != emailChangeRolledBack {
+		t.Fatalf("Cannot roll back: %+v, %v", c, err)
+	}
+	u, _ = User{}.Get(u.ID.Hex())
+	if u.Name != old || !u.canLoginWith(old) || u.canLoginWith(newEmail) {
+		t.Errorf("After the rollback: %+v", u)
+	}
+	if _, err := CancelEmailChange(cancel); err == nil {
+		t.Errorf("Rolled back twice")
+	}
+
+	//an email in use cannot be the new address
+	other, err := User{Name: email()}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(other.ID) })
+	if _, err := u.StartEmailChange(ctx, old, other.Name); err != errIdentifierInUse {
+		t.Errorf("Changed to the email of another user: %v", err)
+	}
+
+	//a change that cannot be made stays pending, and can still be cancelled
+	taken := email()
+	if _, err := u.StartEmailChange(ctx, old, taken); err != nil {
+		t.Fatalf("Cannot start change: %v", err)
+	}
+	confirm = receiveToken(t, mails, taken, "/auth/email/confirm")
+	cancel = receiveToken(t, mails, old, "/auth/email/cancel")
+	registered, err := User{Name: taken}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(registered.ID) })
+	if _, err := ConfirmEmailChange(confirm); err != errIdentifierInUse {
+		t.Errorf("Confirmed the email of another user: %v", err)
+	}
+	if c, err = CancelEmailChange(cancel); err != nil || c.Status != emailChangeCancelled {
+		t.Errorf("Cannot cancel a change that failed: %+v, %v", c, err)
+	}
+
+	//expired confirmation
+	newEmail = email()
+	if c, err = u.StartEmailChange(ctx, old, newEmail); err != nil {
+		t.Fatalf("Cannot start change: %v", err)
+	}
+	confirm = receiveToken(t, mails, newEmail, "/auth/email/confirm")
+	cancel = receiveToken(t, mails, old, "/auth/email/cancel")
+	if err := dbEmailChangeCollection().UpdateId(c.ID, bson.M{"$set": bson.M{"confirmexpiry": time.Now().Add(-time.Minute)}}); err != nil {
+		t.Fatalf("Cannot expire change: %v", err)
+	}
+	if _, err := ConfirmEmailChange(confirm); !invalidCode(err) {
+		t.Errorf("Confirmed an expired change: %v", err)
+	}
+	if c, err = CancelEmailChange(cancel); err != nil || c.Status != emailChangeCancelled {
+		t.Errorf("Cannot cancel a pending change: %+v, %v", c, err)
+	}
+} //TestEmailChange()
@@ -0,0 +1,409 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/item"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//identifier types
+const (
+	IdentifierUsername = "username"
+	IdentifierEmail    = "email"
+	IdentifierPhone    = "phone"
+)
+
+//Identifier is one of the names a user can login with.
+//Values are normalised and unique across all users.
+//Only verified identifiers can be used to login.
+//An identifier that is not verified before its code expires or after
+//too many wrong codes is removed, so it can be added again by any user.
+//Registering with the value removes it from users that did not verify it yet
+type Identifier struct {
+	Type         string
+	Value        string
+	Verified     bool
+	VerifiedTime time.Time `json:",omitempty"`
+	Code         string    `json:"-"` //SHA-1 of pending verification code
+	CodeExpiry   time.Time `json:"-"`
+	Attempts     int       `json:"-"` //nr of wrong codes entered
+}
+
+const (
+	verificationCodeExpiry  = time.Hour * 1
+	maxVerificationAttempts = 5
+)
+
+var (
+	regexValidUsername = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}._-]{2,63}$`)
+	regexValidPhone    = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	regexPhoneFormat   = regexp.MustCompile(`[\s().-]`)
+
+	errIdentifierInUse = apierror.New(apierror.AuthIdentifierInUse, "Identifier already in use")
+
+	//SendSMS sends verification codes to phone identifiers
+	//it must be set to use phone identifiers
+	SendSMS func(phone, message string) error
+)
+
+//NewIdentifier normalises and validates the value for the type
+func NewIdentifier(idType, value string) (Identifier, error) {
+	id := Identifier{Type: idType}
+	switch idType {
+	case IdentifierUsername:
+		id.Value = NormaliseName(value)
+		if !regexValidUsername.MatchString(id.Value) || strings.Contains(id.Value, "@") {
+			return id, log.Errorf(nil, "Invalid username \"%s\"", value)
+		}
+	case IdentifierEmail:
+		id.Value = NormaliseEmail(value)
+		if a, err := mail.ParseAddress(id.Value); err != nil || a.Address != id.Value {
+			return id, log.Errorf(nil, "Invalid email address \"%s\"", value)
+		}
+	case IdentifierPhone:
+		id.Value = NormalisePhone(value)
+		if !regexValidPhone.MatchString(id.Value) {
+			return id, log.Errorf(nil, "Invalid phone number \"%s\", expecting international format +<country><number>", value)
+		}
+	default:
+		return id, log.Errorf(nil, "Unknown identifier type \"%s\"", idType)
+	}
+	return id, nil
+} //NewIdentifier()
+
+//NormalisePhone removes formatting from a phone number
+func NormalisePhone(phone string) string {
+	return regexPhoneFormat.ReplaceAllString(strings.TrimSpace(phone), "")
+} //NormalisePhone()
+
+//normaliseLogin normalises a value entered to login, which may be any type of identifier
+func normaliseLogin(value string) string {
+	if p := NormalisePhone(value); regexValidPhone.MatchString(p) {
+		return p
+	}
+	return NormaliseName(value)
+} //normaliseLogin()
+
+//nameIdentifier is the identifier for the name used to register
+func nameIdentifier(name string) Identifier {
+	if id, err := NewIdentifier(IdentifierEmail, name); err == nil {
+		return id
+	}
+	return Identifier{Type: IdentifierUsername, Value: NormaliseName(name)}
+} //nameIdentifier()
+
+//identifier returns the user's identifier with the normalised value
+func (u User) identifier(value string) (Identifier, bool) {
+	for _, id := range u.Identifiers {
+		if id.Value == value {
+			return id, true
+		}
+	}
+	return Identifier{}, false
+} //User.identifier()
+
+//expired is true for an identifier that was not verified before its code expired
+func (id Identifier) expired() bool {
+	return !id.Verified && id.Code != "" && time.Now().After(id.CodeExpiry)
+} //Identifier.expired()
+
+//canLoginWith checks that the value used to login is the user's name or a verified identifier
+func (u User) canLoginWith(value string) bool {
+	value = normaliseLogin(value)
+	if value == u.Name {
+		return true
+	}
+	id, ok := u.identifier(value)
+	return ok && id.Verified
+} //User.canLoginWith()
+
+//AddIdentifier adds an unverified identifier and sends it a verification code
+func (u User) AddIdentifier(ctx context.Context, id Identifier) error {
+	if existing, ok := u.identifier(id.Value); ok && !existing.expired() {
+		return errIdentifierInUse
+	}
+	code, err := verificationCode()
+	if err != nil {
+		return err
+	}
+	id.Verified = false
+	id.Code = clientSecretHash(code)
+	id.CodeExpiry = time.Now().Add(verificationCodeExpiry)
+	id.Attempts = 0
+	if err := removeExpiredIdentifier(id.Value); err != nil {
+		return err
+	}
+	if err := dbUserCollection().UpdateId(u.ID, bson.M{"$push": bson.M{"identifiers": id}}); err != nil {
+		if isDuplicate(err) {
+			return errIdentifierInUse
+		}
+		return log.Errorf(err, "Failed to add identifier to user.id=%s", u.ID.Hex())
+	}
+	log.Info.Printf("Added %s identifier %s to user %s", id.Type, id.Value, u.Name)
+	if err := sendVerificationCode(ctx, id, code); err != nil {
+		//remove it so the user can try again
+		dbUserCollection().UpdateId(u.ID, bson.M{"$pull": bson.M{"identifiers": bson.M{"value": id.Value}}})
+		return err
+	}
+	return nil
+} //User.AddIdentifier()
+
+//VerifyIdentifier marks the identifier verified if the code is correct.
+//The identifier is removed when the code expired or after maxVerificationAttempts wrong codes
+func (u User) VerifyIdentifier(value, code string) error {
+	id, ok := u.identifier(value)
+	if !ok {
+		return log.Errorf(nil, "User %s has no identifier %s", u.Name, value)
+	}
+	if id.Verified {
+		return nil
+	}
+	if time.Now().After(id.CodeExpiry) {
+		u.removeUnverifiedIdentifier(value)
+		return apierror.New(apierror.AuthInvalidCode, "Verification code expired, add the identifier again")
+	}
+	if clientSecretHash(strings.TrimSpace(code)) != id.Code {
+		//count in the database and use the new count, so that concurrent guesses are all counted
+		updated := User{}
+		if _, err := dbUserCollection().Find(bson.M{"_id": u.ID, "identifiers.value": value}).Apply(mgo.Change{
+			Update:    bson.M{"$inc": bson.M{"identifiers.$.attempts": 1}},
+			ReturnNew: true,
+		}, &updated); err != nil {
+			return log.Errorf(err, "Failed to count wrong code for identifier %s", value)
+		}
+		if id, ok = updated.identifier(value); !ok || id.Attempts >= maxVerificationAttempts {
+			u.removeUnverifiedIdentifier(value)
+			return apierror.New(apierror.AuthInvalidCode, "Too many wrong verification codes, add the identifier again")
+		}
+		return apierror.New(apierror.AuthInvalidCode, "Wrong verification code")
+	}
+	return u.setIdentifierVerified(value)
+} //User.VerifyIdentifier()
+
+//removeUnverifiedIdentifier removes the identifier from the user if not verified
+func (u User) removeUnverifiedIdentifier(value string) {
+	if err := dbUserCollection().UpdateId(u.ID, bson.M{"$pull": bson.M{"identifiers": bson.M{"value": value, "verified": false}}}); err != nil {
+		log.Error.Printf("Failed to remove unverified identifier %s from user %s: %v", value, u.Name, err)
+		return
+	}
+	log.Info.Printf("Removed unverified identifier %s from user %s", value, u.Name)
+} //User.removeUnverifiedIdentifier()
+
+//releaseIdentifier removes the value from any user that added it but did not verify it yet,
+//except from a user that still has to activate with it as name
+func releaseIdentifier(value string) error {
+	pending := bson.M{"value": value, "verified": false}
+	info, err := dbUserCollection().UpdateAll(
+		bson.M{"name": bson.M{"$ne": value}, "identifiers": bson.M{"$elemMatch": pending}},
+		bson.M{"$pull": bson.M{"identifiers": pending}})
+	if err != nil {
+		return log.Errorf(err, "Failed to release identifier %s", value)
+	}
+	if info.Updated > 0 {
+		log.Info.Printf("Released unverified identifier %s", value)
+	}
+	return nil
+} //releaseIdentifier()
+
+//removeExpiredIdentifier removes the value from any user that added it but
+//did not verify it before the code expired, so that it is not held forever
+func removeExpiredIdentifier(value string) error {
+	expired := bson.M{"value": value, "verified": false, "code": bson.M{"$ne": ""}, "codeexpiry": bson.M{"$lt": time.Now()}}
+	info, err := dbUserCollection().UpdateAll(
+		bson.M{"identifiers": bson.M{"$elemMatch": expired}},
+		bson.M{"$pull": bson.M{"identifiers": expired}})
+	if err != nil {
+		return log.Errorf(err, "Failed to remove expired identifier %s", value)
+	}
+	if info.Updated > 0 {
+		log.Info.Printf("Removed expired unverified identifier %s", value)
+	}
+	return nil
+} //removeExpiredIdentifier()
+
+func (u User) setIdentifierVerified(value string) error {
+	if err := dbUserCollection().Update(
+		bson.M{"_id": u.ID, "identifiers.value": value},
+		bson.M{"$set": bson.M{
+			"identifiers.$.verified":     true,
+			"identifiers.$.verifiedtime": time.Now(),
+			"identifiers.$.code":         "",
+		}}); err != nil {
+		return log.Errorf(err, "Failed to verify identifier %s", value)
+	}
+	log.Info.Printf("Verified identifier %s of user %s", value, u.Name)
+	return nil
+} //User.setIdentifierVerified()
+
+//RemoveIdentifier removes an identifier, but not the last verified one
+//because then the user cannot login any more, and not the user name,
+//which must remain an identifier so no other user can add it
+func (u User) RemoveIdentifier(value string) error {
+	id, ok := u.identifier(value)
+	if !ok {
+		return log.Errorf(nil, "User %s has no identifier %s", u.Name, value)
+	}
+	if value == u.Name {
+		return log.Errorf(nil, "Cannot remove the user name %s", value)
+	}
+	if id.Verified {
+		n := 0
+		for _, i := range u.Identifiers {
+			if i.Verified {
+				n++
+			}
+		}
+		if n < 2 {
+			return log.Errorf(nil, "Cannot remove the last verified identifier")
+		}
+	}
+	if err := dbUserCollection().UpdateId(u.ID, bson.M{"$pull": bson.M{"identifiers": bson.M{"value": value}}}); err != nil {
+		return log.Errorf(err, "Failed to remove identifier %s", value)
+	}
+	log.Info.Printf("Removed identifier %s from user %s", value, u.Name)
+	return nil
+} //User.RemoveIdentifier()
+
+func verificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", log.Errorf(err, "Failed to generate verification code")
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+} //verificationCode()
+
+func sendVerificationCode(ctx context.Context, id Identifier, code string) error {
+	switch id.Type {
+	case IdentifierEmail:
+		return item.SendMail(ctx, id.Value, "Verification code", fmt.Sprintf("<p>Your verification code is <b>%s</b></p>", code))
+	case IdentifierPhone:
+		if SendSMS == nil {
+			return log.Errorf(nil, "Cannot verify %s: SMS is not configured", id.Value)
+		}
+		return SendSMS(id.Value, fmt.Sprintf("Your verification code is %s", code))
+	default:
+		//usernames are not delivered anywhere, so they are verified when added
+		return nil
+	}
+} //sendVerificationCode()
+
+//ensureIdentifierIndex adds the name as identifier of users stored before
+//identifiers existed, then creates the unique index on identifier values
+func ensureIdentifierIndex() error {
+	iter := dbUserCollection().Find(bson.M{"identifiers": bson.M{"$exists": false}}).Iter()
+	u := User{}
+	for iter.Next(&u) {
+		id := nameIdentifier(u.Name)
+		id.Verified = u.Status != StatusPendingActivation
+		if err := dbUserCollection().UpdateId(u.ID, bson.M{"$set": bson.M{"identifiers": []Identifier{id}}}); err != nil {
+			log.Error.Printf("Cannot add identifier %s to user.id=%s: %v", id.Value, u.ID.Hex(), err)
+		}
+		u = User{}
+	}
+	if err := iter.Close(); err != nil {
+		return log.Errorf(err, "Failed to add user identifiers")
+	}
+	if err := dbUserCollection().EnsureIndex(mgo.Index{
+		Key:    []string{"identifiers.value"},
+		Unique: true,
+		Sparse: true,
+		Name:   "identifiers_unique",
+	}); err != nil {
+		return log.Errorf(err, "Failed to create unique index on user identifiers")
+	}
+	return nil
+} //ensureIdentifierIndex()
+
+func listIdentifiersHandler(res http.ResponseWriter, req *http.Request) {
+	s, _ := SessionFromContext(req.Context())
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+		return
+	}
+	jsonData, _ := json.Marshal(u.Identifiers)
+	res.Write(jsonData)
+} //listIdentifiersHandler()
+
+//addIdentifierHandler adds an identifier with JSON body {"Type":"email","Value":"..."}
+func addIdentifierHandler(res http.ResponseWriter, req *http.Request) {
+	reqData := struct {
+		Type  string
+		Value string
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	id, err := NewIdentifier(reqData.Type, reqData.Value)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	s, _ := SessionFromContext(req.Context())
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+		return
+	}
+	if err := u.AddIdentifier(req.Context(), id); err != nil {
+		if err == errIdentifierInUse {
+			apierror.Write(res, req, err, apierror.Conflict)
+		} else {
+			apierror.Writef(res, req, apierror.BadRequest, "Failed to add identifier: %v", err)
+		}
+		return
+	}
+	if id.Type == IdentifierUsername {
+		u.setIdentifierVerified(id.Value)
+	}
+	jsonData, _ := json.Marshal(id)
+	res.Write(jsonData)
+} //addIdentifierHandler()
+
+//verifyIdentifierHandler verifies with JSON body {"Value":"...","Code":"..."}
+func verifyIdentifierHandler(res http.ResponseWriter, req *http.Request) {
+	reqData := struct {
+		Value string
+		Code  string
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	s, _ := SessionFromContext(req.Context())
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+		return
+	}
+	if err := u.VerifyIdentifier(normaliseLogin(reqData.Value), reqData.Code); err != nil {
+		apierror.Write(res, req, err, apierror.Forbidden)
+		return
+	}
+} //verifyIdentifierHandler()
+
+func removeIdentifierHandler(res http.ResponseWriter, req *http.Request) {
+	s, _ := SessionFromContext(req.Context())
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+		return
+	}
+	if err := u.RemoveIdentifier(normaliseLogin(req.URL.Query().Get(":value"))); err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+} //removeIdentifierHandler()
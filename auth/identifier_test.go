@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewIdentifier(t *testing.T) {
+	valid := []struct {
+		typ, value, want string
+	}{
+		{IdentifierUsername, " Jan_Semmelink ", "jan_semmelink"},
+		{IdentifierUsername, "jan.s-2", "jan.s-2"},
+		{IdentifierEmail, "Jan@Example.COM", "jan@example.com"},
+		{IdentifierPhone, "+27 (82) 555-1234", "+27825551234"},
+		{IdentifierPhone, "+1.202.555.0100", "+12025550100"},
+	}
+	for _, test := range valid {
+		id, err := NewIdentifier(test.typ, test.value)
+		if err != nil || id.Value != test.want || id.Type != test.typ || id.Verified {
+			t.Errorf("NewIdentifier(%s, %q) = %+v, %v", test.typ, test.value, id, err)
+		}
+	}
+	invalid := []struct {
+		typ, value string
+	}{
+		{IdentifierUsername, "ja"},
+		{IdentifierUsername, ".jan"},
+		{IdentifierUsername, "jan@example.com"},
+		{IdentifierUsername, "jan semmelink"},
+		{IdentifierEmail, "jan"},
+		{IdentifierEmail, "Jan <jan@example.com>"},
+		{IdentifierPhone, "0825551234"},
+		{IdentifierPhone, "+0825551234"},
+		{IdentifierPhone, "+27 82 555 12a4"},
+		{"fax", "+27825551234"},
+	}
+	for _, test := range invalid {
+		if id, err := NewIdentifier(test.typ, test.value); err == nil {
+			t.Errorf("NewIdentifier(%s, %q) = %+v", test.typ, test.value, id)
+		}
+	}
+} //TestNewIdentifier()
+
+func TestNameIdentifier(t *testing.T) {
+	if id := nameIdentifier("Jan@Example.com"); id.Type != IdentifierEmail || id.Value != "jan@example.com" {
+		t.Errorf("nameIdentifier of an email = %+v", id)
+	}
+	if id := nameIdentifier("Jan"); id.Type != IdentifierUsername || id.Value != "jan" {
+		t.Errorf("nameIdentifier of a name = %+v", id)
+	}
+} //TestNameIdentifier()
+
+func TestCanLoginWith(t *testing.T) {
+	u := User{
+		Name: "jan@example.com",
+		Identifiers: []Identifier{
+			{Type: IdentifierEmail, Value: "jan@example.com", Verified: true},
+			{Type: IdentifierPhone, Value: "+27825551234", Verified: true},
+			{Type: IdentifierUsername, Value: "jans", Verified: false},
+		},
+	}
+	for value, want := range map[string]bool{
+		"Jan@Example.com":  true,
+		"+27 82 555 1234":  true,
+		"jans":             false,
+		"jan@example.org":  false,
+		"+27 82 555 12345": false,
+	} {
+		if got := u.canLoginWith(value); got != want {
+			t.Errorf("canLoginWith(%q) = %v", value, got)
+		}
+	}
+} //TestCanLoginWith()
+
+func TestIdentifierExpired(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	tests := []struct {
+		id   Identifier
+		want bool
+	}{
+		{Identifier{Code: "x", CodeExpiry: past}, true},
+		{Identifier{Code: "x", CodeExpiry: future}, false},
+		{Identifier{Code: "x", CodeExpiry: past, Verified: true}, false},
+		{Identifier{Verified: true}, false},
+	}
+	for _, test := range tests {
+		if got := test.id.expired(); got != test.want {
+			t.Errorf("%+v expired = %v", test.id, got)
+		}
+	}
+} //TestIdentifierExpired()
+
+func TestRemoveIdentifierName(t *testing.T) {
+	u := User{Name: "jan@example.com", Identifiers: []Identifier{
+		{Type: IdentifierEmail, Value: "jan@example.com", Verified: true},
+		{Type: IdentifierUsername, Value: "jan", Verified: true},
+	}}
+	if err := u.RemoveIdentifier(u.Name); err == nil {
+		t.Errorf("Removed the user name while another identifier is verified")
+	}
+} //TestRemoveIdentifierName()
+
+func TestVerificationCode(t *testing.T) {
+	valid := regexp.MustCompile(`^[0-9]{6}$`)
+	codes := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		code, err := verificationCode()
+		if err != nil || !valid.MatchString(code) {
+			t.Fatalf("verificationCode = %q, %v", code, err)
+		}
+		codes[code] = true
+	}
+	if len(codes) < 15 {
+		t.Errorf("Only %d different codes in 20", len(codes))
+	}
+} //TestVerificationCode()
+
+//withSMS captures the codes sent by SMS for the test
+func withSMS(t *testing.T) map[string]string {
+	sent := map[string]string{}
+	saved := SendSMS
+	SendSMS = func(phone, message string) error {
+		sent[phone] = message[strings.LastIndex(message, " ")+1:]
+		return nil
+	}
+	t.Cleanup(func() { SendSMS = saved })
+	return sent
+} //withSMS()
+
+//testPhone is a unique phone nr for a test identifier
+func testPhone() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(1000000000))
+	return fmt.Sprintf("+1999%09d", n)
+} //testPhone()
+
+func TestVerifyIdentifier(t *testing.T) {
+	testDatabase(t)
+	if err := EnsureUserIndexes(); err != nil {
+		t.Fatalf("Cannot create user indexes: %v", err)
+	}
+	ctx := context.Background()
+	sent := withSMS(t)
+	newUser := func() User {
+		u, err := User{Name: "identifier-" + bson.NewObjectId().Hex() + "@example.com"}.Insert()
+		if err != nil {
+			t.Fatalf("Cannot insert user: %v", err)
+		}
+		t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+		return u
+	}
+	get := func(u User) User {
+		u, _ = User{}.Get(u.ID.Hex())
+		return u
+	}
+	jan, piet := newUser(), newUser()
+	//as after activation
+	if err := jan.setIdentifierVerified(jan.Name); err != nil {
+		t.Fatalf("Cannot verify name: %v", err)
+	}
+
+	phone, err := NewIdentifier(IdentifierPhone, testPhone())
+	if err != nil {
+		t.Fatalf("Invalid test phone: %v", err)
+	}
+	if err := jan.AddIdentifier(ctx, phone); err != nil {
+		t.Fatalf("Cannot add phone: %v", err)
+	}
+	code := sent[phone.Value]
+	if err := piet.AddIdentifier(ctx, phone); err != errIdentifierInUse {
+		t.Errorf("Added the phone of another user: %v", err)
+	}
+	if get(jan).canLoginWith(phone.Value) {
+		t.Errorf("Can login with an unverified identifier")
+	}
+
+	if e, ok := get(jan).VerifyIdentifier(phone.Value, "x"+code).(*apierror.Error); !ok || e.Code != apierror.AuthInvalidCode {
+		t.Errorf("Verified with a wrong code: %v", e)
+	}
+	if err := get(jan).VerifyIdentifier(phone.Value, " "+code+" "); err != nil {
+		t.Errorf("Cannot verify with the code: %v", err)
+	}
+	if !get(jan).canLoginWith(phone.Value) {
+		t.Errorf("Cannot login with the verified identifier")
+	}
+
+	//too many wrong codes remove the identifier
+	other, _ := NewIdentifier(IdentifierPhone, testPhone())
+	if err := piet.AddIdentifier(ctx, other); err != nil {
+		t.Fatalf("Cannot add phone: %v", err)
+	}
+	for i := 1; i <= maxVerificationAttempts; i++ {
+		if err := get(piet).VerifyIdentifier(other.Value, "wrong"); err == nil {
+			t.Fatalf("Verified with a wrong code")
+		}
+	}
+	if _, ok := get(piet).identifier(other.Value); ok {
+		t.Errorf("Identifier kept after %d wrong codes", maxVerificationAttempts)
+	}
+
+	//an expired identifier is released to other users
+	if err := piet.AddIdentifier(ctx, other); err != nil {
+		t.Fatalf("Cannot add phone again: %v", err)
+	}
+	if err := dbUserCollection().Update(bson.M{"_id": piet.ID, "identifiers.value": other.Value},
+		bson.M{"$set": bson.M{"identifiers.$.codeexpiry": time.Now().Add(-time.Minute)}}); err != nil {
+		t.Fatalf("Cannot expire code: %v", err)
+	}
+	if err := jan.AddIdentifier(ctx, other); err != nil {
+		t.Errorf("Cannot add an expired identifier of another user: %v", err)
+	}
+	if _, ok := get(piet).identifier(other.Value); ok {
+		t.Errorf("Expired identifier not removed from the user that added it")
+	}
+
+	//the name is kept while another identifier is verified
+	jan = get(jan)
+	if err := jan.RemoveIdentifier(jan.Name); err == nil {
+		t.Errorf("Removed the name while the phone is verified")
+	}
+
+	//the last verified identifier is kept
+	if err := jan.RemoveIdentifier(phone.Value); err != nil {
+		t.Errorf("Cannot remove a verified identifier: %v", err)
+	}
+	jan = get(jan)
+	if err := jan.RemoveIdentifier(jan.Name); err == nil {
+		t.Errorf("Removed the last verified identifier")
+	}
+} //TestVerifyIdentifier()
+
+func TestRegisterWithPendingIdentifier(t *testing.T) {
+	testDatabase(t)
+	if err := EnsureUserIndexes(); err != nil {
+		t.Fatalf("Cannot create user indexes: %v", err)
+	}
+	withMail(t)
+	ctx := context.Background()
+	unique := bson.NewObjectId().Hex()
+	piet, err := User{Name: "piet-" + unique + "@example.com"}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(piet.ID) })
+
+	//piet adds the email of jan, who did not register yet, but cannot verify it
+	email, _ := NewIdentifier(IdentifierEmail, "jan-"+unique+"@example.com")
+	if err := piet.AddIdentifier(ctx, email); err != nil {
+		t.Fatalf("Cannot add email: %v", err)
+	}
+	if _, err := (User{}).getByName(ctx, email.Value); err == nil {
+		t.Errorf("Found user by unverified identifier")
+	}
+
+	//jan can still register with it, and piet loses it
+	jan, err := User{Name: email.Value}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot register with the email another user added: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(jan.ID) })
+	if found, err := (User{}).getByName(ctx, email.Value); err != nil || found.ID != jan.ID {
+		t.Errorf("Found %v, %v for the email instead of the registered user", found.ID, err)
+	}
+	piet, _ = User{}.Get(piet.ID.Hex())
+	if _, ok := piet.identifier(email.Value); ok {
+		t.Errorf("Identifier kept by the user that did not verify it")
+	}
+	if err := piet.AddIdentifier(ctx, email); err != errIdentifierInUse {
+		t.Errorf("Added the name of another user: %v", err)
+	}
+} //TestRegisterWithPendingIdentifier()
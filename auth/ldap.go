@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//LDAPConfig configures an LDAP or Active Directory server used to authenticate
+//users instead of the local password. A directory is selected when logging in
+//to one of its TenantIDs (organisation ids), or with a name in one of its Domains,
+//i.e. "<user>@<domain>" or "<domain>\<user>".
+//
+//Users are found with a search using the service account BindDN/BindPassword,
+//then authenticated with a bind as the user's DN (search-then-bind).
+//UserFilter may refer to {login} for the name as entered or {user} for the name
+//without domain, e.g. "(&(objectClass=user)(sAMAccountName={user}))"
+type LDAPConfig struct {
+	Name               string
+	URL                string //e.g. "ldap://dc1.example.com:389" or "ldaps://..."
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+
+	//attributes of the user entry, with AD defaults
+	IDAttribute        string //default "objectGUID", use "entryUUID" for OpenLDAP
+	EmailAttribute     string //default "mail"
+	GivenNameAttribute string //default "givenName"
+	SurnameAttribute   string //default "sn"
+	GroupAttribute     string //default "memberOf"
+
+	//GroupRoles maps group DNs to local roles. When specified, the user's roles
+	//are replaced on every login with the roles of the user's groups
+	GroupRoles map[string][]string
+
+	//TrustEmail links directory users to local users with the same verified email.
+	//Only set it when the directory controls the email attribute, as anyone who
+	//can set it in the directory can otherwise take over the local account
+	TrustEmail bool
+
+	Domains   []string
+	TenantIDs []string
+}
+
+//directoryEntry is what the directory tells us about an authenticated user
+type directoryEntry struct {
+	DN     string
+	ID     string
+	Email  string
+	Names  []string
+	Groups []string
+}
+
+var (
+	ldapDirectories = []LDAPConfig{}
+
+	errDirectoryUnavailable = apierror.New(apierror.AuthDirectoryDown, "Directory is not available")
+)
+
+//AddLDAPDirectory enables login with the directory
+func AddLDAPDirectory(cfg LDAPConfig) error {
+	if cfg.Name == "" || cfg.URL == "" || cfg.BaseDN == "" || cfg.UserFilter == "" {
+		return log.Errorf(nil, "LDAP directory requires Name, URL, BaseDN and UserFilter")
+	}
+	if len(cfg.Domains) == 0 && len(cfg.TenantIDs) == 0 {
+		return log.Errorf(nil, "LDAP directory %s requires Domains or TenantIDs", cfg.Name)
+	}
+	for _, t := range cfg.TenantIDs {
+		if !bson.IsObjectIdHex(t) {
+			return log.Errorf(nil, "LDAP directory %s has invalid tenant id %s", cfg.Name, t)
+		}
+	}
+	for role := range mappedRoles(cfg.GroupRoles) {
+		if _, err := GetRole(role); err != nil {
+			return log.Errorf(err, "LDAP directory %s maps to unknown role %s", cfg.Name, role)
+		}
+	}
+	setDefault(&cfg.IDAttribute, "objectGUID")
+	setDefault(&cfg.EmailAttribute, "mail")
+	setDefault(&cfg.GivenNameAttribute, "givenName")
+	setDefault(&cfg.SurnameAttribute, "sn")
+	setDefault(&cfg.GroupAttribute, "memberOf")
+	for i, d := range cfg.Domains {
+		cfg.Domains[i] = strings.ToLower(d)
+	}
+	ldapDirectories = append(ldapDirectories, cfg)
+	log.Info.Printf("Added LDAP directory %s (%s)", cfg.Name, cfg.URL)
+	return nil
+} //AddLDAPDirectory()
+
+//LoadLDAPDirectories adds all directories from a JSON file with a list of LDAPConfig
+func LoadLDAPDirectories(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return log.Errorf(err, "Failed to read %s", filename)
+	}
+	list := []LDAPConfig{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return log.Errorf(err, "Invalid JSON in %s", filename)
+	}
+	for _, cfg := range list {
+		if err := AddLDAPDirectory(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+} //LoadLDAPDirectories()
+
+func setDefault(value *string, def string) {
+	if *value == "" {
+		*value = def
+	}
+} //setDefault()
+
+//mappedRoles is the set of roles used in a group to roles mapping
+func mappedRoles(groupRoles map[string][]string) map[string]bool {
+	roles := map[string]bool{}
+	for _, list := range groupRoles {
+		for _, r := range list {
+			roles[r] = true
+		}
+	}
+	return roles
+} //mappedRoles()
+
+//splitDomain splits "user@domain" or "domain\user", returning "" domain if neither
+func splitDomain(login string) (user, domain string) {
+	if i := strings.LastIndex(login, "@"); i > 0 {
+		return login[:i], strings.ToLower(login[i+1:])
+	}
+	if i := strings.Index(login, `\`); i > 0 {
+		return login[i+1:], strings.ToLower(login[:i])
+	}
+	return login, ""
+} //splitDomain()
+
+//directoryFor selects the directory for the tenant, else for the domain of the login name
+//it returns nil when the user must be authenticated locally
+func directoryFor(login string, tenant bson.ObjectId) *LDAPConfig {
+	if tenant.Valid() {
+		for i, cfg := range ldapDirectories {
+			for _, t := range cfg.TenantIDs {
+				if t == tenant.Hex() {
+					return &ldapDirectories[i]
+				}
+			}
+		}
+	}
+	if _, domain := splitDomain(strings.TrimSpace(login)); domain != "" {
+		for i, cfg := range ldapDirectories {
+			for _, d := range cfg.Domains {
+				if d == domain {
+					return &ldapDirectories[i]
+				}
+			}
+		}
+	}
+	return nil
+} //directoryFor()
+
+func (cfg LDAPConfig) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		log.Error.Printf("Cannot connect to LDAP directory %s: %v", cfg.Name, err)
+		return nil, errDirectoryUnavailable
+	}
+	if cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			log.Error.Printf("Failed StartTLS with LDAP directory %s: %v", cfg.Name, err)
+			return nil, errDirectoryUnavailable
+		}
+	}
+	return conn, nil
+} //LDAPConfig.connect()
+
+//authenticate searches the user with the service account, then binds as the user
+func (cfg LDAPConfig) authenticate(login, password string) (directoryEntry, error) {
+	//an empty password would be an unauthenticated bind, which succeeds on most servers
+	if password == "" {
+		return directoryEntry{}, errWrongPassword
+	}
+	conn, err := cfg.connect()
+	if err != nil {
+		return directoryEntry{}, err
+	}
+	defer conn.Close()
+
+	if cfg.BindDN != "" {
+		if err := conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+			log.Error.Printf("Service bind to LDAP directory %s failed: %v", cfg.Name, err)
+			return directoryEntry{}, errDirectoryUnavailable
+		}
+	}
+	user, _ := splitDomain(login)
+	filter := strings.NewReplacer(
+		"{login}", ldap.EscapeFilter(login),
+		"{user}", ldap.EscapeFilter(user),
+	).Replace(cfg.UserFilter)
+	result, err := conn.Search(ldap.NewSearchRequest(
+		cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter,
+		[]string{cfg.IDAttribute, cfg.EmailAttribute, cfg.GivenNameAttribute, cfg.SurnameAttribute, cfg.GroupAttribute},
+		nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		log.Error.Printf("LDAP directory %s search %s failed: %v", cfg.Name, filter, err)
+		return directoryEntry{}, errDirectoryUnavailable
+	}
+	if len(result.Entries) != 1 {
+		log.Info.Printf("LDAP directory %s found %d entries for %s", cfg.Name, len(result.Entries), filter)
+		return directoryEntry{}, errUserDoesNotExist
+	}
+	e := result.Entries[0]
+	if err := conn.Bind(e.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return directoryEntry{}, errWrongPassword
+		}
+		log.Error.Printf("LDAP directory %s bind as %s failed: %v", cfg.Name, e.DN, err)
+		return directoryEntry{}, errDirectoryUnavailable
+	}
+
+	entry := directoryEntry{
+		DN:     e.DN,
+		ID:     e.GetAttributeValue(cfg.IDAttribute),
+		Email:  e.GetAttributeValue(cfg.EmailAttribute),
+		Groups: e.GetAttributeValues(cfg.GroupAttribute),
+	}
+	if raw := e.GetRawAttributeValue(cfg.IDAttribute); cfg.IDAttribute == "objectGUID" && len(raw) > 0 {
+		entry.ID = hex.EncodeToString(raw)
+	}
+	if entry.ID == "" {
+		entry.ID = e.DN
+	}
+	entry.Names = strings.Fields(e.GetAttributeValue(cfg.GivenNameAttribute) + " " + e.GetAttributeValue(cfg.SurnameAttribute))
+	return entry, nil
+} //LDAPConfig.authenticate()
+
+//groupRoles returns the roles mapped from the groups (compared case insensitive)
+func groupRoles(groupRoles map[string][]string, groups []string) []string {
+	roles := []string{}
+	added := map[string]bool{}
+	for _, g := range groups {
+		for name, list := range groupRoles {
+			if !strings.EqualFold(name, g) {
+				continue
+			}
+			for _, r := range list {
+				if !added[r] {
+					roles = append(roles, r)
+					added[r] = true
+				}
+			}
+		}
+	}
+	return roles
+} //groupRoles()
+
+//trustedEmail is the email to link or name the user by,
+//"" unless the directory is trusted for the email of its users
+func (cfg LDAPConfig) trustedEmail(entry directoryEntry) string {
+	if !cfg.TrustEmail {
+		return ""
+	}
+	return entry.Email
+} //LDAPConfig.trustedEmail()
+
+//authenticateDirectory authenticates against the directory, then provisions
+//or updates the local user, which must still be allowed to login
+func (u User) authenticateDirectory(ctx context.Context, cfg LDAPConfig, tenant bson.ObjectId) (User, error) {
+	ctx, span := tracing.Start(ctx, "user.authenticate",
+		attribute.String("auth.method", "ldap"),
+		attribute.String("ldap.directory", cfg.Name))
+	entry, err := cfg.authenticate(strings.TrimSpace(u.Name), u.Password)
+	tracing.End(span, err)
+	if err != nil {
+		return u, err
+	}
+	user, err := federatedUser(ctx, ExternalID{Provider: "ldap:" + cfg.Name, Subject: entry.ID}, cfg.trustedEmail(entry), entry.Names)
+	if err != nil {
+		return u, err
+	}
+	if err := user.canAuthenticate(false); err != nil {
+		return u, err
+	}
+
+	update := bson.M{}
+	if len(cfg.GroupRoles) > 0 {
+		user.Roles = groupRoles(cfg.GroupRoles, entry.Groups)
+		update["roles"] = user.Roles
+	}
+	if tenant.Valid() && !user.memberOf(tenant) {
+		user.OrganisationIDs = append(user.OrganisationIDs, tenant)
+		update["_organisation_ids"] = user.OrganisationIDs
+	}
+	if len(update) > 0 {
+		if err := dbUserCollection().UpdateId(user.ID, bson.M{"$set": update}); err != nil {
+			return u, log.Errorf(err, "Failed to update user %s from LDAP directory %s", user.Name, cfg.Name)
+		}
+	}
+	log.Info.Printf("Authenticated %s as %s in LDAP directory %s", u.Name, entry.DN, cfg.Name)
+	return user, nil
+} //User.authenticateDirectory()
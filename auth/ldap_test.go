@@ -0,0 +1,407 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//ldapTestEntry is a user in the test directory
+type ldapTestEntry struct {
+	DN       string
+	Password string
+	Attrs    map[string][]string
+}
+
+//ldapTestServer is a minimal in-process LDAP server that answers simple binds,
+//searches with filters of the form (attr=value) or (&(...)(attr=value)),
+//and the StartTLS extended operation
+type ldapTestServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	entries  []ldapTestEntry
+
+	mutex    sync.Mutex
+	binds    []string //DNs bound as, with " (tls)" when bound over TLS
+	searches []string //filters searched
+}
+
+func startLDAPServer(t *testing.T, entries []ldapTestEntry) *ldapTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	s := &ldapTestServer{
+		listener: l,
+		tls:      &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+		entries:  entries,
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+} //startLDAPServer()
+
+//Binds returns the DNs bound as so far
+func (s *ldapTestServer) Binds() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.binds...)
+} //ldapTestServer.Binds()
+
+//Searches returns the filters searched so far
+func (s *ldapTestServer) Searches() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.searches...)
+} //ldapTestServer.Searches()
+
+func (s *ldapTestServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+} //ldapTestServer.URL()
+
+func (s *ldapTestServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	isTLS := false
+	r := bufio.NewReader(conn)
+	for {
+		packet, err := ber.ReadPacket(r)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			for _, e := range s.entries {
+				if e.DN == dn && e.Password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			s.mutex.Lock()
+			if isTLS {
+				dn += " (tls)"
+			}
+			s.binds = append(s.binds, dn)
+			s.mutex.Unlock()
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			s.mutex.Lock()
+			s.searches = append(s.searches, filter)
+			s.mutex.Unlock()
+			for _, e := range s.entries {
+				if ldapTestMatch(filter, e) {
+					conn.Write(ldapSearchEntry(id, e).Bytes())
+				}
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationExtendedRequest:
+			if op.Children[0].Data.String() != "1.3.6.1.4.1.1466.20037" || isTLS {
+				conn.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError).Bytes())
+				continue
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			isTLS = true
+		default:
+			//unbind or unsupported
+			return
+		}
+	}
+} //ldapTestServer.serve()
+
+//ldapTestMatch matches the last (attr=value) of the filter against the entry
+func ldapTestMatch(filter string, e ldapTestEntry) bool {
+	i := strings.LastIndex(filter, "(")
+	if i < 0 {
+		return false
+	}
+	attrValue := strings.SplitN(strings.TrimRight(filter[i+1:], ")"), "=", 2)
+	if len(attrValue) != 2 {
+		return false
+	}
+	for _, v := range e.Attrs[attrValue[0]] {
+		if v == attrValue[1] {
+			return true
+		}
+	}
+	return false
+} //ldapTestMatch()
+
+func ldapResult(id int64, tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	p.AppendChild(op)
+	return p
+} //ldapResult()
+
+func ldapSearchEntry(id int64, e ldapTestEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.Attrs {
+		a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		a.AppendChild(set)
+		attrs.AppendChild(a)
+	}
+	op.AppendChild(attrs)
+	p.AppendChild(op)
+	return p
+} //ldapSearchEntry()
+
+//testCertificate is a self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+} //testCertificate()
+
+var ldapTestEntries = []ldapTestEntry{
+	{DN: "cn=svc,dc=example,dc=com", Password: "svc-secret"},
+	{
+		DN:       "uid=alice,ou=people,dc=example,dc=com",
+		Password: "alice-secret",
+		Attrs: map[string][]string{
+			"uid":       {"alice"},
+			"entryUUID": {"0b3e-alice"},
+			"mail":      {"alice@example.com"},
+			"givenName": {"Alice"},
+			"sn":        {"Smith"},
+			"memberOf":  {"cn=Admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+		},
+	},
+}
+
+func ldapTestConfig(url string) LDAPConfig {
+	cfg := LDAPConfig{
+		Name:         "test",
+		URL:          url,
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc-secret",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid={user}))",
+		IDAttribute:  "entryUUID",
+		Domains:      []string{"example.com"},
+	}
+	setDefault(&cfg.EmailAttribute, "mail")
+	setDefault(&cfg.GivenNameAttribute, "givenName")
+	setDefault(&cfg.SurnameAttribute, "sn")
+	setDefault(&cfg.GroupAttribute, "memberOf")
+	return cfg
+} //ldapTestConfig()
+
+func TestLDAPSearchThenBind(t *testing.T) {
+	s := startLDAPServer(t, ldapTestEntries)
+	cfg := ldapTestConfig(s.URL())
+
+	entry, err := cfg.authenticate("alice@example.com", "alice-secret")
+	if err != nil {
+		t.Fatalf("authenticate failed: %v", err)
+	}
+	expected := directoryEntry{
+		DN:     "uid=alice,ou=people,dc=example,dc=com",
+		ID:     "0b3e-alice",
+		Email:  "alice@example.com",
+		Names:  []string{"Alice", "Smith"},
+		Groups: []string{"cn=Admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("entry=%+v, expected %+v", entry, expected)
+	}
+	if len(s.Searches()) != 1 || s.Searches()[0] != "(&(objectClass=person)(uid=alice))" {
+		t.Errorf("searches=%v, expected the user filter with the name without domain", s.Searches())
+	}
+	if !reflect.DeepEqual(s.Binds(), []string{"cn=svc,dc=example,dc=com", "uid=alice,ou=people,dc=example,dc=com"}) {
+		t.Errorf("binds=%v, expected the service account then the user", s.Binds())
+	}
+
+	if _, err := cfg.authenticate("alice@example.com", "wrong"); err != errWrongPassword {
+		t.Errorf("wrong password gave %v, expected %v", err, errWrongPassword)
+	}
+	if _, err := cfg.authenticate("bob@example.com", "bob-secret"); err != errUserDoesNotExist {
+		t.Errorf("unknown user gave %v, expected %v", err, errUserDoesNotExist)
+	}
+
+	//an empty password must not reach the server, where it would be an unauthenticated bind
+	n := len(s.Binds())
+	if _, err := cfg.authenticate("alice@example.com", ""); err != errWrongPassword {
+		t.Errorf("empty password gave %v, expected %v", err, errWrongPassword)
+	}
+	if len(s.Binds()) != n {
+		t.Errorf("empty password was sent to the server")
+	}
+
+	//filter values are escaped
+	if _, err := cfg.authenticate("*)(uid=alice", "alice-secret"); err != errUserDoesNotExist {
+		t.Errorf("filter injection gave %v, expected %v", err, errUserDoesNotExist)
+	}
+
+	cfg.BindPassword = "wrong"
+	if _, err := cfg.authenticate("alice@example.com", "alice-secret"); err != errDirectoryUnavailable {
+		t.Errorf("failed service bind gave %v, expected %v", err, errDirectoryUnavailable)
+	}
+} //TestLDAPSearchThenBind()
+
+func TestLDAPStartTLS(t *testing.T) {
+	s := startLDAPServer(t, ldapTestEntries)
+	cfg := ldapTestConfig(s.URL())
+	cfg.StartTLS = true
+
+	//the test certificate is self-signed, so it is only accepted when verification is skipped
+	if _, err := cfg.authenticate("alice@example.com", "alice-secret"); err != errDirectoryUnavailable {
+		t.Errorf("untrusted certificate gave %v, expected %v", err, errDirectoryUnavailable)
+	}
+	if len(s.Binds()) != 0 {
+		t.Errorf("binds=%v, expected none without TLS", s.Binds())
+	}
+
+	cfg.InsecureSkipVerify = true
+	if _, err := cfg.authenticate("alice@example.com", "alice-secret"); err != nil {
+		t.Fatalf("authenticate with StartTLS failed: %v", err)
+	}
+	if !reflect.DeepEqual(s.Binds(), []string{"cn=svc,dc=example,dc=com (tls)", "uid=alice,ou=people,dc=example,dc=com (tls)"}) {
+		t.Errorf("binds=%v, expected all binds over TLS", s.Binds())
+	}
+} //TestLDAPStartTLS()
+
+func TestLDAPGroupRoles(t *testing.T) {
+	mapping := map[string][]string{
+		"cn=admins,ou=groups,dc=example,dc=com": {"admin", "user"},
+		"cn=staff,ou=groups,dc=example,dc=com":  {"user", "staff"},
+		"cn=other,ou=groups,dc=example,dc=com":  {"other"},
+	}
+	tests := []struct {
+		groups []string
+		roles  []string
+	}{
+		{groups: nil, roles: []string{}},
+		{groups: []string{"cn=nobody"}, roles: []string{}},
+		{groups: []string{"CN=Admins,OU=Groups,DC=example,DC=com"}, roles: []string{"admin", "user"}},
+		{groups: []string{"cn=staff,ou=groups,dc=example,dc=com"}, roles: []string{"user", "staff"}},
+	}
+	for _, test := range tests {
+		if roles := groupRoles(mapping, test.groups); !reflect.DeepEqual(roles, test.roles) {
+			t.Errorf("groups %v gave roles %v, expected %v", test.groups, roles, test.roles)
+		}
+	}
+
+	//roles of several groups are added once each, in any order
+	roles := groupRoles(mapping, []string{"cn=Admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"})
+	set := map[string]int{}
+	for _, r := range roles {
+		set[r]++
+	}
+	if !reflect.DeepEqual(set, map[string]int{"admin": 1, "user": 1, "staff": 1}) {
+		t.Errorf("admins and staff gave roles %v", roles)
+	}
+
+	//the roles of a user found in the directory
+	s := startLDAPServer(t, ldapTestEntries)
+	entry, err := ldapTestConfig(s.URL()).authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("authenticate failed: %v", err)
+	}
+	if roles := groupRoles(map[string][]string{"cn=admins,ou=groups,dc=example,dc=com": {"admin"}}, entry.Groups); !reflect.DeepEqual(roles, []string{"admin"}) {
+		t.Errorf("alice has roles %v, expected [admin]", roles)
+	}
+} //TestLDAPGroupRoles()
+
+func TestLDAPTrustEmail(t *testing.T) {
+	entry := directoryEntry{ID: "1", Email: "alice@example.com"}
+	cfg := LDAPConfig{}
+	if email := cfg.trustedEmail(entry); email != "" {
+		t.Errorf("untrusted directory gave email %s, expected none", email)
+	}
+	cfg.TrustEmail = true
+	if email := cfg.trustedEmail(entry); email != "alice@example.com" {
+		t.Errorf("trusted directory gave email %s", email)
+	}
+} //TestLDAPTrustEmail()
+
+func TestLDAPDirectoryFor(t *testing.T) {
+	tenant := bson.NewObjectId()
+	saved := ldapDirectories
+	defer func() { ldapDirectories = saved }()
+	ldapDirectories = []LDAPConfig{
+		{Name: "corp", Domains: []string{"corp.example.com"}},
+		{Name: "tenant", TenantIDs: []string{tenant.Hex()}},
+	}
+	tests := []struct {
+		login     string
+		tenant    bson.ObjectId
+		directory string
+	}{
+		{login: "alice", directory: ""},
+		{login: "alice@corp.example.com", directory: "corp"},
+		{login: "CORP.EXAMPLE.COM\\alice", directory: "corp"},
+		{login: "alice@other.com", directory: ""},
+		{login: "alice", tenant: tenant, directory: "tenant"},
+		{login: "alice", tenant: bson.NewObjectId(), directory: ""},
+	}
+	for _, test := range tests {
+		name := ""
+		if cfg := directoryFor(test.login, test.tenant); cfg != nil {
+			name = cfg.Name
+		}
+		if name != test.directory {
+			t.Errorf("%s in tenant %s gave directory \"%s\", expected \"%s\"", test.login, test.tenant.Hex(), name, test.directory)
+		}
+	}
+} //TestLDAPDirectoryFor()
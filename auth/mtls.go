@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//CertRule maps a client certificate, verified against the client CAs of the server,
+//to a user or service account, so machine callers can authenticate without a password.
+//
+//Field is the part of the certificate that Pattern (a regular expression) must match:
+//"subject" for the subject DN, e.g. "CN=billing,OU=Services,O=Example",
+//or "dns", "email" or "uri" for any subject alternative name of the type, e.g. a SPIFFE ID.
+//User or ServiceAccount may refer to submatches of Pattern, e.g. with Field "email",
+//Pattern "^(.+)@staff\.example\.com$" and User "$1@example.com".
+//
+//User is the name of an existing user to authenticate as.
+//ServiceAccount is the name of a user without a password that is created on first use,
+//with Roles when specified, which replace its roles when they were changed.
+//
+//Rules are tried in the order loaded, and the first match is used
+type CertRule struct {
+	Field          string
+	Pattern        string
+	User           string
+	ServiceAccount string
+	Roles          []string
+
+	//organisation that the session is scoped to, default the user's first organisation
+	TenantID string
+
+	regex *regexp.Regexp
+}
+
+var (
+	certRules = []CertRule{}
+
+	errCertificateUnknown = apierror.New(apierror.AuthCertificateUnknown, "Client certificate is not mapped to a user")
+)
+
+//certProvider is the ExternalID provider of service accounts
+const certProvider = "mtls"
+
+//AddCertRule adds a rule after the existing rules
+func AddCertRule(r CertRule) error {
+	switch r.Field {
+	case "subject", "dns", "email", "uri":
+	default:
+		return log.Errorf(nil, "Client certificate rule Field=%s must be subject, dns, email or uri", r.Field)
+	}
+	var err error
+	if r.regex, err = regexp.Compile(r.Pattern); err != nil || r.Pattern == "" {
+		return log.Errorf(err, "Client certificate rule has invalid Pattern \"%s\"", r.Pattern)
+	}
+	if (r.User == "") == (r.ServiceAccount == "") {
+		return log.Errorf(nil, "Client certificate rule %s requires either User or ServiceAccount", r.Pattern)
+	}
+	if r.User != "" && len(r.Roles) > 0 {
+		return log.Errorf(nil, "Client certificate rule %s can only specify Roles for a ServiceAccount", r.Pattern)
+	}
+	for _, role := range r.Roles {
+		if _, err := GetRole(role); err != nil {
+			return log.Errorf(err, "Client certificate rule %s maps to unknown role %s", r.Pattern, role)
+		}
+	}
+	if r.TenantID != "" && !bson.IsObjectIdHex(r.TenantID) {
+		return log.Errorf(nil, "Client certificate rule %s has invalid tenant id %s", r.Pattern, r.TenantID)
+	}
+	certRules = append(certRules, r)
+	log.Info.Printf("Added client certificate rule %s %s", r.Field, r.Pattern)
+	return nil
+} //AddCertRule()
+
+//LoadCertRules adds all rules from a JSON file with a list of CertRule
+func LoadCertRules(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return log.Errorf(err, "Failed to read %s", filename)
+	}
+	list := []CertRule{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return log.Errorf(err, "Invalid JSON in %s", filename)
+	}
+	for _, r := range list {
+		if err := AddCertRule(r); err != nil {
+			return err
+		}
+	}
+	return nil
+} //LoadCertRules()
+
+//certValues are the values of the field in the certificate
+func certValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "subject":
+		return []string{cert.Subject.String()}
+	case "dns":
+		return cert.DNSNames
+	case "email":
+		return cert.EmailAddresses
+	case "uri":
+		list := []string{}
+		for _, u := range cert.URIs {
+			list = append(list, u.String())
+		}
+		return list
+	}
+	return nil
+} //certValues()
+
+//match returns the name of the user or service account, or "" if the rule does not match
+func (r CertRule) match(cert *x509.Certificate) string {
+	template := r.User
+	if template == "" {
+		template = r.ServiceAccount
+	}
+	for _, value := range certValues(cert, r.Field) {
+		if m := r.regex.FindStringSubmatchIndex(value); m != nil {
+			return string(r.regex.ExpandString(nil, template, value, m))
+		}
+	}
+	return ""
+} //CertRule.match()
+
+//certUser returns the user that the certificate authenticates as, with the rule that matched
+func certUser(ctx context.Context, cert *x509.Certificate) (User, CertRule, error) {
+	for _, r := range certRules {
+		name := r.match(cert)
+		if name == "" {
+			continue
+		}
+		if r.ServiceAccount != "" {
+			u, err := serviceAccount(name, r)
+			return u, r, err
+		}
+		u, err := User{}.getByName(ctx, name)
+		if err != nil {
+			log.Info.Printf("Client certificate %s maps to unknown user %s", cert.Subject, name)
+			return User{}, r, errCertificateUnknown
+		}
+		return u, r, nil
+	}
+	log.Info.Printf("Client certificate %s matches no rule", cert.Subject)
+	return User{}, CertRule{}, errCertificateUnknown
+} //certUser()
+
+//serviceAccount returns the service account, which is created on first use
+func serviceAccount(name string, r CertRule) (User, error) {
+	link := ExternalID{Provider: certProvider, Subject: NormaliseName(name)}
+	u := User{}
+	if err := dbUserCollection().Find(bson.M{"externalids": link}).One(&u); err != nil {
+		u = User{Name: name, Roles: r.Roles, ExternalIDs: []ExternalID{link}}
+		if r.TenantID != "" {
+			u.OrganisationIDs = []bson.ObjectId{bson.ObjectIdHex(r.TenantID)}
+		}
+		if u, err = u.Insert(); err != nil {
+			return User{}, log.Errorf(err, "Failed to create service account %s", name)
+		}
+		if u, err = u.SetStatus(StatusActive, "service account for client certificates", ""); err != nil {
+			return User{}, err
+		}
+		log.Info.Printf("Created service account %s", u.Name)
+		return u, nil
+	}
+	if len(r.Roles) > 0 && !sameStrings(u.Roles, r.Roles) {
+		if err := dbUserCollection().UpdateId(u.ID, bson.M{"$set": bson.M{"roles": r.Roles}}); err != nil {
+			return User{}, log.Errorf(err, "Failed to update roles of service account %s", u.Name)
+		}
+		u.Roles = r.Roles
+	}
+	return u, nil
+} //serviceAccount()
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+} //sameStrings()
+
+//hasClientCertificate is true when the request was made with a verified client certificate
+func hasClientCertificate(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+} //hasClientCertificate()
+
+//SessionFromCertificate returns a session for the verified client certificate of the request.
+//It is the same as a session after login, except that it is not stored and has no id,
+//so it is only valid for this request
+func SessionFromCertificate(req *http.Request) (Session, error) {
+	if !hasClientCertificate(req) {
+		return Session{}, log.Errorf(nil, "No client certificate")
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	u, r, err := certUser(req.Context(), cert)
+	if err != nil {
+		return Session{}, err
+	}
+	if err := u.canAuthenticate(false); err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	s := Session{UserID: u.ID, StartTime: now, LastTime: now, Certificate: cert.Subject.String()}
+	if r.TenantID != "" {
+		s.TenantID = bson.ObjectIdHex(r.TenantID)
+		if !u.memberOf(s.TenantID) {
+			return Session{}, apierror.New(apierror.AuthNotMember, "User %s is not a member of organisation %s", u.Name, r.TenantID)
+		}
+	} else if len(u.OrganisationIDs) > 0 {
+		s.TenantID = u.OrganisationIDs[0]
+	}
+	log.Debug.Printf("Client certificate %s authenticated as %s", cert.Subject, u.Name)
+	return s, nil
+} //SessionFromCertificate()
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//withCertRules replaces the client certificate rules for the test
+func withCertRules(t *testing.T) {
+	saved := certRules
+	certRules = []CertRule{}
+	t.Cleanup(func() { certRules = saved })
+} //withCertRules()
+
+func testClientCert() *x509.Certificate {
+	spiffe, _ := url.Parse("spiffe://example.com/ns/prod/sa/billing")
+	return &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing", OrganizationalUnit: []string{"Services"}, Organization: []string{"Example"}},
+		DNSNames:       []string{"billing.internal", "billing.example.com"},
+		EmailAddresses: []string{"jan@staff.example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+} //testClientCert()
+
+func TestAddCertRule(t *testing.T) {
+	withCertRules(t)
+	for _, r := range []CertRule{
+		{Field: "cn", Pattern: "^billing$", User: "billing"},
+		{Field: "dns", Pattern: "", User: "billing"},
+		{Field: "dns", Pattern: "(", User: "billing"},
+		{Field: "dns", Pattern: "^billing", User: "billing", ServiceAccount: "billing"},
+		{Field: "dns", Pattern: "^billing"},
+		{Field: "dns", Pattern: "^billing", User: "billing", Roles: []string{"admin"}},
+		{Field: "dns", Pattern: "^billing", ServiceAccount: "billing", TenantID: "billing"},
+	} {
+		if err := AddCertRule(r); err == nil {
+			t.Errorf("Added invalid rule %+v", r)
+		}
+	}
+	if len(certRules) != 0 {
+		t.Errorf("Invalid rules were added: %+v", certRules)
+	}
+
+	name := filepath.Join(t.TempDir(), "mtls.json")
+	ioutil.WriteFile(name, []byte(`[
+		{"Field":"uri","Pattern":"^spiffe://example\\.com/ns/prod/sa/(.+)$","ServiceAccount":"svc-$1"},
+		{"Field":"email","Pattern":"^(.+)@staff\\.example\\.com$","User":"$1@example.com"}
+	]`), 0600)
+	if err := LoadCertRules(name); err != nil || len(certRules) != 2 || certRules[0].Field != "uri" {
+		t.Errorf("Loaded %+v: %v", certRules, err)
+	}
+	ioutil.WriteFile(name, []byte(`[{"Field":"cn"}]`), 0600)
+	if err := LoadCertRules(name); err == nil {
+		t.Errorf("Loaded an invalid rule")
+	}
+} //TestAddCertRule()
+
+func TestCertValues(t *testing.T) {
+	cert := testClientCert()
+	tests := map[string][]string{
+		"subject": {"CN=billing,OU=Services,O=Example"},
+		"dns":     {"billing.internal", "billing.example.com"},
+		"email":   {"jan@staff.example.com"},
+		"uri":     {"spiffe://example.com/ns/prod/sa/billing"},
+		"cn":      nil,
+	}
+	for field, want := range tests {
+		got := certValues(cert, field)
+		if len(got) != len(want) {
+			t.Errorf("certValues(%s) = %q, want %q", field, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("certValues(%s) = %q, want %q", field, got, want)
+			}
+		}
+	}
+} //TestCertValues()
+
+func TestCertRuleMatch(t *testing.T) {
+	withCertRules(t)
+	cert := testClientCert()
+	tests := []struct {
+		rule CertRule
+		want string
+	}{
+		{CertRule{Field: "subject", Pattern: `^CN=billing,OU=Services,O=Example$`, User: "billing"}, "billing"},
+		{CertRule{Field: "subject", Pattern: `^CN=([^,]+),OU=Services,`, ServiceAccount: "svc-$1"}, "svc-billing"},
+		{CertRule{Field: "subject", Pattern: `^CN=billing$`, User: "billing"}, ""},
+		//any of the names may match
+		{CertRule{Field: "dns", Pattern: `^(\w+)\.example\.com$`, User: "${1}@example.com"}, "billing@example.com"},
+		{CertRule{Field: "dns", Pattern: `^(\w+)\.other\.com$`, User: "$1"}, ""},
+		{CertRule{Field: "email", Pattern: `^(.+)@staff\.example\.com$`, User: "$1@example.com"}, "jan@example.com"},
+		{CertRule{Field: "uri", Pattern: `^spiffe://example\.com/ns/(\w+)/sa/(\w+)$`, ServiceAccount: "$2-$1"}, "billing-prod"},
+		//the pattern is not anchored unless it says so
+		{CertRule{Field: "uri", Pattern: `sa/billing`, ServiceAccount: "billing"}, "billing"},
+	}
+	for _, test := range tests {
+		if err := AddCertRule(test.rule); err != nil {
+			t.Fatalf("Cannot add %+v: %v", test.rule, err)
+		}
+		r := certRules[len(certRules)-1]
+		if got := r.match(cert); got != test.want {
+			t.Errorf("%s %s matched %q, want %q", r.Field, r.Pattern, got, test.want)
+		}
+	}
+} //TestCertRuleMatch()
+
+func TestSessionFromCertificateWithout(t *testing.T) {
+	req := httptest.NewRequest("GET", "/whoami", nil)
+	if _, err := SessionFromCertificate(req); err == nil {
+		t.Errorf("Session without TLS")
+	}
+	req.TLS = &tls.ConnectionState{}
+	if _, err := SessionFromCertificate(req); err == nil || hasClientCertificate(req) {
+		t.Errorf("Session without verified client certificate")
+	}
+} //TestSessionFromCertificateWithout()
+
+func TestSessionFromCertificate(t *testing.T) {
+	testDatabase(t)
+	withCertRules(t)
+	unique := bson.NewObjectId().Hex()
+	cert := testClientCert()
+	cert.URIs[0], _ = url.Parse("spiffe://example.com/ns/prod/sa/" + unique)
+	cert.EmailAddresses = []string{unique + "@staff.example.com"}
+
+	for _, r := range []CertRule{
+		{Field: "uri", Pattern: `^spiffe://example\.com/ns/prod/sa/(\w+)$`, ServiceAccount: "svc-$1"},
+		{Field: "email", Pattern: `^(.+)@staff\.example\.com$`, User: "$1@example.com"},
+	} {
+		if err := AddCertRule(r); err != nil {
+			t.Fatalf("Cannot add rule: %v", err)
+		}
+	}
+	req := httptest.NewRequest("GET", "/whoami", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	//the first rule creates an active service account on first use
+	s, err := SessionFromCertificate(req)
+	if err != nil {
+		t.Fatalf("No session for the certificate: %v", err)
+	}
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil || u.Name != NormaliseName("svc-"+unique) || u.Status != StatusActive || s.Certificate != cert.Subject.String() || s.ID != "" {
+		t.Errorf("Session %+v as %+v: %v", s, u, err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+	if again, err := SessionFromCertificate(req); err != nil || again.UserID != u.ID {
+		t.Errorf("Second session as %s: %v", again.UserID.Hex(), err)
+	}
+
+	//the second rule only maps to existing users
+	cert.URIs = nil
+	if _, err := SessionFromCertificate(req); err != errCertificateUnknown {
+		t.Errorf("Session for an unknown user: %v", err)
+	}
+	staff, err := User{Name: unique + "@example.com"}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(staff.ID) })
+	if _, err := SessionFromCertificate(req); err == nil {
+		t.Errorf("Session for a user still to activate")
+	}
+	if staff, err = staff.SetStatus(StatusActive, "test", ""); err != nil {
+		t.Fatalf("Cannot activate: %v", err)
+	}
+	if s, err := SessionFromCertificate(req); err != nil || s.UserID != staff.ID {
+		t.Errorf("Session as %s: %v", s.UserID.Hex(), err)
+	}
+
+	cert.EmailAddresses = nil
+	if _, err := SessionFromCertificate(req); err != errCertificateUnknown {
+		t.Errorf("Session for a certificate that matches no rule: %v", err)
+	}
+} //TestSessionFromCertificate()
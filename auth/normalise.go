@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	caseFolder = cases.Fold()
+)
+
+//NormaliseName returns the form in which user names are stored and compared:
+//Unicode NFKC, case folded and without surrounding white space,
+//so that "Bob@X.com" and " bob@x.com" are the same user
+func NormaliseName(name string) string {
+	return strings.TrimSpace(caseFolder.String(norm.NFKC.String(name)))
+} //NormaliseName()
+
+//NormaliseEmail normalises an email address the same way as a name
+//both the local part and the domain are compared without case
+func NormaliseEmail(email string) string {
+	return NormaliseName(email)
+} //NormaliseEmail()
+
+//isDuplicate is true when the store rejected a write on a unique index
+func isDuplicate(err error) bool {
+	return err != nil && mgo.IsDup(err)
+} //isDuplicate()
+
+//EnsureUserIndexes normalises names stored before normalisation existed,
+//then creates the unique indexes on user names and identifiers, and on organisation names. It is called
+//at startup and fails if stored names are still duplicates after normalisation
+func EnsureUserIndexes() error {
+	iter := dbUserCollection().Find(nil).Select(bson.M{"name": 1}).Iter()
+	u := User{}
+	for iter.Next(&u) {
+		n := NormaliseName(u.Name)
+		if n == u.Name {
+			continue
+		}
+		if err := dbUserCollection().UpdateId(u.ID, bson.M{"$set": bson.M{"name": n}}); err != nil {
+			log.Error.Printf("Cannot normalise user.id=%s name \"%s\" to \"%s\": %v", u.ID.Hex(), u.Name, n, err)
+			continue
+		}
+		log.Info.Printf("Normalised user.id=%s name \"%s\" to \"%s\"", u.ID.Hex(), u.Name, n)
+	}
+	if err := iter.Close(); err != nil {
+		return log.Errorf(err, "Failed to normalise user names")
+	}
+
+	if err := dbUserCollection().EnsureIndex(mgo.Index{
+		Key:    []string{"name"},
+		Unique: true,
+		Name:   "name_unique",
+	}); err != nil {
+		return log.Errorf(err, "Failed to create unique index on user names (check for duplicate names)")
+	}
+	if err := ensureIdentifierIndex(); err != nil {
+		return err
+	}
+	if err := ensureExternalIDIndex(); err != nil {
+		return err
+	}
+	return ensureOrganisationIndex()
+} //EnsureUserIndexes()
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNormaliseName(t *testing.T) {
+	tests := map[string]string{
+		"bob@x.com":          "bob@x.com",
+		"Bob@X.COM":          "bob@x.com",
+		"  bob@x.com \t\n":   "bob@x.com",
+		"Straße":             "strasse",
+		"\uff22\uff2f\uff22": "bob",  //fullwidth
+		"\ufb01le":           "file", //ligature
+		"Caf\u00e9":          "caf\u00e9",
+		"Cafe\u0301":         "caf\u00e9", //combining accent
+	}
+	for name, want := range tests {
+		if got := NormaliseName(name); got != want {
+			t.Errorf("NormaliseName(%q) = %q, want %q", name, got, want)
+		}
+		if got := NormaliseName(NormaliseName(name)); got != want {
+			t.Errorf("NormaliseName is not idempotent for %q: %q", name, got)
+		}
+	}
+	if NormaliseEmail("Bob@X.com") != "bob@x.com" {
+		t.Errorf("NormaliseEmail(Bob@X.com) = %s", NormaliseEmail("Bob@X.com"))
+	}
+} //TestNormaliseName()
+
+func TestUniqueName(t *testing.T) {
+	testDatabase(t)
+	if err := EnsureUserIndexes(); err != nil {
+		t.Fatalf("Cannot create user indexes: %v", err)
+	}
+	name := "Unique-" + bson.NewObjectId().Hex() + "@Example.com"
+	u, err := User{Name: name}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+	if u.Name != NormaliseName(name) {
+		t.Errorf("Inserted as %s", u.Name)
+	}
+	for _, same := range []string{name, " " + NormaliseName(name)} {
+		if dup, err := (User{Name: same}).Insert(); err != errUserAlreadyExists {
+			dbUserCollection().RemoveId(dup.ID)
+			t.Errorf("Inserted %q again: %v", same, err)
+		}
+	}
+} //TestUniqueName()
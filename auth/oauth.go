@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jansemmelink/auth2/apierror"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//session ids are introspected as token type "session", next to the OAuth token types in token.go
+const (
+	tokenTypeSession = "session"
+	grantTypeRefresh = "refresh_token"
+)
+
+//introspection is the RFC 7662 response for a token
+//only "active" is present when the token is not active
+type introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+}
+
+//checkTokenHint logs hints that are not a known token type.
+//Session ids and OAuth tokens differ in format, so the hint is not needed to find the token
+func checkTokenHint(hint string) {
+	switch hint {
+	case "", tokenTypeSession, tokenTypeAccess, tokenTypeRefresh:
+	default:
+		log.Debug.Printf("Ignoring unknown token_type_hint=%s", hint)
+	}
+} //checkTokenHint()
+
+//introspectToken looks up the session id or OAuth token and describes it.
+//The scope is that of the OAuth token, or all the user's permissions
+func introspectToken(ctx context.Context, token, hint string) introspection {
+	checkTokenHint(hint)
+	info := introspection{}
+	userID := bson.ObjectId("")
+	if bson.IsObjectIdHex(token) {
+		s, err := Session{ID: bson.ObjectIdHex(token)}.Verify(ctx)
+		if err != nil {
+			log.Debug.Printf("Token is not an active session: %v", err)
+			return introspection{Active: false}
+		}
+		info = introspection{
+			Active:    true,
+			TokenType: tokenTypeSession,
+			Iat:       s.StartTime.Unix(),
+			Exp:       s.Expiry().Unix(),
+		}
+		userID = s.UserID
+	} else {
+		t, _, err := activeToken(token)
+		if err != nil {
+			log.Debug.Printf("Token is not active: %v", err)
+			return introspection{Active: false}
+		}
+		info = introspection{
+			Active:    true,
+			TokenType: t.Type,
+			ClientID:  t.ClientID.Hex(),
+			Scope:     t.Scope,
+			Iat:       t.IssueTime.Unix(),
+			Exp:       t.Expiry.Unix(),
+		}
+		userID = t.UserID
+	}
+	info.Sub = userID.Hex()
+	if u, err := (User{}).Get(userID.Hex()); err == nil {
+		info.Username = u.Name
+		if info.Scope == "" {
+			info.Scope = strings.Join(u.EffectivePermissions(), " ")
+		}
+	}
+	return info
+} //introspectToken()
+
+//revokeToken revokes the session id or OAuth token of the client:
+//a session id or refresh token ends the session and all its tokens,
+//an access token is only removed itself.
+//A client can only revoke a session id if it has tokens for the session.
+//Unknown, already revoked or other clients' tokens are not an error (RFC 7009 section 2.2)
+func revokeToken(ctx context.Context, c Client, token, hint string) error {
+	checkTokenHint(hint)
+	s := Session{}
+	if bson.IsObjectIdHex(token) {
+		s.ID = bson.ObjectIdHex(token)
+		n, err := dbTokenCollection().Find(bson.M{"_session_id": s.ID, "_client_id": c.ID}).Count()
+		if err != nil {
+			return log.Errorf(err, "Failed to find tokens of session.id=%s", s.ID.Hex())
+		}
+		if n == 0 {
+			log.Info.Printf("Client %s may not revoke session.id=%s without tokens for it", c.ID.Hex(), s.ID.Hex())
+			return nil
+		}
+	} else {
+		t, ts, err := activeToken(token)
+		if err != nil {
+			log.Debug.Printf("Nothing to revoke: %v", err)
+			return nil
+		}
+		if t.ClientID != c.ID {
+			log.Info.Printf("Client %s may not revoke token.id=%s of client %s", c.ID.Hex(), t.ID.Hex(), t.ClientID.Hex())
+			return nil
+		}
+		if t.Type == tokenTypeAccess {
+			if err := dbTokenCollection().RemoveId(t.ID); err != nil && err != mgo.ErrNotFound {
+				return log.Errorf(err, "Failed to remove token.id=%s", t.ID.Hex())
+			}
+			return nil
+		}
+		s = ts
+	}
+	if err := removeSessionTokens(s.ID); err != nil {
+		return err
+	}
+	if _, err := s.Verify(ctx); err != nil {
+		log.Debug.Printf("No session to end: %v", err)
+		return nil
+	}
+	return s.End(ctx)
+} //revokeToken()
+
+//oauthError writes an error response as described in RFC 6749 section 5.2
+func oauthError(res http.ResponseWriter, status int, code string, desc string) {
+	if status == http.StatusUnauthorized {
+		res.Header().Set("WWW-Authenticate", "Basic realm=\"oauth\"")
+	}
+	jsonData, _ := json.Marshal(map[string]string{"error": code, "error_description": desc})
+	res.WriteHeader(status)
+	res.Write(jsonData)
+} //oauthError()
+
+func introspectHandler(res http.ResponseWriter, req *http.Request) {
+	client, err := authenticateClient(req)
+	if err != nil {
+		oauthError(res, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	token := req.PostFormValue("token")
+	if token == "" {
+		oauthError(res, http.StatusBadRequest, "invalid_request", "Missing token")
+		return
+	}
+
+	info := introspectToken(req.Context(), token, req.PostFormValue("token_type_hint"))
+	log.Debug.Printf("Client %s introspected token: active=%v", client.ID.Hex(), info.Active)
+
+	jsonData, err := json.Marshal(info)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //introspectHandler()
+
+func revokeHandler(res http.ResponseWriter, req *http.Request) {
+	client, err := authenticateClient(req)
+	if err != nil {
+		oauthError(res, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	token := req.PostFormValue("token")
+	if token == "" {
+		oauthError(res, http.StatusBadRequest, "invalid_request", "Missing token")
+		return
+	}
+
+	if err := revokeToken(req.Context(), client, token, req.PostFormValue("token_type_hint")); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to revoke: %v", err)
+		return
+	}
+	log.Info.Printf("Client %s revoked token", client.ID.Hex())
+} //revokeHandler()
+
+//tokenHandler is the OAuth token endpoint, dispatching on grant_type
+func tokenHandler(res http.ResponseWriter, req *http.Request) {
+	grantType := req.PostFormValue("grant_type")
+	switch grantType {
+	case grantTypeDeviceCode:
+		deviceCodeGrant(res, req)
+	case grantTypeRefresh:
+		refreshTokenGrant(res, req)
+	default:
+		oauthError(res, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("Unsupported grant_type=%s", grantType))
+	}
+} //tokenHandler()
+
+//writeTokens writes the token response, which must not be cached (RFC 6749 section 5.1)
+func writeTokens(res http.ResponseWriter, req *http.Request, tokens tokenResponse) {
+	jsonData, err := json.Marshal(tokens)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	res.Write(jsonData)
+} //writeTokens()
+
+//refreshTokenGrant issues new tokens for a refresh token (RFC 6749 section 6).
+//The refresh token can only be used once, it is replaced by the new one
+func refreshTokenGrant(res http.ResponseWriter, req *http.Request) {
+	client, err := identifyClient(req)
+	if err != nil {
+		oauthError(res, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	t, s, err := activeToken(req.PostFormValue("refresh_token"))
+	if err != nil || t.Type != tokenTypeRefresh || t.ClientID != client.ID {
+		oauthError(res, http.StatusBadRequest, "invalid_grant", "Unknown or expired refresh_token")
+		return
+	}
+	scope := normaliseScope(req.PostFormValue("scope"))
+	if scope == "" {
+		scope = t.Scope
+	} else if !scopeAllows(t.Scope, scope) {
+		oauthError(res, http.StatusBadRequest, "invalid_scope", "The scope exceeds the scope of the refresh_token")
+		return
+	}
+	if err := dbTokenCollection().RemoveId(t.ID); err != nil {
+		if err == mgo.ErrNotFound {
+			oauthError(res, http.StatusBadRequest, "invalid_grant", "The refresh_token was already used")
+		} else {
+			oauthError(res, http.StatusInternalServerError, "server_error", err.Error())
+		}
+		return
+	}
+	tokens, err := issueTokens(client, s, scope)
+	if err != nil {
+		oauthError(res, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeTokens(res, req, tokens)
+} //refreshTokenGrant()
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/item"
+	"github.com/jansemmelink/auth2/metrics"
+	"golang.org/x/oauth2"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//OIDCProviderConfig configures an upstream OpenID Connect identity provider,
+//e.g. Google (Issuer "https://accounts.google.com"), Azure AD or Keycloak
+//RedirectURL defaults to <auth.public_url>/auth/oidc/<Name>/callback
+type OIDCProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+}
+
+//ExternalID links a local user to the subject of an external identity provider
+type ExternalID struct {
+	Provider string
+	Subject  string
+}
+
+type oidcProvider struct {
+	config   OIDCProviderConfig
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+//oidcState is stored between the redirect to the provider and the callback
+type oidcState struct {
+	State    string `bson:"_id"`
+	Provider string
+	Nonce    string
+	Verifier string        //PKCE code verifier
+	TenantID bson.ObjectId `bson:"_tenant_id,omitempty"` //organisation to login to, see tenantParam()
+	Expiry   time.Time
+}
+
+//oidcClaims are the id_token claims used to provision the local user
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+//oidcIdentity is the user who logged in at the provider,
+//Email is only set when verified by the provider
+type oidcIdentity struct {
+	Subject string
+	Email   string
+	Names   []string
+}
+
+const oidcStateExpiry = time.Minute * 10
+
+var (
+	oidcProviders = map[string]*oidcProvider{}
+)
+
+//AddOIDCProvider discovers the provider from its issuer URL
+//(including the JWKS used to validate id_tokens) and enables login with it
+func AddOIDCProvider(cfg OIDCProviderConfig) error {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" {
+		return log.Errorf(nil, "OIDC provider requires Name, Issuer and ClientID")
+	}
+	p, err := oidc.NewProvider(context.Background(), cfg.Issuer)
+	if err != nil {
+		return log.Errorf(err, "Failed to discover OIDC provider %s at %s", cfg.Name, cfg.Issuer)
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	oidcProviders[cfg.Name] = &oidcProvider{
+		config:   cfg,
+		provider: p,
+		verifier: p.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}
+	log.Info.Printf("Added OIDC provider %s (%s)", cfg.Name, cfg.Issuer)
+	return nil
+} //AddOIDCProvider()
+
+//LoadOIDCProviders adds all providers from a JSON file with a list of OIDCProviderConfig
+func LoadOIDCProviders(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return log.Errorf(err, "Failed to read %s", filename)
+	}
+	list := []OIDCProviderConfig{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return log.Errorf(err, "Invalid JSON in %s", filename)
+	}
+	for _, cfg := range list {
+		if err := AddOIDCProvider(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+} //LoadOIDCProviders()
+
+func (p *oidcProvider) oauth2Config() oauth2.Config {
+	redirectURL := p.config.RedirectURL
+	if redirectURL == "" {
+		redirectURL = publicURL() + "/auth/oidc/" + p.config.Name + "/callback"
+	}
+	return oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       p.config.Scopes,
+	}
+} //oidcProvider.oauth2Config()
+
+//ensureExternalIDIndex makes sure an external subject is linked to only one user
+func ensureExternalIDIndex() error {
+	if err := dbUserCollection().EnsureIndex(mgo.Index{
+		Key:    []string{"externalids.provider", "externalids.subject"},
+		Unique: true,
+		Sparse: true,
+		Name:   "externalids_unique",
+	}); err != nil {
+		return log.Errorf(err, "Failed to create unique index on user external ids")
+	}
+	return nil
+} //ensureExternalIDIndex()
+
+//federatedUser finds the local user linked to the external subject.
+//Else it links the user with the same verified email, or creates a new
+//active user and person for the subject (just-in-time provisioning).
+//email must only be specified if verified by the identity provider
+func federatedUser(ctx context.Context, link ExternalID, email string, names []string) (User, error) {
+	u := User{}
+	if err := dbUserCollection().Find(bson.M{"externalids": link}).One(&u); err == nil {
+		return u, nil
+	}
+
+	if email != "" {
+		if id, err := NewIdentifier(IdentifierEmail, email); err == nil {
+			email = id.Value
+		} else {
+			email = ""
+		}
+	}
+	if email != "" {
+		if existing, err := (User{}).getByName(ctx, email); err == nil {
+			if id, ok := existing.identifier(email); ok && id.Verified {
+				if err := dbUserCollection().UpdateId(existing.ID, bson.M{"$push": bson.M{"externalids": link}}); err != nil {
+					return User{}, log.Errorf(err, "Failed to link user %s to %s", existing.Name, link.Provider)
+				}
+				log.Info.Printf("Linked user %s to %s subject %s", existing.Name, link.Provider, link.Subject)
+				existing.ExternalIDs = append(existing.ExternalIDs, link)
+				return existing, nil
+			}
+		}
+	}
+
+	//create a new user, named by email if available
+	name := email
+	if name == "" {
+		name = link.Provider + "-" + link.Subject
+	}
+	u = User{Name: name, Roles: []string{RoleUser}, ExternalIDs: []ExternalID{link}}
+	u, err := u.Insert()
+	if err != nil {
+		return User{}, err
+	}
+	if email != "" {
+		u.setIdentifierVerified(email)
+	}
+	if u, err = u.SetStatus(StatusActive, "federated login with "+link.Provider, ""); err != nil {
+		return User{}, err
+	}
+
+	//also create the person for this user
+	if len(names) == 0 {
+		names = []string{strings.Split(name, "@")[0]}
+	}
+	if _, err := (item.Person{}).New("", &item.Person{UserID: u.ID, Names: names}); err != nil {
+		log.Error.Printf("Failed to create person for user %s: %v", u.Name, err)
+	}
+	log.Info.Printf("Provisioned user %s from %s subject %s", u.Name, link.Provider, link.Subject)
+	return u, nil
+} //federatedUser()
+
+//oidcLoginHandler redirects to the provider with state, nonce and PKCE challenge
+func oidcLoginHandler(res http.ResponseWriter, req *http.Request) {
+	p, ok := oidcProviders[req.URL.Query().Get(":provider")]
+	if !ok {
+		apierror.Writef(res, req, apierror.AuthProviderUnknown, "Unknown identity provider")
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Internal)
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Internal)
+		return
+	}
+	s := oidcState{
+		State:    state,
+		Provider: p.config.Name,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		TenantID: tenantParam(req),
+		Expiry:   time.Now().Add(oidcStateExpiry),
+	}
+	if err := dbOIDCStateCollection().Insert(s); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to store login state: %v", err)
+		return
+	}
+	http.Redirect(res, req, p.authCodeURL(s), http.StatusFound)
+} //oidcLoginHandler()
+
+//authCodeURL is the login URL at the provider with the state, nonce and PKCE challenge
+func (p *oidcProvider) authCodeURL(s oidcState) string {
+	cfg := p.oauth2Config()
+	return cfg.AuthCodeURL(s.State, oidc.Nonce(s.Nonce), oauth2.S256ChallengeOption(s.Verifier))
+} //oidcProvider.authCodeURL()
+
+//checkState checks that the stored state was made for this provider and did not expire
+func (p *oidcProvider) checkState(s oidcState) error {
+	if s.Provider != p.config.Name || time.Now().After(s.Expiry) {
+		return apierror.New(apierror.BadRequest, "Login state expired")
+	}
+	return nil
+} //oidcProvider.checkState()
+
+//exchange exchanges the code with the PKCE verifier of the state,
+//then validates the id_token and its nonce
+func (p *oidcProvider) exchange(ctx context.Context, code string, s oidcState) (oidcIdentity, error) {
+	cfg := p.oauth2Config()
+	token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(s.Verifier))
+	if err != nil {
+		return oidcIdentity{}, apierror.New(apierror.AuthFederationFailed, "Failed to exchange code: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return oidcIdentity{}, apierror.New(apierror.AuthFederationFailed, "No id_token from %s", p.config.Name)
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return oidcIdentity{}, apierror.New(apierror.AuthFederationFailed, "Invalid id_token: %v", err)
+	}
+	if idToken.Nonce != s.Nonce {
+		return oidcIdentity{}, apierror.New(apierror.AuthFederationFailed, "Invalid id_token nonce")
+	}
+	claims := oidcClaims{}
+	if err := idToken.Claims(&claims); err != nil {
+		return oidcIdentity{}, apierror.New(apierror.AuthFederationFailed, "Invalid id_token claims: %v", err)
+	}
+
+	identity := oidcIdentity{Subject: idToken.Subject}
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	identity.Names = strings.Fields(claims.GivenName + " " + claims.FamilyName)
+	if len(identity.Names) == 0 {
+		identity.Names = strings.Fields(claims.Name)
+	}
+	return identity, nil
+} //oidcProvider.exchange()
+
+//oidcCallbackHandler exchanges the code, validates the id_token
+//and creates a normal session for the local user
+func oidcCallbackHandler(res http.ResponseWriter, req *http.Request) {
+	p, ok := oidcProviders[req.URL.Query().Get(":provider")]
+	if !ok {
+		apierror.Writef(res, req, apierror.AuthProviderUnknown, "Unknown identity provider")
+		return
+	}
+	if e := req.URL.Query().Get("error"); e != "" {
+		apierror.Writef(res, req, apierror.AuthFederationFailed, "Login failed at %s: %s %s", p.config.Name, e, req.URL.Query().Get("error_description"))
+		return
+	}
+
+	//state can only be used once
+	s := oidcState{}
+	if err := dbOIDCStateCollection().FindId(req.URL.Query().Get("state")).One(&s); err != nil {
+		apierror.Writef(res, req, apierror.BadRequest, "Unknown login state")
+		return
+	}
+	dbOIDCStateCollection().RemoveId(s.State)
+	if err := p.checkState(s); err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+
+	identity, err := p.exchange(req.Context(), req.URL.Query().Get("code"), s)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.AuthFederationFailed)
+		return
+	}
+	user, err := federatedUser(req.Context(), ExternalID{Provider: p.config.Name, Subject: identity.Subject}, identity.Email, identity.Names)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to provision user: %v", err)
+		return
+	}
+	if err := user.canAuthenticate(false); err != nil {
+		audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditFailure, UserID: user.ID, Name: user.Name, Detail: p.config.Name + ": " + err.Error()})
+		metrics.Login(AuditFailure, loginReason(err))
+		apierror.Write(res, req, err, apierror.Forbidden)
+		return
+	}
+
+	//the provider does not pass ?tenant= back, so it was kept in the state
+	session, err := Session{TenantID: s.TenantID}.Create(req.Context(), user)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	log.Info.Printf("Logged in %s with %s with session %s", user.Name, p.config.Name, session.ID.Hex())
+	audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name, SessionID: session.ID, TenantID: session.TenantID, Detail: p.config.Name})
+	metrics.Login(AuditSuccess, "oidc")
+	jsonData, err := json.Marshal(session)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //oidcCallbackHandler()
@@ -0,0 +1,497 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//oidcTestProvider is an in-process OpenID Connect provider with discovery, JWKS,
+//an authorize endpoint that redirects straight back with a code,
+//and a token endpoint that checks the client secret and the PKCE verifier
+type oidcTestProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mutex    sync.Mutex
+	codes    map[string]oidcTestCode //issued codes, each can be used once
+	subject  string
+	claims   map[string]interface{} //extra id_token claims
+	audience string                 //id_token aud, the client id when ""
+	signer   *rsa.PrivateKey        //signs id_tokens instead of the published key when set
+}
+
+type oidcTestCode struct {
+	challenge string
+	nonce     string
+}
+
+const (
+	oidcTestClientID     = "test-client"
+	oidcTestClientSecret = "test-secret"
+)
+
+func newOIDCTestProvider(t *testing.T) *oidcTestProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p := &oidcTestProvider{key: key, codes: map[string]oidcTestCode{}, subject: "subject-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+} //newOIDCTestProvider()
+
+func (p *oidcTestProvider) set(subject string, claims map[string]interface{}, audience string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.subject = subject
+	p.claims = claims
+	p.audience = audience
+} //oidcTestProvider.set()
+
+func (p *oidcTestProvider) discovery(res http.ResponseWriter, req *http.Request) {
+	writeTestJSON(res, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+} //oidcTestProvider.discovery()
+
+func (p *oidcTestProvider) jwks(res http.ResponseWriter, req *http.Request) {
+	writeTestJSON(res, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+} //oidcTestProvider.jwks()
+
+//authorize "logs in" the user and redirects back with a code bound to the challenge and nonce
+func (p *oidcTestProvider) authorize(res http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != oidcTestClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(res, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code, _ := randomHex(8)
+	p.mutex.Lock()
+	p.codes[code] = oidcTestCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	p.mutex.Unlock()
+	http.Redirect(res, req, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+} //oidcTestProvider.authorize()
+
+func (p *oidcTestProvider) token(res http.ResponseWriter, req *http.Request) {
+	if id, secret, ok := req.BasicAuth(); !ok || id != oidcTestClientID || secret != oidcTestClientSecret {
+		writeTestJSON(res, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	code, ok := p.codes[req.PostFormValue("code")]
+	delete(p.codes, req.PostFormValue("code"))
+	h := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+	if !ok || req.PostFormValue("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(h[:]) != code.challenge {
+		writeTestJSON(res, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	audience := p.audience
+	if audience == "" {
+		audience = oidcTestClientID
+	}
+	claims := map[string]interface{}{
+		"iss":   p.server.URL,
+		"sub":   p.subject,
+		"aud":   audience,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": code.nonce,
+	}
+	for n, v := range p.claims {
+		claims[n] = v
+	}
+	writeTestJSON(res, http.StatusOK, map[string]interface{}{
+		"access_token": "test-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     p.sign(claims),
+	})
+} //oidcTestProvider.token()
+
+//sign makes an RS256 JWT of the claims, call it with the mutex locked
+func (p *oidcTestProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	key := p.key
+	if p.signer != nil {
+		key = p.signer
+	}
+	h := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+} //oidcTestProvider.sign()
+
+func writeTestJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(v)
+} //writeTestJSON()
+
+//addTestOIDCProvider discovers the test provider and removes it when the test ends
+func addTestOIDCProvider(t *testing.T, idp *oidcTestProvider) *oidcProvider {
+	name := "test-" + bson.NewObjectId().Hex()
+	if err := AddOIDCProvider(OIDCProviderConfig{
+		Name:         name,
+		Issuer:       idp.server.URL,
+		ClientID:     oidcTestClientID,
+		ClientSecret: oidcTestClientSecret,
+	}); err != nil {
+		t.Fatalf("Failed to discover the provider: %v", err)
+	}
+	t.Cleanup(func() { delete(oidcProviders, name) })
+	return oidcProviders[name]
+} //addTestOIDCProvider()
+
+func newTestOIDCState(p *oidcProvider) oidcState {
+	return oidcState{
+		State:    bson.NewObjectId().Hex(),
+		Provider: p.config.Name,
+		Nonce:    bson.NewObjectId().Hex(),
+		Verifier: oauth2.GenerateVerifier(),
+		Expiry:   time.Now().Add(oidcStateExpiry),
+	}
+} //newTestOIDCState()
+
+//oidcLogin follows the login URL to the provider and returns the code from its redirect to the callback
+func oidcLogin(t *testing.T, p *oidcProvider, s oidcState) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(p.authCodeURL(s))
+	if err != nil {
+		t.Fatalf("Failed to login at the provider: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("Login at the provider responded %s", res.Status)
+	}
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid callback %q: %v", res.Header.Get("Location"), err)
+	}
+	if got := callback.Scheme + "://" + callback.Host + callback.Path; got != publicURL()+"/auth/oidc/"+p.config.Name+"/callback" {
+		t.Fatalf("Provider redirected to %s", got)
+	}
+	if callback.Query().Get("state") != s.State {
+		t.Fatalf("Provider returned state %q, want %q", callback.Query().Get("state"), s.State)
+	}
+	return callback.Query().Get("code")
+} //oidcLogin()
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := newOIDCTestProvider(t)
+	p := addTestOIDCProvider(t, idp)
+	if e := p.provider.Endpoint(); e.AuthURL != idp.server.URL+"/authorize" || e.TokenURL != idp.server.URL+"/token" {
+		t.Errorf("Discovered endpoints %+v", e)
+	}
+	if !reflect.DeepEqual(p.config.Scopes, []string{"openid", "email", "profile"}) {
+		t.Errorf("Default scopes %v", p.config.Scopes)
+	}
+
+	//the issuer in the document must match the configured issuer
+	if err := AddOIDCProvider(OIDCProviderConfig{Name: "wrong-issuer", Issuer: idp.server.URL + "/other", ClientID: oidcTestClientID}); err == nil {
+		delete(oidcProviders, "wrong-issuer")
+		t.Errorf("Added a provider without a discovery document")
+	}
+} //TestOIDCDiscovery()
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	p := addTestOIDCProvider(t, newOIDCTestProvider(t))
+	s := newTestOIDCState(p)
+	u, err := url.Parse(p.authCodeURL(s))
+	if err != nil {
+		t.Fatalf("Invalid login URL: %v", err)
+	}
+	h := sha256.Sum256([]byte(s.Verifier))
+	for name, want := range map[string]string{
+		"client_id":             oidcTestClientID,
+		"redirect_uri":          publicURL() + "/auth/oidc/" + p.config.Name + "/callback",
+		"response_type":         "code",
+		"scope":                 "openid email profile",
+		"state":                 s.State,
+		"nonce":                 s.Nonce,
+		"code_challenge_method": "S256",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(h[:]),
+	} {
+		if got := u.Query().Get(name); got != want {
+			t.Errorf("Login URL %s=%q, want %q", name, got, want)
+		}
+	}
+	if strings.Contains(u.RawQuery, s.Verifier) {
+		t.Errorf("Login URL contains the PKCE verifier")
+	}
+} //TestOIDCAuthCodeURL()
+
+func TestOIDCCheckState(t *testing.T) {
+	p := addTestOIDCProvider(t, newOIDCTestProvider(t))
+	s := newTestOIDCState(p)
+	if err := p.checkState(s); err != nil {
+		t.Errorf("Valid state rejected: %v", err)
+	}
+	other := s
+	other.Provider = "other"
+	if err := p.checkState(other); err == nil {
+		t.Errorf("State of another provider accepted")
+	}
+	expired := s
+	expired.Expiry = time.Now().Add(-time.Second)
+	if err := p.checkState(expired); err == nil {
+		t.Errorf("Expired state accepted")
+	}
+} //TestOIDCCheckState()
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newOIDCTestProvider(t)
+	p := addTestOIDCProvider(t, idp)
+	ctx := context.Background()
+
+	idp.set("subject-1", map[string]interface{}{"email": "Jan@Example.com", "email_verified": true, "given_name": "Jan", "family_name": "Semmelink"}, "")
+	s := newTestOIDCState(p)
+	identity, err := p.exchange(ctx, oidcLogin(t, p, s), s)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if want := (oidcIdentity{Subject: "subject-1", Email: "Jan@Example.com", Names: []string{"Jan", "Semmelink"}}); !reflect.DeepEqual(identity, want) {
+		t.Errorf("Identity %+v, want %+v", identity, want)
+	}
+
+	//the email is not used unless verified by the provider
+	idp.set("subject-2", map[string]interface{}{"email": "jan@example.com", "name": "Jan Semmelink"}, "")
+	s = newTestOIDCState(p)
+	identity, err = p.exchange(ctx, oidcLogin(t, p, s), s)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if want := (oidcIdentity{Subject: "subject-2", Names: []string{"Jan", "Semmelink"}}); !reflect.DeepEqual(identity, want) {
+		t.Errorf("Identity %+v, want %+v", identity, want)
+	}
+} //TestOIDCExchange()
+
+func TestOIDCExchangeRejected(t *testing.T) {
+	idp := newOIDCTestProvider(t)
+	p := addTestOIDCProvider(t, idp)
+	ctx := context.Background()
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		s := newTestOIDCState(p)
+		code := oidcLogin(t, p, s)
+		s.Verifier = oauth2.GenerateVerifier()
+		if _, err := p.exchange(ctx, code, s); err == nil {
+			t.Errorf("Exchanged with the wrong PKCE verifier")
+		}
+	})
+	t.Run("code reused", func(t *testing.T) {
+		s := newTestOIDCState(p)
+		code := oidcLogin(t, p, s)
+		if _, err := p.exchange(ctx, code, s); err != nil {
+			t.Fatalf("Exchange failed: %v", err)
+		}
+		if _, err := p.exchange(ctx, code, s); err == nil {
+			t.Errorf("Exchanged the same code twice")
+		}
+	})
+	t.Run("wrong nonce", func(t *testing.T) {
+		s := newTestOIDCState(p)
+		code := oidcLogin(t, p, s)
+		s.Nonce = "other"
+		if _, err := p.exchange(ctx, code, s); err == nil || !strings.Contains(err.Error(), "nonce") {
+			t.Errorf("Exchange with the wrong nonce: %v", err)
+		}
+	})
+	t.Run("other audience", func(t *testing.T) {
+		idp.set("subject-1", nil, "other-client")
+		defer idp.set("subject-1", nil, "")
+		s := newTestOIDCState(p)
+		if _, err := p.exchange(ctx, oidcLogin(t, p, s), s); err == nil {
+			t.Errorf("Accepted an id_token for another client")
+		}
+	})
+	t.Run("other signer", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		idp.mutex.Lock()
+		idp.signer = other
+		idp.mutex.Unlock()
+		defer func() {
+			idp.mutex.Lock()
+			idp.signer = nil
+			idp.mutex.Unlock()
+		}()
+		s := newTestOIDCState(p)
+		if _, err := p.exchange(ctx, oidcLogin(t, p, s), s); err == nil {
+			t.Errorf("Accepted an id_token not signed by the provider")
+		}
+	})
+} //TestOIDCExchangeRejected()
+
+//TestOIDCAccountLinking needs a database, see testDatabase()
+func TestOIDCAccountLinking(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+	unique := bson.NewObjectId().Hex()
+	email := "linked-" + unique + "@example.com"
+
+	//first login provisions an active user with the verified email
+	google := ExternalID{Provider: "google", Subject: unique}
+	u, err := federatedUser(ctx, google, email, []string{"Jan"})
+	if err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+	if u.Name != email || u.Status != StatusActive {
+		t.Errorf("Provisioned %s with status %s", u.Name, u.Status)
+	}
+	u, _ = User{}.Get(u.ID.Hex())
+	if id, ok := u.identifier(email); !ok || !id.Verified {
+		t.Errorf("Email of provisioned user not verified: %+v", u.Identifiers)
+	}
+
+	//next login finds the same user by subject
+	if again, err := federatedUser(ctx, google, "", nil); err != nil || again.ID != u.ID {
+		t.Errorf("Second login got user %v, %v", again.ID, err)
+	}
+
+	//another provider with the same verified email links to the user
+	azure := ExternalID{Provider: "azure", Subject: unique}
+	linked, err := federatedUser(ctx, azure, email, nil)
+	if err != nil || linked.ID != u.ID {
+		t.Fatalf("Login with another provider got user %v, %v", linked.ID, err)
+	}
+	linked, _ = User{}.Get(u.ID.Hex())
+	if !reflect.DeepEqual(linked.ExternalIDs, []ExternalID{google, azure}) {
+		t.Errorf("Linked %v", linked.ExternalIDs)
+	}
+
+	//a local user who did not verify the email is not taken over
+	pendingEmail := "pending-" + unique + "@example.com"
+	pending, err := User{Name: pendingEmail}.Insert()
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(pending.ID) })
+	if _, err := federatedUser(ctx, ExternalID{Provider: "google", Subject: "pending-" + unique}, pendingEmail, nil); err == nil {
+		t.Errorf("Linked a user with an unverified email")
+	}
+	pending, _ = User{}.Get(pending.ID.Hex())
+	if len(pending.ExternalIDs) != 0 {
+		t.Errorf("Unverified user linked to %v", pending.ExternalIDs)
+	}
+
+	//without an email, the user is named by provider and subject
+	anonymous, err := federatedUser(ctx, ExternalID{Provider: "github", Subject: unique}, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to provision without email: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(anonymous.ID) })
+	if anonymous.Name != NormaliseName("github-"+unique) {
+		t.Errorf("Provisioned without email as %s", anonymous.Name)
+	}
+} //TestOIDCAccountLinking()
+
+func TestOIDCLoginTenant(t *testing.T) {
+	testDatabase(t)
+	idp := newOIDCTestProvider(t)
+	p := addTestOIDCProvider(t, idp)
+	ctx := context.Background()
+	unique := bson.NewObjectId().Hex()
+	handle := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		q := req.URL.Query()
+		q.Set(":provider", p.config.Name)
+		req.URL.RawQuery = q.Encode()
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	//a user of two organisations logs in to the second
+	idp.set("tenant-"+unique, nil, "")
+	u, err := federatedUser(ctx, ExternalID{Provider: p.config.Name, Subject: "tenant-" + unique}, "", []string{"Jan"})
+	if err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	t.Cleanup(func() {
+		dbUserCollection().RemoveId(u.ID)
+		dbSessionCollection().RemoveAll(bson.M{"_user_id": u.ID})
+	})
+	orgs := []Organisation{}
+	for _, name := range []string{"Acme", "Globex"} {
+		o, err := Organisation{Name: name + " " + unique}.Insert()
+		if err != nil {
+			t.Fatalf("Cannot insert organisation: %v", err)
+		}
+		t.Cleanup(func() { dbOrganisationCollection().RemoveId(o.ID) })
+		if err := o.AddUser(u.ID); err != nil {
+			t.Fatalf("Cannot add member: %v", err)
+		}
+		orgs = append(orgs, o)
+	}
+
+	res := handle(oidcLoginHandler, "/auth/oidc/"+p.config.Name+"/login?tenant="+orgs[1].ID.Hex())
+	if res.Code != http.StatusFound {
+		t.Fatalf("Login responded %d: %s", res.Code, res.Body.String())
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	idpRes, err := client.Get(res.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Failed to login at the provider: %v", err)
+	}
+	idpRes.Body.Close()
+	callback, err := url.Parse(idpRes.Header.Get("Location"))
+	if err != nil || callback.Query().Get("tenant") != "" {
+		t.Fatalf("Provider redirected to %s: %v", idpRes.Header.Get("Location"), err)
+	}
+
+	res = handle(oidcCallbackHandler, callback.Path+"?"+callback.RawQuery)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Callback responded %d: %s", res.Code, res.Body.String())
+	}
+	s := Session{}
+	if err := json.Unmarshal(res.Body.Bytes(), &s); err != nil || s.UserID != u.ID || s.TenantID != orgs[1].ID {
+		t.Errorf("Logged in to %s as %s, want %s as %s: %v", s.TenantID.Hex(), s.UserID.Hex(), orgs[1].ID.Hex(), u.ID.Hex(), err)
+	}
+} //TestOIDCLoginTenant()
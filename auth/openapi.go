@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"github.com/jansemmelink/auth2/openapi"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//request bodies that are not stored types
+type (
+	credentials struct {
+		Name     string
+		Password string
+	}
+	activation struct {
+		Name         string
+		TempPassword string
+		Password     string //new password
+	}
+	whoami struct {
+		UserID      bson.ObjectId `json:"_user_id"`
+		SessionID   bson.ObjectId `json:"_session_id"`
+		Name        string
+		Roles       []string
+		Permissions []string
+	}
+	userRoles struct {
+		Roles       []string
+		Permissions []string
+	}
+)
+
+//secured is op for a route behind RequirePermission(permission, ...)
+func secured(permission string, op openapi.Operation) openapi.Operation {
+	op.Auth = true
+	op.Permission = permission
+	return op
+} //secured()
+
+//describeAuthRoutes documents the routes added by AddAuthRoutes in the OpenAPI document
+//keep it next to the routes when adding or changing them
+func describeAuthRoutes() {
+	d := openapi.Describe
+	d("POST", "/auth/register", openapi.Operation{Summary: "Register a user, who must then activate with the temp password",
+		Request: struct{ Name string }{}, Response: User{}})
+	d("GET", "/auth/reset", openapi.Operation{Summary: "Reset the password to a new temp password", Query: []string{"name"}, Response: User{}})
+	d("POST", "/auth/reset", openapi.Operation{Summary: "Reset the password to a new temp password", Request: struct{ Name string }{}, Response: User{}})
+	d("GET", "/auth/activate", openapi.Operation{Summary: "Set the password with the temp password and login", Query: []string{"name", "tpw", "password", "tenant"}, Response: Session{}})
+	d("POST", "/auth/activate", openapi.Operation{Summary: "Set the password with the temp password and login", Query: []string{"tenant"}, Request: activation{}, Response: Session{}})
+	d("GET", "/auth/login", openapi.Operation{Summary: "Login and start a session", Query: []string{"name", "password", "tenant"}, Response: Session{}})
+	d("POST", "/auth/login", openapi.Operation{Summary: "Login and start a session", Query: []string{"tenant"}, Request: credentials{}, Response: Session{}})
+	d("GET", "/auth/logout", openapi.Operation{Summary: "End the session", Query: []string{"id"}})
+	d("POST", "/auth/logout", openapi.Operation{Summary: "End the session", Request: Session{}})
+
+	d("POST", "/oauth/introspect", openapi.Operation{Summary: "RFC 7662 token introspection (form encoded, client authentication)", Response: introspection{}})
+	d("POST", "/oauth/revoke", openapi.Operation{Summary: "RFC 7009 token revocation (form encoded, client authentication)"})
+	d("POST", "/oauth/device_authorization", openapi.Operation{Summary: "RFC 8628 device authorization request (form encoded)"})
+	d("POST", "/oauth/token", openapi.Operation{Summary: "Token request for the device code and refresh token grants (form encoded)", Response: tokenResponse{}})
+	d("GET", "/device", openapi.Operation{Summary: "HTML page where the user enters the device code"})
+	d("POST", "/device", openapi.Operation{Summary: "Approve or deny a device code (HTML form)"})
+
+	d("GET", "/auth/whoami", secured("", openapi.Operation{Summary: "The logged in user and its effective permissions", Response: whoami{}}))
+	d("GET", "/auth/roles", secured("role:read", openapi.Operation{Summary: "List roles", Response: []Role{}}))
+	d("POST", "/auth/roles", secured("role:write", openapi.Operation{Summary: "Create or update a role", Request: Role{}, Response: Role{}}))
+	d("DELETE", "/auth/roles/{name}", secured("role:write", openapi.Operation{Summary: "Delete a role"}))
+	d("PUT", "/auth/users/{id}/roles", secured("role:write", openapi.Operation{Summary: "Set the roles and permissions of a user", Request: userRoles{}, Response: userRoles{}}))
+
+	d("DELETE", "/auth/organisations/{id}/users/{user_id}", secured("organisation:write", openapi.Operation{Summary: "Remove a user from an organisation"}))
+	d("POST", "/auth/organisations/{id}/users", secured("organisation:write", openapi.Operation{Summary: "Add a user to an organisation",
+		Request: struct {
+			UserID string `json:"_user_id"`
+		}{}}))
+	d("GET", "/auth/organisations", secured("", openapi.Operation{Summary: "List the organisations of the logged in user", Response: []Organisation{}}))
+	d("POST", "/auth/organisations", secured("organisation:write", openapi.Operation{Summary: "Create an organisation", Request: Organisation{}, Response: Organisation{}}))
+
+	d("POST", "/auth/identifiers/verify", secured("", openapi.Operation{Summary: "Verify an identifier with the code sent to it",
+		Request: struct{ Value, Code string }{}}))
+	d("DELETE", "/auth/identifiers/{value}", secured("", openapi.Operation{Summary: "Remove an identifier"}))
+	d("GET", "/auth/identifiers", secured("", openapi.Operation{Summary: "List the identifiers of the logged in user", Response: []Identifier{}}))
+	d("POST", "/auth/identifiers", secured("", openapi.Operation{Summary: "Add an identifier and send it a verification code",
+		Request: struct{ Type, Value string }{}, Response: Identifier{}}))
+
+	d("POST", "/auth/email/change", secured("", openapi.Operation{Summary: "Start changing the email address",
+		Request: struct{ Old, New string }{}, Response: EmailChange{}}))
+	d("GET", "/auth/email/confirm", openapi.Operation{Summary: "Confirm an email change from the link sent to the new address", Query: []string{"token"}, Response: EmailChange{}})
+	d("GET", "/auth/email/cancel", openapi.Operation{Summary: "Cancel an email change from the link sent to the old address", Query: []string{"token"}, Response: EmailChange{}})
+
+	d("GET", "/auth/oidc/{provider}/login", openapi.Operation{Summary: "Redirect to the OpenID Connect provider to login", Query: []string{"tenant"}})
+	d("GET", "/auth/oidc/{provider}/callback", openapi.Operation{Summary: "Redirect back from the OpenID Connect provider", Query: []string{"code", "state"}, Response: Session{}})
+	d("GET", "/auth/saml/{provider}/metadata", openapi.Operation{Summary: "SAML service provider metadata (XML)"})
+	d("GET", "/auth/saml/{provider}/login", openapi.Operation{Summary: "Redirect to the SAML identity provider to login", Query: []string{"tenant"}})
+	d("POST", "/auth/saml/{provider}/acs", openapi.Operation{Summary: "SAML assertion consumer service (form posted by the identity provider)", Response: Session{}})
+
+	d("POST", "/admin/users/{id}/disable", secured("user:write", openapi.Operation{Summary: "Disable a user", Response: adminUser{}}))
+	d("POST", "/admin/users/{id}/enable", secured("user:write", openapi.Operation{Summary: "Enable a user", Response: adminUser{}}))
+	d("POST", "/admin/users/{id}/reset", secured("user:write", openapi.Operation{Summary: "Reset the password of a user"}))
+	d("POST", "/admin/users/{id}/unlock", secured("user:write", openapi.Operation{Summary: "Unlock a user after failed logins", Response: adminUser{}}))
+	d("POST", "/admin/users/{id}/status", secured("user:write", openapi.Operation{Summary: "Set the status of a user",
+		Request: struct{ Status, Reason string }{}, Response: adminUser{}}))
+	d("GET", "/admin/users/{id}/status", secured("user:read", openapi.Operation{Summary: "Status history of a user", Response: []StatusChange{}}))
+	d("DELETE", "/admin/users/{id}/sessions", secured("user:write", openapi.Operation{Summary: "End all sessions of a user", Response: struct{ Ended int }{}}))
+	d("GET", "/admin/users/{id}/sessions", secured("user:read", openapi.Operation{Summary: "List the active sessions of a user", Response: []Session{}}))
+	d("GET", "/admin/users/{id}", secured("user:read", openapi.Operation{Summary: "Get a user", Response: adminUser{}}))
+	d("DELETE", "/admin/users/{id}", secured("user:write", openapi.Operation{Summary: "Delete a user"}))
+	d("GET", "/admin/users", secured("user:read", openapi.Operation{Summary: "Search users", Query: []string{"q", "page", "size"}, Response: userList{}}))
+	d("DELETE", "/admin/clients/{id}", secured("client:write", openapi.Operation{Summary: "Delete a client"}))
+	d("GET", "/admin/clients", secured("client:read", openapi.Operation{Summary: "List clients", Response: []Client{}}))
+	d("POST", "/admin/clients", secured("client:write", openapi.Operation{Summary: "Create a client, the response has the secret",
+		Request: struct{ Name string }{}, Response: Client{}}))
+	d("GET", "/admin/audit/verify", secured("audit:read", openapi.Operation{Summary: "Verify the audit log hash chain, optionally that it reaches anchor=<seq>:<hash>",
+		Query: []string{"anchor"},
+		Response: struct {
+			Verified int
+			Valid    bool
+			Error    string
+		}{}}))
+	d("GET", "/admin/audit/anchor", secured("audit:read", openapi.Operation{Summary: "Get the anchor of the last audit event", Response: AuditAnchor{}}))
+	d("GET", "/admin/audit", secured("audit:read", openapi.Operation{Summary: "Search audit events, newest first",
+		Query: []string{"event", "outcome", "name", "ip", "_user_id", "from", "to", "page", "size"}, Response: auditList{}}))
+	d("POST", "/admin/webhooks/deliveries/{id}/redeliver", secured("webhook:write", openapi.Operation{Summary: "Deliver a webhook event again"}))
+	d("GET", "/admin/webhooks/{id}/deliveries", secured("webhook:read", openapi.Operation{Summary: "List deliveries of a webhook",
+		Query: []string{"status", "page", "size"}, Response: deliveryList{}}))
+	d("DELETE", "/admin/webhooks/{id}", secured("webhook:write", openapi.Operation{Summary: "Delete a webhook"}))
+	d("GET", "/admin/webhooks", secured("webhook:read", openapi.Operation{Summary: "List webhooks", Response: []Webhook{}}))
+	d("POST", "/admin/webhooks", secured("webhook:write", openapi.Operation{Summary: "Create a webhook, the response has the secret",
+		Request: Webhook{}, Response: Webhook{}}))
+} //describeAuthRoutes()
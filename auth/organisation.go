@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Organisation is a customer company (tenant)
+//Users belong to one or more organisations and each session is scoped to one of them,
+//so that items of one organisation are never visible to another
+type Organisation struct {
+	ID      bson.ObjectId `bson:"_id" json:"_id"`
+	Name    string
+	Created time.Time
+}
+
+var errOrganisationExists = apierror.New(apierror.Conflict, "Organisation already exists")
+
+//ensureOrganisationIndex creates the unique index on organisation names
+func ensureOrganisationIndex() error {
+	if err := dbOrganisationCollection().EnsureIndex(mgo.Index{
+		Key:    []string{"name"},
+		Unique: true,
+		Name:   "name_unique",
+	}); err != nil {
+		return log.Errorf(err, "Failed to create unique index on organisation names (check for duplicate names)")
+	}
+	return nil
+} //ensureOrganisationIndex()
+
+//Insert creates a new organisation
+//The name must be unique, which is enforced by the unique index on name
+func (o Organisation) Insert() (Organisation, error) {
+	if o.Name == "" {
+		return o, log.Errorf(nil, "Missing organisation name")
+	}
+	o.ID = bson.NewObjectId()
+	o.Created = time.Now()
+	if err := dbOrganisationCollection().Insert(o); err != nil {
+		if isDuplicate(err) {
+			return o, errOrganisationExists
+		}
+		return o, log.Errorf(err, "Failed on db.insert(%+v)", o)
+	}
+	log.Info.Printf("Created organisation %+v", o)
+	return o, nil
+} //Organisation.Insert()
+
+//Get to retrieve from the database by hex string ID
+func (o Organisation) Get(id string) (Organisation, error) {
+	if !bson.IsObjectIdHex(id) {
+		return Organisation{}, log.Errorf(nil, "Invalid id='%s' is not bson hex object id", id)
+	}
+	if err := dbOrganisationCollection().FindId(bson.ObjectIdHex(id)).One(&o); err != nil {
+		return Organisation{}, log.Errorf(err, "Organisation(id=%s) does not exist", id)
+	}
+	return o, nil
+} //Organisation.Get()
+
+//AddUser makes the user a member of the organisation
+func (o Organisation) AddUser(userID bson.ObjectId) error {
+	if err := dbUserCollection().UpdateId(userID, bson.M{"$addToSet": bson.M{"_organisation_ids": o.ID}}); err != nil {
+		return log.Errorf(err, "Failed to add user.id=%s to organisation %s", userID.Hex(), o.Name)
+	}
+	log.Info.Printf("Added user.id=%s to organisation %s", userID.Hex(), o.Name)
+	return nil
+} //Organisation.AddUser()
+
+//RemoveUser removes the user from the organisation
+//and ends the user's sessions in that organisation
+func (o Organisation) RemoveUser(userID bson.ObjectId) error {
+	if err := dbUserCollection().UpdateId(userID, bson.M{"$pull": bson.M{"_organisation_ids": o.ID}}); err != nil {
+		return log.Errorf(err, "Failed to remove user.id=%s from organisation %s", userID.Hex(), o.Name)
+	}
+	if _, err := dbSessionCollection().UpdateAll(
+		bson.M{"_user_id": userID, "_tenant_id": o.ID, "ended": false},
+		bson.M{"$set": bson.M{"ended": true}}); err != nil {
+		return log.Errorf(err, "Failed to end sessions of user.id=%s in organisation %s", userID.Hex(), o.Name)
+	}
+	log.Info.Printf("Removed user.id=%s from organisation %s", userID.Hex(), o.Name)
+	return nil
+} //Organisation.RemoveUser()
+
+func (u User) memberOf(orgID bson.ObjectId) bool {
+	for _, id := range u.OrganisationIDs {
+		if id == orgID {
+			return true
+		}
+	}
+	return false
+} //User.memberOf()
+
+//tenantParam gets the optional organisation id from URL parameter "tenant"
+//used to select the tenant when logging in
+func tenantParam(req *http.Request) bson.ObjectId {
+	if t := req.URL.Query().Get("tenant"); bson.IsObjectIdHex(t) {
+		return bson.ObjectIdHex(t)
+	}
+	return ""
+} //tenantParam()
+
+func createOrganisationHandler(res http.ResponseWriter, req *http.Request) {
+	o := Organisation{}
+	if err := json.NewDecoder(req.Body).Decode(&o); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	o, err := o.Insert()
+	if err != nil {
+		if err == errOrganisationExists {
+			apierror.Write(res, req, err, apierror.Conflict)
+		} else {
+			apierror.Writef(res, req, apierror.BadRequest, "Failed to create organisation: %v", err)
+		}
+		return
+	}
+	jsonData, _ := json.Marshal(o)
+	res.Write(jsonData)
+} //createOrganisationHandler()
+
+//listOrganisationsHandler lists all organisations for users with organisation:read,
+//else only the organisations that the logged in user belongs to
+func listOrganisationsHandler(res http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if !HasPermission(PermissionsFromContext(req.Context()), "organisation:read") {
+		s, _ := SessionFromContext(req.Context())
+		u, err := User{}.Get(s.UserID.Hex())
+		if err != nil {
+			apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+			return
+		}
+		query["_id"] = bson.M{"$in": append([]bson.ObjectId{}, u.OrganisationIDs...)}
+	}
+	list := []Organisation{}
+	if err := dbOrganisationCollection().Find(query).Sort("name").All(&list); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to list organisations: %v", err)
+		return
+	}
+	jsonData, _ := json.Marshal(list)
+	res.Write(jsonData)
+} //listOrganisationsHandler()
+
+//addMemberHandler adds a user with JSON body {"_user_id":"..."}
+func addMemberHandler(res http.ResponseWriter, req *http.Request) {
+	o, err := Organisation{}.Get(req.URL.Query().Get(":id"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.NotFound)
+		return
+	}
+	reqData := struct {
+		UserID string `json:"_user_id"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	user, err := User{}.Get(reqData.UserID)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.NotFound)
+		return
+	}
+	if err := o.AddUser(user.ID); err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+} //addMemberHandler()
+
+func removeMemberHandler(res http.ResponseWriter, req *http.Request) {
+	o, err := Organisation{}.Get(req.URL.Query().Get(":id"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.NotFound)
+		return
+	}
+	user, err := User{}.Get(req.URL.Query().Get(":user_id"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.NotFound)
+		return
+	}
+	if err := o.RemoveUser(user.ID); err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+} //removeMemberHandler()
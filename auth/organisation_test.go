@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTenantParam(t *testing.T) {
+	id := bson.NewObjectId()
+	for target, want := range map[string]bson.ObjectId{
+		"/auth/login?tenant=" + id.Hex(): id,
+		"/auth/login?tenant=acme":        "",
+		"/auth/login":                    "",
+	} {
+		if got := tenantParam(httptest.NewRequest("POST", target, nil)); got != want {
+			t.Errorf("tenantParam(%s) = %q", target, got)
+		}
+	}
+	u := User{OrganisationIDs: []bson.ObjectId{bson.NewObjectId(), id}}
+	if !u.memberOf(id) || u.memberOf(bson.NewObjectId()) || (User{}).memberOf(id) {
+		t.Errorf("memberOf")
+	}
+} //TestTenantParam()
+
+func TestOrganisationSessions(t *testing.T) {
+	testDatabase(t)
+	if err := EnsureUserIndexes(); err != nil {
+		t.Fatalf("Cannot create indexes: %v", err)
+	}
+	ctx := context.Background()
+	unique := bson.NewObjectId().Hex()
+	newOrganisation := func(name string) Organisation {
+		o, err := Organisation{Name: name + " " + unique}.Insert()
+		if err != nil {
+			t.Fatalf("Cannot insert organisation: %v", err)
+		}
+		t.Cleanup(func() { dbOrganisationCollection().RemoveId(o.ID) })
+		return o
+	}
+	acme, globex := newOrganisation("Acme"), newOrganisation("Globex")
+	if _, err := (Organisation{Name: acme.Name}).Insert(); err != errOrganisationExists {
+		t.Errorf("Inserted organisation %s twice: %v", acme.Name, err)
+	}
+
+	u, err := User{Name: "member-" + unique + "@example.com"}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() {
+		dbUserCollection().RemoveId(u.ID)
+		dbSessionCollection().RemoveAll(bson.M{"_user_id": u.ID})
+	})
+	for _, o := range []Organisation{acme, globex} {
+		if err := o.AddUser(u.ID); err != nil {
+			t.Fatalf("Cannot add member: %v", err)
+		}
+	}
+	u, _ = User{}.Get(u.ID.Hex())
+
+	if s, err := (Session{}).Create(ctx, u); err != nil || s.TenantID != acme.ID {
+		t.Errorf("Default session in %s: %v", s.TenantID.Hex(), err)
+	}
+	s, err := Session{TenantID: globex.ID}.Create(ctx, u)
+	if err != nil || s.TenantID != globex.ID {
+		t.Errorf("Session in %s: %v", s.TenantID.Hex(), err)
+	}
+	if _, err := (Session{TenantID: bson.NewObjectId()}).Create(ctx, u); err == nil {
+		t.Errorf("Session in an organisation the user is not a member of")
+	}
+
+	//removing the member ends its sessions in that organisation only
+	acmeSession, _ := Session{TenantID: acme.ID}.Create(ctx, u)
+	if err := globex.RemoveUser(u.ID); err != nil {
+		t.Fatalf("Cannot remove member: %v", err)
+	}
+	if _, err := s.Verify(ctx); err == nil {
+		t.Errorf("Session in the organisation still valid after removing the member")
+	}
+	if _, err := acmeSession.Verify(ctx); err != nil {
+		t.Errorf("Session in another organisation ended: %v", err)
+	}
+	if u, _ = (User{}).Get(u.ID.Hex()); u.memberOf(globex.ID) || !u.memberOf(acme.ID) {
+		t.Errorf("Member of %v", u.OrganisationIDs)
+	}
+} //TestOrganisationSessions()
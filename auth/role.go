@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/item"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Role is a named set of permissions that can be given to users.
+//Permissions are "<resource>:<action>" strings, e.g. "person:write",
+//where "*" may be used for the resource, the action or as the whole permission
+type Role struct {
+	Name        string `bson:"_id" json:"Name"`
+	Permissions []string
+	BuiltIn     bool `bson:"-"`
+}
+
+//built-in roles are not stored in the database and cannot be changed
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+var (
+	builtInRoles = map[string]Role{
+		RoleAdmin: {Name: RoleAdmin, Permissions: []string{"*"}, BuiltIn: true},
+		RoleUser:  {Name: RoleUser, Permissions: []string{"person:read", "person:write"}, BuiltIn: true},
+	}
+	regexValidRoleName = regexp.MustCompile("^[a-z][a-z0-9_-]*$")
+	regexValidPerm     = regexp.MustCompile(`^(\*|[a-z][a-z0-9_-]*)(:(\*|[a-z][a-z0-9_-]*))?$`)
+)
+
+//Validate checks the role name and permission syntax
+func (r Role) Validate() error {
+	if !regexValidRoleName.MatchString(r.Name) {
+		return log.Errorf(nil, "Invalid role name \"%s\"", r.Name)
+	}
+	for _, p := range r.Permissions {
+		if !regexValidPerm.MatchString(p) {
+			return log.Errorf(nil, "Invalid permission \"%s\"", p)
+		}
+	}
+	return nil
+} //Role.Validate()
+
+//GetRole returns a built-in or custom role
+func GetRole(name string) (Role, error) {
+	if r, ok := builtInRoles[name]; ok {
+		return r, nil
+	}
+	r := Role{}
+	if err := dbRoleCollection().FindId(name).One(&r); err != nil {
+		return Role{}, log.Errorf(err, "Role(%s) does not exist", name)
+	}
+	return r, nil
+} //GetRole()
+
+//ListRoles returns built-in and custom roles sorted by name
+func ListRoles() ([]Role, error) {
+	roles := []Role{}
+	if err := dbRoleCollection().Find(nil).All(&roles); err != nil {
+		return nil, log.Errorf(err, "Failed to list roles")
+	}
+	for _, r := range builtInRoles {
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+} //ListRoles()
+
+//Save creates or replaces a custom role
+func (r Role) Save() error {
+	if _, ok := builtInRoles[r.Name]; ok {
+		return log.Errorf(nil, "Built-in role %s cannot be changed", r.Name)
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if _, err := dbRoleCollection().UpsertId(r.Name, r); err != nil {
+		return log.Errorf(err, "Failed to db.upsert(role=%s)", r.Name)
+	}
+	log.Info.Printf("Saved role %+v", r)
+	return nil
+} //Role.Save()
+
+//DeleteRole deletes a custom role and removes it from all users
+func DeleteRole(name string) error {
+	if _, ok := builtInRoles[name]; ok {
+		return log.Errorf(nil, "Built-in role %s cannot be deleted", name)
+	}
+	if err := dbRoleCollection().RemoveId(name); err != nil {
+		return log.Errorf(err, "Failed to delete role %s", name)
+	}
+	if _, err := dbUserCollection().UpdateAll(bson.M{"roles": name}, bson.M{"$pull": bson.M{"roles": name}}); err != nil {
+		return log.Errorf(err, "Failed to remove role %s from users", name)
+	}
+	log.Info.Printf("Deleted role %s", name)
+	return nil
+} //DeleteRole()
+
+//EffectivePermissions is the sorted union of the user's own permissions and
+//those of all the user's roles. Users without roles get the built-in user role
+func (u User) EffectivePermissions() []string {
+	roles := u.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+	set := map[string]bool{}
+	for _, p := range u.Permissions {
+		set[p] = true
+	}
+	for _, name := range roles {
+		r, err := GetRole(name)
+		if err != nil {
+			log.Error.Printf("User.id=%s has unknown role %s", u.ID.Hex(), name)
+			continue
+		}
+		for _, p := range r.Permissions {
+			set[p] = true
+		}
+	}
+	perms := make([]string, 0, len(set))
+	for p := range set {
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+	return perms
+} //User.EffectivePermissions()
+
+//HasPermission checks if any of the granted permissions allow the required permission
+func HasPermission(granted []string, required string) bool {
+	reqRes, reqAct := splitPermission(required)
+	for _, g := range granted {
+		if g == "*" {
+			return true
+		}
+		res, act := splitPermission(g)
+		if (res == "*" || res == reqRes) && (act == "*" || act == reqAct) {
+			return true
+		}
+	}
+	return false
+} //HasPermission()
+
+func splitPermission(p string) (string, string) {
+	if i := strings.Index(p, ":"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, "*"
+} //splitPermission()
+
+type contextKey string
+
+const (
+	ctxSession     contextKey = "session"
+	ctxPermissions contextKey = "permissions"
+)
+
+//SessionFromContext returns the session stored by RequirePermission
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	s, ok := ctx.Value(ctxSession).(Session)
+	return s, ok
+} //SessionFromContext()
+
+//PermissionsFromContext returns the effective permissions stored by RequirePermission
+func PermissionsFromContext(ctx context.Context) []string {
+	perms, _ := ctx.Value(ctxPermissions).([]string)
+	return perms
+} //PermissionsFromContext()
+
+//RequirePermission is middleware that only calls h for a valid session of
+//a user with the required permission. An empty permission only requires a session.
+//Without a valid session id, a client certificate mapped to a user (see mtls.go) is used as the session.
+//The session, effective permissions (limited to the scope of an OAuth access token)
+//and item tenant are stored in the request context
+func RequirePermission(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		s, err := SessionFromRequest(req)
+		if err != nil && hasClientCertificate(req) {
+			if s, err = SessionFromCertificate(req); err != nil {
+				apierror.Write(res, req, err, apierror.AuthCertificateUnknown)
+				return
+			}
+		}
+		if err != nil {
+			apierror.Writef(res, req, apierror.AuthSessionInvalid, "Not logged in: %v", err)
+			return
+		}
+		u, err := User{}.Get(s.UserID.Hex())
+		if err != nil {
+			apierror.Writef(res, req, apierror.AuthSessionInvalid, "Unknown user")
+			return
+		}
+		perms := scopePermissions(u.EffectivePermissions(), s.Scope)
+		if permission != "" && !HasPermission(perms, permission) {
+			log.Info.Printf("User %s denied %s on %s %s", u.Name, permission, req.Method, req.URL.Path)
+			apierror.Writef(res, req, apierror.AuthPermissionDenied, "Permission denied: requires %s", permission)
+			return
+		}
+		ctx := context.WithValue(req.Context(), ctxSession, s)
+		ctx = context.WithValue(ctx, ctxPermissions, perms)
+		if s.TenantID.Valid() {
+			ctx = item.WithTenant(ctx, s.TenantID.Hex())
+		}
+		h(res, req.WithContext(ctx))
+	}
+} //RequirePermission()
+
+//whoamiHandler describes the logged in user and its effective permissions
+func whoamiHandler(res http.ResponseWriter, req *http.Request) {
+	s, _ := SessionFromContext(req.Context())
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		apierror.Writef(res, req, apierror.AuthUserNotFound, "Unknown user")
+		return
+	}
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"_user_id":    u.ID,
+		"_session_id": s.ID,
+		"Name":        u.Name,
+		"Roles":       u.Roles,
+		"Permissions": PermissionsFromContext(req.Context()),
+	})
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //whoamiHandler()
+
+func listRolesHandler(res http.ResponseWriter, req *http.Request) {
+	roles, err := ListRoles()
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	jsonData, err := json.Marshal(roles)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //listRolesHandler()
+
+//saveRoleHandler creates or replaces a custom role from the JSON body
+func saveRoleHandler(res http.ResponseWriter, req *http.Request) {
+	role := Role{}
+	if err := json.NewDecoder(req.Body).Decode(&role); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	admin, _ := SessionFromContext(req.Context())
+	err := role.Save()
+	AuditChange(req, AuditEvent{Event: AuditRole, By: admin.UserID, Detail: fmt.Sprintf("saved %s %v", role.Name, role.Permissions)}, err)
+	if err != nil {
+		apierror.Writef(res, req, apierror.BadRequest, "Failed to save role: %v", err)
+		return
+	}
+	jsonData, _ := json.Marshal(role)
+	res.Write(jsonData)
+} //saveRoleHandler()
+
+func deleteRoleHandler(res http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+	admin, _ := SessionFromContext(req.Context())
+	err := DeleteRole(name)
+	AuditChange(req, AuditEvent{Event: AuditRole, By: admin.UserID, Detail: "deleted " + name}, err)
+	if err != nil {
+		apierror.Writef(res, req, apierror.BadRequest, "Failed to delete role: %v", err)
+		return
+	}
+} //deleteRoleHandler()
+
+//setUserRolesHandler replaces the roles and own permissions of a user
+//with JSON body {"Roles":[...],"Permissions":[...]}
+func setUserRolesHandler(res http.ResponseWriter, req *http.Request) {
+	reqData := struct {
+		Roles       []string
+		Permissions []string
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	for _, name := range reqData.Roles {
+		if _, err := GetRole(name); err != nil {
+			apierror.Write(res, req, apierror.New(apierror.ValidationFailed, "Unknown role %s", name).WithField("Roles", "Unknown role "+name), apierror.BadRequest)
+			return
+		}
+	}
+	for _, p := range reqData.Permissions {
+		if !regexValidPerm.MatchString(p) {
+			apierror.Write(res, req, apierror.New(apierror.ValidationFailed, "Invalid permission \"%s\"", p).WithField("Permissions", "Invalid permission "+p), apierror.BadRequest)
+			return
+		}
+	}
+
+	user, err := User{}.Get(req.URL.Query().Get(":id"))
+	if err != nil {
+		apierror.Write(res, req, err, apierror.AuthUserNotFound)
+		return
+	}
+	user.Roles = reqData.Roles
+	user.Permissions = reqData.Permissions
+	admin, _ := SessionFromContext(req.Context())
+	user, err = user.update()
+	AuditChange(req, AuditEvent{Event: AuditRoles, UserID: user.ID, Name: user.Name, By: admin.UserID,
+		Detail: fmt.Sprintf("roles %v permissions %v", user.Roles, user.Permissions)}, err)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to update roles: %v", err)
+		return
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"_user_id":    user.ID,
+		"Roles":       user.Roles,
+		"Permissions": user.EffectivePermissions(),
+	})
+	res.Write(jsonData)
+} //setUserRolesHandler()
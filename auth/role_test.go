@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		granted  []string
+		required string
+		want     bool
+	}{
+		{nil, "person:read", false},
+		{[]string{"person:read"}, "person:read", true},
+		{[]string{"person:read"}, "person:write", false},
+		{[]string{"person:read"}, "persons:read", false},
+		{[]string{"person:*"}, "person:delete", true},
+		{[]string{"person"}, "person:delete", true},
+		{[]string{"*:read"}, "audit:read", true},
+		{[]string{"*:read"}, "audit:write", false},
+		{[]string{"*"}, "user:delete", true},
+		{[]string{"person:read", "user:*"}, "user:write", true},
+		//a permission without action requires all actions
+		{[]string{"person:read"}, "person", false},
+		{[]string{"person:*"}, "person", true},
+	}
+	for _, test := range tests {
+		if got := HasPermission(test.granted, test.required); got != test.want {
+			t.Errorf("HasPermission(%v, %s) = %v", test.granted, test.required, got)
+		}
+	}
+} //TestHasPermission()
+
+func TestRoleValidate(t *testing.T) {
+	valid := []Role{
+		{Name: "billing"},
+		{Name: "billing-admin_2", Permissions: []string{"*", "person", "person:*", "*:read", "audit:read"}},
+	}
+	for _, r := range valid {
+		if err := r.Validate(); err != nil {
+			t.Errorf("%+v is invalid: %v", r, err)
+		}
+	}
+	invalid := []Role{
+		{Name: ""},
+		{Name: "Billing"},
+		{Name: "2fa"},
+		{Name: "billing", Permissions: []string{"Person:read"}},
+		{Name: "billing", Permissions: []string{"person:"}},
+		{Name: "billing", Permissions: []string{"person:read:all"}},
+		{Name: "billing", Permissions: []string{""}},
+	}
+	for _, r := range invalid {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%+v is valid", r)
+		}
+	}
+	//built-in roles are not changed, before the database is used
+	if err := (Role{Name: RoleAdmin}).Save(); err == nil {
+		t.Errorf("Saved the built-in admin role")
+	}
+	if err := DeleteRole(RoleUser); err == nil {
+		t.Errorf("Deleted the built-in user role")
+	}
+} //TestRoleValidate()
+
+func TestEffectivePermissions(t *testing.T) {
+	tests := []struct {
+		user User
+		want []string
+	}{
+		{User{}, []string{"person:read", "person:write"}},
+		{User{Permissions: []string{"audit:read", "person:read"}}, []string{"audit:read", "person:read", "person:write"}},
+		{User{Roles: []string{RoleAdmin}}, []string{"*"}},
+		{User{Roles: []string{RoleAdmin}, Permissions: []string{"audit:read"}}, []string{"*", "audit:read"}},
+	}
+	for _, test := range tests {
+		if got := test.user.EffectivePermissions(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v has %v, want %v", test.user, got, test.want)
+		}
+	}
+} //TestEffectivePermissions()
+
+//requirePermission calls RequirePermission with the bearer token,
+//and returns the response with the permissions passed to the handler
+func requirePermission(permission, bearer string) (*httptest.ResponseRecorder, []string) {
+	var perms []string
+	h := RequirePermission(permission, func(res http.ResponseWriter, req *http.Request) {
+		perms = PermissionsFromContext(req.Context())
+	})
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	res := httptest.NewRecorder()
+	h(res, req)
+	return res, perms
+} //requirePermission()
+
+func errorCode(res *httptest.ResponseRecorder) apierror.Code {
+	e := apierror.Error{}
+	json.Unmarshal(res.Body.Bytes(), &e)
+	return e.Code
+} //errorCode()
+
+func TestRequirePermissionWithoutSession(t *testing.T) {
+	res, _ := requirePermission("", "")
+	if res.Code != http.StatusUnauthorized || errorCode(res) != apierror.AuthSessionInvalid {
+		t.Errorf("Without session: %d %s", res.Code, res.Body.String())
+	}
+} //TestRequirePermissionWithoutSession()
+
+func TestRequirePermission(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+	unique := bson.NewObjectId().Hex()
+	role := Role{Name: "test-" + unique, Permissions: []string{"billing:*"}}
+	if err := role.Save(); err != nil {
+		t.Fatalf("Cannot save role: %v", err)
+	}
+	t.Cleanup(func() { DeleteRole(role.Name) })
+	u, err := User{Name: "role-" + unique + "@example.com", Roles: []string{role.Name}}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+	s, err := Session{}.Create(ctx, u)
+	if err != nil {
+		t.Fatalf("Cannot create session: %v", err)
+	}
+	t.Cleanup(func() { dbSessionCollection().RemoveId(s.ID) })
+
+	res, perms := requirePermission("billing:write", s.ID.Hex())
+	if res.Code != http.StatusOK || !reflect.DeepEqual(perms, []string{"billing:*"}) {
+		t.Errorf("With role permission: %d %v", res.Code, perms)
+	}
+	if res, _ := requirePermission("person:read", s.ID.Hex()); res.Code != http.StatusForbidden || errorCode(res) != apierror.AuthPermissionDenied {
+		t.Errorf("Without permission: %d %s", res.Code, res.Body.String())
+	}
+
+	//an access token is limited to its scope
+	c, err := Client{Name: "role test"}.Insert()
+	if err != nil {
+		t.Fatalf("Cannot insert client: %v", err)
+	}
+	t.Cleanup(func() { dbClientCollection().RemoveId(c.ID) })
+	tokens, err := issueTokens(c, s, "billing:read")
+	if err != nil {
+		t.Fatalf("Cannot issue tokens: %v", err)
+	}
+	t.Cleanup(func() { removeSessionTokens(s.ID) })
+	if res, perms := requirePermission("billing:read", tokens.AccessToken); res.Code != http.StatusOK || !reflect.DeepEqual(perms, []string{"billing:read"}) {
+		t.Errorf("Access token in scope: %d %v", res.Code, perms)
+	}
+	if res, _ := requirePermission("billing:write", tokens.AccessToken); res.Code != http.StatusForbidden {
+		t.Errorf("Access token out of scope: %d", res.Code)
+	}
+
+	//deleting the role removes it from the user
+	if err := DeleteRole(role.Name); err != nil {
+		t.Fatalf("Cannot delete role: %v", err)
+	}
+	if u, _ = (User{}).Get(u.ID.Hex()); len(u.Roles) != 0 {
+		t.Errorf("User still has roles %v", u.Roles)
+	}
+	if res, _ := requirePermission("billing:write", s.ID.Hex()); res.Code != http.StatusForbidden {
+		t.Errorf("After deleting the role: %d", res.Code)
+	}
+} //TestRequirePermission()
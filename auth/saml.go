@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/metrics"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//SAMLProviderConfig configures a SAML 2.0 identity provider for SP-initiated login.
+//The IdP metadata is read from IDPMetadataURL or IDPMetadataFile.
+//BaseURL is the external URL of this service, used for the SP entity id
+//<BaseURL>/auth/saml/<Name>/metadata and ACS <BaseURL>/auth/saml/<Name>/acs,
+//by default auth.public_url
+type SAMLProviderConfig struct {
+	Name            string
+	BaseURL         string
+	IDPMetadataURL  string
+	IDPMetadataFile string
+
+	//SP certificate and private key (PEM files) used to sign requests and decrypt assertions
+	CertificateFile string
+	KeyFile         string
+
+	//assertion attributes mapped onto the user and person, with common defaults
+	EmailAttribute     string
+	GivenNameAttribute string
+	SurnameAttribute   string
+	GroupAttribute     string
+
+	//TrustEmail links an existing user with the asserted email,
+	//only set it if the IdP verifies the email addresses of its users
+	TrustEmail bool
+
+	//GroupRoles maps group names to local roles. When specified, the user's roles
+	//are replaced on every login with the roles of the user's groups
+	GroupRoles map[string][]string
+}
+
+type samlProvider struct {
+	config SAMLProviderConfig
+	sp     *saml.ServiceProvider
+}
+
+//samlRequest is stored between the AuthnRequest redirect and the ACS post
+type samlRequest struct {
+	RelayState string `bson:"_id"`
+	Provider   string
+	RequestID  string
+	TenantID   bson.ObjectId `bson:"_tenant_id,omitempty"`
+	Expiry     time.Time
+}
+
+//samlAssertion is stored to reject replay of an assertion until it expires
+type samlAssertion struct {
+	ID       string `bson:"_id"`
+	Provider string
+	Expiry   time.Time
+}
+
+const samlRequestExpiry = time.Minute * 10
+
+var (
+	samlProviders = map[string]*samlProvider{}
+)
+
+//AddSAMLProvider loads the IdP metadata and SP key and enables login with the provider
+func AddSAMLProvider(cfg SAMLProviderConfig) error {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = publicURL()
+	}
+	if cfg.Name == "" || cfg.CertificateFile == "" || cfg.KeyFile == "" {
+		return log.Errorf(nil, "SAML provider requires Name, CertificateFile and KeyFile")
+	}
+	keyPair, err := tls.LoadX509KeyPair(cfg.CertificateFile, cfg.KeyFile)
+	if err != nil {
+		return log.Errorf(err, "Failed to load SAML key pair for %s", cfg.Name)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return log.Errorf(nil, "SAML key for %s must be an RSA key", cfg.Name)
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return log.Errorf(err, "SAML certificate for %s cannot be parsed", cfg.Name)
+	}
+
+	var idp *saml.EntityDescriptor
+	switch {
+	case cfg.IDPMetadataURL != "":
+		u, err := url.Parse(cfg.IDPMetadataURL)
+		if err != nil {
+			return log.Errorf(err, "Invalid IdP metadata URL %s", cfg.IDPMetadataURL)
+		}
+		if idp, err = samlsp.FetchMetadata(context.Background(), http.DefaultClient, *u); err != nil {
+			return log.Errorf(err, "Failed to fetch IdP metadata for %s", cfg.Name)
+		}
+	case cfg.IDPMetadataFile != "":
+		data, err := ioutil.ReadFile(cfg.IDPMetadataFile)
+		if err != nil {
+			return log.Errorf(err, "Failed to read %s", cfg.IDPMetadataFile)
+		}
+		if idp, err = samlsp.ParseMetadata(data); err != nil {
+			return log.Errorf(err, "Invalid IdP metadata in %s", cfg.IDPMetadataFile)
+		}
+	default:
+		return log.Errorf(nil, "SAML provider %s requires IDPMetadataURL or IDPMetadataFile", cfg.Name)
+	}
+
+	for role := range mappedRoles(cfg.GroupRoles) {
+		if _, err := GetRole(role); err != nil {
+			return log.Errorf(err, "SAML provider %s maps to unknown role %s", cfg.Name, role)
+		}
+	}
+	setDefault(&cfg.EmailAttribute, "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress")
+	setDefault(&cfg.GivenNameAttribute, "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname")
+	setDefault(&cfg.SurnameAttribute, "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname")
+	setDefault(&cfg.GroupAttribute, "http://schemas.microsoft.com/ws/2008/06/identity/claims/groups")
+
+	base := strings.TrimRight(cfg.BaseURL, "/") + "/auth/saml/" + cfg.Name
+	metadataURL, err := url.Parse(base + "/metadata")
+	if err != nil {
+		return log.Errorf(err, "Invalid BaseURL %s", cfg.BaseURL)
+	}
+	acsURL, _ := url.Parse(base + "/acs")
+
+	if err := ensureSAMLIndexes(); err != nil {
+		return err
+	}
+	samlProviders[cfg.Name] = &samlProvider{
+		config: cfg,
+		sp: &saml.ServiceProvider{
+			EntityID:    metadataURL.String(),
+			Key:         key,
+			Certificate: cert,
+			MetadataURL: *metadataURL,
+			AcsURL:      *acsURL,
+			IDPMetadata: idp,
+		},
+	}
+	log.Info.Printf("Added SAML provider %s (%s)", cfg.Name, idp.EntityID)
+	return nil
+} //AddSAMLProvider()
+
+//LoadSAMLProviders adds all providers from a JSON file with a list of SAMLProviderConfig
+func LoadSAMLProviders(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return log.Errorf(err, "Failed to read %s", filename)
+	}
+	list := []SAMLProviderConfig{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return log.Errorf(err, "Invalid JSON in %s", filename)
+	}
+	for _, cfg := range list {
+		if err := AddSAMLProvider(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+} //LoadSAMLProviders()
+
+//ensureSAMLIndexes lets mongo remove expired requests and replay cache entries
+func ensureSAMLIndexes() error {
+	for _, c := range []*mgo.Collection{dbSAMLRequestCollection(), dbSAMLReplayCollection()} {
+		if err := c.EnsureIndex(mgo.Index{
+			Key:         []string{"expiry"},
+			ExpireAfter: time.Second,
+			Name:        "expiry_ttl",
+		}); err != nil {
+			return log.Errorf(err, "Failed to create expiry index on %s", c.Name)
+		}
+	}
+	return nil
+} //ensureSAMLIndexes()
+
+//samlAttribute returns the values of the named assertion attribute
+func samlAttribute(assertion *saml.Assertion, name string) []string {
+	values := []string{}
+	for _, s := range assertion.AttributeStatements {
+		for _, a := range s.Attributes {
+			if a.Name != name && a.FriendlyName != name {
+				continue
+			}
+			for _, v := range a.Values {
+				values = append(values, v.Value)
+			}
+		}
+	}
+	return values
+} //samlAttribute()
+
+//checkReplay records the assertion id and fails if it was used before
+func checkReplay(provider string, assertion *saml.Assertion) error {
+	expiry := time.Now().Add(saml.MaxIssueDelay)
+	if assertion.Conditions != nil && assertion.Conditions.NotOnOrAfter.After(expiry) {
+		expiry = assertion.Conditions.NotOnOrAfter
+	}
+	if err := dbSAMLReplayCollection().Insert(samlAssertion{ID: assertion.ID, Provider: provider, Expiry: expiry.Add(saml.MaxClockSkew)}); err != nil {
+		if isDuplicate(err) {
+			return log.Errorf(nil, "Assertion %s was already used", assertion.ID)
+		}
+		return log.Errorf(err, "Failed to record assertion %s", assertion.ID)
+	}
+	return nil
+} //checkReplay()
+
+func samlMetadataHandler(res http.ResponseWriter, req *http.Request) {
+	p, ok := samlProviders[req.URL.Query().Get(":provider")]
+	if !ok {
+		apierror.Writef(res, req, apierror.AuthProviderUnknown, "Unknown identity provider")
+		return
+	}
+	xmlData, err := xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode metadata: %v", err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/samlmetadata+xml")
+	res.Write(xmlData)
+} //samlMetadataHandler()
+
+//samlLoginHandler redirects to the IdP with an AuthnRequest (HTTP-Redirect binding)
+func samlLoginHandler(res http.ResponseWriter, req *http.Request) {
+	p, ok := samlProviders[req.URL.Query().Get(":provider")]
+	if !ok {
+		apierror.Writef(res, req, apierror.AuthProviderUnknown, "Unknown identity provider")
+		return
+	}
+	relayState, err := randomHex(16)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Internal)
+		return
+	}
+	authnRequest, err := p.sp.MakeAuthenticationRequest(
+		p.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding,
+		saml.HTTPPostBinding)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to create authentication request: %v", err)
+		return
+	}
+	redirectURL, err := authnRequest.Redirect(relayState, p.sp)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to create authentication request: %v", err)
+		return
+	}
+	if err := dbSAMLRequestCollection().Insert(samlRequest{
+		RelayState: relayState,
+		Provider:   p.config.Name,
+		RequestID:  authnRequest.ID,
+		TenantID:   tenantParam(req),
+		Expiry:     time.Now().Add(samlRequestExpiry),
+	}); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to store login state: %v", err)
+		return
+	}
+	http.Redirect(res, req, redirectURL.String(), http.StatusFound)
+} //samlLoginHandler()
+
+//samlACSHandler validates the posted assertion and creates a normal session
+//for the local user, provisioned from the assertion attributes
+func samlACSHandler(res http.ResponseWriter, req *http.Request) {
+	p, ok := samlProviders[req.URL.Query().Get(":provider")]
+	if !ok {
+		apierror.Writef(res, req, apierror.AuthProviderUnknown, "Unknown identity provider")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		apierror.Writef(res, req, apierror.BadRequest, "Invalid form: %v", err)
+		return
+	}
+
+	//only responses to our own requests are accepted, each once
+	r := samlRequest{}
+	if err := dbSAMLRequestCollection().FindId(req.PostForm.Get("RelayState")).One(&r); err != nil {
+		apierror.Writef(res, req, apierror.BadRequest, "Unknown login state")
+		return
+	}
+	dbSAMLRequestCollection().RemoveId(r.RelayState)
+	if r.Provider != p.config.Name || time.Now().After(r.Expiry) {
+		apierror.Writef(res, req, apierror.BadRequest, "Login state expired")
+		return
+	}
+
+	//checks the signature, issuer, recipient, request id, audience and time windows
+	assertion, err := p.sp.ParseResponse(req, []string{r.RequestID})
+	if err != nil {
+		if ire, ok := err.(*saml.InvalidResponseError); ok {
+			log.Error.Printf("Invalid SAML response from %s: %v", p.config.Name, ire.PrivateErr)
+		}
+		apierror.Writef(res, req, apierror.AuthFederationFailed, "Invalid SAML response")
+		return
+	}
+	if assertion.Conditions == nil || len(assertion.Conditions.AudienceRestrictions) == 0 {
+		apierror.Writef(res, req, apierror.AuthFederationFailed, "SAML assertion has no audience restriction")
+		return
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		apierror.Writef(res, req, apierror.AuthFederationFailed, "SAML assertion has no subject")
+		return
+	}
+	if err := checkReplay(p.config.Name, assertion); err != nil {
+		apierror.Write(res, req, err, apierror.AuthFederationFailed)
+		return
+	}
+
+	email := ""
+	if p.config.TrustEmail {
+		if values := samlAttribute(assertion, p.config.EmailAttribute); len(values) > 0 {
+			email = values[0]
+		}
+	}
+	names := []string{}
+	for _, attr := range []string{p.config.GivenNameAttribute, p.config.SurnameAttribute} {
+		for _, v := range samlAttribute(assertion, attr) {
+			names = append(names, strings.Fields(v)...)
+		}
+	}
+	user, err := federatedUser(req.Context(), ExternalID{Provider: "saml:" + p.config.Name, Subject: assertion.Subject.NameID.Value}, email, names)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to provision user: %v", err)
+		return
+	}
+	if err := user.canAuthenticate(false); err != nil {
+		audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditFailure, UserID: user.ID, Name: user.Name, Detail: p.config.Name + ": " + err.Error()})
+		metrics.Login(AuditFailure, loginReason(err))
+		apierror.Write(res, req, err, apierror.Forbidden)
+		return
+	}
+	if len(p.config.GroupRoles) > 0 {
+		user.Roles = groupRoles(p.config.GroupRoles, samlAttribute(assertion, p.config.GroupAttribute))
+		if err := dbUserCollection().UpdateId(user.ID, bson.M{"$set": bson.M{"roles": user.Roles}}); err != nil {
+			apierror.Writef(res, req, apierror.Unavailable, "Failed to update roles: %v", err)
+			return
+		}
+	}
+
+	session, err := Session{TenantID: r.TenantID}.Create(req.Context(), user)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.Unavailable)
+		return
+	}
+	log.Info.Printf("Logged in %s with %s with session %s", user.Name, p.config.Name, session.ID.Hex())
+	audit(req, AuditEvent{Event: AuditLogin, Outcome: AuditSuccess, UserID: user.ID, Name: user.Name, SessionID: session.ID, TenantID: session.TenantID, Detail: p.config.Name})
+	metrics.Login(AuditSuccess, "saml")
+	jsonData, err := json.Marshal(session)
+	if err != nil {
+		apierror.Writef(res, req, apierror.Internal, "Failed to encode response: %v", err)
+		return
+	}
+	res.Write(jsonData)
+} //samlACSHandler()
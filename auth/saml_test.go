@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"html"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//samlTestIdP is an in-process SAML identity provider that logs in session
+//without asking, and posts the signed response to the service provider sp
+type samlTestIdP struct {
+	server  *httptest.Server
+	idp     *saml.IdentityProvider
+	session *saml.Session
+	sp      *saml.EntityDescriptor
+}
+
+func (p *samlTestIdP) GetSession(res http.ResponseWriter, req *http.Request, authnRequest *saml.IdpAuthnRequest) *saml.Session {
+	return p.session
+} //samlTestIdP.GetSession()
+
+func (p *samlTestIdP) GetServiceProvider(req *http.Request, id string) (*saml.EntityDescriptor, error) {
+	return p.sp, nil
+} //samlTestIdP.GetServiceProvider()
+
+func newSAMLTestIdP(t *testing.T) *samlTestIdP {
+	key, cert := newSAMLKeyPair(t)
+	p := &samlTestIdP{}
+	mux := http.NewServeMux()
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	metadataURL, _ := url.Parse(p.server.URL + "/metadata")
+	ssoURL, _ := url.Parse(p.server.URL + "/sso")
+	p.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		Logger:                  logger.DefaultLogger,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		SessionProvider:         p,
+		ServiceProviderProvider: p,
+	}
+	mux.HandleFunc("/metadata", func(res http.ResponseWriter, req *http.Request) {
+		xmlData, _ := xml.Marshal(p.idp.Metadata())
+		res.Write(xmlData)
+	})
+	mux.HandleFunc("/sso", p.idp.ServeSSO)
+	return p
+} //newSAMLTestIdP()
+
+//newSAMLKeyPair makes an RSA key with a self-signed certificate
+func newSAMLKeyPair(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "saml-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return key, cert
+} //newSAMLKeyPair()
+
+//writeSAMLKeyPair writes the PEM certificate and key files of the key and returns their names
+func writeSAMLKeyPair(t *testing.T, key interface{}, cert *x509.Certificate) (string, string) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "sp.crt"), filepath.Join(dir, "sp.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", certFile, err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", keyFile, err)
+	}
+	return certFile, keyFile
+} //writeSAMLKeyPair()
+
+//addTestSAMLProvider adds a provider for the IdP with the attribute names of its assertions
+func addTestSAMLProvider(t *testing.T, idp *samlTestIdP, groupRoles map[string][]string) *samlProvider {
+	key, cert := newSAMLKeyPair(t)
+	certFile, keyFile := writeSAMLKeyPair(t, key, cert)
+	name := "test-" + bson.NewObjectId().Hex()
+	if err := AddSAMLProvider(SAMLProviderConfig{
+		Name:               name,
+		IDPMetadataURL:     idp.server.URL + "/metadata",
+		CertificateFile:    certFile,
+		KeyFile:            keyFile,
+		EmailAttribute:     "eduPersonPrincipalName",
+		GivenNameAttribute: "givenName",
+		SurnameAttribute:   "sn",
+		GroupAttribute:     "eduPersonAffiliation",
+		TrustEmail:         true,
+		GroupRoles:         groupRoles,
+	}); err != nil {
+		t.Fatalf("Failed to add SAML provider: %v", err)
+	}
+	t.Cleanup(func() { delete(samlProviders, name) })
+	p := samlProviders[name]
+	idp.sp = p.sp.Metadata()
+	return p
+} //addTestSAMLProvider()
+
+//samlHandle calls the provider handler as routed for the provider
+func samlHandle(handler http.HandlerFunc, req *http.Request, provider string) *httptest.ResponseRecorder {
+	q := req.URL.Query()
+	q.Set(":provider", provider)
+	req.URL.RawQuery = q.Encode()
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+} //samlHandle()
+
+var regexSAMLFormInput = regexp.MustCompile(`name="(SAMLResponse|RelayState)" value="([^"]*)"`)
+
+//samlLogin starts login with the provider and returns the form the IdP posts to the ACS
+func samlLogin(t *testing.T, p *samlProvider) url.Values {
+	res := samlHandle(samlLoginHandler, httptest.NewRequest("GET", "/auth/saml/"+p.config.Name+"/login", nil), p.config.Name)
+	if res.Code != http.StatusFound {
+		t.Fatalf("Login responded %d: %s", res.Code, res.Body.String())
+	}
+	idpRes, err := http.Get(res.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Failed to login at the IdP: %v", err)
+	}
+	defer idpRes.Body.Close()
+	body, _ := ioutil.ReadAll(idpRes.Body)
+	if idpRes.StatusCode != http.StatusOK {
+		t.Fatalf("IdP responded %s: %s", idpRes.Status, body)
+	}
+	form := url.Values{}
+	for _, match := range regexSAMLFormInput.FindAllStringSubmatch(string(body), -1) {
+		form.Set(match[1], html.UnescapeString(match[2]))
+	}
+	if form.Get("SAMLResponse") == "" || form.Get("RelayState") == "" {
+		t.Fatalf("IdP responded without a response form: %s", body)
+	}
+	return form
+} //samlLogin()
+
+func samlACS(p *samlProvider, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/auth/saml/"+p.config.Name+"/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return samlHandle(samlACSHandler, req, p.config.Name)
+} //samlACS()
+
+func TestSAMLAttribute(t *testing.T) {
+	value := func(values ...string) []saml.AttributeValue {
+		list := []saml.AttributeValue{}
+		for _, v := range values {
+			list = append(list, saml.AttributeValue{Value: v})
+		}
+		return list
+	}
+	assertion := &saml.Assertion{AttributeStatements: []saml.AttributeStatement{
+		{Attributes: []saml.Attribute{
+			{Name: "urn:oid:2.5.4.42", FriendlyName: "givenName", Values: value("Jan")},
+			{Name: "groups", Values: value("admins", "users")},
+		}},
+		{Attributes: []saml.Attribute{
+			{Name: "groups", Values: value("staff")},
+		}},
+	}}
+	tests := []struct {
+		name   string
+		values []string
+	}{
+		{"givenName", []string{"Jan"}},
+		{"urn:oid:2.5.4.42", []string{"Jan"}},
+		{"groups", []string{"admins", "users", "staff"}},
+		{"sn", []string{}},
+	}
+	for _, test := range tests {
+		if values := samlAttribute(assertion, test.name); !reflect.DeepEqual(values, test.values) {
+			t.Errorf("Attribute %s = %v, want %v", test.name, values, test.values)
+		}
+	}
+} //TestSAMLAttribute()
+
+func TestAddSAMLProviderInvalid(t *testing.T) {
+	key, cert := newSAMLKeyPair(t)
+	certFile, keyFile := writeSAMLKeyPair(t, key, cert)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.CreateCertificate(rand.Reader, cert, cert, &ecKey.PublicKey, key)
+	ecCert, _ := x509.ParseCertificate(ecDER)
+	ecCertFile, ecKeyFile := writeSAMLKeyPair(t, ecKey, ecCert)
+	invalidMetadata := filepath.Join(t.TempDir(), "idp.xml")
+	ioutil.WriteFile(invalidMetadata, []byte("<EntityDescriptor"), 0600)
+
+	tests := []SAMLProviderConfig{
+		{CertificateFile: certFile, KeyFile: keyFile, IDPMetadataFile: invalidMetadata},
+		{Name: "test", KeyFile: keyFile, IDPMetadataFile: invalidMetadata},
+		{Name: "test", CertificateFile: certFile, KeyFile: ecKeyFile, IDPMetadataFile: invalidMetadata},
+		{Name: "test", CertificateFile: ecCertFile, KeyFile: ecKeyFile, IDPMetadataFile: invalidMetadata},
+		{Name: "test", CertificateFile: certFile, KeyFile: keyFile},
+		{Name: "test", CertificateFile: certFile, KeyFile: keyFile, IDPMetadataFile: invalidMetadata},
+		{Name: "test", CertificateFile: certFile, KeyFile: keyFile, IDPMetadataFile: invalidMetadata + ".missing"},
+		{Name: "test", CertificateFile: certFile, KeyFile: keyFile, IDPMetadataURL: "%zz"},
+	}
+	for _, cfg := range tests {
+		if err := AddSAMLProvider(cfg); err == nil {
+			delete(samlProviders, cfg.Name)
+			t.Errorf("Added invalid provider %+v", cfg)
+		}
+	}
+} //TestAddSAMLProviderInvalid()
+
+func TestSAMLLogin(t *testing.T) {
+	testDatabase(t)
+	idp := newSAMLTestIdP(t)
+	p := addTestSAMLProvider(t, idp, map[string][]string{"Admins": {RoleAdmin}})
+	unique := bson.NewObjectId().Hex()
+	email := "saml-" + unique + "@example.com"
+	idp.session = &saml.Session{
+		ID:            unique,
+		CreateTime:    time.Now(),
+		ExpireTime:    time.Now().Add(time.Hour),
+		NameID:        "subject-" + unique,
+		UserEmail:     email,
+		UserGivenName: "Jan",
+		UserSurname:   "Semmelink",
+		Groups:        []string{"admins"},
+	}
+
+	res := samlHandle(samlMetadataHandler, httptest.NewRequest("GET", "/auth/saml/"+p.config.Name+"/metadata", nil), p.config.Name)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), p.sp.AcsURL.String()) {
+		t.Errorf("Metadata %d: %s", res.Code, res.Body.String())
+	}
+	res = samlHandle(samlLoginHandler, httptest.NewRequest("GET", "/auth/saml/unknown/login", nil), "unknown")
+	if e := errorCode(res); e != apierror.AuthProviderUnknown {
+		t.Errorf("Login with unknown provider: %d %s", res.Code, e)
+	}
+
+	form := samlLogin(t, p)
+	res = samlACS(p, form)
+	if res.Code != http.StatusOK {
+		t.Fatalf("ACS responded %d: %s", res.Code, res.Body.String())
+	}
+	s := Session{}
+	if err := json.Unmarshal(res.Body.Bytes(), &s); err != nil {
+		t.Fatalf("Invalid session %s: %v", res.Body.String(), err)
+	}
+	t.Cleanup(func() {
+		dbUserCollection().RemoveId(s.UserID)
+		dbSessionCollection().RemoveAll(bson.M{"_user_id": s.UserID})
+	})
+	u, err := User{}.Get(s.UserID.Hex())
+	if err != nil {
+		t.Fatalf("No user for the session: %v", err)
+	}
+	link := ExternalID{Provider: "saml:" + p.config.Name, Subject: idp.session.NameID}
+	if u.Name != email || !reflect.DeepEqual(u.ExternalIDs, []ExternalID{link}) || !reflect.DeepEqual(u.Roles, []string{RoleAdmin}) {
+		t.Errorf("Provisioned user %+v", u)
+	}
+
+	//the login state is used once, so the response cannot be posted again
+	if res = samlACS(p, form); res.Code != http.StatusBadRequest {
+		t.Errorf("Response posted twice: %d %s", res.Code, res.Body.String())
+	}
+
+	//the next login finds the same user and replaces the roles
+	idp.session.Groups = []string{"others"}
+	idp.session.ID = bson.NewObjectId().Hex()
+	if res = samlACS(p, samlLogin(t, p)); res.Code != http.StatusOK {
+		t.Fatalf("Second login responded %d: %s", res.Code, res.Body.String())
+	}
+	again := Session{}
+	json.Unmarshal(res.Body.Bytes(), &again)
+	if again.UserID != u.ID {
+		t.Errorf("Second login got user %s, want %s", again.UserID.Hex(), u.ID.Hex())
+	}
+	if u, _ = (User{}).Get(u.ID.Hex()); len(u.Roles) != 0 {
+		t.Errorf("Roles %v kept without the group", u.Roles)
+	}
+
+	//a response for another login state is rejected
+	form = samlLogin(t, p)
+	other := samlLogin(t, p)
+	form.Set("RelayState", other.Get("RelayState"))
+	if res = samlACS(p, form); errorCode(res) != apierror.AuthFederationFailed {
+		t.Errorf("Response for another request: %d %s", res.Code, res.Body.String())
+	}
+} //TestSAMLLogin()
+
+func TestCheckReplay(t *testing.T) {
+	testDatabase(t)
+	if err := ensureSAMLIndexes(); err != nil {
+		t.Fatalf("Cannot create indexes: %v", err)
+	}
+	assertion := &saml.Assertion{ID: "id-" + bson.NewObjectId().Hex(), Conditions: &saml.Conditions{NotOnOrAfter: time.Now().Add(time.Hour)}}
+	t.Cleanup(func() { dbSAMLReplayCollection().RemoveId(assertion.ID) })
+	if err := checkReplay("test", assertion); err != nil {
+		t.Fatalf("First use rejected: %v", err)
+	}
+	if err := checkReplay("test", assertion); err == nil {
+		t.Errorf("Replay accepted")
+	}
+	a := samlAssertion{}
+	if err := dbSAMLReplayCollection().FindId(assertion.ID).One(&a); err != nil || a.Expiry.Before(assertion.Conditions.NotOnOrAfter) {
+		t.Errorf("Recorded %+v, %v: expires before the assertion", a, err)
+	}
+} //TestCheckReplay()
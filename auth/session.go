@@ -1,8 +1,15 @@
 package auth
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/metrics"
+	"github.com/jansemmelink/auth2/tracing"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -15,19 +22,53 @@ type Session struct {
 	LastTime  time.Time
 	Ended     bool
 
+	//organisation that all item operations in this session are scoped to
+	TenantID bson.ObjectId `bson:"_tenant_id,omitempty" json:"_tenant_id,omitempty"`
+
 	//private: not stored in DB
 	//user User
+
+	//subject of the client certificate for a session from SessionFromCertificate
+	Certificate string `bson:"-" json:",omitempty"`
+
+	//scope of the access token for a session from an OAuth access token
+	Scope []string `bson:"-" json:",omitempty"`
 }
 
-var (
-	dbSessionCollection = Db().DB("auth").C("sessions")
-)
+func init() {
+	metrics.ActiveSessions(countActiveSessions)
+}
+
+//countActiveSessions counts sessions that have not ended or expired
+func countActiveSessions() (int, error) {
+	//not Db(), which panics while the database is down
+	if !connected() {
+		return 0, fmt.Errorf("not connected to the auth database")
+	}
+	return dbSessionCollection().Find(bson.M{
+		"ended":    false,
+		"lasttime": bson.M{"$gt": time.Now().Add(-settings.SessionExpiry)},
+	}).Count()
+} //countActiveSessions()
 
 //Create is called from activate/login operation
 //to create a session for the already authenticated user
-func (s Session) Create(u User) (Session, error) {
+//s.TenantID may specify one of the user's organisations,
+//else the session is scoped to the user's first organisation
+func (s Session) Create(ctx context.Context, u User) (Session, error) {
 	//TODO: Limit nr of sessions per user, or close old sessions before creating a new one
 
+	//select the tenant
+	if s.TenantID.Valid() {
+		if !u.memberOf(s.TenantID) {
+			return Session{}, apierror.New(apierror.AuthNotMember, "User %s is not a member of organisation %s", u.Name, s.TenantID.Hex())
+		}
+	} else if len(u.OrganisationIDs) > 0 {
+		s.TenantID = u.OrganisationIDs[0]
+	} else {
+		s.TenantID = ""
+	}
+
 	//describe the new session
 	s.ID = bson.NewObjectId()
 	s.UserID = u.ID
@@ -36,7 +77,11 @@ func (s Session) Create(u User) (Session, error) {
 	s.Ended = false
 
 	//create it in the database
-	err := dbSessionCollection.Insert(s)
+	start := time.Now()
+	_, span := tracing.StartDB(ctx, "sessions", "insert")
+	err := dbSessionCollection().Insert(s)
+	tracing.End(span, err)
+	metrics.ObserveMongo("sessions", "insert", start)
 	if err != nil {
 		return Session{}, log.Errorf(err, "Failed to db.insert(%+v)", s)
 	}
@@ -45,33 +90,43 @@ func (s Session) Create(u User) (Session, error) {
 } //CreateSession()
 
 //Verify loads the latest session data from s.ID from the db
-func (s Session) Verify() (Session, error) {
+func (s Session) Verify(ctx context.Context) (Session, error) {
 	if !bson.IsObjectIdHex(s.ID.Hex()) {
 		return Session{}, log.Errorf(nil, "Invalid session id='%s'", s.ID.Hex())
 	}
 	mgoKey := make(bson.M)
 	mgoKey["_id"] = s.ID
 	sessionData := Session{}
-	if err := dbSessionCollection.Find(mgoKey).One(&sessionData); err != nil {
+	start := time.Now()
+	_, span := tracing.StartDB(ctx, "sessions", "find")
+	err := dbSessionCollection().Find(mgoKey).One(&sessionData)
+	tracing.End(span, err)
+	metrics.ObserveMongo("sessions", "find", start)
+	if err != nil {
 		return Session{}, log.Errorf(nil, "Session.id=%s does not exist", s.ID.Hex())
 	}
 	if sessionData.Ended {
 		return Session{}, log.Errorf(nil, "Session.id=%s already ended", s.ID.Hex())
 	}
-	sessionExpiry := sessionData.LastTime.Add(time.Minute * 10)
-	if time.Now().After(sessionExpiry) {
+	if time.Now().After(sessionData.Expiry()) {
 		return Session{}, log.Errorf(nil, "Session.id=%s expired", s.ID.Hex())
 	}
 	return sessionData, nil
 } //Session.Verify()
 
+//Expiry is the time when the session will expire if not used again
+func (s Session) Expiry() time.Time {
+	return s.LastTime.Add(settings.SessionExpiry)
+} //Session.Expiry()
+
 //Update ...
 func (s *Session) Update() error {
 	if s.ID == "" {
 		return log.Errorf(nil, "Session update without ID")
 	}
 	s.LastTime = time.Now()
-	err := dbSessionCollection.UpdateId(s.ID, s)
+	err := dbSessionCollection().UpdateId(s.ID, s)
+	metrics.ObserveMongo("sessions", "update", s.LastTime)
 	if err != nil {
 		return log.Errorf(err, "Failed to db.update(%+v)", s)
 	}
@@ -80,11 +135,11 @@ func (s *Session) Update() error {
 } //Session.Update()
 
 //End is called to end the session
-func (s *Session) End() error {
+func (s *Session) End(ctx context.Context) error {
 	//verify the session exists
 	var verifiedSession Session
 	var err error
-	if verifiedSession, err = s.Verify(); err != nil {
+	if verifiedSession, err = s.Verify(ctx); err != nil {
 		return log.Errorf(nil, "Session cannot be verified")
 	}
 
@@ -108,16 +163,61 @@ func (s *Session) End() error {
 } //Session.End()
 
 //GetSession ...
-func GetSession(sid string) (Session, error) {
+func GetSession(ctx context.Context, sid string) (Session, error) {
 	s := Session{
 		ID: bson.ObjectIdHex(sid),
 	}
 	log.Debug.Printf("Looking for session=%+v", s)
 	var err error
-	if s, err = s.Verify(); err != nil {
+	if s, err = s.Verify(ctx); err != nil {
 		log.Error.Printf("Could not verify session=%+v", s)
 		return Session{}, log.Errorf(err, "Invalid session")
 	}
 	log.Debug.Printf("Verified session=%+v", s)
 	return s, nil
 }
+
+//SessionFromRequest returns the verified session identified by the request,
+//either as "Authorization: Bearer <id>" header or as "session" URL/form parameter.
+//A bearer OAuth access token gives the session that the token was issued for
+func SessionFromRequest(req *http.Request) (Session, error) {
+	sid := ""
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		sid = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+		if sid != "" && !bson.IsObjectIdHex(sid) {
+			return sessionFromAccessToken(req.Context(), sid)
+		}
+	} else {
+		sid = req.FormValue("session")
+	}
+	if !bson.IsObjectIdHex(sid) {
+		return Session{}, log.Errorf(nil, "Missing or invalid session id")
+	}
+	return GetSession(req.Context(), sid)
+} //SessionFromRequest()
+
+//EndUserSessions ends all active sessions of the user
+//and returns the nr of sessions ended
+func EndUserSessions(userID bson.ObjectId) (int, error) {
+	info, err := dbSessionCollection().UpdateAll(
+		bson.M{"_user_id": userID, "ended": false},
+		bson.M{"$set": bson.M{"ended": true, "lasttime": time.Now()}})
+	if err != nil {
+		return 0, log.Errorf(err, "Failed to end sessions of user.id=%s", userID.Hex())
+	}
+	log.Info.Printf("Ended %d sessions of user.id=%s", info.Updated, userID.Hex())
+	return info.Updated, nil
+} //EndUserSessions()
+
+//UserSessions returns the sessions of the user that have not ended or expired, newest first
+func UserSessions(userID bson.ObjectId) ([]Session, error) {
+	list := []Session{}
+	if err := dbSessionCollection().Find(bson.M{
+		"_user_id": userID,
+		"ended":    false,
+		"lasttime": bson.M{"$gt": time.Now().Add(-settings.SessionExpiry)},
+	}).Sort("-starttime").All(&list); err != nil {
+		return nil, log.Errorf(err, "Failed to list sessions of user.id=%s", userID.Hex())
+	}
+	return list, nil
+} //UserSessions()
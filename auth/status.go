@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//user account lifecycle states
+const (
+	StatusPendingActivation = "pending_activation"
+	StatusActive            = "active"
+	StatusDisabled          = "disabled"
+	StatusLocked            = "locked"
+	StatusPendingDeletion   = "pending_deletion"
+	StatusDeleted           = "deleted"
+)
+
+//statusTransitions lists the states that can be entered from each state
+var statusTransitions = map[string][]string{
+	StatusPendingActivation: {StatusActive, StatusDisabled, StatusLocked, StatusPendingDeletion, StatusDeleted},
+	StatusActive:            {StatusDisabled, StatusLocked, StatusPendingDeletion, StatusDeleted},
+	StatusLocked:            {StatusActive, StatusPendingActivation, StatusDisabled, StatusPendingDeletion, StatusDeleted},
+	StatusDisabled:          {StatusActive, StatusPendingActivation, StatusPendingDeletion, StatusDeleted},
+	StatusPendingDeletion:   {StatusActive, StatusPendingActivation, StatusDeleted},
+	StatusDeleted:           {},
+}
+
+//StatusChange is the record of one user status transition
+type StatusChange struct {
+	ID     bson.ObjectId `bson:"_id" json:"_id"`
+	UserID bson.ObjectId `bson:"_user_id" json:"_user_id"`
+	From   string
+	To     string
+	Time   time.Time
+	Reason string
+	By     bson.ObjectId `bson:"_by_user_id,omitempty" json:"_by_user_id,omitempty"`
+}
+
+var (
+	errUserDisabled  = apierror.New(apierror.AuthUserDisabled, "User is disabled")
+	errUserLocked    = apierror.New(apierror.AuthUserLocked, "User is locked after too many failed logins")
+	errUserNotActive = apierror.New(apierror.AuthUserNotActive, "User is not active")
+)
+
+//canAuthenticate checks if the user status allows login with a password,
+//or, when temp is true, allows activation/reset with a temp password
+func (u User) canAuthenticate(temp bool) error {
+	switch u.Status {
+	case StatusActive:
+		return nil
+	case StatusPendingActivation:
+		if temp {
+			return nil
+		}
+		return errUserNotActive
+	case StatusLocked:
+		//a reset is the way out of a lockout
+		if temp {
+			return nil
+		}
+		return errUserLocked
+	case StatusDisabled:
+		return errUserDisabled
+	default:
+		return errUserNotActive
+	}
+} //User.canAuthenticate()
+
+//canReset checks if the user status allows requesting a password reset
+func (u User) canReset() error {
+	return u.canAuthenticate(true)
+} //User.canReset()
+
+//SetStatus moves the user to a new status, if allowed from the current status,
+//and records the change. by is the admin user making the change, "" for the system
+func (u User) SetStatus(to string, reason string, by bson.ObjectId) (User, error) {
+	if to == u.Status {
+		return u, nil
+	}
+	if !statusAllowed(u.Status, to) {
+		return u, log.Errorf(nil, "User %s cannot change from %s to %s", u.Name, u.Status, to)
+	}
+
+	now := time.Now()
+	if err := dbUserCollection().UpdateId(u.ID, bson.M{"$set": bson.M{
+		"status":            to,
+		"statustimes." + to: now,
+	}}); err != nil {
+		return u, log.Errorf(err, "Failed to set user.id=%s status=%s", u.ID.Hex(), to)
+	}
+	recordStatusChange(u.ID, u.Status, to, reason, by, now)
+	if u.StatusTimes == nil {
+		u.StatusTimes = map[string]time.Time{}
+	}
+	u.StatusTimes[to] = now
+	u.Status = to
+	return u, nil
+} //User.SetStatus()
+
+//statusAllowed checks if the status can be entered from the current status
+func statusAllowed(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+} //statusAllowed()
+
+func recordStatusChange(userID bson.ObjectId, from, to, reason string, by bson.ObjectId, t time.Time) {
+	c := StatusChange{
+		ID:     bson.NewObjectId(),
+		UserID: userID,
+		From:   from,
+		To:     to,
+		Time:   t,
+		Reason: reason,
+		By:     by,
+	}
+	if err := dbStatusCollection().Insert(c); err != nil {
+		log.Error.Printf("Failed to record status change %+v: %v", c, err)
+		return
+	}
+	log.Info.Printf("User.id=%s status %s -> %s: %s", userID.Hex(), from, to, reason)
+} //recordStatusChange()
+
+//StatusHistory returns the status changes of the user, oldest first
+func StatusHistory(userID bson.ObjectId) ([]StatusChange, error) {
+	list := []StatusChange{}
+	if err := dbStatusCollection().Find(bson.M{"_user_id": userID}).Sort("time").All(&list); err != nil {
+		return nil, log.Errorf(err, "Failed to get status history of user.id=%s", userID.Hex())
+	}
+	return list, nil
+} //StatusHistory()
+
+//MigrateUserStatus sets the status of users stored without one, which were
+//active unless never activated, inferred from the password field.
+//It only changes users without a status, so it is safe to run on every start
+func MigrateUserStatus() error {
+	iter := dbUserCollection().Find(bson.M{"status": bson.M{"$in": []interface{}{nil, ""}}}).Iter()
+	doc := bson.M{}
+	n := 0
+	for iter.Next(&doc) {
+		status := StatusActive
+		if pw, _ := doc["password"].(string); pw == "" {
+			status = StatusPendingActivation
+		}
+		id, ok := doc["_id"].(bson.ObjectId)
+		if !ok {
+			log.Error.Printf("Skipping user without object id: %v", doc["_id"])
+			continue
+		}
+		now := time.Now()
+		if err := dbUserCollection().UpdateId(id, bson.M{"$set": bson.M{"status": status, "statustimes." + status: now}}); err != nil {
+			iter.Close()
+			return log.Errorf(err, "Failed to migrate user.id=%s", id.Hex())
+		}
+		recordStatusChange(id, "", status, "migration", "", now)
+		n++
+		doc = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		return log.Errorf(err, "Failed to migrate user status")
+	}
+	if n > 0 {
+		log.Info.Printf("Migrated status of %d users", n)
+	}
+	return nil
+} //MigrateUserStatus()
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCanAuthenticate(t *testing.T) {
+	tests := []struct {
+		status         string
+		password, temp error
+	}{
+		{StatusActive, nil, nil},
+		{StatusPendingActivation, errUserNotActive, nil},
+		{StatusLocked, errUserLocked, nil},
+		{StatusDisabled, errUserDisabled, errUserDisabled},
+		{StatusPendingDeletion, errUserNotActive, errUserNotActive},
+		{StatusDeleted, errUserNotActive, errUserNotActive},
+		{"", errUserNotActive, errUserNotActive},
+	}
+	for _, test := range tests {
+		u := User{Status: test.status}
+		if err := u.canAuthenticate(false); err != test.password {
+			t.Errorf("%s can login with a password: %v", test.status, err)
+		}
+		if err := u.canAuthenticate(true); err != test.temp {
+			t.Errorf("%s can use a temp password: %v", test.status, err)
+		}
+		if err := u.canReset(); err != test.temp {
+			t.Errorf("%s can reset: %v", test.status, err)
+		}
+	}
+} //TestCanAuthenticate()
+
+func TestStatusAllowed(t *testing.T) {
+	all := []string{StatusPendingActivation, StatusActive, StatusDisabled, StatusLocked, StatusPendingDeletion, StatusDeleted}
+	for _, from := range all {
+		if _, ok := statusTransitions[from]; !ok {
+			t.Errorf("No transitions from %s", from)
+		}
+		//every state except deleted can be deleted, nothing leaves deleted
+		if statusAllowed(from, StatusDeleted) != (from != StatusDeleted) {
+			t.Errorf("%s to deleted allowed=%v", from, !(from != StatusDeleted))
+		}
+		if from != StatusDeleted && statusAllowed(StatusDeleted, from) {
+			t.Errorf("Deleted can change to %s", from)
+		}
+		if statusAllowed(from, from) {
+			t.Errorf("Transition from %s to itself", from)
+		}
+	}
+	for _, tr := range [][2]string{
+		{StatusActive, StatusPendingActivation},
+		{StatusPendingActivation, StatusPendingActivation},
+		{StatusActive, "unknown"},
+	} {
+		if statusAllowed(tr[0], tr[1]) {
+			t.Errorf("%s to %s allowed", tr[0], tr[1])
+		}
+	}
+
+	//not allowed and unchanged statuses do not use the database
+	u := User{Name: "jan", Status: StatusActive}
+	if _, err := u.SetStatus(StatusPendingActivation, "test", ""); err == nil {
+		t.Errorf("Changed active to pending activation")
+	}
+	if same, err := u.SetStatus(StatusActive, "test", ""); err != nil || same.Status != StatusActive {
+		t.Errorf("Set the same status: %+v, %v", same, err)
+	}
+	if err := DeleteUser(User{Status: StatusDeleted}, ""); err == nil {
+		t.Errorf("Deleted a deleted user")
+	}
+} //TestStatusAllowed()
+
+func TestUserLifecycle(t *testing.T) {
+	testDatabase(t)
+	admin := bson.NewObjectId()
+	u, err := NewUser("lifecycle-" + bson.NewObjectId().Hex() + "@example.com")
+	if err != nil {
+		t.Fatalf("Cannot create user: %v", err)
+	}
+	t.Cleanup(func() {
+		dbUserCollection().RemoveId(u.ID)
+		dbStatusCollection().RemoveAll(bson.M{"_user_id": u.ID})
+	})
+	if u.Status != StatusPendingActivation || u.TempPassword == "" {
+		t.Fatalf("New user %+v", u)
+	}
+
+	//wrong temp passwords lock a user still to activate and clear the temp password
+	for i := 0; i < maxFailedLogins; i++ {
+		if _, err := (User{Name: u.Name, TempPassword: "wrong"}).Authenticate(); err != errWrongPassword {
+			t.Fatalf("Wrong temp password: %v", err)
+		}
+	}
+	locked, _ := User{}.Get(u.ID.Hex())
+	if locked.Status != StatusLocked || locked.TempPassword != "" {
+		t.Errorf("After %d wrong temp passwords: %s %q", maxFailedLogins, locked.Status, locked.TempPassword)
+	}
+	if _, err := (User{Name: u.Name, TempPassword: u.TempPassword}).Authenticate(); err == nil {
+		t.Errorf("Authenticated with the cleared temp password")
+	}
+
+	//a reset is the way out: activate with the new temp password
+	reset, err := locked.ResetPassword()
+	if err != nil {
+		t.Fatalf("Cannot reset: %v", err)
+	}
+	authenticated, err := User{Name: u.Name, TempPassword: reset.TempPassword}.Authenticate()
+	if err != nil {
+		t.Fatalf("Cannot authenticate with the new temp password: %v", err)
+	}
+	if u, err = authenticated.Activate("Secret12345"); err != nil || u.Status != StatusActive {
+		t.Fatalf("Cannot activate: %+v, %v", u, err)
+	}
+	if _, err := (User{Name: u.Name, Password: "Secret12345"}).Authenticate(); err != nil {
+		t.Errorf("Cannot login after activation: %v", err)
+	}
+
+	if u, err = u.SetStatus(StatusDisabled, "left the company", admin); err != nil {
+		t.Fatalf("Cannot disable: %v", err)
+	}
+	if _, err := (User{Name: u.Name, Password: "Secret12345"}).Authenticate(); err != errUserDisabled {
+		t.Errorf("Login while disabled: %v", err)
+	}
+	if err := DeleteUser(u, admin); err != nil {
+		t.Fatalf("Cannot delete: %v", err)
+	}
+	if _, err := (User{}).Get(u.ID.Hex()); err == nil {
+		t.Errorf("Deleted user still exists")
+	}
+
+	history, err := StatusHistory(u.ID)
+	if err != nil {
+		t.Fatalf("No history: %v", err)
+	}
+	want := [][2]string{
+		{"", StatusPendingActivation},
+		{StatusPendingActivation, StatusLocked},
+		{StatusLocked, StatusActive},
+		{StatusActive, StatusDisabled},
+		{StatusDisabled, StatusDeleted},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("History %+v", history)
+	}
+	for i, c := range history {
+		if c.From != want[i][0] || c.To != want[i][1] {
+			t.Errorf("History[%d] %s to %s, want %s to %s", i, c.From, c.To, want[i][0], want[i][1])
+		}
+	}
+	if history[3].By != admin || history[3].Reason != "left the company" || history[4].By != admin {
+		t.Errorf("Changes by admin recorded as %+v", history[3:])
+	}
+} //TestUserLifecycle()
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//token types, also the token_type_hint values of RFC 7009 and RFC 7662
+const (
+	tokenTypeAccess  = "access_token"
+	tokenTypeRefresh = "refresh_token"
+)
+
+//Token is an OAuth access or refresh token issued to a client for a session.
+//The token value is random and only its SHA-256 is stored.
+//Tokens are valid until they expire or until the session is ended,
+//they do not depend on the session being used (see Session.Expiry)
+type Token struct {
+	ID        bson.ObjectId `bson:"_id" json:"_id"`
+	Hash      string
+	Type      string
+	ClientID  bson.ObjectId `bson:"_client_id" json:"_client_id"`
+	UserID    bson.ObjectId `bson:"_user_id" json:"_user_id"`
+	SessionID bson.ObjectId `bson:"_session_id" json:"_session_id"`
+	Scope     string        //space separated permissions, "" for all permissions of the user
+	IssueTime time.Time
+	Expiry    time.Time
+}
+
+//tokenResponse is the successful response of the token endpoint (RFC 6749 section 5.1)
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func tokenHash(value string) string {
+	h := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(h[:])
+} //tokenHash()
+
+//normaliseScope removes duplicate and extra spaces from a scope parameter
+func normaliseScope(scope string) string {
+	set := map[string]bool{}
+	list := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !set[s] {
+			set[s] = true
+			list = append(list, s)
+		}
+	}
+	return strings.Join(list, " ")
+} //normaliseScope()
+
+//scopeAllows checks that every permission in the requested scope is in the granted scope,
+//an empty granted scope allows any requested scope
+func scopeAllows(granted, requested string) bool {
+	if granted == "" {
+		return true
+	}
+	grantedList := strings.Fields(granted)
+	for _, s := range strings.Fields(requested) {
+		if !HasPermission(grantedList, s) {
+			return false
+		}
+	}
+	return true
+} //scopeAllows()
+
+//scopePermissions limits the user's effective permissions to the scope of an access token
+func scopePermissions(perms []string, scope []string) []string {
+	if len(scope) == 0 {
+		return perms
+	}
+	limited := []string{}
+	for _, s := range scope {
+		if HasPermission(perms, s) {
+			limited = append(limited, s)
+		}
+	}
+	return limited
+} //scopePermissions()
+
+//newToken stores a new token of the type and returns it with its value
+func newToken(typ string, c Client, s Session, scope string, expiry time.Duration) (Token, string, error) {
+	value, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	t := Token{
+		ID:        bson.NewObjectId(),
+		Hash:      tokenHash(value),
+		Type:      typ,
+		ClientID:  c.ID,
+		UserID:    s.UserID,
+		SessionID: s.ID,
+		Scope:     scope,
+		IssueTime: time.Now(),
+	}
+	t.Expiry = t.IssueTime.Add(expiry)
+	if err := dbTokenCollection().Insert(t); err != nil {
+		return Token{}, "", log.Errorf(err, "Failed to db.insert(%s)", typ)
+	}
+	return t, value, nil
+} //newToken()
+
+//issueTokens issues a new access and refresh token for the session to the client
+func issueTokens(c Client, s Session, scope string) (tokenResponse, error) {
+	access, accessValue, err := newToken(tokenTypeAccess, c, s, scope, settings.AccessTokenExpiry)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	_, refreshValue, err := newToken(tokenTypeRefresh, c, s, scope, settings.RefreshTokenExpiry)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	log.Info.Printf("Issued tokens to client.id=%s for session.id=%s scope=\"%s\"", c.ID.Hex(), s.ID.Hex(), scope)
+	return tokenResponse{
+		AccessToken:  accessValue,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(access.Expiry.Sub(access.IssueTime).Seconds()),
+		RefreshToken: refreshValue,
+		Scope:        scope,
+	}, nil
+} //issueTokens()
+
+//activeToken returns the stored token with the value and its session,
+//failing when the token does not exist, expired or its session ended
+func activeToken(value string) (Token, Session, error) {
+	t := Token{}
+	if err := dbTokenCollection().Find(bson.M{"hash": tokenHash(value)}).One(&t); err != nil {
+		return Token{}, Session{}, log.Errorf(err, "Token does not exist")
+	}
+	if time.Now().After(t.Expiry) {
+		return Token{}, Session{}, log.Errorf(nil, "Token.id=%s expired", t.ID.Hex())
+	}
+	s := Session{}
+	if err := dbSessionCollection().FindId(t.SessionID).One(&s); err != nil {
+		return Token{}, Session{}, log.Errorf(err, "Session.id=%s of token.id=%s does not exist", t.SessionID.Hex(), t.ID.Hex())
+	}
+	if s.Ended {
+		return Token{}, Session{}, log.Errorf(nil, "Session.id=%s of token.id=%s ended", s.ID.Hex(), t.ID.Hex())
+	}
+	return t, s, nil
+} //activeToken()
+
+//sessionFromAccessToken returns the session of an active access token,
+//with the token scope to limit the session permissions
+func sessionFromAccessToken(ctx context.Context, value string) (Session, error) {
+	t, s, err := activeToken(value)
+	if err != nil {
+		return Session{}, err
+	}
+	if t.Type != tokenTypeAccess {
+		return Session{}, log.Errorf(nil, "Token.id=%s is not an access token", t.ID.Hex())
+	}
+	s.Scope = strings.Fields(t.Scope)
+	return s, nil
+} //sessionFromAccessToken()
+
+//removeSessionTokens removes all tokens issued for the session
+func removeSessionTokens(sessionID bson.ObjectId) error {
+	info, err := dbTokenCollection().RemoveAll(bson.M{"_session_id": sessionID})
+	if err != nil {
+		return log.Errorf(err, "Failed to remove tokens of session.id=%s", sessionID.Hex())
+	}
+	if info.Removed > 0 {
+		log.Info.Printf("Removed %d tokens of session.id=%s", info.Removed, sessionID.Hex())
+	}
+	return nil
+} //removeSessionTokens()
+
+//EnsureTokenIndexes makes token lookups by value unique
+//and lets mongo remove expired tokens
+func EnsureTokenIndexes() error {
+	if err := dbTokenCollection().EnsureIndex(mgo.Index{
+		Key:    []string{"hash"},
+		Unique: true,
+		Name:   "hash_unique",
+	}); err != nil {
+		return log.Errorf(err, "Failed to create unique index on token hashes")
+	}
+	if err := dbTokenCollection().EnsureIndex(mgo.Index{
+		Key:         []string{"expiry"},
+		ExpireAfter: time.Second,
+		Name:        "expiry_ttl",
+	}); err != nil {
+		return log.Errorf(err, "Failed to create expiry index on tokens")
+	}
+	return nil
+} //EnsureTokenIndexes()
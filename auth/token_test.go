@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTokenHash(t *testing.T) {
+	//sha256("abc")
+	if h := tokenHash("abc"); h != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("tokenHash(abc) = %s", h)
+	}
+	if tokenHash("abc") == tokenHash("abd") {
+		t.Errorf("Different tokens have the same hash")
+	}
+} //TestTokenHash()
+
+func TestNormaliseScope(t *testing.T) {
+	tests := map[string]string{
+		"":                         "",
+		"   ":                      "",
+		"item:read":                "item:read",
+		" item:read   item:write ": "item:read item:write",
+		"item:read item:read user": "item:read user",
+	}
+	for scope, want := range tests {
+		if got := normaliseScope(scope); got != want {
+			t.Errorf("normaliseScope(%q) = %q, want %q", scope, got, want)
+		}
+	}
+} //TestNormaliseScope()
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		granted, requested string
+		want               bool
+	}{
+		{"", "", true},
+		{"", "item:read user:write", true},
+		{"item:read", "", true},
+		{"item:read", "item:read", true},
+		{"item:read", "item:write", false},
+		{"item:read", "item:read item:write", false},
+		{"item", "item:write", true},
+		{"item:*", "item:read item:write", true},
+		{"item:read", "item", false},
+		{"*", "user:delete", true},
+	}
+	for _, test := range tests {
+		if got := scopeAllows(test.granted, test.requested); got != test.want {
+			t.Errorf("scopeAllows(%q, %q) = %v", test.granted, test.requested, got)
+		}
+	}
+} //TestScopeAllows()
+
+func TestScopePermissions(t *testing.T) {
+	perms := []string{"item:*", "user:read"}
+	tests := []struct {
+		scope []string
+		want  []string
+	}{
+		{nil, perms},
+		{[]string{"item:read"}, []string{"item:read"}},
+		{[]string{"item:read", "user:write"}, []string{"item:read"}},
+		{[]string{"user:read", "audit:read"}, []string{"user:read"}},
+		{[]string{"audit:read"}, []string{}},
+	}
+	for _, test := range tests {
+		if got := scopePermissions(perms, test.scope); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("scopePermissions(%v) = %v, want %v", test.scope, got, test.want)
+		}
+	}
+} //TestScopePermissions()
+
+func TestOAuthError(t *testing.T) {
+	res := httptest.NewRecorder()
+	oauthError(res, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	if res.Code != http.StatusUnauthorized || res.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("oauthError = %d %v", res.Code, res.Header())
+	}
+	body := map[string]string{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body["error"] != "invalid_client" {
+		t.Errorf("oauthError body %s: %v", res.Body.String(), err)
+	}
+
+	res = httptest.NewRecorder()
+	oauthError(res, http.StatusBadRequest, "invalid_grant", "Expired")
+	if res.Code != http.StatusBadRequest || res.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("oauthError = %d %v", res.Code, res.Header())
+	}
+} //TestOAuthError()
+
+func TestTokenLifecycle(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+
+	u, err := User{Name: "token-" + bson.NewObjectId().Hex() + "@example.com"}.Insert()
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	t.Cleanup(func() { dbUserCollection().RemoveId(u.ID) })
+	s, err := Session{}.Create(ctx, u)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	t.Cleanup(func() { dbSessionCollection().RemoveId(s.ID) })
+	c, err := Client{Name: "token test"}.Insert()
+	if err != nil {
+		t.Fatalf("Failed to insert client: %v", err)
+	}
+	t.Cleanup(func() { dbClientCollection().RemoveId(c.ID) })
+	other, err := Client{Name: "other token test"}.Insert()
+	if err != nil {
+		t.Fatalf("Failed to insert client: %v", err)
+	}
+	t.Cleanup(func() { dbClientCollection().RemoveId(other.ID) })
+
+	tokens, err := issueTokens(c, s, "item:read")
+	if err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
+	t.Cleanup(func() { removeSessionTokens(s.ID) })
+
+	info := introspectToken(ctx, tokens.AccessToken, "")
+	if !info.Active || info.TokenType != tokenTypeAccess || info.Scope != "item:read" || info.ClientID != c.ID.Hex() || info.Sub != u.ID.Hex() {
+		t.Errorf("Access token introspected as %+v", info)
+	}
+	if as, err := sessionFromAccessToken(ctx, tokens.AccessToken); err != nil || as.ID != s.ID || !reflect.DeepEqual(as.Scope, []string{"item:read"}) {
+		t.Errorf("Session of access token %+v: %v", as, err)
+	}
+	if _, err := sessionFromAccessToken(ctx, tokens.RefreshToken); err == nil {
+		t.Errorf("Refresh token used as access token")
+	}
+
+	//another client cannot revoke the tokens
+	if err := revokeToken(ctx, other, tokens.RefreshToken, ""); err != nil {
+		t.Errorf("Revoke by another client failed: %v", err)
+	}
+	if !introspectToken(ctx, tokens.RefreshToken, "").Active {
+		t.Errorf("Refresh token revoked by another client")
+	}
+	if err := revokeToken(ctx, other, s.ID.Hex(), tokenTypeSession); err != nil {
+		t.Errorf("Revoke of the session id by another client failed: %v", err)
+	}
+	if !introspectToken(ctx, s.ID.Hex(), "").Active || !introspectToken(ctx, tokens.AccessToken, "").Active || !introspectToken(ctx, tokens.RefreshToken, "").Active {
+		t.Errorf("Session or its tokens revoked by another client with the session id")
+	}
+
+	//revoking the access token keeps the refresh token and session
+	if err := revokeToken(ctx, c, tokens.AccessToken, tokenTypeAccess); err != nil {
+		t.Errorf("Failed to revoke access token: %v", err)
+	}
+	if introspectToken(ctx, tokens.AccessToken, "").Active {
+		t.Errorf("Revoked access token still active")
+	}
+	if !introspectToken(ctx, tokens.RefreshToken, "").Active || !introspectToken(ctx, s.ID.Hex(), "").Active {
+		t.Errorf("Revoking the access token ended the session")
+	}
+
+	//revoking the refresh token ends the session
+	if err := revokeToken(ctx, c, tokens.RefreshToken, tokenTypeRefresh); err != nil {
+		t.Errorf("Failed to revoke refresh token: %v", err)
+	}
+	if introspectToken(ctx, tokens.RefreshToken, "").Active || introspectToken(ctx, s.ID.Hex(), "").Active {
+		t.Errorf("Session still active after revoking the refresh token")
+	}
+	//revoking again is not an error
+	if err := revokeToken(ctx, c, tokens.RefreshToken, ""); err != nil {
+		t.Errorf("Revoking again failed: %v", err)
+	}
+
+	//the client with tokens for a session can revoke it by the session id
+	own, err := Session{}.Create(ctx, u)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	t.Cleanup(func() {
+		removeSessionTokens(own.ID)
+		dbSessionCollection().RemoveId(own.ID)
+	})
+	if tokens, err = issueTokens(c, own, "item:read"); err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
+	if err := revokeToken(ctx, c, own.ID.Hex(), ""); err != nil {
+		t.Errorf("Failed to revoke the session id: %v", err)
+	}
+	if introspectToken(ctx, own.ID.Hex(), "").Active || introspectToken(ctx, tokens.RefreshToken, "").Active {
+		t.Errorf("Session still active after revoking the session id")
+	}
+} //TestTokenLifecycle()
@@ -0,0 +1,418 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/health"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Webhook is a subscription to have events POSTed to a URL.
+//Events are filters like "person.created", "user.*" or "*".
+//A webhook with a TenantID only receives events of that tenant.
+//
+//Each POST has headers X-Webhook-Event, X-Webhook-Delivery, X-Webhook-Timestamp
+//and X-Webhook-Signature "sha256=<hex HMAC-SHA256 of timestamp + "." + body>"
+//using the webhook Secret as key
+type Webhook struct {
+	ID       bson.ObjectId `bson:"_id" json:"_id"`
+	URL      string
+	Events   []string
+	Secret   string        `json:",omitempty"`
+	TenantID bson.ObjectId `bson:"_tenant_id,omitempty" json:"_tenant_id,omitempty"`
+	Created  time.Time
+}
+
+//delivery states, dead deliveries are the dead letters kept for redelivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+//Delivery is one event queued for one webhook, with its delivery history
+type Delivery struct {
+	ID          bson.ObjectId `bson:"_id" json:"_id"`
+	WebhookID   bson.ObjectId `bson:"_webhook_id" json:"_webhook_id"`
+	Event       string
+	Payload     string
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	LastStatus  int    `json:",omitempty"`
+	LastError   string `json:",omitempty"`
+	Created     time.Time
+	Delivered   time.Time
+}
+
+//webhook delivery retries with exponential backoff:
+//30s, 1m, 2m, ... up to 6h between attempts
+const (
+	webhookMaxAttempts  = 12
+	webhookFirstBackoff = time.Second * 30
+	webhookMaxBackoff   = time.Hour * 6
+	webhookTimeout      = time.Second * 10
+	webhookLease        = time.Minute * 1 //claimed deliveries are retried after this if not completed
+	webhookPollInterval = time.Second * 1
+)
+
+var (
+	regexValidEvent = regexp.MustCompile(`^(\*|[a-z][a-z0-9_-]*\.(\*|[a-z][a-z0-9_-]*))$`)
+
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+//Insert validates and creates the webhook with a new secret
+func (w Webhook) Insert() (Webhook, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return w, log.Errorf(nil, "Invalid webhook URL \"%s\"", w.URL)
+	}
+	if len(w.Events) == 0 {
+		return w, log.Errorf(nil, "Webhook requires at least one event")
+	}
+	for _, e := range w.Events {
+		if !regexValidEvent.MatchString(e) {
+			return w, log.Errorf(nil, "Invalid webhook event \"%s\"", e)
+		}
+	}
+	if w.Secret, err = randomHex(32); err != nil {
+		return w, err
+	}
+	w.ID = bson.NewObjectId()
+	w.Created = time.Now()
+	if err := dbWebhookCollection().Insert(w); err != nil {
+		return w, log.Errorf(err, "Failed to db.insert(webhook)")
+	}
+	log.Info.Printf("Created webhook %s for %v to %s", w.ID.Hex(), w.Events, w.URL)
+	return w, nil
+} //Webhook.Insert()
+
+//matches checks if the event is selected by one of the webhook event filters
+func (w Webhook) matches(event string) bool {
+	for _, e := range w.Events {
+		if e == "*" || e == event || (strings.HasSuffix(e, ".*") && strings.HasPrefix(event, strings.TrimSuffix(e, "*"))) {
+			return true
+		}
+	}
+	return false
+} //Webhook.matches()
+
+//PublishEvent queues the event for delivery to all matching webhooks
+//tenant is the organisation id of the event, "" if none
+//it can be used as item.Notify
+func PublishEvent(event string, tenant string, data interface{}) {
+	query := bson.M{"_tenant_id": bson.M{"$exists": false}}
+	if bson.IsObjectIdHex(tenant) {
+		query = bson.M{"_tenant_id": bson.M{"$in": []interface{}{nil, bson.ObjectIdHex(tenant)}}}
+	}
+	list := []Webhook{}
+	if err := dbWebhookCollection().Find(query).All(&list); err != nil {
+		log.Error.Printf("Failed to find webhooks for %s: %v", event, err)
+		return
+	}
+	now := time.Now()
+	for _, w := range list {
+		if !w.matches(event) {
+			continue
+		}
+		d := Delivery{
+			ID:          bson.NewObjectId(),
+			WebhookID:   w.ID,
+			Event:       event,
+			Status:      DeliveryPending,
+			NextAttempt: now,
+			Created:     now,
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"_delivery_id": d.ID,
+			"Event":        event,
+			"Time":         now,
+			"_tenant_id":   tenant,
+			"Data":         data,
+		})
+		if err != nil {
+			log.Error.Printf("Failed to encode %s event: %v", event, err)
+			return
+		}
+		d.Payload = string(payload)
+		if err := dbDeliveryCollection().Insert(d); err != nil {
+			log.Error.Printf("Failed to queue %s for webhook %s: %v", event, w.ID.Hex(), err)
+		}
+	}
+} //PublishEvent()
+
+//webhookSignature is the hex HMAC-SHA256 of timestamp + "." + payload
+func webhookSignature(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+"."+payload)
+	return hex.EncodeToString(mac.Sum(nil))
+} //webhookSignature()
+
+//webhookBackoff is the delay before the next attempt after a number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookFirstBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+} //webhookBackoff()
+
+//webhookWorker is the running delivery goroutine, stop is nil when not running
+var webhookWorker struct {
+	sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+//StartWebhookDelivery starts delivering queued events in the background.
+//Several processes can deliver from the same queue,
+//because each delivery is claimed before it is sent
+func StartWebhookDelivery() {
+	webhookWorker.Lock()
+	defer webhookWorker.Unlock()
+	if webhookWorker.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	webhookWorker.stop, webhookWorker.done = stop, done
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if !deliverNext() {
+				select {
+				case <-stop:
+					return
+				case <-time.After(webhookPollInterval):
+				}
+			}
+		}
+	}()
+} //StartWebhookDelivery()
+
+func init() {
+	health.Add("auth.webhook_delivery", webhookDeliveryRunning)
+}
+
+//webhookDeliveryRunning checks that StartWebhookDelivery was called and not stopped
+func webhookDeliveryRunning(ctx context.Context) error {
+	webhookWorker.Lock()
+	defer webhookWorker.Unlock()
+	if webhookWorker.stop == nil {
+		return fmt.Errorf("webhook delivery is not running")
+	}
+	return nil
+} //webhookDeliveryRunning()
+
+//StopWebhookDelivery stops claiming deliveries and waits until the one being sent is done,
+//or ctx is done. A delivery that was claimed but not completed is retried after webhookLease
+func StopWebhookDelivery(ctx context.Context) error {
+	webhookWorker.Lock()
+	stop, done := webhookWorker.stop, webhookWorker.done
+	webhookWorker.stop, webhookWorker.done = nil, nil
+	webhookWorker.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	select {
+	case <-done:
+		log.Info.Printf("Stopped webhook delivery")
+		return nil
+	case <-ctx.Done():
+		return log.Errorf(ctx.Err(), "Webhook delivery did not stop")
+	}
+} //StopWebhookDelivery()
+
+//deliverNext claims and sends one due delivery, returning false when none are due
+func deliverNext() bool {
+	now := time.Now()
+	d := Delivery{}
+	if _, err := dbDeliveryCollection().Find(bson.M{
+		"status":      DeliveryPending,
+		"nextattempt": bson.M{"$lte": now},
+	}).Sort("nextattempt").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"nextattempt": now.Add(webhookLease)}},
+		ReturnNew: true,
+	}, &d); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Error.Printf("Failed to get webhook delivery: %v", err)
+		}
+		return false
+	}
+
+	w := Webhook{}
+	if err := dbWebhookCollection().FindId(d.WebhookID).One(&w); err != nil {
+		if err != mgo.ErrNotFound {
+			//retried when the claim expires
+			log.Error.Printf("Failed to get webhook %s: %v", d.WebhookID.Hex(), err)
+			return false
+		}
+		//webhook was deleted
+		dbDeliveryCollection().UpdateId(d.ID, bson.M{"$set": bson.M{"status": DeliveryDead, "lasterror": "webhook deleted"}})
+		return true
+	}
+
+	status, err := w.send(d)
+	d.Attempts++
+	upd := bson.M{"attempts": d.Attempts, "laststatus": status, "lasterror": ""}
+	if err == nil {
+		upd["status"] = DeliveryDelivered
+		upd["delivered"] = time.Now()
+		log.Debug.Printf("Delivered %s %s to %s", d.Event, d.ID.Hex(), w.URL)
+	} else {
+		upd["lasterror"] = err.Error()
+		if d.Attempts >= webhookMaxAttempts {
+			upd["status"] = DeliveryDead
+			log.Error.Printf("Giving up delivery %s of %s to %s after %d attempts: %v", d.ID.Hex(), d.Event, w.URL, d.Attempts, err)
+		} else {
+			upd["nextattempt"] = time.Now().Add(webhookBackoff(d.Attempts))
+		}
+	}
+	if err := dbDeliveryCollection().UpdateId(d.ID, bson.M{"$set": upd}); err != nil {
+		log.Error.Printf("Failed to update webhook delivery %s: %v", d.ID.Hex(), err)
+	}
+	return true
+} //deliverNext()
+
+//send POSTs the signed delivery payload and returns the HTTP status code
+func (w Webhook) send(d Delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID.Hex())
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(w.Secret, timestamp, d.Payload))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("HTTP status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+} //Webhook.send()
+
+//createWebhookHandler creates a webhook from JSON body {"URL":"...","Events":[...],"_tenant_id":"..."}
+//the response includes the secret, which is not shown again
+func createWebhookHandler(res http.ResponseWriter, req *http.Request) {
+	w := Webhook{}
+	if err := json.NewDecoder(req.Body).Decode(&w); err != nil {
+		apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON: %v", err)
+		return
+	}
+	w, err := w.Insert()
+	if err != nil {
+		apierror.Writef(res, req, apierror.BadRequest, "Failed to create webhook: %v", err)
+		return
+	}
+	writeAdminJSON(res, w)
+} //createWebhookHandler()
+
+func listWebhooksHandler(res http.ResponseWriter, req *http.Request) {
+	list := []Webhook{}
+	if err := dbWebhookCollection().Find(nil).Select(bson.M{"secret": 0}).Sort("created").All(&list); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to list webhooks: %v", err)
+		return
+	}
+	writeAdminJSON(res, list)
+} //listWebhooksHandler()
+
+func deleteWebhookHandler(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	if !bson.IsObjectIdHex(id) {
+		apierror.Writef(res, req, apierror.BadRequest, "Invalid id='%s' is not bson hex object id", id)
+		return
+	}
+	if err := dbWebhookCollection().RemoveId(bson.ObjectIdHex(id)); err != nil {
+		apierror.Writef(res, req, apierror.NotFound, "Webhook(id=%s) does not exist", id)
+		return
+	}
+	log.Info.Printf("Deleted webhook %s", id)
+} //deleteWebhookHandler()
+
+//deliveryList is one page of deliveries
+type deliveryList struct {
+	Total      int
+	Page       int
+	Size       int
+	Deliveries []Delivery
+}
+
+//listDeliveriesHandler shows the delivery history of a webhook, newest first,
+//optionally only with URL parameter status=pending|delivered|dead
+func listDeliveriesHandler(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	if !bson.IsObjectIdHex(id) {
+		apierror.Writef(res, req, apierror.BadRequest, "Invalid id='%s' is not bson hex object id", id)
+		return
+	}
+	page, size, err := pageParams(req)
+	if err != nil {
+		apierror.Write(res, req, err, apierror.BadRequest)
+		return
+	}
+	query := bson.M{"_webhook_id": bson.ObjectIdHex(id)}
+	if status := req.URL.Query().Get("status"); status != "" {
+		query["status"] = status
+	}
+	list := deliveryList{Page: page, Size: size, Deliveries: []Delivery{}}
+	q := dbDeliveryCollection().Find(query)
+	if list.Total, err = q.Count(); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to count deliveries: %v", err)
+		return
+	}
+	if err := q.Sort("-created").Skip(page * size).Limit(size).All(&list.Deliveries); err != nil {
+		apierror.Writef(res, req, apierror.Unavailable, "Failed to list deliveries: %v", err)
+		return
+	}
+	writeAdminJSON(res, list)
+} //listDeliveriesHandler()
+
+//redeliverHandler queues a delivered or dead delivery again, with a fresh set of attempts
+func redeliverHandler(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	if !bson.IsObjectIdHex(id) {
+		apierror.Writef(res, req, apierror.BadRequest, "Invalid id='%s' is not bson hex object id", id)
+		return
+	}
+	if err := dbDeliveryCollection().Update(
+		bson.M{"_id": bson.ObjectIdHex(id), "status": bson.M{"$ne": DeliveryPending}},
+		bson.M{"$set": bson.M{"status": DeliveryPending, "attempts": 0, "nextattempt": time.Now()}}); err != nil {
+		apierror.Writef(res, req, apierror.NotFound, "Delivery(id=%s) does not exist or is already pending", id)
+		return
+	}
+	log.Info.Printf("Redelivering %s", id)
+} //redeliverHandler()
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	//computed independently: HMAC-SHA256(key "secret", `1700000000.{"Event":"person.created"}`)
+	want := "3843a71aae214a6bf58699767b9cd53f9cf9a9c911e1ef862277ca9198e912bc"
+	if got := webhookSignature("secret", "1700000000", `{"Event":"person.created"}`); got != want {
+		t.Errorf("webhookSignature = %s, want %s", got, want)
+	}
+	if webhookSignature("other", "1700000000", `{"Event":"person.created"}`) == want {
+		t.Errorf("Signature does not depend on the secret")
+	}
+	if webhookSignature("secret", "1700000001", `{"Event":"person.created"}`) == want {
+		t.Errorf("Signature does not depend on the timestamp")
+	}
+} //TestWebhookSignature()
+
+//TestWebhookSend checks the request as a receiver would verify it
+func TestWebhookSend(t *testing.T) {
+	var got *http.Request
+	var body string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		got, body = req, string(data)
+		res.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	w := Webhook{URL: server.URL + "/hook", Secret: "0123456789abcdef"}
+	d := Delivery{ID: bson.NewObjectId(), Event: "user.created", Payload: `{"Event":"user.created"}`}
+	if code, err := w.send(d); err != nil || code != http.StatusNoContent {
+		t.Fatalf("send = %d, %v", code, err)
+	}
+	if got.Method != http.MethodPost || got.URL.Path != "/hook" || body != d.Payload {
+		t.Errorf("Sent %s %s %s", got.Method, got.URL.Path, body)
+	}
+	if got.Header.Get("X-Webhook-Event") != d.Event || got.Header.Get("X-Webhook-Delivery") != d.ID.Hex() {
+		t.Errorf("Sent headers %v", got.Header)
+	}
+	timestamp := got.Header.Get("X-Webhook-Timestamp")
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Errorf("Sent timestamp %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write([]byte(timestamp + "." + body))
+	if !hmac.Equal([]byte(got.Header.Get("X-Webhook-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+		t.Errorf("Signature %s does not verify", got.Header.Get("X-Webhook-Signature"))
+	}
+
+	status = http.StatusInternalServerError
+	if code, err := w.send(d); err == nil || code != http.StatusInternalServerError {
+		t.Errorf("send to failing receiver = %d, %v", code, err)
+	}
+	server.Close()
+	if _, err := w.send(d); err == nil {
+		t.Errorf("send to closed receiver did not fail")
+	}
+} //TestWebhookSend()
+
+func TestWebhookMatches(t *testing.T) {
+	w := Webhook{Events: []string{"person.created", "user.*"}}
+	for event, want := range map[string]bool{
+		"person.created": true,
+		"person.deleted": false,
+		"user.created":   true,
+		"user.deleted":   true,
+		"users.created":  false,
+		"user":           false,
+	} {
+		if got := w.matches(event); got != want {
+			t.Errorf("matches(%s) = %v", event, got)
+		}
+	}
+	if !(Webhook{Events: []string{"*"}}).matches("anything.at_all") {
+		t.Errorf("* does not match all events")
+	}
+} //TestWebhookMatches()
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  webhookFirstBackoff,
+		2:  webhookFirstBackoff * 2,
+		3:  webhookFirstBackoff * 4,
+		11: webhookMaxBackoff,
+		50: webhookMaxBackoff,
+	}
+	for attempts, want := range tests {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+} //TestWebhookBackoff()
+
+func TestWebhookInsertInvalid(t *testing.T) {
+	for _, w := range []Webhook{
+		{URL: "ftp://example.com/hook", Events: []string{"user.created"}},
+		{URL: "https:///hook", Events: []string{"user.created"}},
+		{URL: "https://example.com/hook"},
+		{URL: "https://example.com/hook", Events: []string{"User.Created"}},
+		{URL: "https://example.com/hook", Events: []string{"user"}},
+		{URL: "https://example.com/hook", Events: []string{"*.created"}},
+	} {
+		if _, err := w.Insert(); err == nil || strings.Contains(err.Error(), "db.insert") {
+			t.Errorf("Inserted invalid webhook %+v: %v", w, err)
+		}
+	}
+} //TestWebhookInsertInvalid()
+
+func TestWebhookDelivery(t *testing.T) {
+	testDatabase(t)
+	received := make(chan string, 10)
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-Webhook-Event")
+		res.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	//a unique event name, so that other webhooks in the test database do not match
+	event := "test" + bson.NewObjectId().Hex() + ".created"
+	w, err := Webhook{URL: server.URL, Events: []string{strings.TrimSuffix(event, "created") + "*"}}.Insert()
+	if err != nil {
+		t.Fatalf("Failed to insert webhook: %v", err)
+	}
+	t.Cleanup(func() {
+		dbWebhookCollection().RemoveId(w.ID)
+		dbDeliveryCollection().RemoveAll(bson.M{"_webhook_id": w.ID})
+	})
+
+	deliver := func() Delivery {
+		PublishEvent(event, "", map[string]string{"Name": "jan"})
+		d := Delivery{}
+		if err := dbDeliveryCollection().Find(bson.M{"_webhook_id": w.ID, "status": DeliveryPending}).One(&d); err != nil {
+			t.Fatalf("Event not queued: %v", err)
+		}
+		//other pending deliveries in the test database may be claimed first
+		for i := 0; i < 100 && deliverNext(); i++ {
+			dbDeliveryCollection().FindId(d.ID).One(&d)
+			if d.Attempts > 0 {
+				break
+			}
+		}
+		return d
+	}
+
+	d := deliver()
+	if d.Status != DeliveryDelivered || d.Attempts != 1 || <-received != event {
+		t.Errorf("Delivery %+v", d)
+	}
+
+	status = http.StatusServiceUnavailable
+	d = deliver()
+	if d.Status != DeliveryPending || d.LastStatus != status || time.Until(d.NextAttempt) < webhookFirstBackoff/2 {
+		t.Errorf("Failed delivery %+v", d)
+	}
+} //TestWebhookDelivery()
+
+func TestStopWebhookDelivery(t *testing.T) {
+	if err := StopWebhookDelivery(context.Background()); err != nil {
+		t.Errorf("Stop without delivery running: %v", err)
+	}
+	testDatabase(t)
+	received := make(chan bool, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received <- true
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+		StopWebhookDelivery(context.Background())
+	})
+
+	event := "test" + bson.NewObjectId().Hex() + ".created"
+	w, err := Webhook{URL: server.URL, Events: []string{event}}.Insert()
+	if err != nil {
+		t.Fatalf("Failed to insert webhook: %v", err)
+	}
+	t.Cleanup(func() {
+		dbWebhookCollection().RemoveId(w.ID)
+		dbDeliveryCollection().RemoveAll(bson.M{"_webhook_id": w.ID})
+	})
+	PublishEvent(event, "", map[string]string{"Name": "jan"})
+	StartWebhookDelivery()
+	StartWebhookDelivery()
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Event not delivered")
+	}
+
+	//stopping waits for the delivery being sent, until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := StopWebhookDelivery(ctx); err == nil {
+		t.Errorf("Stopped while a delivery is being sent")
+	}
+	close(release)
+	d := Delivery{}
+	for i := 0; i < 50; i++ {
+		dbDeliveryCollection().Find(bson.M{"_webhook_id": w.ID}).One(&d)
+		if d.Status == DeliveryDelivered {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if d.Status != DeliveryDelivered {
+		t.Errorf("Delivery in progress not completed after stopping: %+v", d)
+	}
+	if len(received) != 0 {
+		t.Errorf("Delivered again after stopping")
+	}
+
+	//delivery can be started again
+	StartWebhookDelivery()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := StopWebhookDelivery(ctx); err != nil {
+		t.Errorf("Cannot stop after restarting: %v", err)
+	}
+} //TestStopWebhookDelivery()
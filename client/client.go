@@ -0,0 +1,305 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+)
+
+//User is the user as returned by the service
+//TempPassword is only set after Register and Reset
+type User struct {
+	ID              string `json:"_id"`
+	Name            string
+	TempPassword    string `json:",omitempty"`
+	TempExpiry      time.Time
+	Roles           []string
+	Permissions     []string
+	OrganisationIDs []string `json:"_organisation_ids"`
+	Status          string
+}
+
+//Session is a login session, its ID is the bearer token for later requests
+type Session struct {
+	ID        string `json:"_id"`
+	UserID    string `json:"_user_id"`
+	StartTime time.Time
+	LastTime  time.Time
+	Ended     bool
+	TenantID  string `json:"_tenant_id,omitempty"`
+}
+
+//Client calls the auth and item APIs of one service
+//It is safe for concurrent use. After Login or Activate all requests
+//are made with the session, until Logout or SetSession("")
+type Client struct {
+	BaseURL string //e.g. "http://localhost:3000"
+	HTTP    *http.Client
+
+	//Tenant is the organisation id to login to, "" for the user's first organisation
+	Tenant string
+
+	//Retries is the nr of times that idempotent requests (GET, PUT, DELETE)
+	//are retried after a network error or 502/503/504, with RetryDelay doubling each time
+	Retries    int
+	RetryDelay time.Duration
+
+	mutex   sync.Mutex
+	session string
+}
+
+//New makes a client for the service at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTP:       &http.Client{Timeout: 30 * time.Second},
+		Retries:    2,
+		RetryDelay: 200 * time.Millisecond,
+	}
+} //New()
+
+//Session returns the current session id, "" when not logged in
+func (c *Client) Session() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.session
+} //Client.Session()
+
+//SetSession sets the session id to use, e.g. one stored from an earlier login
+func (c *Client) SetSession(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.session = id
+} //Client.SetSession()
+
+//ErrorCode returns the code of an error from the service, "" for other errors
+func ErrorCode(err error) apierror.Code {
+	if e, ok := err.(*apierror.Error); ok {
+		return e.Code
+	}
+	return ""
+} //ErrorCode()
+
+//Register registers a user, the returned user has the temp password to activate with
+func (c *Client) Register(ctx context.Context, name string) (User, error) {
+	u := User{}
+	err := c.do(ctx, http.MethodPost, "/auth/register", nil, map[string]string{"Name": name}, &u)
+	return u, err
+} //Client.Register()
+
+//Reset gives the user a new temp password, to activate with
+func (c *Client) Reset(ctx context.Context, name string) (User, error) {
+	u := User{}
+	err := c.do(ctx, http.MethodPost, "/auth/reset", nil, map[string]string{"Name": name}, &u)
+	return u, err
+} //Client.Reset()
+
+//Activate sets the password with the temp password, then uses the new session
+func (c *Client) Activate(ctx context.Context, name, tempPassword, newPassword string) (Session, error) {
+	s := Session{}
+	err := c.do(ctx, http.MethodPost, "/auth/activate", c.tenantQuery(),
+		map[string]string{"Name": name, "TempPassword": tempPassword, "Password": newPassword}, &s)
+	if err == nil {
+		c.SetSession(s.ID)
+	}
+	return s, err
+} //Client.Activate()
+
+//Login logs in with the password, then uses the new session
+func (c *Client) Login(ctx context.Context, name, password string) (Session, error) {
+	s := Session{}
+	err := c.do(ctx, http.MethodPost, "/auth/login", c.tenantQuery(),
+		map[string]string{"Name": name, "Password": password}, &s)
+	if err == nil {
+		c.SetSession(s.ID)
+	}
+	return s, err
+} //Client.Login()
+
+//Logout ends the current session
+func (c *Client) Logout(ctx context.Context) error {
+	id := c.Session()
+	if id == "" {
+		return nil
+	}
+	if err := c.do(ctx, http.MethodPost, "/auth/logout", nil, map[string]string{"_id": id}, nil); err != nil {
+		return err
+	}
+	c.SetSession("")
+	return nil
+} //Client.Logout()
+
+func (c *Client) tenantQuery() url.Values {
+	if c.Tenant == "" {
+		return nil
+	}
+	return url.Values{"tenant": {c.Tenant}}
+} //Client.tenantQuery()
+
+//Items is the API of an item type added with item.AddItemRoutes, e.g. "person"
+//Items are passed as any JSON encodable value, e.g. a struct like item.Person
+type Items struct {
+	c    *Client
+	name string
+}
+
+//Items returns the API for the item type
+func (c *Client) Items(name string) Items {
+	return Items{c: c, name: name}
+} //Client.Items()
+
+//Create creates the item and decodes the created item (with id) into result, if not nil
+func (it Items) Create(ctx context.Context, item interface{}, result interface{}) error {
+	return it.c.do(ctx, http.MethodPost, "/"+it.name, nil, item, result)
+} //Items.Create()
+
+//Get decodes the item with the id into result
+func (it Items) Get(ctx context.Context, id string, result interface{}) error {
+	return it.c.do(ctx, http.MethodGet, "/"+it.name+"/"+url.PathEscape(id), nil, nil, result)
+} //Items.Get()
+
+//Find decodes the item with the key fields, e.g. {"email":"a@b.c"}, into result
+func (it Items) Find(ctx context.Context, key map[string]string, result interface{}) error {
+	query := url.Values{}
+	for n, v := range key {
+		query.Set(n, v)
+	}
+	return it.c.do(ctx, http.MethodGet, "/"+it.name, query, nil, result)
+} //Items.Find()
+
+//Update replaces the item with the id, item must have the same id
+func (it Items) Update(ctx context.Context, id string, item interface{}) error {
+	return it.c.do(ctx, http.MethodPut, "/"+it.name+"/"+url.PathEscape(id), nil, item, nil)
+} //Items.Update()
+
+//Delete deletes the item with the id
+func (it Items) Delete(ctx context.Context, id string) error {
+	return it.c.do(ctx, http.MethodDelete, "/"+it.name+"/"+url.PathEscape(id), nil, nil, nil)
+} //Items.Delete()
+
+//Call makes a request to an API that has no method here, e.g. the admin API,
+//with body encoded as JSON and the response decoded into result, if not nil
+func (c *Client) Call(ctx context.Context, method, path string, query url.Values, body interface{}, result interface{}) error {
+	return c.do(ctx, method, path, query, body, result)
+} //Client.Call()
+
+//do makes the request with body encoded as JSON, and decodes the response into result
+//errors from the service are returned as *apierror.Error
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, result interface{}) error {
+	var bodyData []byte
+	if body != nil {
+		var err error
+		if bodyData, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("Cannot encode %s %s request: %v", method, path, err)
+		}
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	retries := 0
+	if method == http.MethodGet || method == http.MethodPut || method == http.MethodDelete {
+		retries = c.Retries
+	}
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, u, bodyData)
+		if err == nil && (!retryStatus(res.StatusCode) || attempt >= retries) {
+			return decodeResponse(res, result)
+		}
+		if attempt >= retries {
+			return fmt.Errorf("%s %s failed: %v", method, path, err)
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+} //Client.do()
+
+func (c *Client) send(ctx context.Context, method, u string, bodyData []byte) (*http.Response, error) {
+	var body io.Reader
+	if bodyData != nil {
+		body = bytes.NewReader(bodyData)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if bodyData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s := c.Session(); s != "" {
+		req.Header.Set("Authorization", "Bearer "+s)
+	}
+	return c.HTTP.Do(req)
+} //Client.send()
+
+func retryStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+} //retryStatus()
+
+//decodeResponse decodes a success response into result,
+//or an error response into *apierror.Error
+func decodeResponse(res *http.Response, result interface{}) error {
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response: %v", err)
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		if result == nil || len(bytes.TrimSpace(data)) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(data, result); err != nil {
+			return fmt.Errorf("Invalid JSON response: %v", err)
+		}
+		return nil
+	}
+
+	e := &apierror.Error{}
+	if err := json.Unmarshal(data, e); err != nil || e.Code == "" {
+		//not from the service, e.g. a proxy
+		e = apierror.New(statusCode(res.StatusCode), "%s: %s", res.Status, strings.TrimSpace(string(data)))
+	}
+	return e
+} //decodeResponse()
+
+//statusCode is the general code for the HTTP status of a response without error body
+func statusCode(status int) apierror.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return apierror.BadRequest
+	case http.StatusUnauthorized:
+		return apierror.Unauthorized
+	case http.StatusForbidden:
+		return apierror.Forbidden
+	case http.StatusNotFound:
+		return apierror.NotFound
+	case http.StatusConflict:
+		return apierror.Conflict
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return apierror.Unavailable
+	default:
+		return apierror.Internal
+	}
+} //statusCode()
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+)
+
+//testService records the requests and answers with the handler
+type testService struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   []map[string]string
+}
+
+func newTestService(t *testing.T, h http.HandlerFunc) *testService {
+	s := &testService{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(req.Body).Decode(&body)
+		s.mutex.Lock()
+		s.requests = append(s.requests, req)
+		s.bodies = append(s.bodies, body)
+		s.mutex.Unlock()
+		h(res, req)
+	}))
+	t.Cleanup(s.Close)
+	return s
+} //newTestService()
+
+func (s *testService) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.requests)
+} //testService.count()
+
+func (s *testService) last() (*http.Request, map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[len(s.requests)-1], s.bodies[len(s.bodies)-1]
+} //testService.last()
+
+func newTestClient(s *testService) *Client {
+	c := New(s.URL + "/")
+	c.RetryDelay = time.Millisecond
+	return c
+} //newTestClient()
+
+func TestLoginSession(t *testing.T) {
+	s := newTestService(t, func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/auth/login":
+			json.NewEncoder(res).Encode(Session{ID: "5f0000000000000000000001", UserID: "5f0000000000000000000002"})
+		case "/person/a b":
+			json.NewEncoder(res).Encode(map[string]string{"Name": "Jan"})
+		case "/auth/logout":
+		default:
+			http.NotFound(res, req)
+		}
+	})
+	c := newTestClient(s)
+	c.Tenant = "5f0000000000000000000003"
+	ctx := context.Background()
+
+	session, err := c.Login(ctx, "jan@example.com", "secret")
+	if err != nil || session.ID != "5f0000000000000000000001" || c.Session() != session.ID {
+		t.Fatalf("Login = %+v, %v", session, err)
+	}
+	req, body := s.last()
+	if req.Method != http.MethodPost || req.URL.Query().Get("tenant") != c.Tenant || body["Name"] != "jan@example.com" || body["Password"] != "secret" {
+		t.Errorf("Login sent %s %s %v", req.Method, req.URL, body)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("Login sent Authorization %s", req.Header.Get("Authorization"))
+	}
+
+	person := map[string]string{}
+	if err := c.Items("person").Get(ctx, "a b", &person); err != nil || person["Name"] != "Jan" {
+		t.Errorf("Get = %v, %v", person, err)
+	}
+	req, _ = s.last()
+	if req.Header.Get("Authorization") != "Bearer "+session.ID || req.URL.EscapedPath() != "/person/a%20b" {
+		t.Errorf("Get sent %s with Authorization %s", req.URL.EscapedPath(), req.Header.Get("Authorization"))
+	}
+
+	if err := c.Logout(ctx); err != nil || c.Session() != "" {
+		t.Errorf("Logout = %v, session %q", err, c.Session())
+	}
+	if _, body := s.last(); body["_id"] != session.ID {
+		t.Errorf("Logout sent %v", body)
+	}
+	n := s.count()
+	if err := c.Logout(ctx); err != nil || s.count() != n {
+		t.Errorf("Logout without session = %v after %d requests", err, s.count()-n)
+	}
+} //TestLoginSession()
+
+func TestErrors(t *testing.T) {
+	s := newTestService(t, func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/auth/login":
+			apierror.Writef(res, req, apierror.AuthWrongPassword, "Wrong password")
+		case "/proxy":
+			res.WriteHeader(http.StatusForbidden)
+			res.Write([]byte("blocked by proxy\n"))
+		case "/invalid":
+			res.Write([]byte("{not json"))
+		}
+	})
+	c := newTestClient(s)
+	ctx := context.Background()
+
+	_, err := c.Login(ctx, "jan@example.com", "wrong")
+	if ErrorCode(err) != apierror.AuthWrongPassword || err.Error() != "Wrong password" || c.Session() != "" {
+		t.Errorf("Login with wrong password = %v (%s)", err, ErrorCode(err))
+	}
+	err = c.Call(ctx, http.MethodGet, "/proxy", nil, nil, nil)
+	if ErrorCode(err) != apierror.Forbidden || err.Error() != "403 Forbidden: blocked by proxy" {
+		t.Errorf("Error from proxy = %v (%s)", err, ErrorCode(err))
+	}
+	result := map[string]string{}
+	if err := c.Call(ctx, http.MethodGet, "/invalid", nil, nil, &result); err == nil || ErrorCode(err) != "" {
+		t.Errorf("Invalid response = %v", err)
+	}
+	if err := c.Call(ctx, http.MethodGet, "/invalid", nil, nil, nil); err != nil {
+		t.Errorf("Ignored response = %v", err)
+	}
+	if ErrorCode(context.Canceled) != "" {
+		t.Errorf("ErrorCode of another error")
+	}
+} //TestErrors()
+
+func TestRetries(t *testing.T) {
+	failures := 0
+	var mutex sync.Mutex
+	s := newTestService(t, func(res http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		res.Write([]byte(`{"Name":"Jan"}`))
+	})
+	setFailures := func(n int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failures = n
+	}
+	c := newTestClient(s)
+	ctx := context.Background()
+	person := map[string]string{}
+
+	//GET is retried
+	setFailures(2)
+	n := s.count()
+	if err := c.Items("person").Get(ctx, "1", &person); err != nil || s.count()-n != 3 {
+		t.Errorf("Get after 2 failures = %v in %d requests", err, s.count()-n)
+	}
+	setFailures(3)
+	n = s.count()
+	if err := c.Items("person").Get(ctx, "1", &person); ErrorCode(err) != apierror.Unavailable || s.count()-n != 3 {
+		t.Errorf("Get after 3 failures = %v in %d requests", err, s.count()-n)
+	}
+
+	//POST is not
+	setFailures(1)
+	n = s.count()
+	if err := c.Items("person").Create(ctx, person, nil); ErrorCode(err) != apierror.Unavailable || s.count()-n != 1 {
+		t.Errorf("Create after a failure = %v in %d requests", err, s.count()-n)
+	}
+
+	//a cancelled context stops retrying
+	setFailures(10)
+	c.RetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	if err := c.Items("person").Delete(ctx, "1"); err != context.DeadlineExceeded {
+		t.Errorf("Delete with deadline = %v", err)
+	}
+} //TestRetries()
+
+func TestNetworkError(t *testing.T) {
+	s := newTestService(t, func(res http.ResponseWriter, req *http.Request) {})
+	c := newTestClient(s)
+	s.Close()
+	err := c.Items("person").Find(context.Background(), map[string]string{"email": "a@b.c"}, nil)
+	if err == nil || ErrorCode(err) != "" {
+		t.Errorf("Find without service = %v", err)
+	}
+	//New trims the "/" that newTestClient adds
+	if c.BaseURL != s.URL {
+		t.Errorf("BaseURL %s", c.BaseURL)
+	}
+} //TestNetworkError()
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/jansemmelink/auth2/auth"
+	"github.com/jansemmelink/auth2/client"
+	"github.com/jansemmelink/auth2/item"
+)
+
+//apiBackend uses the admin API of a running service, with the permissions of its session
+type apiBackend struct {
+	c *client.Client
+}
+
+//the admin API pages lists with at most this many entries
+const apiPageSize = 100
+
+var regexObjectID = regexp.MustCompile("^[0-9a-fA-F]{24}$")
+
+//newAPIBackend uses the session, or logs in with the name and password when name is specified,
+//to the tenant (organisation id) or "" for the user's first organisation
+func newAPIBackend(baseURL, session, name, password, tenant string) (backend, error) {
+	c := client.New(baseURL)
+	c.Tenant = tenant
+	if name != "" {
+		if _, err := c.Login(context.Background(), name, password); err != nil {
+			return nil, fmt.Errorf("cannot login as %s: %v", name, err)
+		}
+	} else if session != "" {
+		c.SetSession(session)
+	} else {
+		return nil, fmt.Errorf("-api needs -session or -user")
+	}
+	return apiBackend{c: c}, nil
+} //newAPIBackend()
+
+func (b apiBackend) call(method, path string, query url.Values, body interface{}) (interface{}, error) {
+	var result interface{}
+	if err := b.c.Call(context.Background(), method, path, query, body, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+} //apiBackend.call()
+
+//userID finds the user by id or else by exact name, because the admin API only takes ids
+func (b apiBackend) userID(user string) (string, error) {
+	if regexObjectID.MatchString(user) {
+		return user, nil
+	}
+	name := auth.NormaliseName(user)
+	list := struct {
+		Users []struct {
+			ID   string `json:"_id"`
+			Name string
+		}
+	}{}
+	query := url.Values{"q": {name}, "size": {strconv.Itoa(apiPageSize)}}
+	if err := b.c.Call(context.Background(), http.MethodGet, "/admin/users", query, nil, &list); err != nil {
+		return "", err
+	}
+	for _, u := range list.Users {
+		if u.Name == name {
+			return u.ID, nil
+		}
+	}
+	return "", fmt.Errorf("unknown user %s", user)
+} //apiBackend.userID()
+
+//userPath is the admin API path of the user, with more path appended
+func (b apiBackend) userPath(user, more string) (string, error) {
+	id, err := b.userID(user)
+	if err != nil {
+		return "", err
+	}
+	return "/admin/users/" + url.PathEscape(id) + more, nil
+} //apiBackend.userPath()
+
+//listUsers gets all pages, so the output is the same as from the stores
+func (b apiBackend) listUsers(search string) (interface{}, error) {
+	all := []interface{}{}
+	total := 0
+	for page := 0; page == 0 || len(all) < total; page++ {
+		list := struct {
+			Total int
+			Users []interface{}
+		}{}
+		query := url.Values{"q": {search}, "page": {strconv.Itoa(page)}, "size": {strconv.Itoa(apiPageSize)}}
+		if err := b.c.Call(context.Background(), http.MethodGet, "/admin/users", query, nil, &list); err != nil {
+			return nil, err
+		}
+		if len(list.Users) == 0 {
+			break
+		}
+		all = append(all, list.Users...)
+		total = list.Total
+	}
+	return map[string]interface{}{"Total": len(all), "Users": all}, nil
+} //apiBackend.listUsers()
+
+func (b apiBackend) getUser(user string) (interface{}, error) {
+	path, err := b.userPath(user, "")
+	if err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodGet, path, nil, nil)
+} //apiBackend.getUser()
+
+func (b apiBackend) createUser(name string) (interface{}, error) {
+	return b.call(http.MethodPost, "/auth/register", nil, map[string]string{"Name": name})
+} //apiBackend.createUser()
+
+//activateUser resets the password and activates with the temp password,
+//using another client so that this session is not replaced by the user's session
+func (b apiBackend) activateUser(user, password string) (interface{}, error) {
+	path, err := b.userPath(user, "")
+	if err != nil {
+		return nil, err
+	}
+	reset := client.User{}
+	if err := b.c.Call(context.Background(), http.MethodPost, path+"/reset", nil, nil, &reset); err != nil {
+		return nil, err
+	}
+	if _, err := client.New(b.c.BaseURL).Activate(context.Background(), reset.Name, reset.TempPassword, password); err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodGet, path, nil, nil)
+} //apiBackend.activateUser()
+
+func (b apiBackend) disableUser(user string) (interface{}, error) {
+	path, err := b.userPath(user, "/disable")
+	if err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodPost, path, nil, nil)
+} //apiBackend.disableUser()
+
+func (b apiBackend) enableUser(user string) (interface{}, error) {
+	path, err := b.userPath(user, "/enable")
+	if err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodPost, path, nil, nil)
+} //apiBackend.enableUser()
+
+func (b apiBackend) deleteUser(user string) error {
+	path, err := b.userPath(user, "")
+	if err != nil {
+		return err
+	}
+	return b.c.Call(context.Background(), http.MethodDelete, path, nil, nil, nil)
+} //apiBackend.deleteUser()
+
+func (b apiBackend) resetPassword(user string) (interface{}, error) {
+	path, err := b.userPath(user, "/reset")
+	if err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodPost, path, nil, nil)
+} //apiBackend.resetPassword()
+
+func (b apiBackend) listSessions(user string) (interface{}, error) {
+	path, err := b.userPath(user, "/sessions")
+	if err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodGet, path, nil, nil)
+} //apiBackend.listSessions()
+
+func (b apiBackend) endSessions(user string) (interface{}, error) {
+	path, err := b.userPath(user, "/sessions")
+	if err != nil {
+		return nil, err
+	}
+	return b.call(http.MethodDelete, path, nil, nil)
+} //apiBackend.endSessions()
+
+func (b apiBackend) listRoles() (interface{}, error) {
+	return b.call(http.MethodGet, "/auth/roles", nil, nil)
+} //apiBackend.listRoles()
+
+func (b apiBackend) saveRole(r auth.Role) (interface{}, error) {
+	return b.call(http.MethodPost, "/auth/roles", nil, r)
+} //apiBackend.saveRole()
+
+func (b apiBackend) deleteRole(name string) error {
+	return b.c.Call(context.Background(), http.MethodDelete, "/auth/roles/"+url.PathEscape(name), nil, nil, nil)
+} //apiBackend.deleteRole()
+
+func (b apiBackend) listClients() (interface{}, error) {
+	return b.call(http.MethodGet, "/admin/clients", nil, nil)
+} //apiBackend.listClients()
+
+func (b apiBackend) createClient(name string) (interface{}, error) {
+	return b.call(http.MethodPost, "/admin/clients", nil, map[string]string{"Name": name})
+} //apiBackend.createClient()
+
+func (b apiBackend) deleteClient(id string) error {
+	return b.c.Call(context.Background(), http.MethodDelete, "/admin/clients/"+url.PathEscape(id), nil, nil, nil)
+} //apiBackend.deleteClient()
+
+//createPerson creates the person in the tenant of the session,
+//which is chosen at login with $AUTHCTL_TENANT
+func (b apiBackend) createPerson(tenant string, p item.Person) (interface{}, error) {
+	if tenant != "" {
+		return nil, fmt.Errorf("with -api persons are created in the tenant of the session, login with $AUTHCTL_TENANT instead")
+	}
+	var result interface{}
+	if err := b.c.Items("person").Create(context.Background(), p, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+} //apiBackend.createPerson()
+
+func (b apiBackend) audit(filter url.Values, size int) (interface{}, error) {
+	if size > apiPageSize {
+		return nil, fmt.Errorf("with -api audit size must be at most %d", apiPageSize)
+	}
+	filter.Set("size", strconv.Itoa(size))
+	return b.call(http.MethodGet, "/admin/audit", filter, nil)
+} //apiBackend.audit()
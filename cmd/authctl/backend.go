@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jansemmelink/auth2/auth"
+	"github.com/jansemmelink/auth2/item"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//backend does the work of the commands, either on the stores or through the API
+//results are printed as their JSON encoding, which is the same for both
+type backend interface {
+	userID(user string) (string, error)
+	listUsers(search string) (interface{}, error)
+	getUser(user string) (interface{}, error)
+	createUser(name string) (interface{}, error)
+	activateUser(user, password string) (interface{}, error)
+	disableUser(user string) (interface{}, error)
+	enableUser(user string) (interface{}, error)
+	deleteUser(user string) error
+	resetPassword(user string) (interface{}, error)
+	listSessions(user string) (interface{}, error)
+	endSessions(user string) (interface{}, error)
+	listRoles() (interface{}, error)
+	saveRole(r auth.Role) (interface{}, error)
+	deleteRole(name string) error
+	listClients() (interface{}, error)
+	createClient(name string) (interface{}, error)
+	deleteClient(id string) error
+	createPerson(tenant string, p item.Person) (interface{}, error)
+	audit(filter url.Values, size int) (interface{}, error)
+}
+
+//storeBackend works directly on the stores, it needs the same mongo access as the service.
+//Changes are attributed to the administrator from -as, who needs the permission
+//that the admin API requires for the change, and are audited like changes through the API
+type storeBackend struct {
+	by auth.User
+}
+
+//admin returns the administrator to attribute a change to, if allowed to make it
+func (b storeBackend) admin(permission string) (auth.User, error) {
+	if !b.by.ID.Valid() {
+		return auth.User{}, fmt.Errorf("changes on the stores need -as <administrator>")
+	}
+	if b.by.Status != auth.StatusActive || !auth.HasPermission(b.by.EffectivePermissions(), permission) {
+		return auth.User{}, fmt.Errorf("%s is not an active user with permission %s", b.by.Name, permission)
+	}
+	return b.by, nil
+} //storeBackend.admin()
+
+func (storeBackend) userID(user string) (string, error) {
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return "", fmt.Errorf("unknown user %s", user)
+	}
+	return u.ID.Hex(), nil
+} //storeBackend.userID()
+
+func (storeBackend) listUsers(search string) (interface{}, error) {
+	list, err := auth.ListUsers(search, 0, 100)
+	if err == nil && list.Total > len(list.Users) {
+		list, err = auth.ListUsers(search, 0, list.Total)
+	}
+	return list, err
+} //storeBackend.listUsers()
+
+func (storeBackend) getUser(user string) (interface{}, error) {
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	return auth.UserDetails(u), nil
+} //storeBackend.getUser()
+
+func (b storeBackend) createUser(name string) (interface{}, error) {
+	admin, err := b.admin("user:write")
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.NewUser(name)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditRegister, UserID: u.ID, Name: u.Name, By: admin.ID, Detail: "by authctl"}, err)
+	return u, err
+} //storeBackend.createUser()
+
+func (b storeBackend) activateUser(user, password string) (interface{}, error) {
+	admin, err := b.admin("user:write")
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	activated, err := u.Activate(password)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditActivate, UserID: u.ID, Name: u.Name, By: admin.ID, Detail: "by authctl"}, err)
+	if err != nil {
+		return nil, err
+	}
+	return auth.UserDetails(activated), nil
+} //storeBackend.activateUser()
+
+//setStatus changes the status of the user as the admin API does
+func (b storeBackend) setStatus(user string, to func(auth.User) string, reason string) (interface{}, error) {
+	admin, err := b.admin("user:write")
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	status := to(u)
+	if status != auth.StatusActive && status != auth.StatusPendingActivation {
+		if _, err := auth.EndUserSessions(u.ID); err != nil {
+			return nil, err
+		}
+	}
+	changed, err := u.SetStatus(status, reason, admin.ID)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditStatus, UserID: u.ID, Name: u.Name, By: admin.ID,
+		Detail: fmt.Sprintf("%s to %s: %s", u.Status, status, reason)}, err)
+	if err != nil {
+		return nil, err
+	}
+	return auth.UserDetails(changed), nil
+} //storeBackend.setStatus()
+
+func (b storeBackend) disableUser(user string) (interface{}, error) {
+	return b.setStatus(user, func(auth.User) string { return auth.StatusDisabled }, "disabled by authctl")
+} //storeBackend.disableUser()
+
+func (b storeBackend) enableUser(user string) (interface{}, error) {
+	return b.setStatus(user, func(u auth.User) string {
+		if u.Password == "" {
+			return auth.StatusPendingActivation
+		}
+		return auth.StatusActive
+	}, "enabled by authctl")
+} //storeBackend.enableUser()
+
+func (b storeBackend) deleteUser(user string) error {
+	admin, err := b.admin("user:write")
+	if err != nil {
+		return err
+	}
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return fmt.Errorf("unknown user %s", user)
+	}
+	if u.ID == admin.ID {
+		return fmt.Errorf("cannot delete yourself")
+	}
+	err = auth.DeleteUser(u, admin.ID)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditDelete, UserID: u.ID, Name: u.Name, By: admin.ID, Detail: "by authctl"}, err)
+	return err
+} //storeBackend.deleteUser()
+
+func (b storeBackend) resetPassword(user string) (interface{}, error) {
+	admin, err := b.admin("user:write")
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	u, err = u.ResetPassword()
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditReset, UserID: u.ID, Name: u.Name, By: admin.ID, Detail: "by authctl"}, err)
+	if err != nil {
+		return nil, err
+	}
+	//same fields as the admin API, without the password hash
+	return map[string]interface{}{
+		"_id":          u.ID,
+		"Name":         u.Name,
+		"TempPassword": u.TempPassword,
+		"TempExpiry":   u.TempExpiry,
+	}, nil
+} //storeBackend.resetPassword()
+
+func (storeBackend) listSessions(user string) (interface{}, error) {
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	return auth.UserSessions(u.ID)
+} //storeBackend.listSessions()
+
+func (b storeBackend) endSessions(user string) (interface{}, error) {
+	admin, err := b.admin("user:write")
+	if err != nil {
+		return nil, err
+	}
+	u, err := auth.FindUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	n, err := auth.EndUserSessions(u.ID)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditSessions, UserID: u.ID, Name: u.Name, By: admin.ID, Detail: fmt.Sprintf("ended %d sessions by authctl", n)}, err)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"Ended": n}, nil
+} //storeBackend.endSessions()
+
+func (storeBackend) listRoles() (interface{}, error) {
+	return auth.ListRoles()
+} //storeBackend.listRoles()
+
+func (b storeBackend) saveRole(r auth.Role) (interface{}, error) {
+	admin, err := b.admin("role:write")
+	if err != nil {
+		return nil, err
+	}
+	err = r.Save()
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditRole, By: admin.ID, Detail: fmt.Sprintf("saved %s %v by authctl", r.Name, r.Permissions)}, err)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+} //storeBackend.saveRole()
+
+func (b storeBackend) deleteRole(name string) error {
+	admin, err := b.admin("role:write")
+	if err != nil {
+		return err
+	}
+	err = auth.DeleteRole(name)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditRole, By: admin.ID, Detail: "deleted " + name + " by authctl"}, err)
+	return err
+} //storeBackend.deleteRole()
+
+func (storeBackend) listClients() (interface{}, error) {
+	return auth.ListClients()
+} //storeBackend.listClients()
+
+func (b storeBackend) createClient(name string) (interface{}, error) {
+	admin, err := b.admin("client:write")
+	if err != nil {
+		return nil, err
+	}
+	c, err := auth.Client{Name: name}.Insert()
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditClient, By: admin.ID, Detail: "created " + name + " " + c.ID.Hex() + " by authctl"}, err)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+} //storeBackend.createClient()
+
+func (b storeBackend) deleteClient(id string) error {
+	admin, err := b.admin("client:write")
+	if err != nil {
+		return err
+	}
+	err = auth.DeleteClient(id)
+	auth.AuditChange(nil, auth.AuditEvent{Event: auth.AuditClient, By: admin.ID, Detail: "deleted " + id + " by authctl"}, err)
+	return err
+} //storeBackend.deleteClient()
+
+func (b storeBackend) createPerson(tenant string, p item.Person) (interface{}, error) {
+	if _, err := b.admin("person:write"); err != nil {
+		return nil, err
+	}
+	if err := item.Connect(); err != nil {
+		return nil, err
+	}
+	return item.Person{}.New(tenant, &p)
+} //storeBackend.createPerson()
+
+func (storeBackend) audit(filter url.Values, size int) (interface{}, error) {
+	f := auth.AuditFilter{
+		Event:   filter.Get("event"),
+		Outcome: filter.Get("outcome"),
+		Name:    filter.Get("name"),
+		IP:      filter.Get("ip"),
+	}
+	if id := filter.Get("_user_id"); id != "" {
+		f.UserID = bson.ObjectIdHex(id)
+	}
+	for param, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := filter.Get(param); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("audit %s=%s must be RFC3339 time", param, v)
+			}
+		}
+	}
+	return auth.SearchAudit(f, 0, size)
+} //storeBackend.audit()
@@ -0,0 +1,281 @@
+//authctl administers the auth service from the command line,
+//either directly on the stores (the same mongo databases that the service uses,
+//from the same config file and AUTH2_ environment variables) or through the admin API of a running service (-api), e.g.
+//
+//	authctl -as admin user create jan@example.com
+//	authctl -api http://localhost:3000 -user admin -o json user list jan
+//
+//Changes on the stores are attributed to the administrator from -as and audited.
+//Passwords are never arguments, they are read from the environment or stdin, e.g.
+//
+//	AUTHCTL_NEW_PASSWORD=... authctl -as admin user activate jan@example.com
+//
+//Run without arguments for the list of commands.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	logger "bitbucket.org/conorit/golib-logger"
+	"github.com/jansemmelink/auth2/auth"
+	"github.com/jansemmelink/auth2/client"
+	"github.com/jansemmelink/auth2/config"
+	"github.com/jansemmelink/auth2/item"
+)
+
+//command is one authctl command, named by its first one or two arguments
+type command struct {
+	args    string   //usage of the arguments
+	minArgs int      //nr of required arguments
+	help    string   //one line description
+	columns []string //table output, from the JSON field names
+	run     func(b backend, args []string) (interface{}, error)
+}
+
+var (
+	userColumns    = []string{"_id", "Name", "Status", "Roles"}
+	tempColumns    = []string{"_id", "Name", "TempPassword", "TempExpiry"}
+	sessionColumns = []string{"_id", "StartTime", "LastTime", "_tenant_id"}
+	roleColumns    = []string{"Name", "Permissions", "BuiltIn"}
+	clientColumns  = []string{"_id", "Name", "Secret"}
+)
+
+var commands = map[string]command{
+	"user list": {args: "[search]", help: "List users with names containing search", columns: userColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.listUsers(optional(args, 0)) }},
+	"user get": {args: "<user>", minArgs: 1, help: "Show a user", columns: append(userColumns, "Permissions", "ActiveSessions"),
+		run: func(b backend, args []string) (interface{}, error) { return b.getUser(args[0]) }},
+	"user create": {args: "<name>", minArgs: 1, help: "Create a user with a temp password to activate with", columns: tempColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.createUser(args[0]) }},
+	"user activate": {args: "<user>", minArgs: 1, help: "Set the password from $AUTHCTL_NEW_PASSWORD or the first line of stdin and make the user active", columns: userColumns,
+		run: func(b backend, args []string) (interface{}, error) {
+			password, err := newPassword(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return b.activateUser(args[0], password)
+		}},
+	"user disable": {args: "<user>", minArgs: 1, help: "Disable a user and end its sessions", columns: userColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.disableUser(args[0]) }},
+	"user enable": {args: "<user>", minArgs: 1, help: "Enable a disabled user", columns: userColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.enableUser(args[0]) }},
+	"user delete": {args: "<user>", minArgs: 1, help: "Delete a user and end its sessions",
+		run: func(b backend, args []string) (interface{}, error) { return nil, b.deleteUser(args[0]) }},
+	"user reset": {args: "<user>", minArgs: 1, help: "Replace the password with a temp password and end all sessions", columns: tempColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.resetPassword(args[0]) }},
+	"session list": {args: "<user>", minArgs: 1, help: "List the active sessions of a user", columns: sessionColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.listSessions(args[0]) }},
+	"session end": {args: "<user>", minArgs: 1, help: "End all sessions of a user", columns: []string{"Ended"},
+		run: func(b backend, args []string) (interface{}, error) { return b.endSessions(args[0]) }},
+	"role list": {help: "List roles", columns: roleColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.listRoles() }},
+	"role save": {args: "<name> <permission>...", minArgs: 2, help: "Create or replace a role", columns: roleColumns,
+		run: func(b backend, args []string) (interface{}, error) {
+			return b.saveRole(auth.Role{Name: args[0], Permissions: args[1:]})
+		}},
+	"role delete": {args: "<name>", minArgs: 1, help: "Delete a role",
+		run: func(b backend, args []string) (interface{}, error) { return nil, b.deleteRole(args[0]) }},
+	"client list": {help: "List OAuth clients", columns: clientColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.listClients() }},
+	"client create": {args: "<name>", minArgs: 1, help: "Create an OAuth client, the secret is only shown now", columns: clientColumns,
+		run: func(b backend, args []string) (interface{}, error) { return b.createClient(args[0]) }},
+	"client delete": {args: "<id>", minArgs: 1, help: "Delete an OAuth client",
+		run: func(b backend, args []string) (interface{}, error) { return nil, b.deleteClient(args[0]) }},
+	"person seed": {args: "<file> [tenant]", minArgs: 1, help: "Create the persons in a JSON file with a list of persons", columns: []string{"_id", "_tenant_id", "Names"},
+		run: seedPersons},
+	"audit": {args: "[event|outcome|name|ip|user|from|to|size=value]...", help: "Print audit events, newest first",
+		columns: []string{"Seq", "Time", "Event", "Outcome", "Name", "IP", "Detail"},
+		run:     printAudit},
+}
+
+func main() {
+	configPtr := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "Config file of the service, for the stores")
+	apiPtr := flag.String("api", "", "Base URL of the service to use through its admin API, default the stores directly")
+	sessionPtr := flag.String("session", os.Getenv("AUTHCTL_SESSION"), "Session id for -api, default $AUTHCTL_SESSION")
+	asPtr := flag.String("as", os.Getenv("AUTHCTL_AS"), "Administrator (user id or name) to attribute changes on the stores to, default $AUTHCTL_AS")
+	userPtr := flag.String("user", "", "Login to -api as this user instead of using -session, with password $AUTHCTL_PASSWORD and organisation $AUTHCTL_TENANT")
+	outputPtr := flag.String("o", "table", "Output format: table or json")
+	debugBoolPtr := flag.Bool("d", false, "Debug")
+	flag.Usage = usage
+	flag.Parse()
+	if *debugBoolPtr {
+		logger.SetDefaultLevel(logger.LevelDebug)
+	}
+	if *outputPtr != "table" && *outputPtr != "json" {
+		fail(fmt.Errorf("unknown output format \"%s\", expecting table or json", *outputPtr))
+	}
+
+	name, cmd, args, ok := findCommand(flag.Args())
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if len(args) < cmd.minArgs {
+		fmt.Fprintf(os.Stderr, "usage: authctl %s %s\n", name, cmd.args)
+		os.Exit(2)
+	}
+
+	var b backend = storeBackend{}
+	if *apiPtr == "" {
+		cfg, err := config.Load(*configPtr, nil)
+		if err != nil {
+			fail(err)
+		}
+		auth.Configure(cfg.Auth)
+		item.Configure(cfg.Item)
+		if err := auth.Connect(); err != nil {
+			fail(err)
+		}
+		if *asPtr != "" {
+			admin, err := auth.FindUser(*asPtr)
+			if err != nil {
+				fail(fmt.Errorf("unknown administrator %s", *asPtr))
+			}
+			b = storeBackend{by: admin}
+		}
+	} else {
+		var err error
+		if b, err = newAPIBackend(*apiPtr, *sessionPtr, *userPtr, os.Getenv("AUTHCTL_PASSWORD"), os.Getenv("AUTHCTL_TENANT")); err != nil {
+			fail(err)
+		}
+	}
+	result, err := cmd.run(b, args)
+	if err != nil {
+		fail(err)
+	}
+	if err := writeOutput(os.Stdout, *outputPtr, result, cmd.columns); err != nil {
+		fail(err)
+	}
+} //main()
+
+//findCommand finds the command named by the first one or two arguments
+//and returns the remaining arguments
+func findCommand(args []string) (string, command, []string, bool) {
+	if len(args) >= 2 {
+		if cmd, ok := commands[args[0]+" "+args[1]]; ok {
+			return args[0] + " " + args[1], cmd, args[2:], true
+		}
+	}
+	if len(args) >= 1 {
+		if cmd, ok := commands[args[0]]; ok {
+			return args[0], cmd, args[1:], true
+		}
+	}
+	return "", command{}, nil, false
+} //findCommand()
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: authctl [options] <command> [arguments]\n\noptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands (<user> is a user id or name):\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n      %s\n", name, commands[name].args, commands[name].help)
+	}
+} //usage()
+
+func fail(err error) {
+	if code := client.ErrorCode(err); code != "" {
+		fmt.Fprintf(os.Stderr, "authctl: %s: %v\n", code, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "authctl: %v\n", err)
+	os.Exit(1)
+} //fail()
+
+func optional(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+} //optional()
+
+//newPassword reads the new password for the user from $AUTHCTL_NEW_PASSWORD,
+//or else from the first line of stdin, so it is not in the process list or shell history
+func newPassword(user string) (string, error) {
+	if password := os.Getenv("AUTHCTL_NEW_PASSWORD"); password != "" {
+		return password, nil
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintf(os.Stderr, "New password for %s (shown as typed, rather pipe it in): ", user)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("cannot read the password: %v", err)
+		}
+		return "", fmt.Errorf("no password in $AUTHCTL_NEW_PASSWORD or on stdin")
+	}
+	return password, nil
+} //newPassword()
+
+//seedPersons creates the persons listed in a JSON file, e.g.
+//
+//	[{"Names":["Jan","Semmelink"]},{"Names":["Piet"]}]
+//
+//stopping at the first person that fails
+func seedPersons(b backend, args []string) (interface{}, error) {
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", args[0], err)
+	}
+	persons := []item.Person{}
+	if err := json.Unmarshal(data, &persons); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON list of persons: %v", args[0], err)
+	}
+	created := []interface{}{}
+	for i, p := range persons {
+		c, err := b.createPerson(optional(args, 1), p)
+		if err != nil {
+			return created, fmt.Errorf("failed on person %d after creating %d: %v", i+1, len(created), err)
+		}
+		created = append(created, c)
+	}
+	return created, nil
+} //seedPersons()
+
+//printAudit parses the filter arguments as the URL parameters of GET /admin/audit,
+//with user being a user id or name, and size the nr of events (default 20)
+func printAudit(b backend, args []string) (interface{}, error) {
+	filter := url.Values{}
+	size := 20
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("audit filter \"%s\" is not name=value", arg)
+		}
+		switch parts[0] {
+		case "event", "outcome", "name", "ip", "from", "to":
+			filter.Set(parts[0], parts[1])
+		case "user":
+			id, err := b.userID(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			filter.Set("_user_id", id)
+		case "size":
+			var err error
+			if size, err = strconv.Atoi(parts[1]); err != nil || size < 1 {
+				return nil, fmt.Errorf("audit size=%s must be a number > 0", parts[1])
+			}
+		default:
+			return nil, fmt.Errorf("unknown audit filter \"%s\"", parts[0])
+		}
+	}
+	return b.audit(filter, size)
+} //printAudit()
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/auth2/auth"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFindCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		name string
+		rest []string
+		ok   bool
+	}{
+		{[]string{"user", "get", "jan"}, "user get", []string{"jan"}, true},
+		{[]string{"audit", "event=login"}, "audit", []string{"event=login"}, true},
+		{[]string{"role", "list"}, "role list", []string{}, true},
+		{[]string{"user"}, "", nil, false},
+		{[]string{"user", "fly"}, "", nil, false},
+		{nil, "", nil, false},
+	} {
+		name, _, rest, ok := findCommand(tc.args)
+		if name != tc.name || ok != tc.ok || (ok && !reflect.DeepEqual(rest, tc.rest)) {
+			t.Errorf("findCommand(%v)=%q %v %v, want %q %v %v", tc.args, name, rest, ok, tc.name, tc.rest, tc.ok)
+		}
+	}
+} //TestFindCommand()
+
+//withStdin replaces stdin with the text for the test
+func withStdin(t *testing.T, text string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to make pipe: %v", err)
+	}
+	w.WriteString(text)
+	w.Close()
+	saved := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = saved
+		r.Close()
+	})
+} //withStdin()
+
+func TestNewPassword(t *testing.T) {
+	t.Setenv("AUTHCTL_NEW_PASSWORD", "")
+	withStdin(t, "Secret123\r\nmore\n")
+	if p, err := newPassword("jan"); err != nil || p != "Secret123" {
+		t.Errorf("Password from stdin %q, %v", p, err)
+	}
+
+	withStdin(t, "Secret123")
+	if p, err := newPassword("jan"); err != nil || p != "Secret123" {
+		t.Errorf("Password from stdin without newline %q, %v", p, err)
+	}
+
+	withStdin(t, "")
+	if _, err := newPassword("jan"); err == nil {
+		t.Errorf("Empty password accepted")
+	}
+
+	t.Setenv("AUTHCTL_NEW_PASSWORD", "FromEnv123")
+	withStdin(t, "Secret123\n")
+	if p, err := newPassword("jan"); err != nil || p != "FromEnv123" {
+		t.Errorf("Password from environment %q, %v", p, err)
+	}
+
+	if cmd := commands["user activate"]; cmd.minArgs != 1 || strings.Contains(cmd.args, "password") {
+		t.Errorf("user activate takes the password as argument: %s", cmd.args)
+	}
+} //TestNewPassword()
+
+func TestStoreBackendAdmin(t *testing.T) {
+	admin := auth.User{ID: bson.NewObjectId(), Name: "admin", Status: auth.StatusActive, Roles: []string{auth.RoleAdmin}}
+	if by, err := (storeBackend{by: admin}).admin("user:write"); err != nil || by.ID != admin.ID {
+		t.Errorf("Admin not allowed: %v", err)
+	}
+
+	own := auth.User{ID: bson.NewObjectId(), Name: "own", Status: auth.StatusActive, Roles: []string{auth.RoleUser}, Permissions: []string{"user:write"}}
+	if _, err := (storeBackend{by: own}).admin("user:write"); err != nil {
+		t.Errorf("User with own permission not allowed: %v", err)
+	}
+	if _, err := (storeBackend{by: own}).admin("role:write"); err == nil {
+		t.Errorf("User allowed without the permission")
+	}
+
+	disabled := admin
+	disabled.Status = auth.StatusDisabled
+	if _, err := (storeBackend{by: disabled}).admin("user:write"); err == nil {
+		t.Errorf("Disabled admin allowed")
+	}
+
+	//without -as, changes fail before the stores are used
+	b := storeBackend{}
+	if _, err := b.admin("user:write"); err == nil || !strings.Contains(err.Error(), "-as") {
+		t.Errorf("Change without -as: %v", err)
+	}
+	if err := b.deleteUser("jan"); err == nil {
+		t.Errorf("Deleted without -as")
+	}
+	if _, err := b.disableUser("jan"); err == nil {
+		t.Errorf("Disabled without -as")
+	}
+	if _, err := b.saveRole(auth.Role{Name: "staff", Permissions: []string{"user:read"}}); err == nil {
+		t.Errorf("Saved role without -as")
+	}
+} //TestStoreBackendAdmin()
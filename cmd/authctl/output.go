@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+//writeOutput writes the result as indented JSON, or as a table with the columns
+func writeOutput(w io.Writer, format string, result interface{}, columns []string) error {
+	if result == nil {
+		return nil
+	}
+	jsonData, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode result: %v", err)
+	}
+	if format == "json" {
+		_, err := fmt.Fprintf(w, "%s\n", jsonData)
+		return err
+	}
+
+	//the table is made from the JSON, so it shows the same as the JSON output
+	var value interface{}
+	if err := json.Unmarshal(jsonData, &value); err != nil {
+		return fmt.Errorf("cannot decode result: %v", err)
+	}
+	rows := tableRows(value)
+	if len(columns) == 0 && len(rows) > 0 {
+		for name := range rows[0] {
+			columns = append(columns, name)
+		}
+		sort.Strings(columns)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		cells := []string{}
+		for _, column := range columns {
+			cells = append(cells, cellText(row[column]))
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+} //writeOutput()
+
+//tableRows are the objects in a list, in a page of a list (e.g. {"Total":..,"Users":[...]})
+//or the single object
+func tableRows(value interface{}) []map[string]interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		rows := []map[string]interface{}{}
+		for _, e := range v {
+			if row, ok := e.(map[string]interface{}); ok {
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	case map[string]interface{}:
+		for _, name := range []string{"Users", "Events"} {
+			if list, ok := v[name].([]interface{}); ok {
+				return tableRows(list)
+			}
+		}
+		return []map[string]interface{}{v}
+	}
+	return nil
+} //tableRows()
+
+func cellText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		texts := []string{}
+		for _, e := range v {
+			texts = append(texts, cellText(e))
+		}
+		return strings.Join(texts, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		jsonData, _ := json.Marshal(v)
+		return string(jsonData)
+	}
+} //cellText()
@@ -0,0 +1,134 @@
+//Package health serves the liveness and readiness of the process for an orchestrator:
+///healthz is ok while the process serves requests, /readyz is ok when all registered checks pass
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "bitbucket.org/conorit/golib-logger"
+)
+
+var (
+	log = logger.New("health")
+
+	mutex  sync.Mutex
+	checks = map[string]*checker{}
+
+	//Timeout is how long a check may take before it fails
+	Timeout = time.Second * 3
+)
+
+//checker is a registered check, running is 1 while it runs
+type checker struct {
+	check   func(ctx context.Context) error
+	running int32
+}
+
+//Add registers a readiness check, which returns nil when ok.
+//It should stop when ctx is done, but fails after Timeout even if it does not.
+//Such a check is not run again until it returned, so checks that hang
+//do not add a goroutine on every request
+func Add(name string, check func(ctx context.Context) error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	checks[name] = &checker{check: check}
+} //Add()
+
+//Result is the outcome of a check, or of all checks
+type Result struct {
+	Status   string            //"ok" or "fail"
+	Duration string            `json:",omitempty"`
+	Error    string            `json:",omitempty"`
+	Checks   map[string]Result `json:",omitempty"`
+}
+
+//Check runs all checks concurrently and returns their results
+func Check(ctx context.Context) Result {
+	mutex.Lock()
+	names := []string{}
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*checker, len(names))
+	for i, name := range names {
+		list[i] = checks[name]
+	}
+	mutex.Unlock()
+
+	results := make([]Result, len(names))
+	wg := sync.WaitGroup{}
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = run(ctx, list[i])
+		}(i)
+	}
+	wg.Wait()
+
+	all := Result{Status: "ok", Checks: map[string]Result{}}
+	for i, name := range names {
+		all.Checks[name] = results[i]
+		if results[i].Status != "ok" {
+			all.Status = "fail"
+		}
+	}
+	return all
+} //Check()
+
+//run runs the check with Timeout, or fails when it is still running from before
+func run(ctx context.Context, c *checker) Result {
+	if !atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		return Result{Status: "fail", Error: "previous check did not return yet"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1) //buffered, so the check can return after the timeout
+	go func() {
+		defer atomic.StoreInt32(&c.running, 0)
+		done <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	r := Result{Status: "ok", Duration: time.Since(start).Round(time.Millisecond).String()}
+	if err != nil {
+		r.Status = "fail"
+		r.Error = err.Error()
+	}
+	return r
+} //run()
+
+//LiveHandler answers ok while the process can serve requests, without checking anything else
+func LiveHandler(res http.ResponseWriter, req *http.Request) {
+	write(res, Result{Status: "ok"})
+} //LiveHandler()
+
+//ReadyHandler runs all checks and answers 200 when all are ok, else 503
+func ReadyHandler(res http.ResponseWriter, req *http.Request) {
+	r := Check(req.Context())
+	if r.Status != "ok" {
+		log.Info.Printf("Not ready: %+v", r.Checks)
+	}
+	write(res, r)
+} //ReadyHandler()
+
+func write(res http.ResponseWriter, r Result) {
+	jsonData, _ := json.Marshal(r)
+	res.Header().Set("Cache-Control", "no-store")
+	if r.Status != "ok" {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	res.Write(jsonData)
+} //write()
@@ -0,0 +1,106 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//withChecks replaces the registered checks and Timeout for the test
+func withChecks(t *testing.T, timeout time.Duration) {
+	mutex.Lock()
+	saved, savedTimeout := checks, Timeout
+	checks = map[string]*checker{}
+	Timeout = timeout
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		checks, Timeout = saved, savedTimeout
+		mutex.Unlock()
+	})
+} //withChecks()
+
+func TestCheck(t *testing.T) {
+	withChecks(t, time.Second)
+	Add("ok", func(ctx context.Context) error { return nil })
+	if r := Check(context.Background()); r.Status != "ok" || r.Checks["ok"].Status != "ok" {
+		t.Errorf("Check with one ok check = %+v", r)
+	}
+
+	Add("fail", func(ctx context.Context) error { return fmt.Errorf("down") })
+	r := Check(context.Background())
+	if r.Status != "fail" || r.Checks["ok"].Status != "ok" || r.Checks["fail"].Error != "down" {
+		t.Errorf("Check with a failing check = %+v", r)
+	}
+} //TestCheck()
+
+func TestCheckTimeout(t *testing.T) {
+	withChecks(t, time.Millisecond*50)
+	release := make(chan struct{})
+	defer close(release)
+	var runs int32
+	Add("hung", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		<-release //ignores ctx
+		return nil
+	})
+
+	r := Check(context.Background())
+	if r.Status != "fail" || r.Checks["hung"].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Check with a hung check = %+v", r)
+	}
+	//the hung check is not started again while it did not return
+	for i := 0; i < 3; i++ {
+		if r := Check(context.Background()); r.Status != "fail" {
+			t.Errorf("Check while a check is hung = %+v", r)
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("Hung check started %d times", n)
+	}
+} //TestCheckTimeout()
+
+func TestCheckAfterHung(t *testing.T) {
+	withChecks(t, time.Millisecond*50)
+	release := make(chan struct{})
+	Add("slow", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	if r := Check(context.Background()); r.Status != "fail" {
+		t.Errorf("Check with a hung check = %+v", r)
+	}
+	//once released, the check returns and runs again
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		r := Check(context.Background())
+		if r.Status == "ok" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Check after the hung check returned = %+v", r)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+} //TestCheckAfterHung()
+
+func TestHandlers(t *testing.T) {
+	withChecks(t, time.Second)
+	Add("fail", func(ctx context.Context) error { return fmt.Errorf("down") })
+
+	res := httptest.NewRecorder()
+	LiveHandler(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("/healthz = %d", res.Code)
+	}
+	res = httptest.NewRecorder()
+	ReadyHandler(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("/readyz = %d %v", res.Code, res.Header())
+	}
+} //TestHandlers()
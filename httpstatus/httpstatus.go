@@ -0,0 +1,39 @@
+//Package httpstatus records the status code written by a handler,
+//for middleware that reports on responses (metrics, tracing)
+package httpstatus
+
+import "net/http"
+
+//Recorder remembers the status code written by a handler
+type Recorder struct {
+	http.ResponseWriter
+	Status  int
+	written bool
+}
+
+//NewRecorder wraps res, with status 200 until the handler writes another
+func NewRecorder(res http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: res, Status: http.StatusOK}
+} //NewRecorder()
+
+//WriteHeader records the first status, as net/http ignores later ones
+func (r *Recorder) WriteHeader(status int) {
+	if !r.written {
+		r.Status = status
+		r.written = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+} //Recorder.WriteHeader()
+
+//Write sends the default status if none was written
+func (r *Recorder) Write(b []byte) (int, error) {
+	if !r.written {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.ResponseWriter.Write(b)
+} //Recorder.Write()
+
+//Unwrap lets http.ResponseController reach the wrapped writer, e.g. to flush
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+} //Recorder.Unwrap()
@@ -0,0 +1,38 @@
+package httpstatus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	for name, tc := range map[string]struct {
+		handler func(http.ResponseWriter)
+		want    int
+	}{
+		"no write":        {func(res http.ResponseWriter) {}, http.StatusOK},
+		"body only":       {func(res http.ResponseWriter) { res.Write([]byte("ok")) }, http.StatusOK},
+		"status":          {func(res http.ResponseWriter) { res.WriteHeader(http.StatusNotFound) }, http.StatusNotFound},
+		"status twice":    {func(res http.ResponseWriter) { res.WriteHeader(http.StatusBadRequest); res.WriteHeader(http.StatusOK) }, http.StatusBadRequest},
+		"status and body": {func(res http.ResponseWriter) { res.WriteHeader(http.StatusCreated); res.Write([]byte("{}")) }, http.StatusCreated},
+		"body then status": {func(res http.ResponseWriter) {
+			res.Write([]byte("ok"))
+			res.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		rec := NewRecorder(w)
+		tc.handler(rec)
+		if rec.Status != tc.want || w.Code != tc.want {
+			t.Errorf("%s: recorded %d and sent %d, want %d", name, rec.Status, w.Code, tc.want)
+		}
+	}
+} //TestRecorder()
+
+func TestRecorderUnwrap(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := http.NewResponseController(NewRecorder(w)).Flush(); err != nil || !w.Flushed {
+		t.Errorf("Flush through the recorder: %v", err)
+	}
+} //TestRecorderUnwrap()
@@ -0,0 +1,12 @@
+package item
+
+import "github.com/jansemmelink/auth2/config"
+
+//settings of the package, the defaults until Configure is called
+var settings = config.Default().Item
+
+//Configure sets the settings of the package,
+//call it at startup before the database is used or mail is sent
+func Configure(c config.Item) {
+	settings = c
+} //Configure()
@@ -1,19 +1,130 @@
 package item
 
-import mgo "gopkg.in/mgo.v2"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
 
-const mongoURL = "/item"
+	"github.com/jansemmelink/auth2/health"
+	mgo "gopkg.in/mgo.v2"
+)
 
-var _mdMgoSession *mgo.Session
+var (
+	dbMutex       sync.Mutex
+	_mdMgoSession *mgo.Session
+	stopKeepAlive chan struct{}
+	keepAliveDone chan struct{}
+)
 
-//Db returns current db connection session
+const (
+	//dbDialTimeout is how long to try to connect before failing
+	dbDialTimeout = time.Second * 5
+
+	//dbKeepAliveInterval is how often the shared session is pinged, see Ping
+	dbKeepAliveInterval = time.Second * 10
+)
+
+func init() {
+	health.Add("item.mongo", Ping)
+}
+
+//Db returns current db connection session, connecting on first use.
+//Db panics when it cannot connect, so call Connect first where the database may be down
 func Db() *mgo.Session {
-	if _mdMgoSession == nil {
-		var err error
-		_mdMgoSession, err = mgo.Dial(mongoURL)
-		if err != nil {
-			panic("Cannot connect to mongo: " + mongoURL + ": " + err.Error())
-		}
+	if err := Connect(); err != nil {
+		panic(err.Error())
 	}
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
 	return _mdMgoSession
 } //Db()
+
+//Connect connects to the database if not yet connected, failing when it is not available.
+//Once connected, operations fail while the database is down, and the session is
+//pinged in the background to refresh it when the connection failed (see Ping)
+func Connect() error {
+	if connected() {
+		return nil
+	}
+	//dial without the lock, so Ping and Close do not wait for it
+	s, err := mgo.DialWithTimeout(settings.MongoURL, dbDialTimeout)
+	if err != nil {
+		//not the url, it may contain the password
+		return log.Errorf(err, "Cannot connect to the item database")
+	}
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if _mdMgoSession != nil {
+		s.Close()
+		return nil
+	}
+	_mdMgoSession = s
+	stopKeepAlive = make(chan struct{})
+	keepAliveDone = make(chan struct{})
+	go keepAlive(stopKeepAlive, keepAliveDone)
+	return nil
+} //Connect()
+
+//keepAlive pings the shared session until stop is closed,
+//so that it is refreshed after a failure even when nothing checks readiness
+func keepAlive(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(dbKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := Ping(context.Background()); err != nil {
+			log.Error.Printf("%v", err)
+		}
+	}
+} //keepAlive()
+
+func connected() bool {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	return _mdMgoSession != nil
+} //connected()
+
+//Ping checks that the database answers on the shared session, and refreshes it when not:
+//mgo keeps a Strong session on its failed connection until Refresh,
+//so all operations would still fail once the database is back.
+//mgo takes no ctx so the caller must time it out. It does not connect, that is up to Connect
+func Ping(ctx context.Context) error {
+	dbMutex.Lock()
+	s := _mdMgoSession
+	dbMutex.Unlock()
+	if s == nil {
+		return fmt.Errorf("not connected to the item database")
+	}
+	if err := s.Ping(); err == nil {
+		return nil
+	}
+	s.Refresh()
+	if err := s.Ping(); err != nil {
+		return fmt.Errorf("item database does not answer: %v", err)
+	}
+	log.Info.Printf("Reconnected to the item database")
+	return nil
+} //Ping()
+
+//Close closes the db connection, the next Db() connects again
+func Close() {
+	dbMutex.Lock()
+	s, stop, done := _mdMgoSession, stopKeepAlive, keepAliveDone
+	_mdMgoSession, stopKeepAlive, keepAliveDone = nil, nil, nil
+	dbMutex.Unlock()
+	if s == nil {
+		return
+	}
+	//wait for a ping in progress, before the session is closed under it
+	close(stop)
+	<-done
+	s.Close()
+} //Close()
+
+func dbPersonCollection() *mgo.Collection { return Db().DB("item").C("persons") }
@@ -0,0 +1,31 @@
+package item
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jansemmelink/auth2/config"
+)
+
+//testMongoURLEnv names the mongo server used by tests that need a database, same as in package auth
+const testMongoURLEnv = "AUTH2_TEST_MONGO_URL"
+
+//testDatabase connects to the test server, skipping the test when none is configured
+func testDatabase(t *testing.T) {
+	url := os.Getenv(testMongoURLEnv)
+	if url == "" {
+		t.Skipf("%s is not set", testMongoURLEnv)
+	}
+	saved := settings
+	c := config.Default().Item
+	c.MongoURL = url
+	Close()
+	Configure(c)
+	if err := Connect(); err != nil {
+		t.Fatalf("Cannot connect to %s: %v", testMongoURLEnv, err)
+	}
+	t.Cleanup(func() {
+		Close()
+		Configure(saved)
+	})
+} //testDatabase()
@@ -2,12 +2,14 @@ package item
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"reflect"
 
 	logger "bitbucket.org/conorit/golib-logger"
 	pat "github.com/gorilla/pat"
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/openapi"
+	"github.com/jansemmelink/auth2/tracing"
 )
 
 var (
@@ -15,72 +17,117 @@ var (
 )
 
 //Item interface for use in API
+//All operations are scoped to a tenant: items created in one tenant
+//cannot be retrieved, updated or deleted from another
 type Item interface {
 	Validate() error
-	Blank() interface{}                                //return empty item
-	New(interface{}) (interface{}, error)              //return item with ID
-	Get(ID string) (interface{}, error)                //return item with ID
-	GetKey(key map[string]string) (interface{}, error) //return item with ID
-	Upd(string, interface{}) error
-	Del(ID string) error
+	Blank() interface{}                                               //return empty item
+	New(tenant string, data interface{}) (interface{}, error)         //return item with ID
+	Get(tenant string, ID string) (interface{}, error)                //return item with ID
+	GetKey(tenant string, key map[string]string) (interface{}, error) //return item with ID
+	Upd(tenant string, ID string, data interface{}) error
+	Del(tenant string, ID string) error
+}
+
+//Guard wraps item handlers to enforce a permission, e.g. "person:write"
+//auth.RequirePermission is a Guard
+type Guard func(permission string, h http.HandlerFunc) http.HandlerFunc
+
+//Notify is called after items are created, updated or deleted through the API
+//with event "<item>.created", "<item>.updated" or "<item>.deleted"
+//it may be set to publish the events, e.g. to auth.PublishEvent
+var Notify func(event string, tenant string, data interface{})
+
+func notify(event string, tenant string, data interface{}) {
+	if Notify != nil {
+		Notify(event, tenant, data)
+	}
+}
+
+//openGuard is used when no guard is specified and allows all requests
+func openGuard(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return h
 }
 
 //AddItemRoutes ...
-func AddItemRoutes(r *pat.Router, item string, i Item) {
+//GET requires permission "<item>:read", POST and PUT require "<item>:write"
+//and DELETE requires "<item>:delete" when a guard is specified
+func AddItemRoutes(r *pat.Router, item string, i Item, guard Guard) {
 	log.Debug.Printf("Adding item")
+	guarded := guard != nil
+	if guard == nil {
+		guard = openGuard
+	}
 	URLsimple := "/" + item
 	URLwithID := "/" + item + "/{id}"
 	itemType := reflect.TypeOf(i) //.Elem()
 
 	log.Debug.Printf("Item type %s", reflect.TypeOf(i))
 
+	//document the routes, with the item type as request/response schema
+	op := func(summary, permission string, request, response interface{}) openapi.Operation {
+		return openapi.Operation{Summary: summary, Auth: guarded, Permission: permission, Request: request, Response: response}
+	}
+	openapi.Describe("POST", URLsimple, op("Create a "+item, item+":write", i.Blank(), i.Blank()))
+	openapi.Describe("GET", URLwithID, op("Get a "+item, item+":read", nil, i.Blank()))
+	openapi.Describe("GET", URLsimple, op("Find a "+item+" by the fields in the URL parameters", item+":read", nil, i.Blank()))
+	openapi.Describe("PUT", URLwithID, op("Update a "+item, item+":write", i.Blank(), nil))
+	openapi.Describe("DELETE", URLwithID, op("Delete a "+item, item+":delete", nil, nil))
+
 	//HTTP POST /item
 	//with JSON body is used to create an item
 	//on success the new item is echoed with an id
-	r.Post(URLsimple, func(res http.ResponseWriter, req *http.Request) {
+	r.Post(URLsimple, guard(item+":write", func(res http.ResponseWriter, req *http.Request) {
 		//parse the JSON body into a new copy of the item type
 		jsonDecoder := json.NewDecoder(req.Body)
 		newItemPtr := reflect.New(itemType).Interface()
 		if err := jsonDecoder.Decode(&newItemPtr); err != nil {
-			http.Error(res, fmt.Sprintf("Invalid JSON for %s: %v", item, err.Error()), http.StatusBadRequest)
+			apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON for %s: %v", item, err)
 			return
 		}
 		log.Debug.Printf("Parsed JSON into %s: %+v", item, newItemPtr)
 
 		//create the new item
-		itemData, err := i.New(newItemPtr)
+		_, span := tracing.Start(req.Context(), item+".new")
+		itemData, err := i.New(TenantFromContext(req.Context()), newItemPtr)
+		tracing.End(span, err)
 		if err != nil {
-			http.Error(res, fmt.Sprintf("Cannot create %s: %v", item, err.Error()), http.StatusBadRequest)
+			apierror.Write(res, req, err, apierror.ItemInvalid)
 			return
 		}
 
+		notify(item+".created", TenantFromContext(req.Context()), itemData)
+
 		//succes: output Item
 		if itemJSON, err := json.Marshal(itemData); err != nil {
-			http.Error(res, fmt.Sprintf("Internal Error: %v", err.Error()), http.StatusServiceUnavailable)
+			apierror.Writef(res, req, apierror.Internal, "Internal Error: %v", err)
 		} else {
 			res.Write([]byte(itemJSON))
 		}
-	}) //HTTP POST /item
+	})) //HTTP POST /item
 
 	//r.Get(URLsimple, GetItemHandler) ...for list
 
 	//HTTP GET /item/<id>
-	r.Get(URLwithID, func(res http.ResponseWriter, req *http.Request) {
+	r.Get(URLwithID, guard(item+":read", func(res http.ResponseWriter, req *http.Request) {
 		ID := req.URL.Query().Get(":id")
-		if itemData, err := i.Get(ID); err != nil {
-			http.Error(res, fmt.Sprintf("Cannot get %s.id=%s: %v", item, ID, err), http.StatusNotFound)
+		_, span := tracing.Start(req.Context(), item+".get")
+		itemData, err := i.Get(TenantFromContext(req.Context()), ID)
+		tracing.End(span, err)
+		if err != nil {
+			apierror.Writef(res, req, apierror.ItemNotFound, "Cannot get %s.id=%s: %v", item, ID, err)
 		} else {
 			if itemJSON, err := json.Marshal(itemData); err != nil {
-				http.Error(res, fmt.Sprintf("Internal Error: %v", err.Error()), http.StatusServiceUnavailable)
+				apierror.Writef(res, req, apierror.Internal, "Internal Error: %v", err)
 			} else {
 				//success: output item
 				res.Write([]byte(itemJSON))
 			}
 		}
-	}) //HTTP GET /item/<id>
+	})) //HTTP GET /item/<id>
 
 	//HTTP GET /item (with search params in URL, e.g. ?email=a@b.c
-	r.Get(URLsimple, func(res http.ResponseWriter, req *http.Request) {
+	r.Get(URLsimple, guard(item+":read", func(res http.ResponseWriter, req *http.Request) {
 		log.Debug.Printf("Getting")
 		itemData := i.Blank()
 		var err error
@@ -93,46 +140,57 @@ func AddItemRoutes(r *pat.Router, item string, i Item) {
 				key[n] = v[0]
 			}
 		}
-		if itemData, err = i.GetKey(key); err != nil {
-			http.Error(res, fmt.Sprintf("Cannot get %s(%+v): %v", item, key, err), http.StatusNotFound)
+		_, span := tracing.Start(req.Context(), item+".getkey")
+		itemData, err = i.GetKey(TenantFromContext(req.Context()), key)
+		tracing.End(span, err)
+		if err != nil {
+			apierror.Writef(res, req, apierror.ItemNotFound, "Cannot get %s(%+v): %v", item, key, err)
+			return
 		}
 
 		if itemJSON, err := json.Marshal(itemData); err != nil {
-			http.Error(res, fmt.Sprintf("Internal Error: %v", err.Error()), http.StatusServiceUnavailable)
+			apierror.Writef(res, req, apierror.Internal, "Internal Error: %v", err)
 		} else {
 			//success: output item
 			res.Write([]byte(itemJSON))
 		}
-	}) //HTTP GET /item/<id>
+	})) //HTTP GET /item/<id>
 
 	//HTTP PUT /item/<id>
 	//with JSON body is used to update an item
 	//id in URL and body should match
-	r.Put(URLwithID, func(res http.ResponseWriter, req *http.Request) {
+	r.Put(URLwithID, guard(item+":write", func(res http.ResponseWriter, req *http.Request) {
 		//parse the JSON body into a new copy of the item type
 		jsonDecoder := json.NewDecoder(req.Body)
 		newItemPtr := reflect.New(itemType).Interface()
 		if err := jsonDecoder.Decode(&newItemPtr); err != nil {
-			http.Error(res, fmt.Sprintf("Invalid JSON for %s: %v", item, err.Error()), http.StatusBadRequest)
+			apierror.Writef(res, req, apierror.InvalidJSON, "Invalid JSON for %s: %v", item, err)
 			return
 		}
 		log.Debug.Printf("Parsed JSON into %s: %+v", item, newItemPtr)
 		ID := req.URL.Query().Get(":id")
-		var err error
-		if i.Upd(ID, newItemPtr); err != nil {
-			http.Error(res, fmt.Sprintf("Get %s.id=%s failed: %v", item, ID, err.Error()), http.StatusNotFound)
+		_, span := tracing.Start(req.Context(), item+".upd")
+		err := i.Upd(TenantFromContext(req.Context()), ID, newItemPtr)
+		tracing.End(span, err)
+		if err != nil {
+			apierror.Write(res, req, err, apierror.ItemNotFound)
 			return
 		}
 		log.Debug.Printf("Updated")
-	}) //HTTP PUT /item/<id>
+		notify(item+".updated", TenantFromContext(req.Context()), newItemPtr)
+	})) //HTTP PUT /item/<id>
 
 	//HTTP DELETE /item/<id>
-	r.Delete(URLwithID, func(res http.ResponseWriter, req *http.Request) {
+	r.Delete(URLwithID, guard(item+":delete", func(res http.ResponseWriter, req *http.Request) {
 		ID := req.URL.Query().Get(":id")
-		if err := i.Del(ID); err != nil {
-			http.Error(res, fmt.Sprintf("Delete %s.id=%s failed: %v", item, ID, err.Error()), http.StatusNotFound)
+		_, span := tracing.Start(req.Context(), item+".del")
+		err := i.Del(TenantFromContext(req.Context()), ID)
+		tracing.End(span, err)
+		if err != nil {
+			apierror.Writef(res, req, apierror.ItemNotFound, "Delete %s.id=%s failed: %v", item, ID, err)
 			return
 		}
 		log.Debug.Printf("Deleted %s.id=%s", item, ID)
-	}) //DELETE /item/<id>
+		notify(item+".deleted", TenantFromContext(req.Context()), map[string]string{"_id": ID})
+	})) //DELETE /item/<id>
 }
@@ -1,17 +1,39 @@
 package item
 
 import (
+	"context"
 	"fmt"
 	"net/smtp"
+
+	"github.com/jansemmelink/auth2/health"
+	"github.com/jansemmelink/auth2/metrics"
+	"github.com/jansemmelink/auth2/tracing"
 )
 
-//SendMail sends email through mail.google.com
-func SendMail(toEmail string, subject string, htmlMessage string) error {
+func init() {
+	health.Add("item.mail", mailConfigured)
+}
+
+//mailConfigured checks that mail can be sent, without connecting to the SMTP server
+func mailConfigured(ctx context.Context) error {
+	if !settings.Mail.Configured() {
+		return fmt.Errorf("mail is not configured, item.mail.host, port and from are required")
+	}
+	return nil
+} //mailConfigured()
+
+//SendMail sends email through the configured SMTP server
+//ctx is the context of the request that sends the mail, for tracing
+func SendMail(ctx context.Context, toEmail string, subject string, htmlMessage string) error {
+	mail := settings.Mail
+	if !mail.Configured() {
+		return fmt.Errorf("Failed to send mail: mail is not configured")
+	}
 	boundary := "boundary-type-1234567890-alt"
 	var msgString string
 	//header
 	msgString = msgString + "To: " + toEmail + "\r\n"
-	msgString = msgString + "From: \"TrotsEk\" <trotsek@gmail.com>\r\n"
+	msgString = msgString + "From: \"" + mail.FromName + "\" <" + mail.From + ">\r\n"
 	msgString = msgString + "Subject: " + subject + "\r\n"
 	msgString = msgString + "MIME-Version: 1.0\r\n"
 	msgString = msgString + "Content-Type: multipart/alternative;boundary=\"" + boundary + "\"\r\n"
@@ -38,10 +60,19 @@ func SendMail(toEmail string, subject string, htmlMessage string) error {
 	msgString = msgString + "--" + boundary + "--\r\n"
 
 	msgBytes := []byte(msgString)
-	auth := smtp.PlainAuth("", "jan.semmelink@gmail.com", "tbconiwnujmhnoha", "smtp.gmail.com")
+	//without login the envelope sender is the from address
+	var auth smtp.Auth
+	sender := mail.From
+	if mail.Username != "" {
+		auth = smtp.PlainAuth("", mail.Username, mail.Password, mail.Host)
+		sender = mail.Username
+	}
 	var to []string
 	to = append(to, toEmail)
-	err := smtp.SendMail("smtp.gmail.com:587", auth, "jan.semmelink@gmail.com", to, msgBytes)
+	_, span := tracing.Start(ctx, "smtp.send")
+	err := smtp.SendMail(fmt.Sprintf("%s:%d", mail.Host, mail.Port), auth, sender, to, msgBytes)
+	tracing.End(span, err)
+	metrics.MailSent(err)
 	if err != nil {
 		return fmt.Errorf("Failed to send mail: %s", err.Error())
 	}
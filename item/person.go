@@ -1,9 +1,13 @@
 package item
 
 import (
+	"fmt"
 	"path"
 	"runtime"
+	"time"
 
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/metrics"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -15,28 +19,34 @@ type Person struct {
 	//else this will be undefined ""
 	UserID bson.ObjectId `bson:"_user_id" json:"_user_id"`
 
+	//organisation (tenant) that the person belongs to, "" when not multi-tenant
+	TenantID string `bson:"_tenant_id" json:"_tenant_id"`
+
 	//profile
 	Names []string
 }
 
 var (
-	//regexValidName   = regexp.MustCompile("^[a-zA-Z][0-9a-zA-Z]*$")
-	dbPersonCollection = Db().DB("item").C("persons")
+//regexValidName   = regexp.MustCompile("^[a-zA-Z][0-9a-zA-Z]*$")
 )
 
-//Validate ...
+//Validate returns an *apierror.Error with the details of all invalid fields
 func (notUsedItem Person) Validate() error {
 	//Name
 	person := notUsedItem
+	invalid := apierror.New(apierror.ItemInvalid, "Invalid person data")
 
 	if len(person.Names) == 0 {
-		return log.Errorf(nil, "Missing names")
+		invalid = invalid.WithField("Names", "Missing names")
 	}
-	for _, name := range person.Names {
+	for i, name := range person.Names {
 		if name == "" {
-			return log.Errorf(nil, "Names may not have empty string values")
+			invalid = invalid.WithField(fmt.Sprintf("Names[%d]", i), "Names may not have empty string values")
 		}
 	}
+	if len(invalid.Details) > 0 {
+		return invalid
+	}
 
 	/*_, err := mail.ParseAddress(u.Email)
 	if err != nil {
@@ -53,7 +63,7 @@ func (notUsedItem Person) Blank() interface{} {
 }
 
 //New ...
-func (notUsedItem Person) New(newDataInterfacePtr interface{}) (interface{}, error) {
+func (notUsedItem Person) New(tenant string, newDataInterfacePtr interface{}) (interface{}, error) {
 	//convert type
 	var ok bool
 	var newDataPtr *Person
@@ -63,7 +73,7 @@ func (notUsedItem Person) New(newDataInterfacePtr interface{}) (interface{}, err
 
 	p := *newDataPtr
 	if err := p.Validate(); err != nil {
-		return "", log.Errorf(err, "Invalid person data")
+		return "", err
 	}
 
 	//TODO: check all unique keys, e.g. all national ids must be unique
@@ -72,14 +82,17 @@ func (notUsedItem Person) New(newDataInterfacePtr interface{}) (interface{}, err
 			return "", log.Errorf(err, "Person %s already exists", u.Email)
 		}*/
 
-	//assign ID and save
+	//assign ID and tenant and save
 	p.ID = bson.NewObjectId()
+	p.TenantID = tenant
 	if !p.UserID.Valid() {
 		p.UserID = bson.ObjectIdHex("FFFFFFFFFFFFFFFFFFFFFFFF")
 	}
 
 	log.Debug.Printf("Creating id=%v", p.ID)
-	err := dbPersonCollection.Insert(p)
+	start := time.Now()
+	err := dbPersonCollection().Insert(p)
+	metrics.ObserveMongo("persons", "insert", start)
 	if err != nil {
 		return "", log.Errorf(err, "Failed to db.insert(%+v)", p)
 	}
@@ -88,33 +101,41 @@ func (notUsedItem Person) New(newDataInterfacePtr interface{}) (interface{}, err
 } //Person.New()
 
 //Get ...
-func (notUsedItem Person) Get(id string) (interface{}, error) {
+func (notUsedItem Person) Get(tenant string, id string) (interface{}, error) {
 	log.Debug.Printf("Getting id=%s", id)
 	if !bson.IsObjectIdHex(id) {
 		return Person{}, log.Errorf(nil, "Invalid id='%s' is not bson hex object id", id)
 	}
 	mgoKey := make(bson.M)
 	mgoKey["_id"] = bson.ObjectIdHex(id)
+	mgoKey["_tenant_id"] = tenantFilter(tenant)
 	personData := Person{}
-	if err := dbPersonCollection.Find(mgoKey).One(&personData); err != nil {
+	defer metrics.ObserveMongo("persons", "find", time.Now())
+	if err := dbPersonCollection().Find(mgoKey).One(&personData); err != nil {
 		return Person{}, log.Errorf(err, "Failed to get id=%s", id)
 	}
 	return personData, nil
 } //Person.Get()
 
 //GetKey to get by any key fields
-func (notUsedItem Person) GetKey(key map[string]string) (interface{}, error) {
+//the tenant cannot be overridden by the key
+func (notUsedItem Person) GetKey(tenant string, key map[string]string) (interface{}, error) {
 	log.Debug.Printf("Getting key=%+v", key)
 	mgoKey := make(bson.M)
 	for n, v := range key {
 		if n == "id" {
+			if !bson.IsObjectIdHex(v) {
+				return Person{}, log.Errorf(nil, "Invalid id='%s' is not bson hex object id", v)
+			}
 			mgoKey["_id"] = bson.ObjectIdHex(v)
 		} else {
 			mgoKey[n] = v
 		}
 	}
+	mgoKey["_tenant_id"] = tenantFilter(tenant)
 	personData := Person{}
-	if err := dbPersonCollection.Find(mgoKey).One(&personData); err != nil {
+	defer metrics.ObserveMongo("persons", "find", time.Now())
+	if err := dbPersonCollection().Find(mgoKey).One(&personData); err != nil {
 		return Person{}, log.Errorf(err, "Failed to get %+v", key)
 	}
 	return personData, nil
@@ -126,7 +147,7 @@ func GetPersonByEmail(email string) (Person, error) {
 	mgoKey := make(bson.M)
 	mgoKey["email"] = email
 	u := Person{}
-	if err := dbPersonCollection.Find(mgoKey).One(&u); err != nil {
+	if err := dbPersonCollection().Find(mgoKey).One(&u); err != nil {
 		return Person{}, log.Errorf(err, "Person(email=%s) does not exist", email)
 	}
 	return u, nil
@@ -139,14 +160,14 @@ func GetPersonAuth(email, pwSha1 string) (Person, error) {
 	mgoKey["email"] = email
 	mgoKey["passwordsha1"] = pwSha1
 	u := Person{}
-	if err := dbPersonCollection.Find(mgoKey).One(&u); err != nil {
+	if err := dbPersonCollection().Find(mgoKey).One(&u); err != nil {
 		return Person{}, log.Errorf(nil, "Invalid credentials")
 	}
 	return u, nil
 } //GetPersonAuth()
 
 //Upd ...
-func (notUsedItem Person) Upd(id string, newDataInterfacePtr interface{}) error {
+func (notUsedItem Person) Upd(tenant string, id string, newDataInterfacePtr interface{}) error {
 	//convert type
 	var ok bool
 	var newDataPtr *Person
@@ -156,7 +177,7 @@ func (notUsedItem Person) Upd(id string, newDataInterfacePtr interface{}) error
 
 	u := *newDataPtr
 	if err := u.Validate(); err != nil {
-		return log.Errorf(err, "Invalid person data")
+		return err
 	}
 
 	//id specified on URL and id in body contents must be the same
@@ -164,8 +185,12 @@ func (notUsedItem Person) Upd(id string, newDataInterfacePtr interface{}) error
 		return log.Errorf(nil, "Specified id=%s not same as data id=%s", id, u.ID.Hex())
 	}
 
+	//only update the person in the same tenant
+	u.TenantID = tenant
 	log.Debug.Printf("Updating id=%v", u.ID)
-	err := dbPersonCollection.UpdateId(u.ID, u)
+	start := time.Now()
+	err := dbPersonCollection().Update(bson.M{"_id": u.ID, "_tenant_id": tenantFilter(tenant)}, u)
+	metrics.ObserveMongo("persons", "update", start)
 	if err != nil {
 		return log.Errorf(err, "Failed to db.update(%+v)", u)
 	}
@@ -174,9 +199,14 @@ func (notUsedItem Person) Upd(id string, newDataInterfacePtr interface{}) error
 } //Person.Upd()
 
 //Del ...
-func (notUsedItem Person) Del(id string) error {
+func (notUsedItem Person) Del(tenant string, id string) error {
 	log.Debug.Printf("Deleting id=%s...", id)
-	err := dbPersonCollection.RemoveId(bson.ObjectIdHex(id))
+	if !bson.IsObjectIdHex(id) {
+		return log.Errorf(nil, "Invalid id='%s' is not bson hex object id", id)
+	}
+	start := time.Now()
+	err := dbPersonCollection().Remove(bson.M{"_id": bson.ObjectIdHex(id), "_tenant_id": tenantFilter(tenant)})
+	metrics.ObserveMongo("persons", "remove", start)
 	if err != nil {
 		return log.Errorf(err, "Failed to delete id=%+v from mongo", id)
 	}
@@ -0,0 +1,33 @@
+package item
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type contextKey string
+
+const ctxTenant contextKey = "tenant"
+
+//WithTenant returns a context in which item operations are scoped to the tenant
+//(organisation id). The auth package sets it from the session of the request
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, ctxTenant, tenantID)
+} //WithTenant()
+
+//TenantFromContext returns the tenant of item operations, "" if not scoped to a tenant
+func TenantFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(ctxTenant).(string)
+	return t
+} //TenantFromContext()
+
+//tenantFilter is the mongo query value for the tenant field
+//items stored before tenants existed have no tenant field and
+//belong to the "" tenant
+func tenantFilter(tenant string) interface{} {
+	if tenant == "" {
+		return bson.M{"$in": []interface{}{"", nil}}
+	}
+	return tenant
+} //tenantFilter()
@@ -0,0 +1,77 @@
+package item
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jansemmelink/auth2/apierror"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTenantContext(t *testing.T) {
+	ctx := context.Background()
+	if TenantFromContext(ctx) != "" {
+		t.Errorf("Tenant without WithTenant")
+	}
+	if TenantFromContext(WithTenant(ctx, "5f0000000000000000000001")) != "5f0000000000000000000001" {
+		t.Errorf("Tenant not in context")
+	}
+	if !reflect.DeepEqual(tenantFilter(""), bson.M{"$in": []interface{}{"", nil}}) || tenantFilter("abc") != "abc" {
+		t.Errorf("tenantFilter")
+	}
+} //TestTenantContext()
+
+func TestPersonValidate(t *testing.T) {
+	if err := (Person{Names: []string{"Jan"}}).Validate(); err != nil {
+		t.Errorf("Valid person: %v", err)
+	}
+	err := Person{Names: []string{"Jan", ""}}.Validate()
+	if e, ok := err.(*apierror.Error); !ok || e.Code != apierror.ItemInvalid || len(e.Details) != 1 || e.Details[0].Field != "Names[1]" {
+		t.Errorf("Person with an empty name: %+v", err)
+	}
+	if e, ok := (Person{}).Validate().(*apierror.Error); !ok || len(e.Details) != 1 || e.Details[0].Field != "Names" {
+		t.Errorf("Person without names: %+v", e)
+	}
+} //TestPersonValidate()
+
+//TestPersonTenants checks that persons are only visible in their own tenant
+func TestPersonTenants(t *testing.T) {
+	testDatabase(t)
+	a, b := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	created, err := Person{}.New(a, &Person{Names: []string{"Jan"}, TenantID: b})
+	if err != nil {
+		t.Fatalf("Cannot create person: %v", err)
+	}
+	p := created.(Person)
+	t.Cleanup(func() { dbPersonCollection().RemoveId(p.ID) })
+	if p.TenantID != a {
+		t.Errorf("Created in tenant %s, not %s", p.TenantID, a)
+	}
+
+	if _, err := (Person{}).Get(a, p.ID.Hex()); err != nil {
+		t.Errorf("Cannot get in own tenant: %v", err)
+	}
+	for _, other := range []string{b, ""} {
+		if _, err := (Person{}).Get(other, p.ID.Hex()); err == nil {
+			t.Errorf("Got person of tenant %s in tenant %q", a, other)
+		}
+		if _, err := (Person{}).GetKey(other, map[string]string{"id": p.ID.Hex(), "_tenant_id": a}); err == nil {
+			t.Errorf("Got person of tenant %s by key in tenant %q", a, other)
+		}
+		changed := p
+		changed.Names = []string{"Piet"}
+		if err := (Person{}).Upd(other, p.ID.Hex(), &changed); err == nil {
+			t.Errorf("Updated person of tenant %s in tenant %q", a, other)
+		}
+		if err := (Person{}).Del(other, p.ID.Hex()); err == nil {
+			t.Errorf("Deleted person of tenant %s in tenant %q", a, other)
+		}
+	}
+	if got, err := (Person{}).Get(a, p.ID.Hex()); err != nil || !reflect.DeepEqual(got.(Person).Names, []string{"Jan"}) {
+		t.Errorf("Person changed by another tenant: %+v, %v", got, err)
+	}
+	if err := (Person{}).Del(a, p.ID.Hex()); err != nil {
+		t.Errorf("Cannot delete in own tenant: %v", err)
+	}
+} //TestPersonTenants()
@@ -1,19 +1,33 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	logger "bitbucket.org/conorit/golib-logger"
 	pidfile "bitbucket.org/conorit/golib-pidfile"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/pat"
+	"github.com/jansemmelink/auth2/apierror"
 	"github.com/jansemmelink/auth2/auth"
+	"github.com/jansemmelink/auth2/config"
+	"github.com/jansemmelink/auth2/health"
 	"github.com/jansemmelink/auth2/item"
+	"github.com/jansemmelink/auth2/metrics"
+	"github.com/jansemmelink/auth2/openapi"
+	"github.com/jansemmelink/auth2/tlscert"
+	"github.com/jansemmelink/auth2/tracing"
 )
 
 var (
@@ -22,54 +36,314 @@ var (
 
 func main() {
 	// process command line options
-	pidfile.WritePIDFile("/tmp/auth.pid")
-	addrPtr := flag.String("addr", "localhost", "IP address to bind for HTTP")
-	portPtr := flag.Int("port", 3000, "TCP Port to bind")
-	debugBoolPtr := flag.Bool("d", false, "Debug")
+	configPtr := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "YAML or TOML config file, overridden by "+config.EnvPrefix+"* environment variables and flags")
+	printConfigPtr := flag.Bool("print-config", false, "Print the effective config (secrets redacted) and exit")
+	verifyAuditPtr := flag.Bool("verify-audit", false, "Verify the audit log hash chain and exit")
+	auditAnchorPtr := flag.String("audit-anchor", "", "With -verify-audit, <seq>:<hash> of an earlier verification that the chain must still reach")
+	config.AddFlags(flag.CommandLine)
 	flag.Parse()
-	if *debugBoolPtr {
+	cfg, err := config.Load(*configPtr, flag.CommandLine)
+	if err != nil {
+		log.Error.Printf("%v", err)
+		os.Exit(1)
+	}
+	if *printConfigPtr {
+		cfg.Print(os.Stdout)
+		os.Exit(0)
+	}
+	if cfg.Server.Debug {
 		logger.SetDefaultLevel(logger.LevelDebug)
 	}
+	auth.Configure(cfg.Auth)
+	item.Configure(cfg.Item)
 
-	// start the http server
-	addr := fmt.Sprintf("%s:%d", *addrPtr, *portPtr)
-	log.Info.Printf("Listening on %s", addr)
-	http.Handle("/", app())
-	if err := http.ListenAndServe(addr, nil /*App()*/); err != nil {
-		log.Error.Printf("Failed: %v", err)
+	if *verifyAuditPtr {
+		if err := auth.Connect(); err != nil {
+			log.Error.Printf("%v", err)
+			os.Exit(1)
+		}
+		anchor := auth.AuditAnchor{}
+		if *auditAnchorPtr != "" {
+			if anchor, err = auth.ParseAuditAnchor(*auditAnchorPtr); err != nil {
+				log.Error.Printf("%v", err)
+				os.Exit(1)
+			}
+		}
+		n, err := auth.VerifyAuditChain(anchor)
+		if err != nil {
+			log.Error.Printf("Audit log is broken after %d events: %v", n, err)
+			os.Exit(1)
+		}
+		last, err := auth.LastAuditAnchor()
+		if err != nil {
+			log.Error.Printf("%v", err)
+			os.Exit(1)
+		}
+		log.Info.Printf("Audit log verified %d events, record -audit-anchor=%s for the next verification", n, last)
+		os.Exit(0)
+	}
+
+	//load the certificates before starting anything, they are reloaded while serving
+	var certs *tlscert.Reloader
+	if cfg.Server.TLS.Enabled() {
+		if certs, err = tlscert.New(cfg.Server.TLS); err != nil {
+			log.Error.Printf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	//W3C traceparent is passed on even without an exporter
+	shutdownTracing, err := tracing.Init(cfg.Server.Trace, "auth")
+	if err != nil {
+		log.Error.Printf("Failed to start tracing: %v", err)
 		os.Exit(1)
 	}
+
+	// start the http server, with HTTPS when a certificate is configured
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", cfg.Server.Addr, cfg.Server.Port),
+		Handler:           app(cfg),
+		ReadHeaderTimeout: cfg.Server.ReadTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	servers := []*http.Server{server}
+	stopWatch := make(chan struct{})
+	if certs != nil {
+		server.TLSConfig = certs.Config()
+		server.Handler = tlscert.HSTS(cfg.Server.TLS.HSTSMaxAge, server.Handler)
+		go certs.Watch(cfg.Server.TLS.ReloadInterval, stopWatch)
+		if cfg.Server.TLS.RedirectPort != 0 {
+			servers = append(servers, &http.Server{
+				Addr:              fmt.Sprintf("%s:%d", cfg.Server.Addr, cfg.Server.TLS.RedirectPort),
+				Handler:           tlscert.RedirectHandler(cfg.Server.Port),
+				ReadHeaderTimeout: cfg.Server.ReadTimeout,
+				ReadTimeout:       cfg.Server.ReadTimeout,
+				WriteTimeout:      cfg.Server.WriteTimeout,
+				IdleTimeout:       cfg.Server.IdleTimeout,
+			})
+		}
+	}
+	if cfg.Server.MetricsAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:              cfg.Server.MetricsAddr,
+			Handler:           metricsApp(),
+			ReadHeaderTimeout: cfg.Server.ReadTimeout,
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			IdleTimeout:       cfg.Server.IdleTimeout,
+		})
+	}
+	pidfile.WritePIDFile(cfg.Server.PIDFile)
+	failed := make(chan error, len(servers)+1)
+	for _, s := range servers {
+		go func(s *http.Server) {
+			var err error
+			if s.TLSConfig != nil {
+				log.Info.Printf("Listening on %s (HTTPS)", s.Addr)
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				log.Info.Printf("Listening on %s", s.Addr)
+				err = s.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(s)
+	}
+
+	//serve the health requests while starting, so the orchestrator can tell the process is alive
+	health.Add("startup", func(ctx context.Context) error {
+		if atomic.LoadInt32(&started) == 0 {
+			return fmt.Errorf("starting")
+		}
+		return nil
+	})
+	go func() {
+		if err := start(cfg); err != nil {
+			failed <- err
+		}
+	}()
+
+	//serve until stopped, a second signal kills the process without waiting
+	//SIGHUP reloads the certificates
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	exitCode := -1
+	for exitCode < 0 {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.Info.Printf("Received %v, shutting down", sig)
+				exitCode = 0
+			} else if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Error.Printf("Keeping the current certificates: %v", err)
+				}
+			}
+		case err := <-failed:
+			log.Error.Printf("Failed: %v", err)
+			exitCode = 1
+		}
+	}
+	signal.Stop(signals)
+	close(stopWatch)
+
+	//stop accepting and finish requests in progress before stopping what they use
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			log.Error.Printf("Requests still in progress after %v are cut off: %v", cfg.Server.ShutdownTimeout, err)
+			s.Close()
+			exitCode = 1
+		}
+	}
+	if err := auth.StopWebhookDelivery(ctx); err != nil {
+		exitCode = 1
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error.Printf("Failed to flush traces: %v", err)
+	}
+	cancel()
+	auth.Close()
+	item.Close()
+	removePIDFile(cfg.Server.PIDFile)
 	log.Info.Printf("Terminated")
+	os.Exit(exitCode)
 } /*main()*/
 
-func app() http.Handler {
+//started is set when start is done, until then only these paths are served
+var (
+	started             int32
+	servedWhileStarting = map[string]bool{"/healthz": true, "/readyz": true}
+)
+
+//start waits for the databases, brings stored data up to date and loads the identity providers,
+//then starts the background workers. It fails on anything but the databases being down
+func start(cfg config.Config) error {
+	for wait := time.Second; ; {
+		err := auth.Connect()
+		if err == nil {
+			err = item.Connect()
+		}
+		if err == nil {
+			break
+		}
+		log.Error.Printf("Waiting %v for the database: %v", wait, err)
+		time.Sleep(wait)
+		if wait < time.Minute {
+			wait *= 2
+		}
+	}
+
+	//bring stored data up to date before serving
+	if err := auth.MigrateUserStatus(); err != nil {
+		return fmt.Errorf("Failed to migrate: %v", err)
+	}
+	if err := auth.EnsureUserIndexes(); err != nil {
+		return fmt.Errorf("Failed to create indexes: %v", err)
+	}
+	if err := auth.EnsureTokenIndexes(); err != nil {
+		return fmt.Errorf("Failed to create indexes: %v", err)
+	}
+	if cfg.Auth.OIDCFile != "" {
+		if err := auth.LoadOIDCProviders(cfg.Auth.OIDCFile); err != nil {
+			return fmt.Errorf("Failed to load identity providers: %v", err)
+		}
+	}
+	if cfg.Auth.LDAPFile != "" {
+		if err := auth.LoadLDAPDirectories(cfg.Auth.LDAPFile); err != nil {
+			return fmt.Errorf("Failed to load LDAP directories: %v", err)
+		}
+	}
+	if cfg.Auth.SAMLFile != "" {
+		if err := auth.LoadSAMLProviders(cfg.Auth.SAMLFile); err != nil {
+			return fmt.Errorf("Failed to load SAML identity providers: %v", err)
+		}
+	}
+	if cfg.Auth.MTLSFile != "" {
+		if err := auth.LoadCertRules(cfg.Auth.MTLSFile); err != nil {
+			return fmt.Errorf("Failed to load client certificate rules: %v", err)
+		}
+	}
+
+	//publish item events to webhooks and deliver them in the background
+	item.Notify = auth.PublishEvent
+	auth.StartWebhookDelivery()
+	atomic.StoreInt32(&started, 1)
+	log.Info.Printf("Started")
+	return nil
+} //start()
+
+//whileStarting answers all but servedWhileStarting with 503 until started
+func whileStarting(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&started) == 0 && !servedWhileStarting[req.URL.Path] {
+			res.Header().Set("Retry-After", "5")
+			apierror.Writef(res, req, apierror.Unavailable, "Service is starting")
+			return
+		}
+		h.ServeHTTP(res, req)
+	})
+} //whileStarting()
+
+//removePIDFile removes the pidfile if it is still ours,
+//not that of another process that was started with the same pidfile
+func removePIDFile(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Error.Printf("Failed to remove pidfile: %v", err)
+	}
+} //removePIDFile()
+
+func app(cfg config.Config) http.Handler {
 	r := pat.New()
-	r.Options("/", corsHandler)
+	r.Options("/", corsHandler(cfg.CORS))
 	auth.AddAuthRoutes(r)
-	item.AddItemRoutes(r, "person", item.Person{})
+	item.AddItemRoutes(r, "person", item.Person{}, auth.RequirePermission)
+	r.Get("/healthz", health.LiveHandler)
+	r.Get("/readyz", health.ReadyHandler)
+	if cfg.Server.MetricsAddr == "" {
+		r.Get("/metrics", auth.RequirePermission("metrics:read", metrics.Handler().ServeHTTP))
+	}
+	r.Get("/openapi.json", openapi.Handler().ServeHTTP)
+	r.Get("/docs", openapi.DocsHandler("/openapi.json").ServeHTTP)
+	r.NotFoundHandler = http.HandlerFunc(unknownHandler)
 
-	//debug output for all routes... later use to document
+	//document all routes in the OpenAPI document
+	//and count/time/trace requests per route template
 	r.Router.Walk(
 		func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 			tpl, _ := route.GetPathTemplate()
 			met, _ := route.GetMethods()
 			log.Debug.Printf("%v %v", tpl, met)
+			for _, m := range met {
+				openapi.AddRoute(tpl, m)
+			}
+			if len(met) == 1 {
+				h := tracing.InstrumentRoute(tpl, met[0], route.GetHandler())
+				route.Handler(metrics.InstrumentRoute(tpl, met[0], h))
+			}
 			return nil
 		})
-	return contentType(r)
+	return contentType(cfg.CORS, apierror.WithRequestID(whileStarting(r)))
 }
 
-func errorHandler(res http.ResponseWriter, req *http.Request, err string) {
-	log.Info.Printf("ERROR Handler: %s", err)
-	//generate error response
-	res.Write([]byte("{\"code\":-1,\"desc\":\"Failed: " + err + "\"}"))
-} //errorHandler()
+//metricsApp serves only /metrics, for the separate listener on server.metrics_addr
+func metricsApp() http.Handler {
+	r := pat.New()
+	r.Get("/metrics", metrics.Handler().ServeHTTP)
+	r.NotFoundHandler = http.HandlerFunc(unknownHandler)
+	return apierror.WithRequestID(whileStarting(r))
+} //metricsApp()
 
 func unknownHandler(res http.ResponseWriter, req *http.Request) {
 	log.Info.Printf("Ignore unknown URI: %s", req.RequestURI)
-	//generate error response
-	http.Error(res, "{\"code\":-1,\"desc\":\"Unknown Resource\"}", http.StatusNotFound)
-	return
+	apierror.Writef(res, req, apierror.NotFound, "Unknown resource %s %s", req.Method, req.URL.Path)
 } //unknownHandler()
 
 /* CORS: Example HTTP Trace:
@@ -92,27 +366,37 @@ Content-Type: application/json
 Date: Thu, 12 Oct 2017 05:22:13 GMT
 Content-Length: 0
 */
-func corsHandler(res http.ResponseWriter, req *http.Request) {
-	log.Trace.Printf("CORS HANDLER...")
-	res.Header().Add("Content-Type", "application/json")
-	if origin := req.Header.Get("Origin"); origin != "" {
-		res.Header().Set("Access-Control-Allow-Origin", "*")
-		res.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST, GET, PUT, DELETE")
-		res.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-CSRF-Token")
+func corsHandler(cors config.CORS) http.HandlerFunc {
+	methods := strings.Join(cors.AllowedMethods, ", ")
+	headers := strings.Join(cors.AllowedHeaders, ", ")
+	return func(res http.ResponseWriter, req *http.Request) {
+		log.Trace.Printf("CORS HANDLER...")
+		res.Header().Add("Content-Type", "application/json")
+		if allow := cors.AllowOrigin(req.Header.Get("Origin")); allow != "" {
+			res.Header().Set("Access-Control-Allow-Origin", allow)
+			res.Header().Set("Access-Control-Allow-Methods", methods)
+			res.Header().Set("Access-Control-Allow-Headers", headers)
+			if allow != "*" {
+				res.Header().Add("Vary", "Origin")
+			}
+		}
 	}
 } /*corsHandler()*/
 
 // contentType is middleware that adds an application/json Content-Type header
 // to all outgoing responses.
-func contentType(h http.Handler) http.Handler {
+func contentType(cors config.CORS, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Add("Content-Type", "application/json")
 
 		//allowedHeaders := "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization,X-CSRF-Token"
 		if origin := req.Header.Get("Origin"); origin != "" {
-			res.Header().Set("Access-Control-Allow-Origin", "*")
-			//res.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			//res.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+			if allow := cors.AllowOrigin(origin); allow != "" {
+				res.Header().Set("Access-Control-Allow-Origin", allow)
+				if allow != "*" {
+					res.Header().Add("Vary", "Origin")
+				}
+			}
 			//res.Header().Set("Access-Control-Expose-Headers", "Authorization")
 		}
 		h.ServeHTTP(res, req)
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jansemmelink/auth2/apierror"
+)
+
+func TestWhileStarting(t *testing.T) {
+	saved := atomic.LoadInt32(&started)
+	t.Cleanup(func() { atomic.StoreInt32(&started, saved) })
+	h := whileStarting(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+		return res
+	}
+
+	atomic.StoreInt32(&started, 0)
+	for path := range servedWhileStarting {
+		if res := serve(path); res.Code != http.StatusNoContent {
+			t.Errorf("%s while starting responded %d", path, res.Code)
+		}
+	}
+	res := serve("/auth/login")
+	e := apierror.Error{}
+	json.Unmarshal(res.Body.Bytes(), &e)
+	if res.Code != http.StatusServiceUnavailable || e.Code != apierror.Unavailable || res.Header().Get("Retry-After") == "" {
+		t.Errorf("Login while starting responded %d %s: %s", res.Code, res.Header().Get("Retry-After"), res.Body.String())
+	}
+
+	atomic.StoreInt32(&started, 1)
+	if res := serve("/auth/login"); res.Code != http.StatusNoContent {
+		t.Errorf("Login after starting responded %d", res.Code)
+	}
+} //TestWhileStarting()
+
+func TestRemovePIDFile(t *testing.T) {
+	dir := t.TempDir()
+	ours := filepath.Join(dir, "ours.pid")
+	ioutil.WriteFile(ours, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	removePIDFile(ours)
+	if _, err := os.Stat(ours); !os.IsNotExist(err) {
+		t.Errorf("Our pidfile was not removed: %v", err)
+	}
+
+	//another process started with the same pidfile
+	other := filepath.Join(dir, "other.pid")
+	ioutil.WriteFile(other, []byte(strconv.Itoa(os.Getpid()+1)), 0644)
+	removePIDFile(other)
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Pidfile of another process removed: %v", err)
+	}
+
+	removePIDFile(filepath.Join(dir, "missing.pid"))
+} //TestRemovePIDFile()
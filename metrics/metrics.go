@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "bitbucket.org/conorit/golib-logger"
+	"github.com/jansemmelink/auth2/httpstatus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	log = logger.New("metrics")
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_http_requests_total",
+		Help: "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logins_total",
+		Help: "Logins by outcome and reason (login method on success, failure reason else).",
+	}, []string{"outcome", "reason"})
+	registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_registrations_total",
+		Help: "Users registered.",
+	})
+	resets = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_password_resets_total",
+		Help: "Password resets requested.",
+	})
+	mails = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_mail_sent_total",
+		Help: "Emails sent by result (ok or error).",
+	}, []string{"result"})
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_mongo_operation_duration_seconds",
+		Help:    "Mongo operation latency by collection and operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"collection", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, logins, registrations, resets, mails, mongoDuration)
+}
+
+//Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+} //Handler()
+
+//InstrumentRoute counts and times requests to h, labelled with the route template
+//(not the actual path, to keep the nr of series bounded)
+func InstrumentRoute(route, method string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := httpstatus.NewRecorder(res)
+		h.ServeHTTP(rec, req)
+		httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(rec.Status)).Inc()
+	})
+} //InstrumentRoute()
+
+//Login counts a login attempt
+func Login(outcome, reason string) {
+	logins.WithLabelValues(outcome, reason).Inc()
+} //Login()
+
+//Registration counts a registered user
+func Registration() {
+	registrations.Inc()
+} //Registration()
+
+//Reset counts a password reset
+func Reset() {
+	resets.Inc()
+} //Reset()
+
+//MailSent counts an email by the result of sending it
+func MailSent(err error) {
+	if err != nil {
+		mails.WithLabelValues("error").Inc()
+	} else {
+		mails.WithLabelValues("ok").Inc()
+	}
+} //MailSent()
+
+//ObserveMongo records the latency of a mongo operation started at start
+//use as: defer metrics.ObserveMongo("users", "find", time.Now())
+func ObserveMongo(collection, operation string, start time.Time) {
+	mongoDuration.WithLabelValues(collection, operation).Observe(time.Since(start).Seconds())
+} //ObserveMongo()
+
+//activeSessionsTTL is how long a session count is reported before counting again,
+//so that scrapes (of several Prometheus servers) do not each query the database
+const activeSessionsTTL = time.Second * 30
+
+//ActiveSessions registers a gauge that calls count when a scrape finds the last count older than activeSessionsTTL
+func ActiveSessions(count func() (int, error)) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auth_active_sessions",
+		Help: "Sessions that have not ended or expired.",
+	}, cachedCount(count, activeSessionsTTL)))
+} //ActiveSessions()
+
+//cachedCount returns the last count for ttl, and counts once at a time.
+//A failed count is logged and reports the last count
+func cachedCount(count func() (int, error), ttl time.Duration) func() float64 {
+	var (
+		mutex   sync.Mutex
+		last    float64
+		counted time.Time
+	)
+	return func() float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if time.Since(counted) < ttl {
+			return last
+		}
+		counted = time.Now()
+		n, err := count()
+		if err != nil {
+			log.Error.Printf("Failed to count active sessions: %v", err)
+			return last
+		}
+		last = float64(n)
+		return last
+	}
+} //cachedCount()
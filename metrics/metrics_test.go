@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachedCount(t *testing.T) {
+	calls := 0
+	n := 3
+	var err error
+	gauge := cachedCount(func() (int, error) {
+		calls++
+		return n, err
+	}, time.Hour)
+
+	if v := gauge(); v != 3 || calls != 1 {
+		t.Errorf("First scrape %v after %d counts", v, calls)
+	}
+	n = 4
+	if v := gauge(); v != 3 || calls != 1 {
+		t.Errorf("Scrape within ttl %v after %d counts", v, calls)
+	}
+
+	//expired: a failed count reports the last count
+	gauge = cachedCount(func() (int, error) {
+		calls++
+		return n, err
+	}, 0)
+	calls = 0
+	gauge()
+	err = fmt.Errorf("database down")
+	if v := gauge(); v != 4 || calls != 2 {
+		t.Errorf("Failed count %v after %d counts", v, calls)
+	}
+} //TestCachedCount()
+
+func TestCachedCountOnceAtATime(t *testing.T) {
+	var mutex sync.Mutex
+	calls := 0
+	gauge := cachedCount(func() (int, error) {
+		mutex.Lock()
+		calls++
+		mutex.Unlock()
+		time.Sleep(time.Millisecond * 10)
+		return 1, nil
+	}, time.Hour)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gauge()
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Concurrent scrapes counted %d times", calls)
+	}
+} //TestCachedCountOnceAtATime()
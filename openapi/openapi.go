@@ -0,0 +1,360 @@
+package openapi
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/auth2/apierror"
+)
+
+//Operation describes a route beyond what the router knows (path and method)
+//Request and Response are example values, only their types are used for the schemas
+type Operation struct {
+	Summary     string
+	Description string
+	Query       []string    //names of URL parameters
+	Request     interface{} //JSON body, nil if none
+	Response    interface{} //JSON body of the success response, nil if none
+
+	//Auth is true when the route requires a session (auth.RequirePermission),
+	//with Permission the required permission, "" for any logged in user
+	Auth       bool
+	Permission string
+}
+
+//route is a path and method of the router
+type route struct {
+	Path   string
+	Method string
+}
+
+var (
+	mutex      sync.Mutex
+	routes     = []route{}
+	operations = map[route]Operation{}
+
+	//title and version of the API in the document
+	Title   = "auth2"
+	Version = "1.0"
+)
+
+//Describe documents the route, it may be called before or after AddRoute
+func Describe(method, path string, op Operation) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	operations[route{Path: path, Method: method}] = op
+} //Describe()
+
+//AddRoute adds a route served by the router to the document.
+//Routes that are not described are listed with only the error responses
+func AddRoute(path, method string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	routes = append(routes, route{Path: path, Method: method})
+} //AddRoute()
+
+var pathParam = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+//Document returns the OpenAPI 3 document of all added routes
+func Document() map[string]interface{} {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	schemas := newSchemas()
+	errorRef := schemas.ref(reflect.TypeOf(apierror.Error{}))
+	codes := []string{}
+	for _, c := range apierror.Catalogue() {
+		codes = append(codes, string(c.Code))
+	}
+	schemas.Components["Error"]["properties"].(map[string]interface{})["Code"] = map[string]interface{}{
+		"type": "string",
+		"enum": codes,
+	}
+
+	paths := map[string]map[string]interface{}{}
+	for _, r := range routes {
+		op := operations[r]
+
+		//mux templates may have a pattern, e.g. {id:[0-9]+}, which is not part of the OpenAPI path
+		path := pathParam.ReplaceAllString(r.Path, "{$1}")
+		params := []interface{}{}
+		for _, m := range pathParam.FindAllStringSubmatch(r.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name":   q,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		success := map[string]interface{}{"description": "Success"}
+		if op.Response != nil {
+			success["content"] = jsonContent(schemas.schema(reflect.TypeOf(op.Response)))
+		}
+		operation := map[string]interface{}{
+			"operationId": operationID(r.Method, path),
+			"tags":        []string{strings.Split(strings.TrimPrefix(path, "/"), "/")[0]},
+			"responses": map[string]interface{}{
+				"200": success,
+				"default": map[string]interface{}{
+					"description": "Error, see Code",
+					"content":     jsonContent(errorRef),
+				},
+			},
+		}
+		if op.Summary != "" {
+			operation["summary"] = op.Summary
+		}
+		description := op.Description
+		if op.Auth {
+			operation["security"] = []interface{}{map[string]interface{}{"session": []string{}}}
+			if op.Permission != "" {
+				description = strings.TrimSpace(description + "\n\nRequires permission `" + op.Permission + "`.")
+			}
+		}
+		if description != "" {
+			operation["description"] = description
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemas.schema(reflect.TypeOf(op.Request))),
+			}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(r.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   Title,
+			"version": Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.Components,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Session id from login, as \"Authorization: Bearer <id>\", or else a client certificate when the service is configured for mutual TLS",
+				},
+			},
+		},
+	}
+} //Document()
+
+//operationID is e.g. "post_auth_users_id_roles" for POST /auth/users/{id}/roles
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.Split(path, "/") {
+		part = strings.Trim(part, "{}")
+		if part != "" {
+			id += "_" + strings.NewReplacer("-", "_", ".", "_").Replace(part)
+		}
+	}
+	return id
+} //operationID()
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+} //jsonContent()
+
+//schemas reflects Go types to OpenAPI schemas, with structs as named components
+type schemas struct {
+	Components map[string]map[string]interface{}
+	names      map[reflect.Type]string
+}
+
+func newSchemas() *schemas {
+	return &schemas{
+		Components: map[string]map[string]interface{}{},
+		names:      map[reflect.Type]string{},
+	}
+} //newSchemas()
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	rawJSONType  = reflect.TypeOf(json.RawMessage{})
+	objectIDName = "gopkg.in/mgo.v2/bson.ObjectId"
+)
+
+//schema returns the schema of the type, with a reference for structs
+func (s *schemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]interface{}{}
+	case t.PkgPath()+"."+t.Name() == objectIDName:
+		return map[string]interface{}{"type": "string", "pattern": "^[0-9a-f]{24}$"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		return s.ref(t)
+	default:
+		//interface{} and anything else that JSON may hold
+		return map[string]interface{}{}
+	}
+} //schemas.schema()
+
+//ref adds the struct as component (once) and returns a reference to it
+func (s *schemas) ref(t reflect.Type) map[string]interface{} {
+	name, ok := s.names[t]
+	if !ok {
+		name = t.Name()
+		if name == "" {
+			//anonymous struct, inline it
+			return s.object(t)
+		}
+		if s.Components[name] != nil {
+			//same name in another package
+			name = path.Base(t.PkgPath()) + "." + t.Name()
+		}
+		s.names[t] = name
+		s.Components[name] = map[string]interface{}{} //placeholder for recursive types
+		s.Components[name] = s.object(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+} //schemas.ref()
+
+//object is the schema of the struct fields, named as encoding/json names them
+func (s *schemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	s.addFields(t, properties)
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+} //schemas.object()
+
+func (s *schemas) addFields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.addFields(ft, properties)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue //unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.schema(f.Type)
+	}
+} //schemas.addFields()
+
+//Handler serves the document as JSON
+func Handler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		jsonData, err := json.MarshalIndent(Document(), "", "  ")
+		if err != nil {
+			apierror.Writef(res, req, apierror.Internal, "Failed to encode OpenAPI document: %v", err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(jsonData)
+	})
+} //Handler()
+
+//go:generate go run redoc/fetch.go
+
+//DocsHandler serves Redoc to render the document from specURL.
+//The Redoc bundle is embedded and inlined in the page, so it loads no third-party code,
+//and the Content-Security-Policy allows only that script by its hash.
+//Redoc adds its styles and search worker at runtime, so those cannot be hashed.
+//Without the bundle (see redoc/fetch.go) the page only links to the document
+func DocsHandler(specURL string) http.Handler {
+	spec := html.EscapeString(specURL)
+	body := `<p>The documentation viewer is not in this build, see the <a href="` + spec + `">OpenAPI document</a>.</p>`
+	csp := "default-src 'none'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+	if len(redocBundle) > 0 {
+		//the bundle may contain "</script" in strings, which would end the inline element
+		script := scriptEnd.ReplaceAllString(string(redocBundle), `<\/script`)
+		body = `<redoc spec-url="` + spec + `"></redoc>` + "\n<script>" + script + "</script>"
+		csp = fmt.Sprintf("default-src 'none'; script-src '%s'; style-src 'unsafe-inline'; img-src 'self' data:; font-src 'self' data:; worker-src blob:; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'",
+			cspHash(script))
+	}
+	page := strings.Replace(docsPage, "{{body}}", body, 1)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.Header().Set("Content-Security-Policy", csp)
+		res.Header().Set("X-Content-Type-Options", "nosniff")
+		res.Write([]byte(page))
+	})
+} //DocsHandler()
+
+var (
+	//go:embed docs.html
+	docsPage string
+	//go:embed redoc
+	redocFiles embed.FS
+	//redocBundle is empty when the bundle was not fetched
+	redocBundle, _ = redocFiles.ReadFile("redoc/redoc.standalone.js")
+
+	scriptEnd = regexp.MustCompile(`(?i)</script`)
+)
+
+//cspHash is the CSP source expression that allows an inline element with the content
+func cspHash(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return "sha256-" + base64.StdEncoding.EncodeToString(h[:])
+} //cspHash()
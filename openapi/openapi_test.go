@@ -0,0 +1,146 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testItem struct {
+	ID      string `json:"_id"`
+	Name    string
+	Tags    []string
+	Created time.Time
+	Next    *testItem `json:",omitempty"`
+	secret  string
+	Skipped string `json:"-"`
+}
+
+//withRoutes replaces the documented routes for the test
+func withRoutes(t *testing.T) {
+	mutex.Lock()
+	savedRoutes, savedOperations := routes, operations
+	routes, operations = []route{}, map[route]Operation{}
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		routes, operations = savedRoutes, savedOperations
+		mutex.Unlock()
+	})
+} //withRoutes()
+
+//get returns the value at the path of keys in the decoded document
+func get(t *testing.T, v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.Fatalf("No %s in %v", k, v)
+		}
+		v = m[k]
+	}
+	return v
+} //get()
+
+func TestDocument(t *testing.T) {
+	withRoutes(t)
+	AddRoute("/items/{id:[0-9a-f]+}", "GET")
+	Describe("GET", "/items/{id:[0-9a-f]+}", Operation{Summary: "Get an item", Query: []string{"fields"}, Response: testItem{}, Auth: true, Permission: "item:read"})
+	AddRoute("/items", "POST")
+	Describe("POST", "/items", Operation{Request: testItem{}, Response: testItem{}})
+	AddRoute("/healthz", "GET")
+
+	//through JSON, as it is served
+	data, err := json.Marshal(Document())
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	doc := map[string]interface{}{}
+	json.Unmarshal(data, &doc)
+
+	op := get(t, doc, "paths", "/items/{id}", "get")
+	if get(t, op, "operationId") != "get_items_id" || get(t, op, "summary") != "Get an item" {
+		t.Errorf("Operation %v", op)
+	}
+	if !strings.Contains(get(t, op, "description").(string), "`item:read`") || get(t, op, "security") == nil {
+		t.Errorf("Operation security %v", op)
+	}
+	params := get(t, op, "parameters").([]interface{})
+	if len(params) != 2 || get(t, params[0], "name") != "id" || get(t, params[0], "in") != "path" || get(t, params[1], "in") != "query" {
+		t.Errorf("Parameters %v", params)
+	}
+	if ref := get(t, op, "responses", "200", "content", "application/json", "schema", "$ref"); ref != "#/components/schemas/testItem" {
+		t.Errorf("Response schema %v", ref)
+	}
+	if ref := get(t, doc, "paths", "/items", "post", "requestBody", "content", "application/json", "schema", "$ref"); ref != "#/components/schemas/testItem" {
+		t.Errorf("Request schema %v", ref)
+	}
+
+	//undescribed routes have only the error response and no security
+	health := get(t, doc, "paths", "/healthz", "get")
+	if get(t, health, "security") != nil || get(t, health, "responses", "default") == nil {
+		t.Errorf("Undescribed route %v", health)
+	}
+
+	properties := get(t, doc, "components", "schemas", "testItem", "properties").(map[string]interface{})
+	names := []string{}
+	for n := range properties {
+		names = append(names, n)
+	}
+	for _, n := range []string{"_id", "Name", "Tags", "Created", "Next"} {
+		if properties[n] == nil {
+			t.Errorf("No property %s in %v", n, names)
+		}
+	}
+	if len(properties) != 5 {
+		t.Errorf("Properties %v", names)
+	}
+	if !reflect.DeepEqual(properties["Created"], map[string]interface{}{"type": "string", "format": "date-time"}) {
+		t.Errorf("Time schema %v", properties["Created"])
+	}
+	if get(t, properties["Next"], "$ref") != "#/components/schemas/testItem" {
+		t.Errorf("Recursive schema %v", properties["Next"])
+	}
+	if codes := get(t, doc, "components", "schemas", "Error", "properties", "Code", "enum"); len(codes.([]interface{})) == 0 {
+		t.Errorf("Error codes %v", codes)
+	}
+} //TestDocument()
+
+func TestDocsHandler(t *testing.T) {
+	saved := redocBundle
+	t.Cleanup(func() { redocBundle = saved })
+
+	for _, bundle := range []string{"", `Redoc.init();var s="</script>";`} {
+		redocBundle = []byte(bundle)
+		res := httptest.NewRecorder()
+		DocsHandler(`/openapi.json?"x"`).ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/docs", nil))
+		page := res.Body.String()
+		csp := res.Header().Get("Content-Security-Policy")
+
+		if strings.Contains(page, "src=") || strings.Contains(page, "http://") || strings.Contains(page, "https://") {
+			t.Errorf("bundle=%q: Docs page loads other resources", bundle)
+		}
+		if !strings.Contains(page, `"/openapi.json?&#34;x&#34;"`) {
+			t.Errorf("bundle=%q: Spec URL not escaped in the page", bundle)
+		}
+		if !strings.HasPrefix(csp, "default-src 'none'") {
+			t.Errorf("bundle=%q: CSP %s", bundle, csp)
+		}
+		if bundle == "" {
+			if strings.Contains(page, "<script") || strings.Contains(csp, "script-src") {
+				t.Errorf("Page without bundle has a script")
+			}
+			continue
+		}
+		script := `Redoc.init();var s="<\/script>";`
+		if !strings.Contains(page, "<script>"+script+"</script>") || !strings.Contains(csp, "script-src '"+cspHash(script)+"'") {
+			t.Errorf("CSP %s does not allow the inline script", csp)
+		}
+		if strings.Count(page, "</script") != 1 {
+			t.Errorf("Bundle ends the inline script")
+		}
+	}
+} //TestDocsHandler()
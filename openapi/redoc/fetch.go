@@ -0,0 +1,61 @@
+//go:build ignore
+
+//fetch downloads the Redoc bundle that DocsHandler embeds, run it with "go generate ./openapi"
+//and commit the files in this directory. The checksum of the first download is kept in
+//redoc.standalone.js.sha256 and later downloads of the same version must match it.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//version of redoc on npm, change it and remove the .sha256 file to upgrade
+const version = "2.1.5"
+
+const base = "https://cdn.jsdelivr.net/npm/redoc@" + version + "/"
+
+func main() {
+	bundle, err := download(base + "bundles/redoc.standalone.js")
+	if err != nil {
+		fail(err)
+	}
+	license, err := download(base + "LICENSE")
+	if err != nil {
+		fail(err)
+	}
+	sum := fmt.Sprintf("%x  redoc@%s\n", sha256.Sum256(bundle), version)
+	if known, err := os.ReadFile("redoc/redoc.standalone.js.sha256"); err == nil && string(known) != sum {
+		fail(fmt.Errorf("checksum %s does not match redoc/redoc.standalone.js.sha256 %s", strings.TrimSpace(sum), strings.TrimSpace(string(known))))
+	}
+	for name, data := range map[string][]byte{
+		"redoc/redoc.standalone.js":        bundle,
+		"redoc/LICENSE":                    license,
+		"redoc/redoc.standalone.js.sha256": []byte(sum),
+	} {
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			fail(err)
+		}
+	}
+} //main()
+
+func download(url string) ([]byte, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return io.ReadAll(res.Body)
+} //download()
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "Failed to fetch redoc: %v\n", err)
+	os.Exit(1)
+} //fail()
@@ -82,6 +82,8 @@ function api()
 	shift
 	file=$1
 	shift
+	session=$1
+	shift
 	verbose ${method} ${url} file=${file}
 	out=$(mktemp)
 
@@ -89,11 +91,14 @@ function api()
 	# -s for silent, without progress meter
 	# -w to write http code to ...
 	# -o to redirect output to file
+	# -H to send the session id for operations that require login
+	auth_opts=()
+	[ -n "${session}" ] && auth_opts=(-H "Authorization: Bearer ${session}")
 	if [ -z "${file}" ]
 	then
-		http_code=$(curl -s -w "%{http_code}" -X${method} ${url} -o ${out})
+		http_code=$(curl -s -w "%{http_code}" -X${method} ${url} "${auth_opts[@]}" -o ${out})
 	else
-		http_code=$(curl -s -w "%{http_code}" -X${method} ${url} -d @${file} -o ${out})
+		http_code=$(curl -s -w "%{http_code}" -X${method} ${url} "${auth_opts[@]}" -d @${file} -o ${out})
 	fi
 
 	if [ $? -ne 0 ]
@@ -157,12 +162,27 @@ then
 
 	verbose "Registered user._id=${_user_id} TempPassword=${TempPassword}"
 
+	#--------------------------------------------------
+	# activate with email and TempPassword added to activation url
+	#--------------------------------------------------
+	debug "Activating with password=${password}"
+	activate_res=$(api GET "${addr}/auth/activate?name=${email}&tpw=${TempPassword}&password=${password}")
+	http_code=${activate_res%%,*}
+	activate_res=${activate_res#*,}
+	debug "http_code=${http_code} response=${activate_res}"
+
+	[ ${http_code} -ne 200 ] && error "Failed to activate: ${activate_res}"
+	_session_id=$(echo ${activate_res} | jq '._id' | sed "s/\"//g")
+
+	verbose "Activated and logged in user: session.id==${_session_id}"
+
 	#-------------------------------------
 	# also create the person for this user
+	# (requires the session from activation)
 	#-------------------------------------
 	echo "{\"_user_id\":\"${_user_id}\",\"Names\":[${namesJSONArray}]}" > ${t}
 	debug "person data in file ${t}: $(cat ${t})"
-	person_response=$(api POST "${addr}/person" ${t})
+	person_response=$(api POST "${addr}/person" ${t} ${_session_id})
 	http_code=${person_response%%,*}
 	person_response=${person_response#*,}
 	debug "http_code=${http_code} response=${person_response}"
@@ -173,20 +193,6 @@ then
 	else
 		error "Failed to created person: HTTP=${http_code}: ${person_response}"
 	fi
-
-	#--------------------------------------------------
-	# activate with email and TempPassword added to activation url
-	#--------------------------------------------------
-	debug "Activating with password=${password}"
-	activate_res=$(api GET "${addr}/auth/activate?name=${email}&tpw=${TempPassword}&password=${password}")
-	http_code=${activate_res%%,*}
-	activate_res=${activate_res#*,}
-	debug "http_code=${http_code} response=${activate_res}"
-
-	[ ${http_code} -ne 200 ] && error "Failed to activate: ${activate_res}"
-	_session_id=$(echo ${activate_res} | jq '._id' | sed "s/\"//g")
-
-	verbose "Activated and logged in user: session.id==${_session_id}"
 else
 	#----------------------------------------------------
 	# registration failed
@@ -0,0 +1,284 @@
+//Package tlscert serves HTTPS with a certificate, and optionally client certificate CAs and CRL,
+//that are reloaded from their files when they change or on request,
+//so that renewed certificates and revocations are used without a restart
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "bitbucket.org/conorit/golib-logger"
+	"github.com/jansemmelink/auth2/apierror"
+	"github.com/jansemmelink/auth2/config"
+)
+
+var (
+	log = logger.New("tlscert")
+)
+
+//Reloader holds the certificate and the client certificate CAs and CRL loaded from the files
+type Reloader struct {
+	files config.TLS
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	revoked   map[string]bool //issuer and serial nr of revoked client certificates
+	modTimes  [4]time.Time
+}
+
+//New loads the files, failing if they are not valid
+func New(files config.TLS) (*Reloader, error) {
+	r := &Reloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+} //New()
+
+//Reload loads all the files again. When any is not valid,
+//e.g. while being replaced, all of the current ones are kept
+func (r *Reloader) Reload() error {
+	modTimes := r.fileModTimes()
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Cannot load certificate %s with key %s: %v", r.files.CertFile, r.files.KeyFile, err)
+	}
+	var clientCAs *x509.CertPool
+	var revoked map[string]bool
+	if r.files.ClientCAFile != "" {
+		cas, err := readCertificates(r.files.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			clientCAs.AddCert(ca)
+		}
+		if r.files.ClientCRLFile != "" {
+			if revoked, err = readCRL(r.files.ClientCRLFile, cas); err != nil {
+				return err
+			}
+		}
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.revoked = revoked
+	r.modTimes = modTimes
+	r.mutex.Unlock()
+	log.Info.Printf("Loaded certificate %s", r.files.CertFile)
+	return nil
+} //Reloader.Reload()
+
+//fileModTimes are the modification times of the files, zero for a file that is not used or cannot be read
+func (r *Reloader) fileModTimes() [4]time.Time {
+	modTimes := [4]time.Time{}
+	for i, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile, r.files.ClientCRLFile} {
+		if info, err := os.Stat(name); name != "" && err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+} //Reloader.fileModTimes()
+
+//readCertificates reads a PEM file with one or more certificates
+func readCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read CA bundle: %v", err)
+	}
+	list := []*x509.Certificate{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certificate in %s: %v", filename, err)
+		}
+		list = append(list, cert)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("No PEM certificates in %s", filename)
+	}
+	return list, nil
+} //readCertificates()
+
+//readCRL reads a PEM file with one or more CRLs, or a DER file with one CRL,
+//each signed by one of the CAs, and returns the revoked certificates
+func readCRL(filename string, cas []*x509.Certificate) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read CRL: %v", err)
+	}
+	ders := [][]byte{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	revoked := map[string]bool{}
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CRL in %s: %v", filename, err)
+		}
+		signed := false
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, fmt.Errorf("CRL in %s is not signed by a client CA", filename)
+		}
+		//an old CRL is still the best list there is, so it is used
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			log.Error.Printf("CRL in %s should have been updated at %v", filename, crl.NextUpdate)
+		}
+		for _, e := range crl.RevokedCertificateEntries {
+			revoked[revokedKey(crl.RawIssuer, e.SerialNumber)] = true
+		}
+	}
+	return revoked, nil
+} //readCRL()
+
+func revokedKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + ":" + serial.String()
+} //revokedKey()
+
+//Watch checks the files every interval until stop is closed,
+//and reloads when any changed since they were last loaded
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mutex.RLock()
+		changed := r.fileModTimes() != r.modTimes
+		r.mutex.RUnlock()
+		if changed {
+			if err := r.Reload(); err != nil {
+				log.Error.Printf("Keeping the current certificates: %v", err)
+			}
+		}
+	}
+} //Reloader.Watch()
+
+//GetCertificate is for tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+} //Reloader.GetCertificate()
+
+//verifyConnection rejects a client certificate that is in the CRL
+func (r *Reloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := cs.VerifiedChains[0][0]
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.revoked[revokedKey(leaf.RawIssuer, leaf.SerialNumber)] {
+		log.Info.Printf("Rejected revoked client certificate %s serial %s", leaf.Subject, leaf.SerialNumber)
+		return fmt.Errorf("client certificate %s is revoked", leaf.Subject)
+	}
+	return nil
+} //Reloader.verifyConnection()
+
+//Config is a modern TLS policy with the reloaded certificate:
+//TLS 1.2 or later, with only forward secret AEAD cipher suites for TLS 1.2
+//(TLS 1.3 suites are not configurable and are all secure).
+//With client CAs, clients may present a certificate, which must be valid and not revoked
+func (r *Reloader) Config() *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+	if r.files.ClientCAFile == "" {
+		return base
+	}
+	//the config is made per connection, to use the client CAs loaded last
+	c := base.Clone()
+	c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		r.mutex.RLock()
+		c.ClientCAs = r.clientCAs
+		r.mutex.RUnlock()
+		c.VerifyConnection = r.verifyConnection
+		return c, nil
+	}
+	return c
+} //Reloader.Config()
+
+//RedirectHandler redirects plain HTTP GET and HEAD requests to the same URL on HTTPS at port.
+//Other requests fail, because their body (e.g. a password) was already sent in the clear,
+//and a client that is redirected would not notice it should use HTTPS
+func RedirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			apierror.Writef(res, req, apierror.HTTPSRequired, "Use HTTPS for %s requests", req.Method)
+			return
+		}
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = strings.Trim(req.Host, "[]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(res, req, u.String(), http.StatusMovedPermanently)
+	})
+} //RedirectHandler()
+
+//HSTS adds Strict-Transport-Security to HTTPS responses, so browsers use only HTTPS
+//for the host during maxAge, 0 for none
+func HSTS(maxAge time.Duration, h http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return h
+	}
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			res.Header().Set("Strict-Transport-Security", value)
+		}
+		h.ServeHTTP(res, req)
+	})
+} //HSTS()
@@ -0,0 +1,401 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/auth2/config"
+)
+
+//testCert is a certificate with its key, signed by itself or by a CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64 = 100
+
+//newTestCert makes a certificate for the name, a CA when ca is true, signed by parent or else by itself
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.DNSNames = []string{name}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key}
+} //newTestCert()
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+} //testCert.certPEM()
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+} //testCert.keyPEM()
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+} //testCert.tlsCertificate()
+
+//writeFile writes the file and moves its modification time, so that Watch sees the change
+//even when written twice within the file system's time resolution
+func writeFile(t *testing.T, name string, data []byte) {
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	testModTime = testModTime.Add(time.Second)
+	if err := os.Chtimes(name, testModTime, testModTime); err != nil {
+		t.Fatalf("Failed to touch %s: %v", name, err)
+	}
+} //writeFile()
+
+var testModTime = time.Now().Add(-time.Hour)
+
+//writeServerCert writes the certificate and key files in dir
+func writeServerCert(t *testing.T, dir string, c *testCert) config.TLS {
+	files := config.TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeFile(t, files.CertFile, c.certPEM())
+	writeFile(t, files.KeyFile, c.keyPEM(t))
+	return files
+} //writeServerCert()
+
+func servedSerial(t *testing.T, r *Reloader) int64 {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Invalid served certificate: %v", err)
+	}
+	return leaf.SerialNumber.Int64()
+} //servedSerial()
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "localhost", false, nil)
+	files := writeServerCert(t, dir, first)
+	r, err := New(files)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if servedSerial(t, r) != first.cert.SerialNumber.Int64() {
+		t.Errorf("Not serving the loaded certificate")
+	}
+
+	second := newTestCert(t, "localhost", false, nil)
+	writeServerCert(t, dir, second)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if servedSerial(t, r) != second.cert.SerialNumber.Int64() {
+		t.Errorf("Not serving the reloaded certificate")
+	}
+
+	//a key that does not match, e.g. while the files are being replaced, keeps the current certificate
+	writeFile(t, files.KeyFile, newTestCert(t, "localhost", false, nil).keyPEM(t))
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reloaded a certificate with another key")
+	}
+	if servedSerial(t, r) != second.cert.SerialNumber.Int64() {
+		t.Errorf("Invalid files replaced the certificate")
+	}
+
+	if _, err := New(config.TLS{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: files.KeyFile}); err == nil {
+		t.Errorf("New without a certificate file")
+	}
+} //TestReload()
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	files := writeServerCert(t, dir, newTestCert(t, "localhost", false, nil))
+	r, err := New(files)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.Watch(time.Millisecond*10, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	renewed := newTestCert(t, "localhost", false, nil)
+	writeServerCert(t, dir, renewed)
+	for deadline := time.Now().Add(time.Second * 5); servedSerial(t, r) != renewed.cert.SerialNumber.Int64(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Changed files were not reloaded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+} //TestWatch()
+
+//crl is a CRL of the CA revoking the certificates, valid until nextUpdate
+func (c *testCert) crl(t *testing.T, nextUpdate time.Time, revoked ...*testCert) []byte {
+	entries := []x509.RevocationListEntry{}
+	for _, r := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: r.cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	testSerial++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(testSerial),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, c.cert, c.key)
+	if err != nil {
+		t.Fatalf("Failed to create CRL: %v", err)
+	}
+	return der
+} //testCert.crl()
+
+func crlPEM(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+} //crlPEM()
+
+func TestReadCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Client CA", true, nil)
+	other := newTestCert(t, "Other CA", true, nil)
+	revoked := newTestCert(t, "revoked", false, ca)
+	valid := newTestCert(t, "valid", false, ca)
+	otherRevoked := newTestCert(t, "other revoked", false, other)
+	nextUpdate := time.Now().Add(time.Hour)
+	name := filepath.Join(dir, "ca.crl")
+
+	isRevoked := func(list map[string]bool, c *testCert) bool {
+		return list[revokedKey(c.cert.RawIssuer, c.cert.SerialNumber)]
+	}
+	for format, data := range map[string][]byte{
+		"DER": ca.crl(t, nextUpdate, revoked),
+		"PEM": crlPEM(ca.crl(t, nextUpdate, revoked)),
+		//an expired CRL is used, with an error logged
+		"expired": ca.crl(t, time.Now().Add(-time.Minute), revoked),
+	} {
+		writeFile(t, name, data)
+		list, err := readCRL(name, []*x509.Certificate{ca.cert})
+		if err != nil || !isRevoked(list, revoked) || isRevoked(list, valid) {
+			t.Errorf("%s CRL read as %v, %v", format, list, err)
+		}
+	}
+
+	//a PEM file with the CRLs of several CAs
+	writeFile(t, name, append(crlPEM(ca.crl(t, nextUpdate, revoked)), crlPEM(other.crl(t, nextUpdate, otherRevoked))...))
+	list, err := readCRL(name, []*x509.Certificate{ca.cert, other.cert})
+	if err != nil || !isRevoked(list, revoked) || !isRevoked(list, otherRevoked) || len(list) != 2 {
+		t.Errorf("CRLs of two CAs read as %v, %v", list, err)
+	}
+	//the same serial nr of another CA is not revoked
+	if list[revokedKey(other.cert.RawSubject, revoked.cert.SerialNumber)] {
+		t.Errorf("Serial nr revoked by another CA")
+	}
+
+	if _, err := readCRL(name, []*x509.Certificate{ca.cert}); err == nil {
+		t.Errorf("Read a CRL that is not signed by a client CA")
+	}
+	writeFile(t, name, []byte("not a CRL"))
+	if _, err := readCRL(name, []*x509.Certificate{ca.cert}); err == nil {
+		t.Errorf("Read an invalid CRL")
+	}
+	if _, err := readCRL(filepath.Join(dir, "missing.crl"), []*x509.Certificate{ca.cert}); err == nil {
+		t.Errorf("Read a CRL that does not exist")
+	}
+} //TestReadCRL()
+
+//TestClientCertificates connects with client certificates to a server with the client CA and CRL
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	server := newTestCert(t, "localhost", false, nil)
+	ca := newTestCert(t, "Client CA", true, nil)
+	valid := newTestCert(t, "valid", false, ca)
+	revoked := newTestCert(t, "revoked", false, ca)
+	unknown := newTestCert(t, "unknown", false, newTestCert(t, "Other CA", true, nil))
+
+	files := writeServerCert(t, dir, server)
+	files.ClientCAFile = filepath.Join(dir, "ca.pem")
+	files.ClientCRLFile = filepath.Join(dir, "ca.crl")
+	writeFile(t, files.ClientCAFile, ca.certPEM())
+	writeFile(t, files.ClientCRLFile, crlPEM(ca.crl(t, time.Now().Add(time.Hour), revoked)))
+	r, err := New(files)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			res.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	ts.TLS = r.Config()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	get := func(c *testCert) (string, error) {
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if c != nil {
+			//sent even when not issued by a CA that the server asks for
+			cert := c.tlsCertificate()
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		defer client.CloseIdleConnections()
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if cn, err := get(valid); err != nil || cn != "valid" {
+		t.Errorf("Valid client certificate got %q, %v", cn, err)
+	}
+	if cn, err := get(nil); err != nil || cn != "" {
+		t.Errorf("Without client certificate got %q, %v", cn, err)
+	}
+	if _, err := get(revoked); err == nil {
+		t.Errorf("Revoked client certificate was accepted")
+	}
+	if _, err := get(unknown); err == nil {
+		t.Errorf("Client certificate of another CA was accepted")
+	}
+
+	//a new CRL applies after reload
+	writeFile(t, files.ClientCRLFile, crlPEM(ca.crl(t, time.Now().Add(time.Hour), valid)))
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, err := get(valid); err == nil {
+		t.Errorf("Client certificate revoked by the new CRL was accepted")
+	}
+	if cn, err := get(revoked); err != nil || cn != "revoked" {
+		t.Errorf("Client certificate no longer in the CRL got %q, %v", cn, err)
+	}
+} //TestClientCertificates()
+
+func TestConfigMinVersion(t *testing.T) {
+	server := newTestCert(t, "localhost", false, nil)
+	r, err := New(writeServerCert(t, t.TempDir(), server))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	ts.TLS = r.Config()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	for version, ok := range map[uint16]bool{tls.VersionTLS11: false, tls.VersionTLS12: true, tls.VersionTLS13: true} {
+		conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: version, MaxVersion: version})
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != ok {
+			t.Errorf("TLS version %x connected=%v: %v", version, err == nil, err)
+		}
+	}
+} //TestConfigMinVersion()
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tc := range []struct {
+		method, target, host string
+		port                 int
+		status               int
+		location             string
+	}{
+		{"GET", "/auth/login?name=jan", "example.com", 8443, http.StatusMovedPermanently, "https://example.com:8443/auth/login?name=jan"},
+		{"HEAD", "/", "example.com:80", 443, http.StatusMovedPermanently, "https://example.com/"},
+		{"GET", "/docs", "[::1]:8080", 443, http.StatusMovedPermanently, "https://[::1]/docs"},
+		{"GET", "/docs", "[::1]:8080", 8443, http.StatusMovedPermanently, "https://[::1]:8443/docs"},
+		{"POST", "/auth/login", "example.com", 443, http.StatusForbidden, ""},
+		{"DELETE", "/auth/logout", "example.com", 443, http.StatusForbidden, ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(""))
+		req.Host = tc.host
+		res := httptest.NewRecorder()
+		RedirectHandler(tc.port).ServeHTTP(res, req)
+		if res.Code != tc.status || res.Header().Get("Location") != tc.location {
+			t.Errorf("%s %s%s: %d %q, want %d %q", tc.method, tc.host, tc.target, res.Code, res.Header().Get("Location"), tc.status, tc.location)
+		}
+		if tc.status == http.StatusForbidden && !strings.Contains(res.Body.String(), "HTTPS_REQUIRED") {
+			t.Errorf("%s %s: error %s", tc.method, tc.target, res.Body.String())
+		}
+	}
+} //TestRedirectHandler()
+
+func TestHSTS(t *testing.T) {
+	ok := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {})
+	secure := httptest.NewRequest("GET", "https://example.com/", nil)
+	plain := httptest.NewRequest("GET", "http://example.com/", nil)
+	plain.TLS = nil
+
+	res := httptest.NewRecorder()
+	HSTS(time.Hour*24*365, ok).ServeHTTP(res, secure)
+	if got := res.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("HTTPS response header %q", got)
+	}
+	res = httptest.NewRecorder()
+	HSTS(time.Hour*24*365, ok).ServeHTTP(res, plain)
+	if got := res.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Plain HTTP response header %q", got)
+	}
+	res = httptest.NewRecorder()
+	HSTS(0, ok).ServeHTTP(res, secure)
+	if got := res.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Disabled HSTS header %q", got)
+	}
+} //TestHSTS()
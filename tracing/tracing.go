@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	logger "bitbucket.org/conorit/golib-logger"
+	"github.com/jansemmelink/auth2/httpstatus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	log    = logger.New("tracing")
+	tracer = otel.Tracer("github.com/jansemmelink/auth2")
+)
+
+//Init sets up the exporter for spans:
+//
+//	""       spans are not recorded, but W3C traceparent is still passed on
+//	"stdout" spans are written to stdout as they end
+//	"otlp"   spans are sent with OTLP/HTTP, configured with the standard
+//	         OTEL_EXPORTER_OTLP_ENDPOINT/_HEADERS environment variables
+//
+//the returned func flushes the remaining spans and must be called before exit
+func Init(exporter, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var opt sdktrace.TracerProviderOption
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, log.Errorf(err, "Failed to create stdout span exporter")
+		}
+		opt = sdktrace.WithSyncer(exp)
+	case "otlp":
+		exp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, log.Errorf(err, "Failed to create OTLP span exporter")
+		}
+		opt = sdktrace.WithBatcher(exp)
+	default:
+		return nil, log.Errorf(nil, "Unknown trace exporter \"%s\", expecting stdout or otlp", exporter)
+	}
+
+	//service.name is the resource attribute used by all tracing backends to group spans
+	provider := sdktrace.NewTracerProvider(
+		opt,
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Info.Printf("Tracing with %s exporter as service %s", exporter, serviceName)
+	return provider.Shutdown, nil
+} //Init()
+
+//InstrumentRoute starts a server span for every request to h, named by the
+//route template, continuing the trace from the request's traceparent header.
+//The span is in the request context, so handlers can start child spans.
+func InstrumentRoute(route, method string, h http.Handler) http.Handler {
+	name := method + " " + route
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", req.URL.Path),
+			))
+		defer span.End()
+
+		rec := httpstatus.NewRecorder(res)
+		h.ServeHTTP(rec, req.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.Status))
+		if rec.Status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status))
+		}
+	})
+} //InstrumentRoute()
+
+//Start starts a child span of the span in ctx.
+//Without a span in ctx (e.g. called from a background task or a command line option)
+//it does not start a new trace, but returns ctx with a span that records nothing.
+//use as:
+//
+//	ctx, span := tracing.Start(ctx, "session.create")
+//	defer span.End()
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+} //Start()
+
+//StartDB starts a child span for a mongo operation on the collection
+func StartDB(ctx context.Context, collection, operation string) (context.Context, trace.Span) {
+	return Start(ctx, "mongo "+collection+"."+operation,
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.collection.name", collection),
+		attribute.String("db.operation.name", operation))
+} //StartDB()
+
+//End ends the span, marking it as failed when err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+} //End()
@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	recorder     = tracetest.NewSpanRecorder()
+	recorderOnce sync.Once
+)
+
+//recordSpans records the spans ended by the test. The tracer of this package
+//delegates to the first global provider set, so all tests share one recorder
+func recordSpans(t *testing.T) func() []sdktrace.ReadOnlySpan {
+	recorderOnce.Do(func() {
+		if _, err := Init("", "test"); err != nil {
+			t.Fatalf("Cannot init: %v", err)
+		}
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+	before := len(recorder.Ended())
+	return func() []sdktrace.ReadOnlySpan { return recorder.Ended()[before:] }
+} //recordSpans()
+
+//attr returns the value of the span attribute, or "" when not set
+func attr(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, a := range span.Attributes() {
+		if a.Key == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+} //attr()
+
+func TestInstrumentRoute(t *testing.T) {
+	ended := recordSpans(t)
+	h := InstrumentRoute("/items/{id}", "GET", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, span := StartDB(req.Context(), "items", "find")
+		End(span, nil)
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	req := httptest.NewRequest("GET", "/items/123", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := ended()
+	if len(spans) != 2 {
+		t.Fatalf("Ended %d spans, want the mongo and the server span", len(spans))
+	}
+	db, server := spans[0], spans[1]
+	if server.Name() != "GET /items/{id}" || attr(server, "url.path") != "/items/123" || attr(server, "http.response.status_code") != "503" {
+		t.Errorf("Server span %s %v", server.Name(), server.Attributes())
+	}
+	if server.Status().Code != codes.Error {
+		t.Errorf("Server span of 503 has status %v", server.Status())
+	}
+	if server.SpanContext().TraceID().String() != "0af7651916cd43dd8448eb211c80319c" || server.Parent().SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("Server span did not continue the trace of the traceparent header")
+	}
+	if db.Name() != "mongo items.find" || db.Parent().SpanID() != server.SpanContext().SpanID() || attr(db, "db.collection.name") != "items" {
+		t.Errorf("Mongo span %s %v is not a child of the server span", db.Name(), db.Attributes())
+	}
+	if db.Status().Code == codes.Error {
+		t.Errorf("Mongo span without error has status %v", db.Status())
+	}
+} //TestInstrumentRoute()
+
+func TestStart(t *testing.T) {
+	ended := recordSpans(t)
+
+	//without a span in ctx nothing is recorded
+	ctx, span := Start(context.Background(), "background")
+	if span.IsRecording() || ctx != context.Background() {
+		t.Errorf("Started a span without a trace")
+	}
+	End(span, fmt.Errorf("failed"))
+	if len(ended()) != 0 {
+		t.Errorf("Recorded a span without a trace")
+	}
+
+	h := InstrumentRoute("/fail", "POST", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, span := Start(req.Context(), "session.create", attribute.String("user", "jan"))
+		End(span, fmt.Errorf("failed"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/fail", nil))
+	spans := ended()
+	if len(spans) != 2 {
+		t.Fatalf("Ended %d spans", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if child.Status().Code != codes.Error || child.Status().Description != "failed" || len(child.Events()) != 1 || attr(child, "user") != "jan" {
+		t.Errorf("Failed span %v %v %v", child.Status(), child.Events(), child.Attributes())
+	}
+	if server.Parent().IsValid() || child.SpanContext().TraceID() != server.SpanContext().TraceID() {
+		t.Errorf("Request without traceparent did not start a new trace")
+	}
+	if server.Status().Code == codes.Error || attr(server, "http.response.status_code") != "200" {
+		t.Errorf("Server span of 200 %v %v", server.Status(), server.Attributes())
+	}
+} //TestStart()
+
+func TestInit(t *testing.T) {
+	shutdown, err := Init("", "test")
+	if err != nil || shutdown(context.Background()) != nil {
+		t.Errorf("Init without exporter: %v", err)
+	}
+	if _, err := Init("jaeger", "test"); err == nil {
+		t.Errorf("Init with unknown exporter")
+	}
+} //TestInit()